@@ -0,0 +1,460 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+// newAttachmentForm returns a multipart form with the file in its `file` field
+func newAttachmentForm(t *testing.T, field string, file []byte) (io.Reader, string) {
+	t.Helper()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile(field, "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(file); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return body, writer.FormDataContentType()
+}
+
+// uploadAttachment saves an attachment to the conversation as the owner
+func uploadAttachment(
+	t *testing.T,
+	app *tests.TestApp,
+	conversationID, ownerID string,
+	data []byte,
+) chat.Attachment {
+	t.Helper()
+
+	file, err := filesystem.NewFileFromBytes(data, "blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	attachment, err := chat.NewPocketBaseAttachmentRepo(app).
+		Upload(conversationID, ownerID, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return attachment
+}
+
+func TestAttachments(t *testing.T) {
+	t.Parallel()
+
+	const (
+		// Get this info from the pre-populated test DB
+		creatorEmail = "test2@example.com"
+		editorEmail  = "no_data@example.com"
+		editorID     = "j8prcx3dum2l3kc"
+		viewerEmail  = "test1@example.com"
+
+		sharedConversationID  = "sharedconvtest1"
+		privateConversationID = "privateconvtest"
+	)
+
+	creatorToken, err := generateRecordToken("users", creatorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editorToken, err := generateRecordToken("users", editorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerToken, err := generateRecordToken("users", viewerEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := func(conversationID, path string) string {
+		return "/v1/conversations/" + conversationID + "/attachments" + path
+	}
+
+	// The nonce and secretbox overhead of the client's encryption
+	encrypted := bytes.Repeat([]byte("x"), 24+16+100)
+
+	form, contentType := newAttachmentForm(t, "file", encrypted)
+	editorForm, editorContentType := newAttachmentForm(t, "file", encrypted)
+	plainForm, plainContentType := newAttachmentForm(t, "file", []byte("plain text"))
+	wrongFieldForm, wrongFieldContentType := newAttachmentForm(t, "document", encrypted)
+	largeForm, largeContentType := newAttachmentForm(
+		t,
+		"file",
+		make([]byte, chat.MaxAttachmentSize+24+16+1),
+	)
+
+	// uploadShared uploads an attachment to the shared conversation, and
+	// puts its ID in the URL as it isn't known before it's uploaded
+	uploadShared := func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+		attachment := uploadAttachment(t, app, sharedConversationID, editorID, encrypted)
+		app.ResetEventCalls()
+
+		e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+			return func(c echo.Context) error {
+				c.Request().URL.Path = strings.Replace(
+					c.Request().URL.Path,
+					"sharedattach01",
+					attachment.ID,
+					1,
+				)
+				return next(c)
+			}
+		})
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "editor uploads an attachment",
+			Method: http.MethodPost,
+			Url:    url(sharedConversationID, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": editorToken,
+				"Content-Type":  editorContentType,
+			},
+			Body:           editorForm,
+			ExpectedStatus: http.StatusCreated,
+			ExpectedContent: []string{
+				`"conversation_id":"sharedconvtest1"`,
+				`"owner_id":"j8prcx3dum2l3kc"`,
+				`"size":140`,
+			},
+			NotExpectedContent: []string{`"message_id"`},
+			ExpectedEvents:     map[string]int{"OnModelBeforeCreate": 1, "OnModelAfterCreate": 1},
+			TestAppFactory:     setupTestApp,
+		},
+		{
+			Name:   "viewer can't upload an attachment",
+			Method: http.MethodPost,
+			Url:    url(sharedConversationID, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+				"Content-Type":  contentType,
+			},
+			Body:            form,
+			ExpectedStatus:  http.StatusForbidden,
+			ExpectedContent: []string{`"message":"You do not have permission to write to this conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "attachment that isn't encrypted",
+			Method: http.MethodPost,
+			Url:    url(privateConversationID, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+				"Content-Type":  plainContentType,
+			},
+			Body:            plainForm,
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"The attachment must be encrypted."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "attachment in the wrong field",
+			Method: http.MethodPost,
+			Url:    url(privateConversationID, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+				"Content-Type":  wrongFieldContentType,
+			},
+			Body:            wrongFieldForm,
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"The attachment must be the file field of a multipart form."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "attachment too large",
+			Method: http.MethodPost,
+			Url:    url(privateConversationID, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+				"Content-Type":  largeContentType,
+			},
+			Body:            largeForm,
+			ExpectedStatus:  http.StatusRequestEntityTooLarge,
+			ExpectedContent: []string{`"message":"The attachment must be at most 10485760 bytes."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "request too large",
+			Method: http.MethodPost,
+			Url:    url(privateConversationID, ""),
+			RequestHeaders: map[string]string{
+				"Authorization":  creatorToken,
+				"Content-Type":   contentType,
+				"Content-Length": fmt.Sprint(chat.MaxAttachmentRequestSize + 1),
+			},
+			Body:            bytes.NewReader(make([]byte, chat.MaxAttachmentRequestSize+1)),
+			ExpectedStatus:  http.StatusRequestEntityTooLarge,
+			ExpectedContent: []string{`"message":"Request Entity Too Large."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "viewer downloads an attachment",
+			Method: http.MethodGet,
+			Url:    url(sharedConversationID, "/sharedattach01"),
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{string(encrypted)},
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  uploadShared,
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				if res.Header.Get("Content-Type") != "application/octet-stream" {
+					t.Errorf("Expected a binary download, got %s", res.Header.Get("Content-Type"))
+				}
+			},
+		},
+		{
+			Name:   "attachment of another conversation",
+			Method: http.MethodGet,
+			Url:    url(privateConversationID, "/sharedattach01"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			ExpectedStatus:  http.StatusNotFound,
+			ExpectedContent: []string{`"message":"Attachment not found."`},
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  uploadShared,
+		},
+		{
+			Name:   "non-member can't download an attachment",
+			Method: http.MethodGet,
+			Url:    url(privateConversationID, "/privattach0001"),
+			RequestHeaders: map[string]string{
+				"Authorization": editorToken,
+			},
+			ExpectedStatus:  http.StatusForbidden,
+			ExpectedContent: []string{`"message":"You do not have permission to view this conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestChatCompletionsAttachments(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		userEmail      = "test2@example.com"
+		userID         = "xq9ndvc2kbrvrng"
+		conversationID = "privateconvtest"
+		vaultPassword  = "correct horse battery staple"
+	)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := newTestVault(t, userEmail, vaultPassword)
+
+	fileKey := make([]byte, 32)
+	if _, err := rand.Read(fileKey); err != nil {
+		t.Fatal(err)
+	}
+	encodedFileKey := base64.StdEncoding.EncodeToString(fileKey)
+
+	// requestBody refers to the attachment, the ID is replaced once it's
+	// uploaded
+	requestBody := func(conversationID, key string) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"model": "test:echo",
+			"messages": [{"role": "user", "content": "Summarise notes.txt"}],
+			"metadata": {"cognos": {
+				"agent_id": "cognos:simple-assistant",
+				"conversation_id": "%s",
+				"attachments": [{
+					"id": "attachment0001",
+					"name": "notes.txt",
+					"media_type": "text/plain",
+					"size": 100,
+					"key": "%s"
+				}]
+			}}
+		}`, conversationID, key))
+	}
+
+	// uploadFor uploads an attachment and refers to it in the request
+	uploadFor := func(
+		attachment *chat.Attachment,
+		linkToMessage bool,
+	) func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+		return func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+			vault.install(t, app, conversationID)
+			*attachment = uploadAttachment(
+				t,
+				app,
+				conversationID,
+				userID,
+				bytes.Repeat([]byte("x"), 140),
+			)
+			if linkToMessage {
+				collection, err := app.Dao().FindCollectionByNameOrId("messages")
+				if err != nil {
+					t.Fatal(err)
+				}
+				message := models.NewRecord(collection)
+				message.Set("conversation", conversationID)
+				message.Set("data", "c2VhbGVk")
+				if err := app.Dao().SaveRecord(message); err != nil {
+					t.Fatal(err)
+				}
+				err = chat.NewPocketBaseAttachmentRepo(app).
+					LinkToMessage(conversationID, message.Id, []string{attachment.ID})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			app.ResetEventCalls()
+
+			e.Pre(func(next echo.HandlerFunc) echo.HandlerFunc {
+				return func(c echo.Context) error {
+					body, err := io.ReadAll(c.Request().Body)
+					if err != nil {
+						return err
+					}
+					body = bytes.Replace(body, []byte("attachment0001"), []byte(attachment.ID), 1)
+					c.Request().Body = io.NopCloser(bytes.NewReader(body))
+					c.Request().ContentLength = int64(len(body))
+					return next(c)
+				}
+			})
+		}
+	}
+
+	var attached, linked chat.Attachment
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "attachments are kept with the request message",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           requestBody(conversationID, encodedFileKey),
+			ExpectedStatus: http.StatusOK,
+			// The attachment is linked to the request message
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 3,
+				"OnModelAfterCreate":  3,
+				"OnModelBeforeUpdate": 3,
+				"OnModelAfterUpdate":  3,
+			},
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+			BeforeTestFunc:  uploadFor(&attached, false),
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				var request chat.MessageRecordData
+				for _, message := range vault.decryptMessages(t, app, conversationID) {
+					if message.OwnerID == userID {
+						request = message
+					}
+				}
+				expected := chat.MessageAttachment{
+					ID:        attached.ID,
+					Name:      "notes.txt",
+					MediaType: "text/plain",
+					Size:      100,
+					Key:       encodedFileKey,
+				}
+				if len(request.Attachments) != 1 || request.Attachments[0] != expected {
+					t.Errorf("Expected the attachment %+v, got %+v", expected, request.Attachments)
+				}
+
+				attachment, err := chat.NewPocketBaseAttachmentRepo(app).
+					Attachment(conversationID, attached.ID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				record, err := app.Dao().FindRecordById("messages", attachment.MessageID)
+				if err != nil {
+					t.Fatalf("Expected the attachment to be linked to a message, %v", err)
+				}
+				if record.GetString("parent_message") != "" {
+					t.Error("Expected the attachment to be linked to the request message")
+				}
+			},
+		},
+		{
+			Name:   "attachment already attached to a message",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(conversationID, encodedFileKey),
+			ExpectedStatus:  http.StatusConflict,
+			ExpectedContent: []string{`"message":"The attachment already belongs to a message."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+			BeforeTestFunc:  uploadFor(&linked, true),
+		},
+		{
+			Name:   "unknown attachment",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(conversationID, encodedFileKey),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid attachment."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "attachment without a key",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(conversationID, ""),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid attachment."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "attachments without a conversation",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody("", encodedFileKey),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Attachments need a conversation."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/usage"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// fakeUpstreamResponse is returned by the fake OpenAI compatible upstream
+const fakeUpstreamResponse = `{
+	"id": "chatcmpl-test",
+	"object": "chat.completion",
+	"created": 1720000000,
+	"model": "echo",
+	"choices": [{
+		"index": 0,
+		"message": {"role": "assistant", "content": "Ahoy"},
+		"finish_reason": "stop"
+	}],
+	"usage": {"prompt_tokens": 12, "completion_tokens": 3, "total_tokens": 15}
+}`
+
+// completionEvents are the model events of a completion that isn't persisted,
+// only the token usage is recorded
+func completionEvents() map[string]int {
+	return map[string]int{"OnModelBeforeCreate": 1, "OnModelAfterCreate": 1}
+}
+
+// newFakeUpstream starts an OpenAI compatible upstream which replies to every
+// request with the given status and body, returning its URL.
+func newFakeUpstream(t *testing.T, status int, body string) string {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			_, _ = w.Write([]byte(body))
+		}),
+	)
+	t.Cleanup(server.Close)
+
+	return server.URL
+}
+
+// setupTestAppWithUpstream registers a `test` provider with a single `echo`
+// model that is served by a fake upstream so completions never leave the test.
+func setupTestAppWithUpstream(t *testing.T) *tests.TestApp {
+	return setupTestAppWithConfig(t, &config.APIConfig{
+		Providers: map[string]config.OpenAICompatibleProviderConfig{
+			"test": {
+				URL: newFakeUpstream(t, http.StatusOK, fakeUpstreamResponse),
+				Models: []config.ModelMappingConfig{
+					{Name: "echo", Upstream: "echo"},
+				},
+			},
+		},
+	})
+}
+
+// setupTestAppWithFailover registers a `flaky` provider whose upstream always
+// fails with the given status, and a `test` provider that works. Both serve the
+// `echo` model which is in the same family in the model catalogue. The
+// `flaky-only` agent can only be used with the `flaky` one.
+func setupTestAppWithFailover(flakyStatus int) func(t *testing.T) *tests.TestApp {
+	return func(t *testing.T) *tests.TestApp {
+		app := setupTestAppWithConfig(t, &config.APIConfig{
+			Providers: map[string]config.OpenAICompatibleProviderConfig{
+				"flaky": {URL: newFakeUpstream(
+					t,
+					flakyStatus,
+					`{"error": {"message": "flaky", "type": "server_error"}}`,
+				)},
+				"test": {URL: newFakeUpstream(t, http.StatusOK, fakeUpstreamResponse)},
+			},
+		})
+
+		collection, err := app.Dao().FindCollectionByNameOrId("models")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, provider := range []string{"flaky", "test"} {
+			record := models.NewRecord(collection)
+			record.Set("name", "Echo")
+			record.Set("slug", "echo")
+			record.Set("description", "Replies with a canned response")
+			record.Set("group", "Other")
+			record.Set("provider", provider)
+			record.Set("upstream_model", "echo")
+			record.Set("family", "echo")
+			record.Set("enabled", true)
+			if err := app.Dao().SaveRecord(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		agents, err := app.Dao().FindCollectionByNameOrId("agents")
+		if err != nil {
+			t.Fatal(err)
+		}
+		agent := models.NewRecord(agents)
+		agent.Set("name", "Flaky Only")
+		agent.Set("slug", "flaky-only")
+		agent.Set("system_message", "You are a helpful assistant")
+		agent.Set("visibility", "public")
+		agent.Set("allowed_models", []string{"flaky:echo"})
+		if err := app.Dao().SaveRecord(agent); err != nil {
+			t.Fatal(err)
+		}
+		app.ResetEventCalls()
+
+		return app
+	}
+}
+
+func TestChatCompletionsAgentPermissions(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		ownerEmail      = "test1@example.com"
+		sharedWithEmail = "test2@example.com"
+		otherUserEmail  = "no_data@example.com"
+		privateAgentID  = "test1-private"
+		sharedAgentID   = "test1-shared"
+		publicAgentID   = "cognos:simple-assistant"
+	)
+
+	ownerToken, err := generateRecordToken("users", ownerEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedWithToken, err := generateRecordToken("users", sharedWithEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherUserToken, err := generateRecordToken("users", otherUserEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestBody := func(agentID string) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"model": "test:echo",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"metadata": {"cognos": {"agent_id": "%s"}}
+		}`, agentID))
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "use private agent as guest",
+			Method:          http.MethodPost,
+			Url:             url,
+			RequestHeaders:  map[string]string{},
+			Body:            requestBody(privateAgentID),
+			ExpectedStatus:  http.StatusUnauthorized,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "use private agent as owner",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": ownerToken,
+			},
+			Body:            requestBody(privateAgentID),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  completionEvents(),
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "use private agent as another user",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": otherUserToken,
+			},
+			Body:           requestBody(privateAgentID),
+			ExpectedStatus: http.StatusForbidden,
+			// OpenAI style errors bypass the PocketBase error handler
+			ExpectedEvents: map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			ExpectedContent: []string{
+				`"type":"permission_error"`,
+				`"message":"You do not have permission to use this agent"`,
+			},
+			NotExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:     setupTestAppWithUpstream,
+		},
+		{
+			Name:   "use shared agent as owner",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": ownerToken,
+			},
+			Body:            requestBody(sharedAgentID),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  completionEvents(),
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "use shared agent as user it is shared with",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": sharedWithToken,
+			},
+			Body:            requestBody(sharedAgentID),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  completionEvents(),
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "use shared agent as another user",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": otherUserToken,
+			},
+			Body:            requestBody(sharedAgentID),
+			ExpectedStatus:  http.StatusForbidden,
+			ExpectedEvents:  map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			ExpectedContent: []string{`"type":"permission_error"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:            "use public agent as guest",
+			Method:          http.MethodPost,
+			Url:             url,
+			RequestHeaders:  map[string]string{},
+			Body:            requestBody(publicAgentID),
+			ExpectedStatus:  http.StatusUnauthorized,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "use public agent as another user",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": otherUserToken,
+			},
+			Body:            requestBody(publicAgentID),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  completionEvents(),
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestChatCompletionsConversationPermissions(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		creatorEmail        = "test2@example.com"
+		editorEmail         = "no_data@example.com"
+		viewerEmail         = "test1@example.com"
+		sharedConversation  = "sharedconvtest1"
+		privateConversation = "privateconvtest"
+	)
+
+	creatorToken, err := generateRecordToken("users", creatorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editorToken, err := generateRecordToken("users", editorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerToken, err := generateRecordToken("users", viewerEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestBody := func(conversationID string) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"model": "test:echo",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"metadata": {"cognos": {
+				"agent_id": "cognos:simple-assistant",
+				"conversation_id": "%s"
+			}}
+		}`, conversationID))
+	}
+
+	// Both the request and response messages are saved and each one
+	// updates the conversation, plus the usage is recorded
+	persistedEvents := map[string]int{
+		"OnModelBeforeCreate": 3,
+		"OnModelAfterCreate":  3,
+		"OnModelBeforeUpdate": 2,
+		"OnModelAfterUpdate":  2,
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "write to conversation as creator",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            requestBody(sharedConversation),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  persistedEvents,
+			ExpectedContent: []string{`"content":"Ahoy"`, `"response_record_id":`},
+			TestAppFactory:  setupTestAppWithUpstream,
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				// Both messages record the version of the key that sealed them
+				records, err := app.Dao().FindRecordsByExpr(
+					"messages",
+					dbx.HashExp{"conversation": sharedConversation},
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(records) != 2 {
+					t.Fatalf("Expected 2 messages, got %d", len(records))
+				}
+				for _, record := range records {
+					if got := record.GetInt("key_version"); got != 1 {
+						t.Errorf("Expected key version 1, got %d", got)
+					}
+				}
+			},
+		},
+		{
+			Name:   "write to conversation as editor",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": editorToken,
+			},
+			Body:            requestBody(sharedConversation),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  persistedEvents,
+			ExpectedContent: []string{`"content":"Ahoy"`, `"response_record_id":`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "write to conversation as viewer",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			Body:           requestBody(sharedConversation),
+			ExpectedStatus: http.StatusForbidden,
+			ExpectedEvents: map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			ExpectedContent: []string{
+				`"type":"permission_error"`,
+				`"message":"You do not have permission to write to this conversation"`,
+			},
+			NotExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:     setupTestAppWithUpstream,
+		},
+		{
+			Name:   "write to another users conversation",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			Body:               requestBody(privateConversation),
+			ExpectedStatus:     http.StatusForbidden,
+			ExpectedEvents:     map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			ExpectedContent:    []string{`"type":"permission_error"`},
+			NotExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:     setupTestAppWithUpstream,
+		},
+		{
+			Name:   "write to missing conversation",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            requestBody("missingconvtest"),
+			ExpectedStatus:  http.StatusNotFound,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestChatCompletionsFailover(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		userEmail = "test1@example.com"
+	)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestBody := func(model string) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"model": "%s",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"metadata": {"cognos": {"agent_id": "cognos:simple-assistant"}}
+		}`, model))
+	}
+	restrictedRequestBody := strings.NewReader(`{
+		"model": "flaky:echo",
+		"messages": [{"role": "user", "content": "Hello"}],
+		"metadata": {"cognos": {"agent_id": "flaky-only"}}
+	}`)
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "fail over when the provider is unavailable",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           requestBody("flaky:echo"),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: completionEvents(),
+			ExpectedContent: []string{
+				`"content":"Ahoy"`,
+				`"provider":"test"`,
+				`"model_id":"test:echo"`,
+			},
+			TestAppFactory: setupTestAppWithFailover(http.StatusServiceUnavailable),
+		},
+		{
+			Name:   "fail over when the provider is rate limiting",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody("flaky:echo"),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  completionEvents(),
+			ExpectedContent: []string{`"content":"Ahoy"`, `"provider":"test"`},
+			TestAppFactory:  setupTestAppWithFailover(http.StatusTooManyRequests),
+		},
+		{
+			Name:   "do not fail over on a bad request",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:               requestBody("flaky:echo"),
+			ExpectedStatus:     http.StatusInternalServerError,
+			ExpectedContent:    []string{`"message":"Failed to process request."`},
+			NotExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:     setupTestAppWithFailover(http.StatusBadRequest),
+		},
+		{
+			Name:   "do not fail over to a model the agent doesn't allow",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:               restrictedRequestBody,
+			ExpectedStatus:     http.StatusInternalServerError,
+			ExpectedContent:    []string{`"message":"Failed to process request."`},
+			NotExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:     setupTestAppWithFailover(http.StatusServiceUnavailable),
+		},
+		{
+			Name:   "use the requested provider when it works",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody("test:echo"),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  completionEvents(),
+			ExpectedContent: []string{`"content":"Ahoy"`, `"model_id":"test:echo"`},
+			TestAppFactory:  setupTestAppWithFailover(http.StatusServiceUnavailable),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+// setupTestAppWithQuotas is the same as setupTestAppWithUpstream with a daily
+// quota of 100 tokens for the default plan and no quota for the `pro` plan.
+// Test1 has already used 100 tokens today.
+func setupTestAppWithQuotas(t *testing.T) *tests.TestApp {
+	app := setupTestAppWithConfig(t, &config.APIConfig{
+		Providers: map[string]config.OpenAICompatibleProviderConfig{
+			"test": {
+				URL: newFakeUpstream(t, http.StatusOK, fakeUpstreamResponse),
+				Models: []config.ModelMappingConfig{
+					{Name: "echo", Upstream: "echo"},
+				},
+			},
+		},
+		Quotas: map[string]config.QuotaConfig{
+			config.DefaultPlan: {DailyTokens: 100},
+			"pro":              {},
+		},
+	})
+
+	user, err := app.Dao().FindAuthRecordByEmail("users", "test1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = usage.NewPocketBaseTokenUsageRepo(app, app.Logger()).
+		RecordUsage(usage.CompletionUsage{
+			UserID:           user.Id,
+			AgentID:          "simple-assistant",
+			ModelID:          "test:echo",
+			PromptTokens:     80,
+			CompletionTokens: 20,
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.ResetEventCalls()
+
+	return app
+}
+
+func TestChatCompletionsTokenQuotas(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		overQuotaEmail  = "test1@example.com"
+		underQuotaEmail = "test2@example.com"
+	)
+
+	overQuotaToken, err := generateRecordToken("users", overQuotaEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	underQuotaToken, err := generateRecordToken("users", underQuotaEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestBody := func() *strings.Reader {
+		return strings.NewReader(`{
+			"model": "test:echo",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"metadata": {"cognos": {"agent_id": "cognos:simple-assistant"}}
+		}`)
+	}
+
+	// tokensUsed checks the tokens the user has used today
+	tokensUsed := func(email string, expected int) func(*testing.T, *tests.TestApp, *http.Response) {
+		return func(t *testing.T, app *tests.TestApp, res *http.Response) {
+			user, err := app.Dao().FindAuthRecordByEmail("users", email)
+			if err != nil {
+				t.Fatal(err)
+			}
+			used, err := usage.NewPocketBaseTokenUsageRepo(app, app.Logger()).
+				TotalTokens(user.Id, time.Now(), time.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if used != expected {
+				t.Errorf("Expected %d tokens to be used, got %d", expected, used)
+			}
+		}
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "reject user over their daily quota",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": overQuotaToken,
+			},
+			Body:           requestBody(),
+			ExpectedStatus: http.StatusTooManyRequests,
+			ExpectedContent: []string{
+				`"type":"rate_limit_error"`,
+				`"code":"insufficient_quota"`,
+				`"message":"daily token quota of 100 exceeded`,
+			},
+			ExpectedEvents: map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			TestAppFactory: setupTestAppWithQuotas,
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				if res.Header.Get("Retry-After") == "" {
+					t.Error("Expected a Retry-After header")
+				}
+				tokensUsed(overQuotaEmail, 100)(t, app, res)
+			},
+		},
+		{
+			Name:   "record usage of user under their quota",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": underQuotaToken,
+			},
+			Body:            requestBody(),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"Ahoy"`, `"total_tokens":15`},
+			ExpectedEvents:  completionEvents(),
+			TestAppFactory:  setupTestAppWithQuotas,
+			AfterTestFunc:   tokensUsed(underQuotaEmail, 15),
+		},
+		{
+			Name:   "allow user on a plan without a quota",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": overQuotaToken,
+			},
+			Body:            requestBody(),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			// Adds to the usage already recorded today
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeUpdate": 1,
+				"OnModelAfterUpdate":  1,
+			},
+			TestAppFactory: func(t *testing.T) *tests.TestApp {
+				app := setupTestAppWithQuotas(t)
+				user, err := app.Dao().FindAuthRecordByEmail("users", overQuotaEmail)
+				if err != nil {
+					t.Fatal(err)
+				}
+				user.Set("plan", "pro")
+				if err := app.Dao().SaveRecord(user); err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+				return app
+			},
+			AfterTestFunc: tokensUsed(overQuotaEmail, 115),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
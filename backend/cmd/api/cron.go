@@ -26,7 +26,7 @@ func cleanUpExpiredMessageJob(
 		gocron.NewTask(func(logger *slog.Logger, repo ExpiredMessagesRepo) {
 			messageIds, err := repo.FindExpiredMessages()
 			if err != nil {
-				logger.Error("failed to find expired messages", err)
+				logger.Error("failed to find expired messages", "err", err)
 				return
 			}
 
@@ -35,9 +35,102 @@ func cleanUpExpiredMessageJob(
 			}
 
 			if _, err := repo.CleanUpExpiredMessages(messageIds); err != nil {
-				logger.Error("failed to clean up expired messages", err)
+				logger.Error("failed to clean up expired messages", "err", err)
 				return
 			}
 		}, logger, expiredMessagesRepo),
 	)
 }
+
+// How long idempotency keys are kept, retries after this are processed again
+const idempotencyKeyTTL = 24 * time.Hour
+
+type ExpiredIdempotencyKeysRepo interface {
+	PurgeExpired(before time.Time) (int64, error)
+}
+
+func purgeIdempotencyKeysJob(
+	scheduler gocron.Scheduler,
+	logger *slog.Logger,
+	idempotencyRepo ExpiredIdempotencyKeysRepo,
+) (gocron.Job, error) {
+	return scheduler.NewJob(
+		gocron.DurationRandomJob(
+			50*time.Minute,
+			70*time.Minute,
+		),
+		gocron.NewTask(func(logger *slog.Logger, repo ExpiredIdempotencyKeysRepo) {
+			purged, err := repo.PurgeExpired(time.Now().Add(-idempotencyKeyTTL))
+			if err != nil {
+				logger.Error("failed to purge expired idempotency keys", "err", err)
+				return
+			}
+
+			if purged > 0 {
+				logger.Info("purged expired idempotency keys", "count", purged)
+			}
+		}, logger, idempotencyRepo),
+	)
+}
+
+// How long an uploaded attachment can wait for a message to refer to it
+const orphanedAttachmentTTL = 24 * time.Hour
+
+type OrphanedAttachmentsRepo interface {
+	PurgeOrphaned(before time.Time) (int64, error)
+}
+
+func purgeOrphanedAttachmentsJob(
+	scheduler gocron.Scheduler,
+	logger *slog.Logger,
+	attachmentRepo OrphanedAttachmentsRepo,
+) (gocron.Job, error) {
+	return scheduler.NewJob(
+		gocron.DurationRandomJob(
+			50*time.Minute,
+			70*time.Minute,
+		),
+		gocron.NewTask(func(logger *slog.Logger, repo OrphanedAttachmentsRepo) {
+			purged, err := repo.PurgeOrphaned(time.Now().Add(-orphanedAttachmentTTL))
+			if err != nil {
+				logger.Error("failed to purge orphaned attachments", "err", err)
+				return
+			}
+
+			if purged > 0 {
+				logger.Info("purged orphaned attachments", "count", purged)
+			}
+		}, logger, attachmentRepo),
+	)
+}
+
+type ExpiredRateLimitsRepo interface {
+	PurgeExpired(before time.Time) (int64, error)
+}
+
+// purgeRateLimitsJob deletes the counts of rate limit windows which have ended,
+// there's one for every user and IP address so they add up
+func purgeRateLimitsJob(
+	scheduler gocron.Scheduler,
+	logger *slog.Logger,
+	rateLimitRepo ExpiredRateLimitsRepo,
+	longestWindow time.Duration,
+) (gocron.Job, error) {
+	return scheduler.NewJob(
+		gocron.DurationRandomJob(
+			50*time.Minute,
+			70*time.Minute,
+		),
+		gocron.NewTask(func(logger *slog.Logger, repo ExpiredRateLimitsRepo) {
+			purged, err := repo.PurgeExpired(time.Now().Add(-longestWindow))
+			if err != nil {
+				logger.Error("failed to purge expired rate limits", "err", err)
+				return
+			}
+
+			if purged > 0 {
+				logger.Info("purged expired rate limits", "count", purged)
+			}
+		}, logger, rateLimitRepo),
+	)
+}
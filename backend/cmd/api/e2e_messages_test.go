@@ -0,0 +1,561 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/crypto"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tests"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// testVault holds the keys of a user and one of their conversations, wrapped
+// the same way as the clients and cmd/cognos-keys do
+type testVault struct {
+	email    string
+	password string
+
+	kdfParams                    crypto.KDFParams
+	userPublicKey                [32]byte
+	wrappedUserSecretKey         []byte
+	conversationPublicKey        [32]byte
+	conversationSecretKey        [32]byte
+	wrappedConversationSecretKey []byte
+}
+
+func newTestVault(t *testing.T, email, password string) *testVault {
+	t.Helper()
+
+	userPublicKey, userSecretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversationPublicKey, conversationSecretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The user secret key is sealed with their hashed vault password
+	kdfParams, err := crypto.DefaultKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaultPasswordKey, err := kdfParams.DeriveKey(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := generateNonce()
+	wrappedUserSecretKey := secretbox.Seal(nonce[:], userSecretKey[:], &nonce, &vaultPasswordKey)
+
+	// The conversation secret key is boxed with the key shared by the
+	// conversation public key and the user secret key
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, conversationPublicKey, userSecretKey)
+	nonce = generateNonce()
+	wrappedConversationSecretKey := box.SealAfterPrecomputation(
+		nonce[:],
+		conversationSecretKey[:],
+		&nonce,
+		&sharedKey,
+	)
+
+	return &testVault{
+		email:                        email,
+		password:                     password,
+		kdfParams:                    kdfParams,
+		userPublicKey:                *userPublicKey,
+		wrappedUserSecretKey:         wrappedUserSecretKey,
+		conversationPublicKey:        *conversationPublicKey,
+		conversationSecretKey:        *conversationSecretKey,
+		wrappedConversationSecretKey: wrappedConversationSecretKey,
+	}
+}
+
+// install replaces the key pair of the user and the first key of the
+// conversation in the test DB with the vault's keys
+func (v *testVault) install(t *testing.T, app *tests.TestApp, conversationID string) {
+	t.Helper()
+
+	user := v.installKeyPair(t, app)
+	v.installConversationKey(t, app, user, conversationID)
+}
+
+// installKeyPair replaces the key pair of the user in the test DB with the
+// vault's key pair
+func (v *testVault) installKeyPair(t *testing.T, app *tests.TestApp) *models.Record {
+	t.Helper()
+
+	user, err := app.Dao().FindAuthRecordByEmail("users", v.email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userKeyPair, err := app.Dao().FindFirstRecordByData("user_key_pairs", "user", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userKeyPair.Set("public_key", base64.StdEncoding.EncodeToString(v.userPublicKey[:]))
+	userKeyPair.Set("secret_key", base64.StdEncoding.EncodeToString(v.wrappedUserSecretKey))
+	userKeyPair.Set("kdf_algorithm", string(v.kdfParams.Algorithm))
+	userKeyPair.Set("kdf_salt", base64.StdEncoding.EncodeToString(v.kdfParams.Salt))
+	userKeyPair.Set("kdf_iterations", v.kdfParams.Iterations)
+	userKeyPair.Set("kdf_memory", v.kdfParams.Memory)
+	userKeyPair.Set("kdf_threads", v.kdfParams.Threads)
+	if err := app.Dao().SaveRecord(userKeyPair); err != nil {
+		t.Fatal(err)
+	}
+
+	return user
+}
+
+// wrapConversationKeyFor wraps the conversation secret key for another member,
+// the way an admin does when they invite them
+func (v *testVault) wrapConversationKeyFor(t *testing.T, memberPublicKey [32]byte) string {
+	t.Helper()
+
+	nonce := generateNonce()
+	sharedKey := crypto.SharedKey(memberPublicKey, v.conversationSecretKey)
+	wrapped := box.SealAfterPrecomputation(
+		nonce[:],
+		v.conversationSecretKey[:],
+		&nonce,
+		&sharedKey,
+	)
+
+	return base64.StdEncoding.EncodeToString(wrapped)
+}
+
+// installConversationKey replaces the first key of the conversation in the test
+// DB and wraps its secret key for the user
+func (v *testVault) installConversationKey(
+	t *testing.T,
+	app *tests.TestApp,
+	user *models.Record,
+	conversationID string,
+) {
+	t.Helper()
+
+	conversationKey, err := app.Dao().FindFirstRecordByFilter(
+		"conversation_public_keys",
+		"conversation = {:conversation} && version = 1",
+		dbx.Params{"conversation": conversationID},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversationKey.Set(
+		"public_key",
+		base64.StdEncoding.EncodeToString(v.conversationPublicKey[:]),
+	)
+	if err := app.Dao().SaveRecord(conversationKey); err != nil {
+		t.Fatal(err)
+	}
+
+	collection, err := app.Dao().FindCollectionByNameOrId("conversation_secret_keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversationSecretKey := models.NewRecord(collection)
+	conversationSecretKey.Set("conversation", conversationID)
+	conversationSecretKey.Set("user", user.Id)
+	conversationSecretKey.Set(
+		"secret_key",
+		base64.StdEncoding.EncodeToString(v.wrappedConversationSecretKey),
+	)
+	if err := app.Dao().SaveRecord(conversationSecretKey); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// openConversation unlocks the conversation secret key from the records in the
+// test DB with the vault password, like a client does
+func (v *testVault) openConversation(
+	t *testing.T,
+	app *tests.TestApp,
+	conversationID string,
+	password string,
+) (publicKey, secretKey [32]byte, err error) {
+	t.Helper()
+
+	user, err := app.Dao().FindAuthRecordByEmail("users", v.email)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userKeyPair, err := app.Dao().FindFirstRecordByData("user_key_pairs", "user", user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The vault password key is derived with the parameters stored with it
+	kdfParams := crypto.KDFParams{
+		Algorithm:  crypto.KDFAlgorithm(userKeyPair.GetString("kdf_algorithm")),
+		Salt:       decodeBase64(t, userKeyPair.GetString("kdf_salt")),
+		Iterations: uint32(userKeyPair.GetInt("kdf_iterations")),
+		Memory:     uint32(userKeyPair.GetInt("kdf_memory")),
+		Threads:    uint8(userKeyPair.GetInt("kdf_threads")),
+	}
+	vaultPasswordKey, err := kdfParams.DeriveKey(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	userSecretKey, err := crypto.OpenSecretKey(
+		vaultPasswordKey,
+		decodeBase64(t, userKeyPair.GetString("secret_key")),
+	)
+	if err != nil {
+		return publicKey, secretKey, err
+	}
+
+	conversationKey, err := app.Dao().FindFirstRecordByFilter(
+		"conversation_public_keys",
+		"conversation = {:conversation} && version = 1",
+		dbx.Params{"conversation": conversationID},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	copy(publicKey[:], decodeBase64(t, conversationKey.GetString("public_key")))
+
+	wrapped, err := app.Dao().FindFirstRecordByFilter(
+		"conversation_secret_keys",
+		"conversation = {:conversation} && user = {:user}",
+		dbx.Params{"conversation": conversationID, "user": user.Id},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey, err = crypto.OpenSecretKey(
+		crypto.SharedKey(publicKey, userSecretKey),
+		decodeBase64(t, wrapped.GetString("secret_key")),
+	)
+
+	return publicKey, secretKey, err
+}
+
+// decryptMessages opens every message of the conversation with the vault
+func (v *testVault) decryptMessages(
+	t *testing.T,
+	app *tests.TestApp,
+	conversationID string,
+) []chat.MessageRecordData {
+	t.Helper()
+
+	publicKey, secretKey, err := v.openConversation(t, app, conversationID, v.password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := app.Dao().FindRecordsByExpr(
+		"messages",
+		dbx.HashExp{"conversation": conversationID},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	messages := make([]chat.MessageRecordData, 0, len(records))
+	for _, record := range records {
+		envelope, err := chat.DecodeEnvelope(record.GetString("data"))
+		if err != nil {
+			t.Fatalf("Failed to decode message %s: %v", record.Id, err)
+		}
+		if envelope.Version != chat.EnvelopeVersionLegacy &&
+			envelope.KeyID != record.GetInt("key_version") {
+			t.Errorf(
+				"Expected message %s envelope key %d, got %d",
+				record.Id,
+				record.GetInt("key_version"),
+				envelope.KeyID,
+			)
+		}
+
+		plaintext, err := crypto.AsymmetricDecrypt(publicKey, secretKey, envelope.Ciphertext)
+		if err != nil {
+			t.Fatalf("Failed to decrypt message %s: %v", record.Id, err)
+		}
+
+		var message chat.MessageRecordData
+		if err := json.Unmarshal(plaintext, &message); err != nil {
+			t.Fatal(err)
+		}
+		messages = append(messages, message)
+	}
+
+	return messages
+}
+
+func decodeBase64(t *testing.T, encoded string) []byte {
+	t.Helper()
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return decoded
+}
+
+func TestEncryptedMessagesRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		userEmail      = "test2@example.com"
+		userID         = "xq9ndvc2kbrvrng"
+		conversationID = "privateconvtest"
+		vaultPassword  = "correct horse battery staple"
+	)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := newTestVault(t, userEmail, vaultPassword)
+
+	requestBody := func() *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"model": "test:echo",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"metadata": {"cognos": {
+				"agent_id": "cognos:simple-assistant",
+				"conversation_id": "%s"
+			}}
+		}`, conversationID))
+	}
+
+	// Both the request and response messages are saved and each one
+	// updates the conversation, plus the usage is recorded
+	persistedEvents := map[string]int{
+		"OnModelBeforeCreate": 3,
+		"OnModelAfterCreate":  3,
+		"OnModelBeforeUpdate": 2,
+		"OnModelAfterUpdate":  2,
+	}
+
+	// wantCompletion checks the request and response messages were sealed
+	// with the current message data version
+	wantCompletion := func(t *testing.T, messages []chat.MessageRecordData) {
+		t.Helper()
+
+		found := map[string]bool{}
+		for _, message := range messages {
+			switch {
+			case message.OwnerID == userID && message.Content == "Hello":
+				found["request"] = true
+			case message.ModelID == "test:echo" && message.Content == "Ahoy":
+				found["response"] = true
+			default:
+				continue
+			}
+			if message.Version != chat.CurrentMessageDataVersion {
+				t.Errorf(
+					"Expected message data version %s, got %s",
+					chat.CurrentMessageDataVersion,
+					message.Version,
+				)
+			}
+		}
+		if !found["request"] || !found["response"] {
+			t.Errorf("Expected the request and response messages, got %+v", messages)
+		}
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "persisted messages open with the vault",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  persistedEvents,
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				vault.install(t, app, conversationID)
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				messages := vault.decryptMessages(t, app, conversationID)
+				if len(messages) != 2 {
+					t.Fatalf("Expected 2 messages, got %d", len(messages))
+				}
+				wantCompletion(t, messages)
+
+				// A wrong vault password can't unlock the conversation
+				_, _, err := vault.openConversation(t, app, conversationID, "wrong password")
+				if !errors.Is(err, crypto.ErrDecryptionFailed) {
+					t.Errorf("Expected ErrDecryptionFailed with a wrong password, got %v", err)
+				}
+			},
+		},
+		{
+			Name:   "legacy messages open alongside envelopes",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  persistedEvents,
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				vault.install(t, app, conversationID)
+
+				// A message written before envelopes, a bare base64 sealed box
+				plaintext, err := json.Marshal(chat.MessageRecordData{
+					Content: "Before envelopes",
+					OwnerID: userID,
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ciphertext, err := crypto.AsymmetricEncrypt(vault.conversationPublicKey, plaintext)
+				if err != nil {
+					t.Fatal(err)
+				}
+				collection, err := app.Dao().FindCollectionByNameOrId("messages")
+				if err != nil {
+					t.Fatal(err)
+				}
+				record := models.NewRecord(collection)
+				record.Set("conversation", conversationID)
+				record.Set("data", base64.StdEncoding.EncodeToString(ciphertext))
+				record.Set("key_version", 1)
+				if err := app.Dao().SaveRecord(record); err != nil {
+					t.Fatal(err)
+				}
+
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				messages := vault.decryptMessages(t, app, conversationID)
+				if len(messages) != 3 {
+					t.Fatalf("Expected 3 messages, got %d", len(messages))
+				}
+				wantCompletion(t, messages)
+
+				legacy := 0
+				for _, message := range messages {
+					if message.Content == "Before envelopes" && message.Version == "" {
+						legacy++
+					}
+				}
+				if legacy != 1 {
+					t.Errorf("Expected the legacy message to open, got %+v", messages)
+				}
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestSharedConversationMessages(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		creatorEmail   = "test2@example.com"
+		editorEmail    = "no_data@example.com"
+		editorID       = "j8prcx3dum2l3kc"
+		conversationID = "sharedconvtest1"
+	)
+
+	editorToken, err := generateRecordToken("users", editorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	creator := newTestVault(t, creatorEmail, "creator vault password")
+	editor := newTestVault(t, editorEmail, "editor vault password")
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "messages from an editor open for every member",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": editorToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"model": "test:echo",
+				"messages": [{"role": "user", "content": "Hello from the editor"}],
+				"metadata": {"cognos": {
+					"agent_id": "cognos:simple-assistant",
+					"conversation_id": "%s"
+				}}
+			}`, conversationID)),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 3,
+				"OnModelAfterCreate":  3,
+				"OnModelBeforeUpdate": 2,
+				"OnModelAfterUpdate":  2,
+			},
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				creator.install(t, app, conversationID)
+
+				// The creator wraps the conversation key for the editor
+				user := editor.installKeyPair(t, app)
+				collection, err := app.Dao().FindCollectionByNameOrId("conversation_secret_keys")
+				if err != nil {
+					t.Fatal(err)
+				}
+				record := models.NewRecord(collection)
+				record.Set("conversation", conversationID)
+				record.Set("user", user.Id)
+				record.Set("secret_key", creator.wrapConversationKeyFor(t, editor.userPublicKey))
+				if err := app.Dao().SaveRecord(record); err != nil {
+					t.Fatal(err)
+				}
+
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				for _, vault := range []*testVault{creator, editor} {
+					messages := vault.decryptMessages(t, app, conversationID)
+					if len(messages) != 2 {
+						t.Fatalf("Expected 2 messages, got %d", len(messages))
+					}
+
+					// The request is owned by the editor who sent it
+					owners := 0
+					for _, message := range messages {
+						if message.Content == "Hello from the editor" && message.OwnerID == editorID {
+							owners++
+						}
+					}
+					if owners != 1 {
+						t.Errorf("Expected the request to be owned by the editor, got %+v", messages)
+					}
+				}
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
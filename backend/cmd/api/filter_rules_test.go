@@ -29,9 +29,12 @@ import (
 	"testing"
 
 	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/crypto"
+	"github.com/go-co-op/gocron/v2"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/models"
 	"github.com/pocketbase/pocketbase/tests"
 	"github.com/pocketbase/pocketbase/tokens"
-	"golang.org/x/crypto/argon2"
 	"golang.org/x/crypto/nacl/box"
 	"golang.org/x/crypto/nacl/secretbox"
 )
@@ -53,31 +56,51 @@ func generateRecordToken(collectionNameOrId string, email string) (string, error
 	return tokens.NewRecordAuthToken(app, record)
 }
 
+func generateAdminToken(email string) (string, error) {
+	app, err := tests.NewTestApp(testDataDir)
+	if err != nil {
+		return "", err
+	}
+	defer app.Cleanup()
+
+	admin, err := app.Dao().FindAdminByEmail(email)
+	if err != nil {
+		return "", err
+	}
+
+	return tokens.NewAdminAuthToken(app, admin)
+}
+
 func setupTestApp(t *testing.T) *tests.TestApp {
+	return setupTestAppWithConfig(t, &config.APIConfig{})
+}
+
+func setupTestAppWithConfig(t *testing.T, testConfig *config.APIConfig) *tests.TestApp {
 	app, err := tests.NewTestApp(testDataDir)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	testConfig := config.APIConfig{}
+	scheduler, err := gocron.NewScheduler()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	bindAppHooks(appHookParams{
-		App:    app,
-		Config: &testConfig,
+		App:           app,
+		Config:        testConfig,
+		CronScheduler: scheduler,
 	})
 
 	return app
 }
 
+// hashVaultPassword derives the key of a legacy key pair, salted with the email
 func hashVaultPassword(vaultPassword, userEmail string) [32]byte {
-	hashedPassword := argon2.IDKey(
-		[]byte(vaultPassword),
-		[]byte(userEmail),
-		2, 19*1024, 1,
-		32,
-	)
-	var vaultPasswordKey [32]byte
-	copy(vaultPasswordKey[:], hashedPassword)
+	vaultPasswordKey, err := crypto.LegacyKDFParams(userEmail).DeriveKey(vaultPassword)
+	if err != nil {
+		panic(err)
+	}
 
 	return vaultPasswordKey
 }
@@ -206,10 +229,12 @@ func TestConversationFilterRules(t *testing.T) {
 			RequestHeaders: map[string]string{
 				"Authorization": recordToken,
 			},
-			ExpectedStatus:  http.StatusOK,
-			ExpectedEvents:  map[string]int{"OnRecordsListRequest": 1},
-			ExpectedContent: []string{"\"items\":[]"},
-			TestAppFactory:  setupTestApp,
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{"OnRecordsListRequest": 1},
+			// The user is a participant of the shared conversation only
+			ExpectedContent:    []string{`"totalItems":1`, `"id":"sharedconvtest1"`},
+			NotExpectedContent: []string{`"id":"privateconvtest"`},
+			TestAppFactory:     setupTestApp,
 		},
 	}
 
@@ -237,6 +262,38 @@ func TestUserKeyPairFilterRules(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// kdfParams are the KDF fields of a key pair wrapped with a random salt,
+	// the salts are 16 bytes encoded in base64
+	kdfParams := func(salt string, iterations int) string {
+		return fmt.Sprintf(`
+			"kdf_algorithm": "argon2id",
+			"kdf_salt": "%s",
+			"kdf_iterations": %d,
+			"kdf_memory": 19456,
+			"kdf_threads": 1`, salt, iterations)
+	}
+	const (
+		firstSalt  = "c2FsdHNhbHRzYWx0c2FsdA=="
+		secondSalt = "cGVwcGVycGVwcGVycGVwcA=="
+	)
+
+	// setKDFParams stores KDF parameters for the legacy key pair of the user
+	setKDFParams := func(t *testing.T, app *tests.TestApp) {
+		record, err := app.Dao().FindRecordById(collectionName, "3gtr36mn54ldo53")
+		if err != nil {
+			t.Fatal(err)
+		}
+		record.Set("kdf_algorithm", "argon2id")
+		record.Set("kdf_salt", firstSalt)
+		record.Set("kdf_iterations", 3)
+		record.Set("kdf_memory", 19456)
+		record.Set("kdf_threads", 1)
+		if err := app.Dao().SaveRecord(record); err != nil {
+			t.Fatal(err)
+		}
+		app.ResetEventCalls()
+	}
+
 	scenarios := []tests.ApiScenario{
 		// List/Search
 		{
@@ -321,8 +378,8 @@ func TestUserKeyPairFilterRules(t *testing.T) {
 			Body: strings.NewReader(fmt.Sprintf(`{
 				"user": "%s",
 				"public_key": "%s",
-				"secret_key": "%s"
-			}`, userId, userPublicKey, userEncryptedSecretKey)),
+				"secret_key": "%s",%s
+			}`, userId, userPublicKey, userEncryptedSecretKey, kdfParams(firstSalt, 2))),
 			ExpectedStatus: http.StatusOK,
 			ExpectedEvents: map[string]int{
 				"OnModelAfterCreate":          1,
@@ -330,8 +387,68 @@ func TestUserKeyPairFilterRules(t *testing.T) {
 				"OnRecordAfterCreateRequest":  1,
 				"OnRecordBeforeCreateRequest": 1,
 			},
-			ExpectedContent: []string{fmt.Sprintf(`"public_key":"%s"`, userPublicKey)},
-			TestAppFactory:  setupTestApp,
+			ExpectedContent: []string{
+				fmt.Sprintf(`"public_key":"%s"`, userPublicKey),
+				fmt.Sprintf(`"kdf_salt":"%s"`, firstSalt),
+			},
+			TestAppFactory: setupTestApp,
+		},
+		{
+			Name:   "create user key pair via user token without KDF parameters",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"user": "%s",
+				"public_key": "%s",
+				"secret_key": "%s"
+			}`, userId, userPublicKey, userEncryptedSecretKey)),
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedEvents: map[string]int{"OnRecordBeforeCreateRequest": 1},
+			ExpectedContent: []string{
+				`"message":"Invalid KDF parameters: kdf_algorithm, kdf_salt, kdf_iterations, kdf_memory and kdf_threads are required."`,
+			},
+			TestAppFactory: setupTestApp,
+		},
+		{
+			Name:   "create user key pair via user token with a weak KDF",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"user": "%s",
+				"public_key": "%s",
+				"secret_key": "%s",%s
+			}`, userId, userPublicKey, userEncryptedSecretKey, kdfParams(firstSalt, 1))),
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedEvents: map[string]int{"OnRecordBeforeCreateRequest": 1},
+			ExpectedContent: []string{
+				`"message":"Invalid KDF parameters: iterations must be between 2 and 16."`,
+			},
+			TestAppFactory: setupTestApp,
+		},
+		{
+			Name:   "create user key pair via user token with a short salt",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"user": "%s",
+				"public_key": "%s",
+				"secret_key": "%s",%s
+			}`, userId, userPublicKey, userEncryptedSecretKey, kdfParams("c2FsdA==", 2))),
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedEvents: map[string]int{"OnRecordBeforeCreateRequest": 1},
+			ExpectedContent: []string{
+				`"message":"Invalid KDF parameters: the salt must be at least 16 random bytes."`,
+			},
+			TestAppFactory: setupTestApp,
 		},
 		{
 			Name:   "create user key pair via user token with missing user ID",
@@ -344,9 +461,12 @@ func TestUserKeyPairFilterRules(t *testing.T) {
 				"public_key": "%s",
 				"secret_key": "%s"
 			}`, userPublicKey, userEncryptedSecretKey)),
-			ExpectedStatus:  http.StatusBadRequest,
-			ExpectedContent: []string{`"data":{}`},
-			TestAppFactory:  setupTestApp,
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedContent: []string{
+				`"data":{"user":`,
+				`"code":"validation_required"`,
+			},
+			TestAppFactory: setupTestApp,
 		},
 		{
 			Name:   "create user key pair via user token with invalid keys",
@@ -418,6 +538,459 @@ func TestUserKeyPairFilterRules(t *testing.T) {
 			ExpectedContent: []string{`"data":{}`},
 			TestAppFactory:  setupTestApp,
 		},
+		// Update
+		{
+			Name:   "upgrade legacy user key pair as guest",
+			Method: http.MethodPatch,
+			Url:    fmt.Sprintf("%s/3gtr36mn54ldo53", url),
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"secret_key": "%s",%s
+			}`, userEncryptedSecretKey, kdfParams(firstSalt, 2))),
+			RequestHeaders:  map[string]string{},
+			ExpectedStatus:  http.StatusNotFound,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "upgrade legacy user key pair via user token",
+			Method: http.MethodPatch,
+			Url:    fmt.Sprintf("%s/3gtr36mn54ldo53", url),
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"secret_key": "%s",%s
+			}`, userEncryptedSecretKey, kdfParams(firstSalt, 2))),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{
+				"OnModelAfterUpdate":          1,
+				"OnModelBeforeUpdate":         1,
+				"OnRecordAfterUpdateRequest":  1,
+				"OnRecordBeforeUpdateRequest": 1,
+			},
+			ExpectedContent: []string{
+				fmt.Sprintf(`"public_key":"%s"`, userPublicKey),
+				fmt.Sprintf(`"kdf_salt":"%s"`, firstSalt),
+				`"kdf_algorithm":"argon2id"`,
+			},
+			TestAppFactory: setupTestApp,
+		},
+		{
+			Name:   "re-wrap user key pair via user token with a new salt",
+			Method: http.MethodPatch,
+			Url:    fmt.Sprintf("%s/3gtr36mn54ldo53", url),
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"secret_key": "%s",%s
+			}`, userEncryptedSecretKey, kdfParams(secondSalt, 4))),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{
+				"OnModelAfterUpdate":          1,
+				"OnModelBeforeUpdate":         1,
+				"OnRecordAfterUpdateRequest":  1,
+				"OnRecordBeforeUpdateRequest": 1,
+			},
+			ExpectedContent: []string{
+				fmt.Sprintf(`"kdf_salt":"%s"`, secondSalt),
+				`"kdf_iterations":4`,
+			},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				setKDFParams(t, app)
+			},
+		},
+		{
+			Name:   "re-wrap user key pair via user token with the same salt",
+			Method: http.MethodPatch,
+			Url:    fmt.Sprintf("%s/3gtr36mn54ldo53", url),
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"secret_key": "%s",%s
+			}`, userEncryptedSecretKey, kdfParams(firstSalt, 3))),
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedEvents: map[string]int{"OnRecordBeforeUpdateRequest": 1},
+			ExpectedContent: []string{
+				`"message":"Invalid KDF parameters: the secret key must be re-wrapped with a new salt."`,
+			},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				setKDFParams(t, app)
+			},
+		},
+		{
+			Name:   "re-wrap user key pair via user token with a lower cost",
+			Method: http.MethodPatch,
+			Url:    fmt.Sprintf("%s/3gtr36mn54ldo53", url),
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"secret_key": "%s",%s
+			}`, userEncryptedSecretKey, kdfParams(secondSalt, 2))),
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedEvents: map[string]int{"OnRecordBeforeUpdateRequest": 1},
+			ExpectedContent: []string{
+				`"message":"Invalid KDF parameters: the cost can't be lowered."`,
+			},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				setKDFParams(t, app)
+			},
+		},
+		{
+			Name:   "change the public key via user token",
+			Method: http.MethodPatch,
+			Url:    fmt.Sprintf("%s/3gtr36mn54ldo53", url),
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"public_key": "%s",
+				"secret_key": "%s",%s
+			}`, userPublicKey, userEncryptedSecretKey, kdfParams(firstSalt, 2))),
+			ExpectedStatus:  http.StatusNotFound,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "upgrade another users key pair via user token",
+			Method: http.MethodPatch,
+			Url:    fmt.Sprintf("%s/nekxd2byk1j1cof", url),
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(`{
+				"secret_key": "%s",%s
+			}`, userEncryptedSecretKey, kdfParams(firstSalt, 2))),
+			ExpectedStatus:  http.StatusNotFound,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestParticipantFilterRules(t *testing.T) {
+	t.Parallel()
+
+	const (
+		// Get this info from the pre-populated test DB
+		sharedConversation  = "sharedconvtest1"
+		privateConversation = "privateconvtest"
+		creatorEmail        = "test2@example.com"
+		creatorID           = "xq9ndvc2kbrvrng"
+		viewerEmail         = "test1@example.com"
+		viewerID            = "uvi8zmr78j9y5hz"
+		editorParticipantID = "yb2kbcuqw0ttwvt"
+	)
+
+	creatorToken, err := generateRecordToken("users", creatorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerToken, err := generateRecordToken("users", viewerEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrappedKey := base64.StdEncoding.EncodeToString(make([]byte, 72))
+
+	// seedConversations adds a message to both conversations and wraps their
+	// keys for their members
+	seedConversations := func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+		messages, err := app.Dao().FindCollectionByNameOrId("messages")
+		if err != nil {
+			t.Fatal(err)
+		}
+		secretKeys, err := app.Dao().FindCollectionByNameOrId("conversation_secret_keys")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, conversationID := range []string{sharedConversation, privateConversation} {
+			message := models.NewRecord(messages)
+			message.Set("conversation", conversationID)
+			message.Set("data", "c2VhbGVk")
+			if err := app.Dao().SaveRecord(message); err != nil {
+				t.Fatal(err)
+			}
+
+			members := []string{creatorID}
+			if conversationID == sharedConversation {
+				members = append(members, viewerID)
+			}
+			for _, userID := range members {
+				secretKey := models.NewRecord(secretKeys)
+				secretKey.Set("conversation", conversationID)
+				secretKey.Set("user", userID)
+				secretKey.Set("secret_key", wrappedKey)
+				if err := app.Dao().SaveRecord(secretKey); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		app.ResetEventCalls()
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "participant lists the messages of a shared conversation",
+			Method: http.MethodGet,
+			Url:    "/api/collections/messages/records?conversation=" + sharedConversation,
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  map[string]int{"OnRecordsListRequest": 1},
+			ExpectedContent: []string{`"totalItems":1`, `"conversation":"sharedconvtest1"`},
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  seedConversations,
+		},
+		{
+			Name:   "non participant can't list the messages of a conversation",
+			Method: http.MethodGet,
+			Url:    "/api/collections/messages/records?conversation=" + privateConversation,
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  map[string]int{"OnRecordsListRequest": 1},
+			ExpectedContent: []string{`"items":[]`},
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc:  seedConversations,
+		},
+		{
+			Name:   "participant lists the public keys of a shared conversation",
+			Method: http.MethodGet,
+			Url:    "/api/collections/conversation_public_keys/records",
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			ExpectedStatus:     http.StatusOK,
+			ExpectedEvents:     map[string]int{"OnRecordsListRequest": 1},
+			ExpectedContent:    []string{`"totalItems":1`, `"conversation":"sharedconvtest1"`},
+			NotExpectedContent: []string{`"conversation":"privateconvtest"`},
+			TestAppFactory:     setupTestApp,
+		},
+		{
+			Name:   "participant lists only their own secret keys",
+			Method: http.MethodGet,
+			Url:    "/api/collections/conversation_secret_keys/records",
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			ExpectedStatus:     http.StatusOK,
+			ExpectedEvents:     map[string]int{"OnRecordsListRequest": 1},
+			ExpectedContent:    []string{`"totalItems":1`, `"user":"` + viewerID + `"`},
+			NotExpectedContent: []string{`"user":"` + creatorID + `"`},
+			TestAppFactory:     setupTestApp,
+			BeforeTestFunc:     seedConversations,
+		},
+		{
+			Name:   "participant lists the other participants",
+			Method: http.MethodGet,
+			Url:    "/api/collections/participants/records",
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  map[string]int{"OnRecordsListRequest": 1},
+			ExpectedContent: []string{`"totalItems":2`, `"id":"` + editorParticipantID + `"`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "creator can't add participants directly",
+			Method: http.MethodPost,
+			Url:    "/api/collections/participants/records",
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(
+				`{"conversation": "%s", "user": "%s", "role": "Admin"}`,
+				privateConversation,
+				viewerID,
+			)),
+			ExpectedStatus:  http.StatusForbidden,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "creator can't remove participants directly",
+			Method: http.MethodDelete,
+			Url:    "/api/collections/participants/records/" + editorParticipantID,
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			ExpectedStatus:  http.StatusForbidden,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "creator saves their secret key with the current key version",
+			Method: http.MethodPost,
+			Url:    "/api/collections/conversation_secret_keys/records",
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(
+				`{"conversation": "%s", "user": "%s", "secret_key": "%s"}`,
+				sharedConversation,
+				creatorID,
+				wrappedKey,
+			)),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{
+				"OnModelAfterCreate":          1,
+				"OnModelBeforeCreate":         1,
+				"OnRecordAfterCreateRequest":  1,
+				"OnRecordBeforeCreateRequest": 1,
+			},
+			ExpectedContent: []string{`"key_version":1`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "participant can't save a secret key directly",
+			Method: http.MethodPost,
+			Url:    "/api/collections/conversation_secret_keys/records",
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			Body: strings.NewReader(fmt.Sprintf(
+				`{"conversation": "%s", "user": "%s", "secret_key": "%s"}`,
+				sharedConversation,
+				viewerID,
+				wrappedKey,
+			)),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestAgentFilterRules(t *testing.T) {
+	t.Parallel()
+
+	const (
+		collectionName = "agents"
+		// Get this info from the pre-populated test DB
+		userEmail = "test1@example.com"
+		userId    = "uvi8zmr78j9y5hz"
+	)
+
+	url := fmt.Sprintf("/api/collections/%s/records", collectionName)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	agentBody := func(owner, visibility string) io.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"name": "Pirate",
+			"slug": "pirate-%s",
+			"description": "Talks like a pirate",
+			"system_message": "Reply as if you were a pirate",
+			"owner": "%s",
+			"visibility": "%s"
+		}`, visibility, owner, visibility))
+	}
+
+	scenarios := []tests.ApiScenario{
+		// List/Search
+		{
+			Name:            "list agents as guest",
+			Method:          http.MethodGet,
+			Url:             url,
+			RequestHeaders:  map[string]string{},
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  map[string]int{"OnRecordsListRequest": 1},
+			ExpectedContent: []string{`"items":[]`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "list public and own agents via user token",
+			Method: http.MethodGet,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{"OnRecordsListRequest": 1},
+			ExpectedContent: []string{
+				`"totalItems":4`,
+				`"slug":"simple-assistant"`,
+				`"slug":"generate-conversation-agent"`,
+				`"slug":"test1-private"`,
+				`"slug":"test1-shared"`,
+			},
+			TestAppFactory: setupTestApp,
+		},
+		// Create
+		{
+			Name:            "create agent as guest",
+			Method:          http.MethodPost,
+			Url:             url,
+			RequestHeaders:  map[string]string{},
+			Body:            agentBody(userId, "private"),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedEvents:  map[string]int{},
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "create private agent via user token",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           agentBody(userId, "private"),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{
+				"OnModelAfterCreate":          1,
+				"OnModelBeforeCreate":         1,
+				"OnRecordAfterCreateRequest":  1,
+				"OnRecordBeforeCreateRequest": 1,
+			},
+			ExpectedContent: []string{`"slug":"pirate-private"`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "create public agent via user token",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            agentBody(userId, "public"),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "create another users agent via user token",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            agentBody("xq9ndvc2kbrvrng", "private"),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
 	}
 
 	for _, scenario := range scenarios {
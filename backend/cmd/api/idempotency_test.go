@@ -0,0 +1,396 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/idempotency"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/tests"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// fakeUpstreamStream is streamed by the fake upstream when a completion is
+// requested with `stream: true`
+const fakeUpstreamStream = `data: {"id":"chatcmpl-test","object":"chat.completion.chunk","created":1720000000,"model":"echo","choices":[{"index":0,"delta":{"role":"assistant","content":"Ahoy"}}]}
+
+data: {"id":"chatcmpl-test","object":"chat.completion.chunk","created":1720000000,"model":"echo","choices":[],"usage":{"prompt_tokens":12,"completion_tokens":3,"total_tokens":15}}
+
+data: [DONE]
+
+`
+
+// setupTestAppWithStreamingUpstream registers a `test` provider whose upstream
+// replies with a JSON completion, or a server-sent event stream if requested.
+func setupTestAppWithStreamingUpstream(t *testing.T) *tests.TestApp {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if strings.Contains(string(body), `"stream":true`) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				_, _ = w.Write([]byte(fakeUpstreamStream))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(fakeUpstreamResponse))
+		}),
+	)
+	t.Cleanup(server.Close)
+
+	return setupTestAppWithConfig(t, &config.APIConfig{
+		Providers: map[string]config.OpenAICompatibleProviderConfig{
+			"test": {
+				URL: server.URL,
+				Models: []config.ModelMappingConfig{
+					{Name: "echo", Upstream: "echo"},
+				},
+			},
+		},
+	})
+}
+
+func TestChatCompletionsIdempotency(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		userEmail      = "test1@example.com"
+		userID         = "uvi8zmr78j9y5hz"
+		idempotencyKey = "4f1c2b8e-retry-me"
+	)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestJSON := func(stream bool) string {
+		streamField := ""
+		if stream {
+			streamField = `"stream": true,`
+		}
+		return `{
+			"model": "test:echo",` + streamField + `
+			"messages": [{"role": "user", "content": "Hello"}],
+			"metadata": {"cognos": {"agent_id": "cognos:simple-assistant"}}
+		}`
+	}
+	requestBody := func(stream bool) *strings.Reader {
+		return strings.NewReader(requestJSON(stream))
+	}
+	// requestHash is the hash the key is reserved with for the request
+	requestHash := func(stream bool) string {
+		hash := sha256.Sum256([]byte(requestJSON(stream)))
+		return hex.EncodeToString(hash[:])
+	}
+
+	headers := map[string]string{
+		"Authorization":   recordToken,
+		"Idempotency-Key": idempotencyKey,
+	}
+
+	// savedResponse finds the saved response of the idempotency key
+	savedResponse := func(t *testing.T, app *tests.TestApp, stream bool) *idempotency.Response {
+		saved, err := idempotency.NewPocketBaseIdempotencyRepo(app).
+			Reserve(userID, idempotencyKey, requestHash(stream))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return saved
+	}
+
+	// idempotencyEvents are the model events of reserving the key and saving
+	// the response on top of those of the completion itself
+	idempotencyEvents := func() map[string]int {
+		events := completionEvents()
+		events["OnModelBeforeCreate"]++
+		events["OnModelAfterCreate"]++
+		events["OnModelBeforeUpdate"] = 1
+		events["OnModelAfterUpdate"] = 1
+		return events
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "first request is saved",
+			Method:          http.MethodPost,
+			Url:             url,
+			RequestHeaders:  headers,
+			Body:            requestBody(false),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			ExpectedEvents:  idempotencyEvents(),
+			TestAppFactory:  setupTestAppWithUpstream,
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				if res.Header.Get("Idempotent-Replayed") != "" {
+					t.Error("Didn't expect the first response to be replayed")
+				}
+
+				saved := savedResponse(t, app, false)
+				if saved == nil {
+					t.Fatal("Expected the response to be saved")
+				}
+				if saved.StatusCode != http.StatusOK {
+					t.Errorf("Expected saved status 200, got %d", saved.StatusCode)
+				}
+				if !strings.Contains(string(saved.Body), `"content":"Ahoy"`) {
+					t.Errorf("Expected saved body to contain the completion, got %s", saved.Body)
+				}
+			},
+		},
+		{
+			Name:            "retry replays the saved response",
+			Method:          http.MethodPost,
+			Url:             url,
+			RequestHeaders:  headers,
+			Body:            requestBody(false),
+			ExpectedStatus:  http.StatusCreated,
+			ExpectedContent: []string{`"content":"Replayed"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				repo := idempotency.NewPocketBaseIdempotencyRepo(app)
+				if _, err := repo.Reserve(userID, idempotencyKey, requestHash(false)); err != nil {
+					t.Fatal(err)
+				}
+				err := repo.SaveResponse(userID, idempotencyKey, idempotency.Response{
+					StatusCode: http.StatusCreated,
+					Headers: http.Header{
+						"Content-Type": []string{"application/json; charset=UTF-8"},
+					},
+					Body: []byte(`{"content":"Replayed"}`),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				if got := res.Header.Get("Content-Type"); got != "application/json; charset=UTF-8" {
+					t.Errorf("Expected saved Content-Type, got %s", got)
+				}
+				if res.Header.Get("Idempotent-Replayed") != "true" {
+					t.Error("Expected Idempotent-Replayed header")
+				}
+			},
+		},
+		{
+			Name:           "key reused with a different request",
+			Method:         http.MethodPost,
+			Url:            url,
+			RequestHeaders: headers,
+			Body:           requestBody(true),
+			ExpectedStatus: http.StatusUnprocessableEntity,
+			ExpectedContent: []string{
+				`"type":"invalid_request_error"`,
+				`"message":"The idempotency key was already used by a request with a different body"`,
+			},
+			NotExpectedContent: []string{`"content":"Replayed"`},
+			ExpectedEvents:     map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			TestAppFactory:     setupTestAppWithUpstream,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				repo := idempotency.NewPocketBaseIdempotencyRepo(app)
+				if _, err := repo.Reserve(userID, idempotencyKey, requestHash(false)); err != nil {
+					t.Fatal(err)
+				}
+				err := repo.SaveResponse(userID, idempotencyKey, idempotency.Response{
+					StatusCode: http.StatusCreated,
+					Body:       []byte(`{"content":"Replayed"}`),
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+			},
+		},
+		{
+			Name:           "request still in flight",
+			Method:         http.MethodPost,
+			Url:            url,
+			RequestHeaders: headers,
+			Body:           requestBody(false),
+			ExpectedStatus: http.StatusConflict,
+			ExpectedContent: []string{
+				`"type":"conflict_error"`,
+				`"message":"A request with the same idempotency key is still in progress"`,
+			},
+			ExpectedEvents: map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			TestAppFactory: setupTestAppWithUpstream,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				_, err := idempotency.NewPocketBaseIdempotencyRepo(app).
+					Reserve(userID, idempotencyKey, requestHash(false))
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+			},
+		},
+		{
+			Name:            "abandoned request's key is taken over",
+			Method:          http.MethodPost,
+			Url:             url,
+			RequestHeaders:  headers,
+			Body:            requestBody(false),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			// The key is reserved again rather than created
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 1,
+				"OnModelAfterCreate":  1,
+				"OnModelBeforeUpdate": 2,
+				"OnModelAfterUpdate":  2,
+			},
+			TestAppFactory: setupTestAppWithUpstream,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				_, err := idempotency.NewPocketBaseIdempotencyRepo(app).
+					Reserve(userID, idempotencyKey, requestHash(false))
+				if err != nil {
+					t.Fatal(err)
+				}
+				// Reserved by a request which never finished
+				_, err = app.Dao().DB().
+					Update(
+						"idempotency",
+						dbx.Params{
+							"updated": time.Now().Add(-2 * idempotency.InFlightLease).UTC().
+								Format(types.DefaultDateLayout),
+						},
+						dbx.HashExp{"idempotency_key": idempotencyKey},
+					).
+					Execute()
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				if saved := savedResponse(t, app, false); saved == nil {
+					t.Error("Expected the response to be saved")
+				}
+			},
+		},
+		{
+			Name:            "failed request releases the key",
+			Method:          http.MethodPost,
+			Url:             url,
+			RequestHeaders:  headers,
+			Body:            requestBody(false),
+			ExpectedStatus:  http.StatusInternalServerError,
+			ExpectedContent: []string{`"message":"Failed to process request."`},
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 1,
+				"OnModelAfterCreate":  1,
+				"OnModelBeforeDelete": 1,
+				"OnModelAfterDelete":  1,
+			},
+			TestAppFactory: func(t *testing.T) *tests.TestApp {
+				return setupTestAppWithConfig(t, &config.APIConfig{
+					Providers: map[string]config.OpenAICompatibleProviderConfig{
+						"test": {
+							URL: newFakeUpstream(
+								t,
+								http.StatusBadRequest,
+								`{"error": {"message": "bad", "type": "invalid_request_error"}}`,
+							),
+							Models: []config.ModelMappingConfig{
+								{Name: "echo", Upstream: "echo"},
+							},
+						},
+					},
+				})
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				// The retry is processed again
+				if saved := savedResponse(t, app, false); saved != nil {
+					t.Errorf("Expected the key to be released, got %+v", saved)
+				}
+			},
+		},
+		{
+			Name:           "streamed response is saved as sent",
+			Method:         http.MethodPost,
+			Url:            url,
+			RequestHeaders: headers,
+			Body:           requestBody(true),
+			ExpectedStatus: http.StatusOK,
+			ExpectedContent: []string{
+				`"content":"Ahoy"`,
+				"data: [DONE]\n\n",
+			},
+			ExpectedEvents: idempotencyEvents(),
+			TestAppFactory: setupTestAppWithStreamingUpstream,
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				saved := savedResponse(t, app, true)
+				if saved == nil {
+					t.Fatal("Expected the response to be saved")
+				}
+				if got := saved.Headers.Get("Content-Type"); got != "text/event-stream" {
+					t.Errorf("Expected saved Content-Type text/event-stream, got %s", got)
+				}
+				// Nothing is written after the end of the stream
+				if !strings.HasSuffix(string(saved.Body), "data: [DONE]\n\n") {
+					t.Errorf("Expected saved body to end the stream, got %s", saved.Body)
+				}
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestPurgeExpiredIdempotencyKeys(t *testing.T) {
+	t.Parallel()
+
+	const userID = "uvi8zmr78j9y5hz"
+
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	repo := idempotency.NewPocketBaseIdempotencyRepo(app)
+	for _, key := range []string{"old", "new"} {
+		if _, err := repo.Reserve(userID, key, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Backdate one of the keys past the TTL
+	_, err := app.Dao().DB().
+		Update(
+			"idempotency",
+			dbx.Params{
+				"created": time.Now().Add(-2 * idempotencyKeyTTL).UTC().
+					Format(types.DefaultDateLayout),
+			},
+			dbx.HashExp{"idempotency_key": "old"},
+		).
+		Execute()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	purged, err := repo.PurgeExpired(time.Now().Add(-idempotencyKeyTTL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected 1 key to be purged, got %d", purged)
+	}
+
+	// The new key is still reserved
+	if _, err := repo.Reserve(userID, "new", ""); err != idempotency.ErrRequestInFlight {
+		t.Errorf("Expected the new key to still be in flight, got %v", err)
+	}
+	// The old key can be used again
+	if _, err := repo.Reserve(userID, "old", ""); err != nil {
+		t.Errorf("Expected the old key to be reusable, got %v", err)
+	}
+}
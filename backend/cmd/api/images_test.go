@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestChatCompletionsImages(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		userEmail      = "test2@example.com"
+		userID         = "xq9ndvc2kbrvrng"
+		conversationID = "privateconvtest"
+		vaultPassword  = "correct horse battery staple"
+		// The PNG signature, enough for the format to be accepted
+		pngDataURL = "data:image/png;base64,iVBORw0KGgo="
+	)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := newTestVault(t, userEmail, vaultPassword)
+
+	requestBody := func(role, imageURL, conversationID string) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"model": "test:echo",
+			"messages": [{"role": "%s", "content": [
+				{"type": "text", "text": "What's this?"},
+				{"type": "image_url", "image_url": {"url": "%s", "detail": "low"}}
+			]}],
+			"metadata": {"cognos": {
+				"agent_id": "cognos:simple-assistant",
+				"conversation_id": "%s"
+			}}
+		}`, role, imageURL, conversationID))
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "images are persisted with the request message",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           requestBody("user", pngDataURL, conversationID),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 3,
+				"OnModelAfterCreate":  3,
+				"OnModelBeforeUpdate": 2,
+				"OnModelAfterUpdate":  2,
+			},
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				vault.install(t, app, conversationID)
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				found := false
+				for _, message := range vault.decryptMessages(t, app, conversationID) {
+					if message.OwnerID != userID {
+						continue
+					}
+					found = true
+					if message.Content != "What's this?" {
+						t.Errorf("Expected the text of the request, got %q", message.Content)
+					}
+					if len(message.Images) != 1 ||
+						message.Images[0].URL != pngDataURL ||
+						message.Images[0].Detail != "low" {
+						t.Errorf("Expected the image of the request, got %+v", message.Images)
+					}
+				}
+				if !found {
+					t.Error("Expected the request message")
+				}
+			},
+		},
+		{
+			Name:   "linked images are passed on",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody("user", "https://example.com/cat.png", ""),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedEvents:  completionEvents(),
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "unsupported image format",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: requestBody(
+				"user",
+				"data:image/svg+xml;base64,PHN2Zz48L3N2Zz4=",
+				conversationID,
+			),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid image."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "image over plain http",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody("user", "http://example.com/cat.png", conversationID),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid image."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "image in a system message",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody("system", pngDataURL, conversationID),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid image."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
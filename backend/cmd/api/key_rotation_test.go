@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestConversationKeyRotation(t *testing.T) {
+	t.Parallel()
+
+	const (
+		// Get this info from the pre-populated test DB
+		conversationID     = "privateconvtest"
+		sharedConversation = "sharedconvtest1"
+		creatorEmail       = "test2@example.com"
+		creatorID          = "xq9ndvc2kbrvrng"
+		editorID           = "j8prcx3dum2l3kc"
+		viewerEmail        = "test1@example.com"
+		viewerID           = "uvi8zmr78j9y5hz"
+		// A random 32 byte key encoded in base64
+		newPublicKey = "Xx2PUeS3BR9n0QkZ2zHq3B9dTtyv4nE4m1V7Lr5cW0o="
+	)
+
+	creatorToken, err := generateRecordToken("users", creatorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerToken, err := generateRecordToken("users", viewerEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := func(path string) string {
+		return "/v1/conversations/" + conversationID + path
+	}
+
+	// Wrapped keys are opaque to the server, only their size is checked
+	wrappedKey := base64.StdEncoding.EncodeToString(make([]byte, 72))
+	secretKeys := func(userIDs ...string) []chat.WrappedKey {
+		keys := []chat.WrappedKey{}
+		for _, userID := range userIDs {
+			keys = append(keys, chat.WrappedKey{UserID: userID, SecretKey: wrappedKey})
+		}
+		return keys
+	}
+	rotateBody := func(publicKey string, userIDs ...string) *strings.Reader {
+		body, _ := json.Marshal(map[string]any{
+			"public_key":  publicKey,
+			"secret_keys": secretKeys(userIDs...),
+		})
+		return strings.NewReader(string(body))
+	}
+
+	// seedMessages adds two messages sealed with the first key, in order as
+	// the pending messages are sorted by when they were created
+	seedMessages := func(t *testing.T, app *tests.TestApp) {
+		collection, err := app.Dao().FindCollectionByNameOrId("messages")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, message := range []struct{ id, data string }{
+			{"rotatemessage01", "sealed-with-v1-a"},
+			{"rotatemessage02", "sealed-with-v1-b"},
+		} {
+			record := models.NewRecord(collection)
+			record.SetId(message.id)
+			record.Set("conversation", conversationID)
+			record.Set("data", message.data)
+			record.Set("key_version", 1)
+			if err := app.Dao().SaveRecord(record); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// envelope seals the data with the version of the key as the client does,
+	// the ciphertext is opaque to the server
+	envelope := func(keyVersion int, ciphertext string) string {
+		return fmt.Sprintf(
+			`{"v":1,"alg":"x25519-xsalsa20poly1305-sealedbox","kid":%d,"ct":"%s"}`,
+			keyVersion,
+			ciphertext,
+		)
+	}
+	reencryptBody := func(messages ...chat.SealedMessage) *strings.Reader {
+		body, _ := json.Marshal(map[string]any{"messages": messages})
+		return strings.NewReader(string(body))
+	}
+
+	// startRotation seeds the messages and rotates the key
+	startRotation := func(t *testing.T, app *tests.TestApp) {
+		seedMessages(t, app)
+		_, err := chat.NewPocketBaseKeyRotationRepo(app).
+			RotateKey(conversationID, newPublicKey, secretKeys(creatorID))
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.ResetEventCalls()
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "viewer can't rotate the key",
+			Method: http.MethodPost,
+			Url:    "/v1/conversations/" + sharedConversation + "/keys",
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			Body:            rotateBody(newPublicKey, creatorID, editorID, viewerID),
+			ExpectedStatus:  http.StatusForbidden,
+			ExpectedContent: []string{`"message":"You do not have permission to manage this conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "invalid public key",
+			Method: http.MethodPost,
+			Url:    url("/keys"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            rotateBody("dG9vIHNob3J0", creatorID),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"The public key must be 32 bytes encoded in base64."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "creator rotates the key",
+			Method: http.MethodPost,
+			Url:    url("/keys"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:           rotateBody(newPublicKey, creatorID),
+			ExpectedStatus: http.StatusCreated,
+			ExpectedContent: []string{
+				`"key_version":2`,
+				`"status":"in_progress"`,
+				`"reencrypted":0`,
+				`"remaining":2`,
+			},
+			// The new key, the rotation and the secret key of the creator
+			ExpectedEvents: map[string]int{"OnModelBeforeCreate": 3, "OnModelAfterCreate": 3},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				seedMessages(t, app)
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				record, err := app.Dao().FindFirstRecordByFilter(
+					"conversation_public_keys",
+					"conversation = {:conversation} && version = 2",
+					dbx.Params{"conversation": conversationID},
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetString("public_key") != newPublicKey {
+					t.Errorf("Expected the new key to be saved, got %s", record.GetString("public_key"))
+				}
+
+				_, err = app.Dao().FindFirstRecordByFilter(
+					"conversation_secret_keys",
+					"conversation = {:conversation} && user = {:user} && key_version = 2",
+					dbx.Params{"conversation": conversationID, "user": creatorID},
+				)
+				if err != nil {
+					t.Errorf("Expected a secret key version 2 for the creator, got %v", err)
+				}
+			},
+		},
+		{
+			Name:   "rotate without wrapping the key for every member",
+			Method: http.MethodPost,
+			Url:    "/v1/conversations/" + sharedConversation + "/keys",
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            rotateBody(newPublicKey, creatorID, editorID),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"The new key must be wrapped for every remaining member exactly once."`},
+			TestAppFactory:  setupTestApp,
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				// Nothing is saved
+				latest, err := chat.LatestKeyVersion(app.Dao().DB(), sharedConversation)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if latest != 1 {
+					t.Errorf("Expected the key not to be rotated, got version %d", latest)
+				}
+			},
+		},
+		{
+			Name:   "participant gets the rotated key",
+			Method: http.MethodGet,
+			Url:    "/api/collections/conversation_secret_keys/records?filter=(key_version=2)",
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{"OnRecordsListRequest": 1},
+			ExpectedContent: []string{
+				`"totalItems":1`,
+				`"user":"` + viewerID + `"`,
+				`"key_version":2`,
+			},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				// Rotated by the creator
+				_, err := chat.NewPocketBaseKeyRotationRepo(app).RotateKey(
+					sharedConversation,
+					newPublicKey,
+					secretKeys(creatorID, editorID, viewerID),
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+			},
+		},
+		{
+			Name:   "rotation already in progress",
+			Method: http.MethodPost,
+			Url:    url("/keys"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            rotateBody(newPublicKey, creatorID),
+			ExpectedStatus:  http.StatusConflict,
+			ExpectedContent: []string{`"message":"The conversation key is already being rotated."`},
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				startRotation(t, app)
+			},
+		},
+		{
+			Name:   "re-encrypted data must be an envelope",
+			Method: http.MethodPost,
+			Url:    url("/key-rotation/messages"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            strings.NewReader(`{"messages": [{"id": "rotatemessage01", "data": "not encrypted"}]}`),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid message data."`},
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				startRotation(t, app)
+			},
+		},
+		{
+			Name:   "re-encrypted data must be sealed with the new key",
+			Method: http.MethodPost,
+			Url:    url("/key-rotation/messages"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			// A stale client still sealing with the old key
+			Body: reencryptBody(
+				chat.SealedMessage{ID: "rotatemessage01", Data: envelope(2, "YQ==")},
+				chat.SealedMessage{ID: "rotatemessage02", Data: envelope(1, "Yg==")},
+			),
+			ExpectedStatus: http.StatusBadRequest,
+			ExpectedContent: []string{
+				`"message":"The message isn't sealed with the key being rotated to: message rotatemessage02."`,
+			},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				startRotation(t, app)
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				// Nothing is saved from the batch
+				rotation, err := chat.NewPocketBaseKeyRotationRepo(app).
+					CurrentRotation(conversationID)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rotation.Remaining != 2 {
+					t.Errorf("Expected 2 messages still pending, got %d", rotation.Remaining)
+				}
+			},
+		},
+		{
+			Name:   "no rotation",
+			Method: http.MethodGet,
+			Url:    url("/key-rotation"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			ExpectedStatus:  http.StatusNotFound,
+			ExpectedContent: []string{`"message":"The conversation key isn't being rotated."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "pending messages",
+			Method: http.MethodGet,
+			Url:    url("/key-rotation/messages?limit=1"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedContent: []string{
+				`"object":"list"`,
+				`"data":"sealed-with-v1-a","key_version":1`,
+			},
+			NotExpectedContent: []string{`sealed-with-v1-b`},
+			TestAppFactory:     setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				startRotation(t, app)
+			},
+		},
+		{
+			Name:   "re-encrypting the last messages completes the rotation",
+			Method: http.MethodPost,
+			Url:    url("/key-rotation/messages"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			// Resuming with a retry of the first message in the batch
+			Body: reencryptBody(
+				chat.SealedMessage{ID: "rotatemessage01", Data: envelope(2, "cmV0cmllZA==")},
+				chat.SealedMessage{ID: "rotatemessage02", Data: envelope(2, "c2VhbGVk")},
+			),
+			ExpectedStatus: http.StatusOK,
+			ExpectedContent: []string{
+				`"key_version":2`,
+				`"status":"completed"`,
+				`"reencrypted":2`,
+				`"remaining":0`,
+			},
+			ExpectedEvents: map[string]int{"OnModelBeforeUpdate": 1, "OnModelAfterUpdate": 1},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				startRotation(t, app)
+				// The first message was re-encrypted before the client stopped
+				_, err := chat.NewPocketBaseKeyRotationRepo(app).SaveReencrypted(
+					conversationID,
+					[]chat.SealedMessage{{ID: "rotatemessage01", Data: envelope(2, "YQ==")}},
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				records, err := app.Dao().FindRecordsByFilter(
+					"messages",
+					"conversation = {:conversation}",
+					"id",
+					0,
+					0,
+					dbx.Params{"conversation": conversationID},
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for i, want := range []string{
+					envelope(2, "YQ=="),
+					envelope(2, "c2VhbGVk"),
+				} {
+					if got := records[i].GetString("data"); got != want {
+						t.Errorf("Expected message %d data %s, got %s", i, want, got)
+					}
+					if got := records[i].GetInt("key_version"); got != 2 {
+						t.Errorf("Expected message %d key version 2, got %d", i, got)
+					}
+				}
+			},
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -13,7 +13,14 @@ import (
 	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/hooks"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/idempotency"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/middleware"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/permissions"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/ratelimit"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/usage"
 	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aitool"
 	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
 	"github.com/go-co-op/gocron/v2"
 	"github.com/google/generative-ai-go/genai"
@@ -28,6 +35,9 @@ import (
 	_ "github.com/cognos-io/chat.cognos.io/backend/db/migrations" // import migration files
 )
 
+// How long conversation public keys are cached for
+const keyPairCacheTTL = time.Minute
+
 type appHookParams struct {
 	App                    core.App
 	Config                 *config.APIConfig
@@ -69,23 +79,47 @@ func bindAppHooks(
 		deepinfraClient        = params.DeepinfraOpenAIClient
 	)
 
+	// Shared by every request so conversation keys are only looked up once
+	keyPairRepo := auth.NewCachedKeyPairRepo(
+		auth.NewPocketBaseKeyPairRepo(app),
+		keyPairCacheTTL,
+	)
+
 	// Have to use OnBeforeServe to ensure that the app is fully initialized incl. the DB
 	// so we can create the various Repos without panic'ing
 	app.OnBeforeServe().Add(func(e *core.ServeEvent) error {
 		// Separate into collection services
+		aiModelRepo := aimodel.NewPocketBaseAIModelRepo(app, app.Logger())
 		upstreamRepo := proxy.NewInMemoryUpstreamRepo(proxy.RepoParams{
 			Logger:                 app.Logger(),
+			ModelRepo:              aiModelRepo,
 			OpenAIClient:           openaiClient,
 			CloudflareOpenAIClient: cloudflareOpenAIClient,
 			GoogleGeminiAIClient:   googleGeminiClient,
 			AnthropicClient:        anthropicClient,
 			DeepInfraOpenAIClient:  deepinfraClient,
+			Providers:              config.Providers,
 		},
 		)
 		messageRepo := chat.NewPocketBaseMessageRepo(app)
-		keyPairRepo := auth.NewPocketBaseKeyPairRepo(app)
-		aiAgentRepo := aiagent.NewInMemoryAIAgentRepo(app.Logger())
+		aiAgentRepo := aiagent.NewPocketBaseAIAgentRepo(app, app.Logger())
+		aiToolRepo := aitool.NewInMemoryAIToolRepo(app.Logger())
 		conversationRepo := chat.NewPocketBaseConversationRepo(app, keyPairRepo)
+		permissionsRepo := permissions.NewPocketBasePermissionsRepo(app)
+		tokenUsageRepo := usage.NewPocketBaseTokenUsageRepo(app, app.Logger())
+		rateLimitStore := ratelimit.NewPocketBaseStore(app)
+		idempotencyRepo := idempotency.NewPocketBaseIdempotencyRepo(app)
+		keyRotationRepo := chat.NewPocketBaseKeyRotationRepo(app)
+		participantRepo := chat.NewPocketBaseParticipantRepo(app, keyPairRepo)
+		attachmentRepo := chat.NewPocketBaseAttachmentRepo(app)
+
+		// Guests are rate limited by their IP address, which is only taken
+		// from the headers set by trusted proxies
+		ipExtractor, err := middleware.IPExtractor(config.TrustedProxies)
+		if err != nil {
+			return err
+		}
+		e.Router.IPExtractor = ipExtractor
 
 		addPocketBaseRoutes(
 			e,
@@ -96,7 +130,16 @@ func bindAppHooks(
 			messageRepo,
 			keyPairRepo,
 			aiAgentRepo,
+			aiToolRepo,
 			conversationRepo,
+			permissionsRepo,
+			aiModelRepo,
+			tokenUsageRepo,
+			rateLimitStore,
+			idempotencyRepo,
+			keyRotationRepo,
+			participantRepo,
+			attachmentRepo,
 		)
 
 		// Add SoftDelete hook
@@ -109,7 +152,6 @@ func bindAppHooks(
 	// This means the user will see the conversations they have most recently interacted with at the top of the list.
 	app.OnModelAfterCreate("messages").
 		Add(func(e *core.ModelEvent) error {
-			keyPairRepo := auth.NewPocketBaseKeyPairRepo(app)
 			conversationRepo := chat.NewPocketBaseConversationRepo(app, keyPairRepo)
 
 			return conversationRepo.SetConversationUpdated(
@@ -117,6 +159,21 @@ func bindAppHooks(
 			)
 		})
 
+	// Number the keys of each conversation
+	hooks.ConversationKeyVersion(app)
+
+	// Validate how user secret keys are wrapped
+	hooks.UserKeyPairKDFParams(app)
+
+	// Forget the cached key when the keys of a conversation change
+	invalidateKey := func(e *core.ModelEvent) error {
+		keyPairRepo.Invalidate(e.Model.(*models.Record).GetString("conversation"))
+		return nil
+	}
+	app.OnModelAfterCreate("conversation_public_keys").Add(invalidateKey)
+	app.OnModelAfterUpdate("conversation_public_keys").Add(invalidateKey)
+	app.OnModelAfterDelete("conversation_public_keys").Add(invalidateKey)
+
 	app.OnAfterBootstrap().Add(func(e *core.BootstrapEvent) error {
 		expiredMessagesRepo := chat.NewPocketBaseMessageRepo(app)
 		_, err := cleanUpExpiredMessageJob(
@@ -124,6 +181,34 @@ func bindAppHooks(
 			app.Logger(),
 			expiredMessagesRepo,
 		)
+		if err != nil {
+			return err
+		}
+
+		_, err = purgeIdempotencyKeysJob(
+			params.CronScheduler,
+			app.Logger(),
+			idempotency.NewPocketBaseIdempotencyRepo(app),
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = purgeOrphanedAttachmentsJob(
+			params.CronScheduler,
+			app.Logger(),
+			chat.NewPocketBaseAttachmentRepo(app),
+		)
+		if err != nil {
+			return err
+		}
+
+		_, err = purgeRateLimitsJob(
+			params.CronScheduler,
+			app.Logger(),
+			ratelimit.NewPocketBaseStore(app),
+			config.LongestRateLimitWindow(),
+		)
 		return err
 	})
 
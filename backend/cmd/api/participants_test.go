@@ -0,0 +1,490 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+func TestConversationParticipants(t *testing.T) {
+	t.Parallel()
+
+	const (
+		// Get this info from the pre-populated test DB
+		sharedConversation  = "sharedconvtest1"
+		privateConversation = "privateconvtest"
+		creatorEmail        = "test2@example.com"
+		creatorID           = "xq9ndvc2kbrvrng"
+		editorEmail         = "no_data@example.com"
+		editorID            = "j8prcx3dum2l3kc"
+		viewerEmail         = "test1@example.com"
+		viewerID            = "uvi8zmr78j9y5hz"
+		// A random 32 byte key encoded in base64
+		newPublicKey = "Xx2PUeS3BR9n0QkZ2zHq3B9dTtyv4nE4m1V7Lr5cW0o="
+		// The key of a rotation which hasn't been finished
+		unfinishedPublicKey = "b3Vq4P0xQ2m9Zt7kLw1sN8cR5yH6dJ2fG4aE0vU9iTo="
+	)
+
+	creatorToken, err := generateRecordToken("users", creatorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	editorToken, err := generateRecordToken("users", editorEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewerToken, err := generateRecordToken("users", viewerEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	url := func(conversationID, path string) string {
+		return "/v1/conversations/" + conversationID + "/participants" + path
+	}
+
+	// Wrapped keys are opaque to the server, only their size is checked
+	wrappedKey := base64.StdEncoding.EncodeToString(make([]byte, 72))
+
+	creator := newTestVault(t, creatorEmail, "creator vault password")
+	invitee := newTestVault(t, viewerEmail, "invitee vault password")
+
+	inviteBody := func(userID, role, secretKey string, keyVersion int) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(
+			`{"user_id": "%s", "role": "%s", "secret_key": "%s", "key_version": %d}`,
+			userID,
+			role,
+			secretKey,
+			keyVersion,
+		))
+	}
+	revokeBody := func(userIDs ...string) *strings.Reader {
+		secretKeys := []string{}
+		for _, userID := range userIDs {
+			secretKeys = append(secretKeys, fmt.Sprintf(
+				`{"user_id": "%s", "secret_key": "%s"}`,
+				userID,
+				wrappedKey,
+			))
+		}
+		return strings.NewReader(fmt.Sprintf(
+			`{"public_key": "%s", "secret_keys": [%s]}`,
+			newPublicKey,
+			strings.Join(secretKeys, ","),
+		))
+	}
+
+	// wantParticipant checks if the user is a participant and how many secret
+	// keys are wrapped for them
+	wantParticipant := func(
+		t *testing.T,
+		app *tests.TestApp,
+		conversationID, userID string,
+		want bool,
+		wantSecretKeys int,
+	) {
+		t.Helper()
+
+		participants, err := app.Dao().FindRecordsByExpr(
+			"participants",
+			dbx.HashExp{"conversation": conversationID, "user": userID},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(participants) == 1; got != want {
+			t.Errorf("Expected participant %s to be %v, got %v", userID, want, got)
+		}
+
+		secretKeys, err := app.Dao().FindRecordsByExpr(
+			"conversation_secret_keys",
+			dbx.HashExp{"conversation": conversationID, "user": userID},
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(secretKeys) != wantSecretKeys {
+			t.Errorf(
+				"Expected %d secret keys for %s, got %d",
+				wantSecretKeys,
+				userID,
+				len(secretKeys),
+			)
+		}
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "creator lists the members",
+			Method: http.MethodGet,
+			Url:    url(sharedConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedContent: []string{
+				`"object":"list"`,
+				`"user_id":"` + creatorID + `","role":"Admin","creator":true`,
+				`"user_id":"` + editorID + `","role":"Editor","public_key":"`,
+				`"user_id":"` + viewerID + `","role":"Viewer","public_key":"`,
+			},
+			TestAppFactory: setupTestApp,
+		},
+		{
+			Name:   "editor can't manage the members",
+			Method: http.MethodGet,
+			Url:    url(sharedConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": editorToken,
+			},
+			ExpectedStatus:  http.StatusForbidden,
+			ExpectedContent: []string{`"message":"You do not have permission to manage this conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "invited user opens the conversation key",
+			Method: http.MethodPost,
+			Url:    url(privateConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body: inviteBody(
+				viewerID,
+				"Viewer",
+				creator.wrapConversationKeyFor(t, invitee.userPublicKey),
+				1,
+			),
+			ExpectedStatus: http.StatusCreated,
+			ExpectedContent: []string{
+				`"user_id":"` + viewerID + `","role":"Viewer"`,
+				`"public_key":"` + base64.StdEncoding.EncodeToString(invitee.userPublicKey[:]) + `"`,
+			},
+			// The participant and their secret key
+			ExpectedEvents: map[string]int{"OnModelBeforeCreate": 2, "OnModelAfterCreate": 2},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				creator.install(t, app, privateConversation)
+				invitee.installKeyPair(t, app)
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				wantParticipant(t, app, privateConversation, viewerID, true, 1)
+
+				_, secretKey, err := invitee.openConversation(
+					t,
+					app,
+					privateConversation,
+					invitee.password,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if secretKey != creator.conversationSecretKey {
+					t.Error("Expected the invitee to open the conversation secret key")
+				}
+			},
+		},
+		{
+			Name:   "invite with an unknown role",
+			Method: http.MethodPost,
+			Url:    url(privateConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            inviteBody(viewerID, "Owner", wrappedKey, 1),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"The role must be Viewer, Editor or Admin."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "invite with an unwrapped key",
+			Method: http.MethodPost,
+			Url:    url(privateConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            inviteBody(viewerID, "Viewer", newPublicKey, 1),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"The secret key must be a wrapped 32 byte key encoded in base64."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "invite a user without a key pair",
+			Method: http.MethodPost,
+			Url:    url(privateConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            inviteBody("missinguser0000", "Viewer", wrappedKey, 1),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"The user has no key pair."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "invite an existing participant",
+			Method: http.MethodPost,
+			Url:    url(sharedConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            inviteBody(viewerID, "Editor", wrappedKey, 1),
+			ExpectedStatus:  http.StatusConflict,
+			ExpectedContent: []string{`"message":"The user is already a participant of the conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "invite the creator",
+			Method: http.MethodPost,
+			Url:    url(privateConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            inviteBody(creatorID, "Editor", wrappedKey, 1),
+			ExpectedStatus:  http.StatusConflict,
+			ExpectedContent: []string{`"message":"The user is already a participant of the conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "invite with a rotated key",
+			Method: http.MethodPost,
+			Url:    url(privateConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            inviteBody(viewerID, "Viewer", wrappedKey, 1),
+			ExpectedStatus:  http.StatusConflict,
+			ExpectedContent: []string{`"message":"The conversation key has been rotated since it was wrapped."`},
+			TestAppFactory:  setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				_, err := chat.NewPocketBaseKeyRotationRepo(app).
+					RotateKey(privateConversation, newPublicKey, []chat.WrappedKey{
+						{UserID: creatorID, SecretKey: wrappedKey},
+					})
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				wantParticipant(t, app, privateConversation, viewerID, false, 0)
+			},
+		},
+		{
+			Name:   "viewer can't invite",
+			Method: http.MethodPost,
+			Url:    url(sharedConversation, ""),
+			RequestHeaders: map[string]string{
+				"Authorization": viewerToken,
+			},
+			Body:            inviteBody(creatorID, "Admin", wrappedKey, 1),
+			ExpectedStatus:  http.StatusForbidden,
+			ExpectedContent: []string{`"message":"You do not have permission to manage this conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "change the role of a participant",
+			Method: http.MethodPatch,
+			Url:    url(sharedConversation, "/"+viewerID),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            strings.NewReader(`{"role": "Editor"}`),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"user_id":"` + viewerID + `","role":"Editor"`},
+			ExpectedEvents:  map[string]int{"OnModelBeforeUpdate": 1, "OnModelAfterUpdate": 1},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "change the role of a non participant",
+			Method: http.MethodPatch,
+			Url:    url(privateConversation, "/"+viewerID),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            strings.NewReader(`{"role": "Editor"}`),
+			ExpectedStatus:  http.StatusNotFound,
+			ExpectedContent: []string{`"message":"The user isn't a participant of the conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "revoke a participant rotates the key",
+			Method: http.MethodPost,
+			Url:    url(sharedConversation, "/"+editorID+"/revoke"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:           revokeBody(creatorID, viewerID),
+			ExpectedStatus: http.StatusCreated,
+			ExpectedContent: []string{
+				`"key_version":2`,
+				`"status":"completed"`,
+			},
+			// The participant and their secret key are deleted, then the new
+			// key, the rotation and a secret key for each member are created
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeDelete": 2,
+				"OnModelAfterDelete":  2,
+				"OnModelBeforeCreate": 4,
+				"OnModelAfterCreate":  4,
+			},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				collection, err := app.Dao().FindCollectionByNameOrId("conversation_secret_keys")
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, userID := range []string{creatorID, editorID, viewerID} {
+					record := models.NewRecord(collection)
+					record.Set("conversation", sharedConversation)
+					record.Set("user", userID)
+					record.Set("secret_key", wrappedKey)
+					if err := app.Dao().SaveRecord(record); err != nil {
+						t.Fatal(err)
+					}
+				}
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				wantParticipant(t, app, sharedConversation, editorID, false, 0)
+				wantParticipant(t, app, sharedConversation, viewerID, true, 2)
+
+				// Every remaining member has the new version of the key
+				for _, userID := range []string{creatorID, viewerID} {
+					_, err := app.Dao().FindFirstRecordByFilter(
+						"conversation_secret_keys",
+						"conversation = {:conversation} && user = {:user} && key_version = 2",
+						dbx.Params{"conversation": sharedConversation, "user": userID},
+					)
+					if err != nil {
+						t.Errorf("Expected a secret key version 2 for %s, got %v", userID, err)
+					}
+				}
+			},
+		},
+		{
+			Name:   "revoke without wrapping the key for every member",
+			Method: http.MethodPost,
+			Url:    url(sharedConversation, "/"+editorID+"/revoke"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            revokeBody(creatorID, editorID),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"The new key must be wrapped for every remaining member exactly once."`},
+			TestAppFactory:  setupTestApp,
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				// Nothing changes
+				wantParticipant(t, app, sharedConversation, editorID, true, 0)
+			},
+		},
+		{
+			Name:   "revoke while the key is being rotated",
+			Method: http.MethodPost,
+			Url:    url(sharedConversation, "/"+editorID+"/revoke"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:           revokeBody(creatorID, viewerID),
+			ExpectedStatus: http.StatusCreated,
+			// The new rotation picks up the message the unfinished one had left
+			ExpectedContent: []string{
+				`"key_version":3`,
+				`"status":"in_progress"`,
+				`"remaining":1`,
+			},
+			// The participant and the secret key of the unfinished rotation
+			// wrapped for them are deleted, the unfinished rotation superseded,
+			// then the new key, the rotation and a secret key for each member
+			// are created
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeDelete": 2,
+				"OnModelAfterDelete":  2,
+				"OnModelBeforeUpdate": 1,
+				"OnModelAfterUpdate":  1,
+				"OnModelBeforeCreate": 4,
+				"OnModelAfterCreate":  4,
+			},
+			TestAppFactory: setupTestApp,
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				collection, err := app.Dao().FindCollectionByNameOrId("messages")
+				if err != nil {
+					t.Fatal(err)
+				}
+				message := models.NewRecord(collection)
+				message.Set("conversation", sharedConversation)
+				message.Set("data", "sealed-with-v1")
+				message.Set("key_version", 1)
+				if err := app.Dao().SaveRecord(message); err != nil {
+					t.Fatal(err)
+				}
+				_, err = chat.NewPocketBaseKeyRotationRepo(app).
+					RotateKey(sharedConversation, unfinishedPublicKey, []chat.WrappedKey{
+						{UserID: creatorID, SecretKey: wrappedKey},
+						{UserID: editorID, SecretKey: wrappedKey},
+						{UserID: viewerID, SecretKey: wrappedKey},
+					})
+				if err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				wantParticipant(t, app, sharedConversation, editorID, false, 0)
+
+				superseded, err := app.Dao().FindFirstRecordByFilter(
+					"key_rotations",
+					"conversation = {:conversation} && key_version = 2",
+					dbx.Params{"conversation": sharedConversation},
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if status := superseded.GetString("status"); status != "superseded" {
+					t.Errorf("Expected the unfinished rotation to be superseded, got %s", status)
+				}
+			},
+		},
+		{
+			Name:   "revoke a non participant",
+			Method: http.MethodPost,
+			Url:    url(privateConversation, "/"+viewerID+"/revoke"),
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			Body:            revokeBody(creatorID),
+			ExpectedStatus:  http.StatusNotFound,
+			ExpectedContent: []string{`"message":"The user isn't a participant of the conversation."`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:   "user public key",
+			Method: http.MethodGet,
+			Url:    "/v1/users/" + viewerID + "/public-key",
+			RequestHeaders: map[string]string{
+				"Authorization": creatorToken,
+			},
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"user_id":"` + viewerID + `","public_key":"`},
+			TestAppFactory:  setupTestApp,
+		},
+		{
+			Name:            "user public key as guest",
+			Method:          http.MethodGet,
+			Url:             "/v1/users/" + viewerID + "/public-key",
+			ExpectedStatus:  http.StatusUnauthorized,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestApp,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/ratelimit"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// setupTestAppWithRateLimits allows a single completion an hour on the default
+// plan and 10 on the `pro` plan
+func setupTestAppWithRateLimits(t *testing.T) *tests.TestApp {
+	return setupTestAppWithConfig(t, &config.APIConfig{
+		Providers: map[string]config.OpenAICompatibleProviderConfig{
+			"test": {
+				URL: newFakeUpstream(t, http.StatusOK, fakeUpstreamResponse),
+				Models: []config.ModelMappingConfig{
+					{Name: "echo", Upstream: "echo"},
+				},
+			},
+		},
+		RateLimits: map[string]map[string]config.RateLimitConfig{
+			"completions": {
+				config.DefaultPlan: {Requests: 1, Window: time.Hour},
+				"pro":              {Requests: 10, Window: time.Hour},
+			},
+		},
+	})
+}
+
+func TestChatCompletionsRateLimits(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		userEmail = "test1@example.com"
+		userID    = "uvi8zmr78j9y5hz"
+	)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestBody := func() *strings.Reader {
+		return strings.NewReader(`{
+			"model": "test:echo",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"metadata": {"cognos": {"agent_id": "cognos:simple-assistant"}}
+		}`)
+	}
+
+	// useLimit makes a request on behalf of the user before the test
+	useLimit := func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+		_, err := ratelimit.NewPocketBaseStore(app).Allow(
+			"completions:user:"+userID,
+			config.RateLimitConfig{Requests: 1, Window: time.Hour},
+			time.Now(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// expectHeaders checks the rate limit headers of the response
+	expectHeaders := func(limit, remaining string, retryAfter bool) func(*testing.T, *tests.TestApp, *http.Response) {
+		return func(t *testing.T, app *tests.TestApp, res *http.Response) {
+			if got := res.Header.Get("X-RateLimit-Limit"); got != limit {
+				t.Errorf("Expected X-RateLimit-Limit %s, got %s", limit, got)
+			}
+			if got := res.Header.Get("X-RateLimit-Remaining"); got != remaining {
+				t.Errorf("Expected X-RateLimit-Remaining %s, got %s", remaining, got)
+			}
+			if res.Header.Get("X-RateLimit-Reset") == "" {
+				t.Error("Expected a X-RateLimit-Reset header")
+			}
+			if (res.Header.Get("Retry-After") != "") != retryAfter {
+				t.Errorf("Expected Retry-After header %v", retryAfter)
+			}
+		}
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "within the limit",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			ExpectedEvents:  completionEvents(),
+			TestAppFactory:  setupTestAppWithRateLimits,
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				expectHeaders("1", "0", false)(t, app, res)
+
+				// The count is persisted
+				record, err := app.Dao().FindFirstRecordByData(
+					"rate_limits",
+					"key",
+					"completions:user:"+userID,
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if record.GetInt("count") != 1 {
+					t.Errorf("Expected count of 1, got %d", record.GetInt("count"))
+				}
+			},
+		},
+		{
+			Name:   "over the limit",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           requestBody(),
+			ExpectedStatus: http.StatusTooManyRequests,
+			ExpectedContent: []string{
+				`"type":"rate_limit_error"`,
+				`"message":"Too many requests, please retry after`,
+			},
+			ExpectedEvents: map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			TestAppFactory: setupTestAppWithRateLimits,
+			BeforeTestFunc: useLimit,
+			AfterTestFunc:  expectHeaders("1", "0", true),
+		},
+		{
+			Name:   "higher limit of plan",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			ExpectedEvents:  completionEvents(),
+			TestAppFactory: func(t *testing.T) *tests.TestApp {
+				app := setupTestAppWithRateLimits(t)
+				user, err := app.Dao().FindAuthRecordByEmail("users", userEmail)
+				if err != nil {
+					t.Fatal(err)
+				}
+				user.Set("plan", "pro")
+				if err := app.Dao().SaveRecord(user); err != nil {
+					t.Fatal(err)
+				}
+				app.ResetEventCalls()
+				return app
+			},
+			BeforeTestFunc: useLimit,
+			AfterTestFunc:  expectHeaders("10", "8", false),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+// setupTestAppWithGuestRateLimits allows guests a single health check an hour,
+// with requests from the trusted proxies identified by `X-Forwarded-For`
+func setupTestAppWithGuestRateLimits(trustedProxies ...string) func(t *testing.T) *tests.TestApp {
+	return func(t *testing.T) *tests.TestApp {
+		return setupTestAppWithConfig(t, &config.APIConfig{
+			RateLimits: map[string]map[string]config.RateLimitConfig{
+				"health": {config.DefaultPlan: {Requests: 1, Window: time.Hour}},
+			},
+			TrustedProxies: trustedProxies,
+		})
+	}
+}
+
+func TestGuestRateLimits(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/health"
+		// The address httptest gives requests
+		remoteIP    = "192.0.2.1"
+		forwardedIP = "203.0.113.7"
+	)
+
+	// useLimit makes a request from the IP address before the test
+	useLimit := func(ip string) func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+		return func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+			_, err := ratelimit.NewPocketBaseStore(app).Allow(
+				"health:ip:"+ip,
+				config.RateLimitConfig{Requests: 1, Window: time.Hour},
+				time.Now(),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "forwarded headers are ignored without a trusted proxy",
+			Method: http.MethodGet,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"X-Forwarded-For": forwardedIP,
+				"X-Real-IP":       forwardedIP,
+			},
+			ExpectedStatus:  http.StatusTooManyRequests,
+			ExpectedContent: []string{`"type":"rate_limit_error"`},
+			ExpectedEvents:  map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			TestAppFactory:  setupTestAppWithGuestRateLimits(),
+			BeforeTestFunc:  useLimit(remoteIP),
+		},
+		{
+			Name:   "forwarded address is used behind a trusted proxy",
+			Method: http.MethodGet,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"X-Forwarded-For": forwardedIP,
+			},
+			ExpectedStatus:  http.StatusTooManyRequests,
+			ExpectedContent: []string{`"type":"rate_limit_error"`},
+			ExpectedEvents:  map[string]int{"OnBeforeApiError": 0, "OnAfterApiError": 0},
+			TestAppFactory:  setupTestAppWithGuestRateLimits("192.0.2.0/24"),
+			BeforeTestFunc:  useLimit(forwardedIP),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestPurgeExpiredRateLimits(t *testing.T) {
+	t.Parallel()
+
+	app := setupTestApp(t)
+	defer app.Cleanup()
+
+	store := ratelimit.NewPocketBaseStore(app)
+	limit := config.RateLimitConfig{Requests: 10, Window: time.Minute}
+	now := time.Now()
+	for key, at := range map[string]time.Time{
+		"completions:ip:10.0.0.1": now.Add(-2 * time.Hour),
+		"completions:ip:10.0.0.2": now,
+	} {
+		if _, err := store.Allow(key, limit, at); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	purged, err := store.PurgeExpired(now.Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected 1 rate limit to be purged, got %d", purged)
+	}
+
+	// The current window keeps counting
+	result, err := store.Allow("completions:ip:10.0.0.2", limit, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Remaining != 8 {
+		t.Errorf("Expected 8 requests remaining, got %d", result.Remaining)
+	}
+}
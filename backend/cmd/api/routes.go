@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log/slog"
 	"net"
@@ -10,48 +11,25 @@ import (
 	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/idempotency"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/middleware"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/permissions"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/ratelimit"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/usage"
 	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aitool"
 	"github.com/cognos-io/chat.cognos.io/backend/pkg/compat/openai"
 	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
 	"github.com/labstack/echo/v5"
-	"github.com/labstack/echo/v5/middleware"
+	echomiddleware "github.com/labstack/echo/v5/middleware"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-func rateLimiterMiddleware() echo.MiddlewareFunc {
-	config := middleware.RateLimiterConfig{
-		Skipper: middleware.DefaultSkipper,
-		Store: middleware.NewRateLimiterMemoryStoreWithConfig(
-			// Allow 1 request per second
-			middleware.RateLimiterMemoryStoreConfig{
-				Rate:      60.0 / 3600.0,    // 60 requests per 3600 seconds
-				Burst:     30,               // Allows a portion of the requests to be used in bursts
-				ExpiresIn: 30 * time.Minute, // Cleanup every 30 minutes
-			},
-		),
-		IdentifierExtractor: func(ctx echo.Context) (string, error) {
-			user := auth.ExtractUser(ctx)
-			if user == nil {
-				return ctx.RealIP(), nil
-			}
-			return user.ID, nil
-		},
-		ErrorHandler: func(context echo.Context, err error) error {
-			return context.JSON(http.StatusForbidden, nil)
-		},
-		DenyHandler: func(context echo.Context, identifier string, err error) error {
-			return context.JSON(http.StatusTooManyRequests, nil)
-		},
-	}
-
-	return middleware.RateLimiterWithConfig(config)
-}
-
 // addPocketBaseRoutes adds additional routes to the PocketBase app.
 func addPocketBaseRoutes(
 	e *core.ServeEvent,
@@ -62,7 +40,16 @@ func addPocketBaseRoutes(
 	messageRepo chat.MessageRepo,
 	keyPairRepo auth.KeyPairRepo,
 	aiAgentRepo aiagent.AIAgentRepo,
+	aiToolRepo aitool.AIToolRepo,
 	conversationRepo chat.ConversationRepo,
+	permissionsRepo permissions.PermissionsRepo,
+	aiModelRepo aimodel.AIModelRepo,
+	tokenUsageRepo usage.TokenUsageRepo,
+	rateLimitStore ratelimit.Store,
+	idempotencyRepo idempotency.IdempotencyRepo,
+	keyRotationRepo chat.KeyRotationRepo,
+	participantRepo chat.ParticipantRepo,
+	attachmentRepo chat.AttachmentRepo,
 ) {
 	// https://platform.openai.com/docs/api-reference/chat/create
 	e.Router.POST(
@@ -74,10 +61,91 @@ func addPocketBaseRoutes(
 			messageRepo,
 			keyPairRepo,
 			aiAgentRepo,
+			aiToolRepo,
 			conversationRepo,
+			permissionsRepo,
+			aiModelRepo,
+			tokenUsageRepo,
+			attachmentRepo,
 		),
 		apis.RequireRecordAuth(),
-		rateLimiterMiddleware(),
+		middleware.RateLimit("completions", config, rateLimitStore, logger),
+		middleware.Idempotency(idempotencyRepo, logger),
+		middleware.LoadKeyPair(keyPairRepo, logger),
+	)
+
+	// Spend by day, model and agent
+	e.Router.GET(
+		"/v1/usage",
+		usage.EchoHandler(logger, tokenUsageRepo),
+		apis.RequireAdminOrRecordAuth(),
+		middleware.RateLimit("usage", config, rateLimitStore, logger),
+	)
+
+	// Conversation key rotation, the client re-encrypts the older messages in
+	// batches as only it has the secret keys
+	keys := e.Router.Group(
+		"/v1/conversations/:conversation_id",
+		apis.RequireRecordAuth(),
+		middleware.RateLimit("keys", config, rateLimitStore, logger),
+	)
+	keys.POST(
+		"/keys",
+		chat.RotateKeyEchoHandler(logger, permissionsRepo, keyRotationRepo),
+	)
+	keys.GET(
+		"/key-rotation",
+		chat.KeyRotationEchoHandler(logger, permissionsRepo, keyRotationRepo),
+	)
+	keys.GET(
+		"/key-rotation/messages",
+		chat.PendingMessagesEchoHandler(logger, permissionsRepo, keyRotationRepo),
+	)
+	keys.POST(
+		"/key-rotation/messages",
+		chat.ReencryptEchoHandler(logger, permissionsRepo, keyRotationRepo),
+	)
+
+	// Participants, the client wraps the conversation key for each of them and
+	// rotates it when one is revoked
+	keys.GET(
+		"/participants",
+		chat.ParticipantsEchoHandler(logger, permissionsRepo, participantRepo),
+	)
+	keys.POST(
+		"/participants",
+		chat.InviteParticipantEchoHandler(logger, permissionsRepo, participantRepo),
+	)
+	keys.PATCH(
+		"/participants/:user_id",
+		chat.UpdateParticipantEchoHandler(logger, permissionsRepo, participantRepo),
+	)
+	keys.POST(
+		"/participants/:user_id/revoke",
+		chat.RevokeParticipantEchoHandler(logger, permissionsRepo, participantRepo),
+	)
+
+	// Attachments, encrypted by the client with keys kept in the messages
+	e.Router.POST(
+		"/v1/conversations/:conversation_id/attachments",
+		chat.UploadAttachmentEchoHandler(logger, permissionsRepo, attachmentRepo),
+		// Before anything reads the body
+		echomiddleware.BodyLimit(chat.MaxAttachmentRequestSize),
+		apis.RequireRecordAuth(),
+		middleware.RateLimit("attachments", config, rateLimitStore, logger),
+	)
+	e.Router.GET(
+		"/v1/conversations/:conversation_id/attachments/:attachment_id",
+		chat.DownloadAttachmentEchoHandler(logger, permissionsRepo, attachmentRepo),
+		apis.RequireRecordAuth(),
+		middleware.RateLimit("attachments", config, rateLimitStore, logger),
+	)
+
+	e.Router.GET(
+		"/v1/users/:user_id/public-key",
+		auth.PublicKeyEchoHandler(logger, keyPairRepo),
+		apis.RequireRecordAuth(),
+		middleware.RateLimit("keys", config, rateLimitStore, logger),
 	)
 
 	e.Router.GET(
@@ -133,7 +201,7 @@ func addPocketBaseRoutes(
 
 			return ctx.JSON(status, resp)
 		},
-		rateLimiterMiddleware(),
+		middleware.RateLimit("health", config, rateLimitStore, logger),
 	)
 
 	// Prometheus metrics endpoint for Grafana Alloy
@@ -161,7 +229,7 @@ func registerPrometheusGauge(
 	name string,
 	help string,
 ) {
-	_ = promauto.NewGaugeFunc(prometheus.GaugeOpts{
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Namespace: "cognos",
 		Subsystem: "chat",
 		Name:      name,
@@ -181,4 +249,12 @@ func registerPrometheusGauge(
 
 		return float64(totalCount)
 	})
+
+	// The routes can be bound more than once per process (e.g. in tests) so
+	// ignore gauges that have already been registered.
+	err := prometheus.Register(gauge)
+	var alreadyRegisteredErr prometheus.AlreadyRegisteredError
+	if err != nil && !errors.As(err, &alreadyRegisteredErr) {
+		logger.Error("failed to register gauge", "name", name, "err", err)
+	}
 }
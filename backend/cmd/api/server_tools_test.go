@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tests"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// toolUpstream is an OpenAI compatible upstream which calls the calculator
+// then answers with its result. A greedy upstream keeps calling it until it's
+// told not to.
+type toolUpstream struct {
+	greedy bool
+
+	mu       sync.Mutex
+	requests []oai.ChatCompletionRequest
+}
+
+func (u *toolUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req oai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	u.requests = append(u.requests, req)
+	step := len(u.requests)
+	u.mu.Unlock()
+
+	last := req.Messages[len(req.Messages)-1]
+	message := oai.ChatCompletionMessage{Role: "assistant"}
+	finishReason := oai.FinishReasonStop
+	if req.ToolChoice == "none" || (last.Role == "tool" && !u.greedy) {
+		message.Content = "It's " + last.Content
+	} else {
+		message.ToolCalls = []oai.ToolCall{{
+			ID:   fmt.Sprintf("call_%d", step),
+			Type: oai.ToolTypeFunction,
+			Function: oai.FunctionCall{
+				Name:      "calculator",
+				Arguments: `{"expression": "2 * 3"}`,
+			},
+		}}
+		finishReason = oai.FinishReasonToolCalls
+	}
+
+	if req.Stream {
+		// The role, then the content or tool calls, then the finish reason
+		for i := range message.ToolCalls {
+			message.ToolCalls[i].Index = &i
+		}
+		deltas := []oai.ChatCompletionStreamChoice{
+			{Delta: oai.ChatCompletionStreamChoiceDelta{Role: message.Role}},
+			{Delta: oai.ChatCompletionStreamChoiceDelta{
+				Content:   message.Content,
+				ToolCalls: message.ToolCalls,
+			}},
+			{FinishReason: finishReason},
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, delta := range deltas {
+			chunk, _ := json.Marshal(oai.ChatCompletionStreamResponse{
+				ID:      "chatcmpl-test",
+				Object:  "chat.completion.chunk",
+				Model:   "echo",
+				Choices: []oai.ChatCompletionStreamChoice{delta},
+			})
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+		fmt.Fprint(w, "data: [DONE]\n\n")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(oai.ChatCompletionResponse{
+		ID:     "chatcmpl-test",
+		Object: "chat.completion",
+		Model:  "echo",
+		Choices: []oai.ChatCompletionChoice{{
+			Message:      message,
+			FinishReason: finishReason,
+		}},
+		Usage: oai.Usage{PromptTokens: 20, CompletionTokens: 5, TotalTokens: 25},
+	})
+}
+
+// setupTestAppWithToolUpstream registers a `test` provider served by the
+// upstream and an agent with the built-in tools
+func setupTestAppWithToolUpstream(
+	upstream *toolUpstream,
+	tools []string,
+	maxToolSteps int,
+) func(t *testing.T) *tests.TestApp {
+	return func(t *testing.T) *tests.TestApp {
+		server := httptest.NewServer(upstream)
+		t.Cleanup(server.Close)
+
+		app := setupTestAppWithConfig(t, &config.APIConfig{
+			Providers: map[string]config.OpenAICompatibleProviderConfig{
+				"test": {
+					URL: server.URL,
+					Models: []config.ModelMappingConfig{
+						{Name: "echo", Upstream: "echo"},
+					},
+				},
+			},
+		})
+
+		collection, err := app.Dao().FindCollectionByNameOrId("agents")
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := models.NewRecord(collection)
+		record.Set("name", "Maths Tutor")
+		record.Set("slug", "maths-tutor")
+		record.Set("system_message", "Use the calculator")
+		record.Set("visibility", "public")
+		record.Set("tools", tools)
+		record.Set("max_tool_steps", maxToolSteps)
+		if err := app.Dao().SaveRecord(record); err != nil {
+			t.Fatal(err)
+		}
+		app.ResetEventCalls()
+
+		return app
+	}
+}
+
+func TestChatCompletionsServerTools(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		userEmail      = "test2@example.com"
+		userID         = "xq9ndvc2kbrvrng"
+		conversationID = "privateconvtest"
+		vaultPassword  = "correct horse battery staple"
+	)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	vault := newTestVault(t, userEmail, vaultPassword)
+
+	requestBody := func(stream bool, conversationID string) *strings.Reader {
+		return strings.NewReader(fmt.Sprintf(`{
+			"model": "test:echo",
+			"stream": %t,
+			"messages": [{"role": "user", "content": "What's 2 times 3?"}],
+			"metadata": {"cognos": {
+				"agent_id": "maths-tutor",
+				"conversation_id": "%s"
+			}}
+		}`, stream, conversationID))
+	}
+
+	persisted := &toolUpstream{}
+	streamed := &toolUpstream{}
+	greedy := &toolUpstream{greedy: true}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "tool calls and results are persisted as messages",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           requestBody(false, conversationID),
+			ExpectedStatus: http.StatusOK,
+			// The request, tool call, tool result and response messages each
+			// update the conversation, plus the usage of both steps
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 5,
+				"OnModelAfterCreate":  5,
+				"OnModelBeforeUpdate": 5,
+				"OnModelAfterUpdate":  5,
+			},
+			ExpectedContent: []string{`"content":"It's 6"`, `"finish_reason":"stop"`},
+			TestAppFactory:  setupTestAppWithToolUpstream(persisted, []string{"calculator"}, 0),
+			BeforeTestFunc: func(t *testing.T, app *tests.TestApp, e *echo.Echo) {
+				vault.install(t, app, conversationID)
+				app.ResetEventCalls()
+			},
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				if len(persisted.requests) != 2 {
+					t.Fatalf("Expected 2 upstream requests, got %d", len(persisted.requests))
+				}
+				tools := persisted.requests[0].Tools
+				if len(tools) != 1 || tools[0].Function.Name != "calculator" {
+					t.Errorf("Expected the calculator tool, got %+v", tools)
+				}
+				// The result is sent back to the model
+				messages := persisted.requests[1].Messages
+				result := messages[len(messages)-1]
+				if result.Role != "tool" || result.ToolCallID != "call_1" || result.Content != "6" {
+					t.Errorf("Expected the calculator result, got %+v", result)
+				}
+
+				found := map[string]bool{}
+				for _, message := range vault.decryptMessages(t, app, conversationID) {
+					switch {
+					case message.OwnerID == userID:
+						found["request"] = true
+					case len(message.ToolCalls) == 1 &&
+						message.ToolCalls[0].Function.Name == "calculator" &&
+						message.AgentID == "maths-tutor" &&
+						message.ModelID == "test:echo":
+						found["tool call"] = true
+					case message.ToolCallID == "call_1" && message.Content == "6":
+						found["tool result"] = true
+					case message.Content == "It's 6" && message.ModelID == "test:echo":
+						found["response"] = true
+					default:
+						t.Errorf("Unexpected message %+v", message)
+					}
+				}
+				if len(found) != 4 {
+					t.Errorf("Expected the tool call messages, got %v", found)
+				}
+
+				// The tool messages are children of the request message so
+				// they're deleted with it
+				records, err := app.Dao().FindRecordsByFilter(
+					"messages",
+					"conversation = {:conversation} && parent_message != ''",
+					"",
+					0,
+					0,
+					map[string]any{"conversation": conversationID},
+				)
+				if err != nil {
+					t.Fatal(err)
+				}
+				for _, record := range records {
+					if record.GetString("parent_message") != records[0].GetString("parent_message") {
+						t.Errorf("Expected every reply to have the request as its parent")
+					}
+				}
+				if len(records) != 3 {
+					t.Errorf("Expected 3 replies to the request, got %d", len(records))
+				}
+			},
+		},
+		{
+			Name:   "the answer is streamed once the tools have run",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           requestBody(true, ""),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 1,
+				"OnModelAfterCreate":  1,
+				"OnModelBeforeUpdate": 1,
+				"OnModelAfterUpdate":  1,
+			},
+			ExpectedContent: []string{
+				`"delta":{"role":"assistant"}`,
+				`"delta":{"content":"It's 6"}`,
+				`"finish_reason":"stop"`,
+				"data: [DONE]",
+			},
+			// The calls of built-in tools aren't sent to the client
+			NotExpectedContent: []string{"tool_calls", "call_1"},
+			TestAppFactory: setupTestAppWithToolUpstream(
+				streamed,
+				[]string{"calculator"},
+				0,
+			),
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				if len(streamed.requests) != 2 {
+					t.Fatalf(
+						"Expected 2 upstream requests, got %d",
+						len(streamed.requests),
+					)
+				}
+				for _, req := range streamed.requests {
+					if !req.Stream {
+						t.Error("Expected the steps to be streamed")
+					}
+				}
+			},
+		},
+		{
+			Name:   "the model has to answer after the step limit",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           requestBody(true, ""),
+			ExpectedStatus: http.StatusOK,
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 1,
+				"OnModelAfterCreate":  1,
+				"OnModelBeforeUpdate": 2,
+				"OnModelAfterUpdate":  2,
+			},
+			ExpectedContent: []string{`"content":"It's 6"`, "data: [DONE]"},
+			TestAppFactory: setupTestAppWithToolUpstream(
+				greedy,
+				[]string{"calculator", "current_time"},
+				2,
+			),
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				if len(greedy.requests) != 3 {
+					t.Fatalf("Expected 3 upstream requests, got %d", len(greedy.requests))
+				}
+				last := greedy.requests[2]
+				if last.ToolChoice != "none" || !last.Stream {
+					t.Errorf(
+						"Expected the last step to be streamed without tools, got %v %t",
+						last.ToolChoice,
+						last.Stream,
+					)
+				}
+				if len(last.Tools) != 2 {
+					t.Errorf("Expected both tools, got %+v", last.Tools)
+				}
+			},
+		},
+		{
+			Name:   "agent with an unknown tool",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(false, ""),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid agent tool."`},
+			TestAppFactory: setupTestAppWithToolUpstream(
+				&toolUpstream{},
+				[]string{"rm"},
+				0,
+			),
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/pocketbase/pocketbase/tests"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// jsonUpstream is an OpenAI compatible upstream which gives each of its
+// answers in turn, repeating the last one
+type jsonUpstream struct {
+	answers []string
+
+	mu       sync.Mutex
+	requests []oai.ChatCompletionRequest
+}
+
+func (u *jsonUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req oai.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	u.mu.Lock()
+	u.requests = append(u.requests, req)
+	answer := u.answers[min(len(u.requests), len(u.answers))-1]
+	u.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(oai.ChatCompletionResponse{
+		ID:     "chatcmpl-test",
+		Object: "chat.completion",
+		Model:  "echo",
+		Choices: []oai.ChatCompletionChoice{{
+			Message:      oai.ChatCompletionMessage{Role: "assistant", Content: answer},
+			FinishReason: oai.FinishReasonStop,
+		}},
+		Usage: oai.Usage{PromptTokens: 20, CompletionTokens: 5, TotalTokens: 25},
+	})
+}
+
+func (u *jsonUpstream) received() []oai.ChatCompletionRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.requests
+}
+
+// setupTestAppWithJSONUpstream registers a `test` provider served by the
+// upstream
+func setupTestAppWithJSONUpstream(upstream *jsonUpstream) func(t *testing.T) *tests.TestApp {
+	return func(t *testing.T) *tests.TestApp {
+		server := httptest.NewServer(upstream)
+		t.Cleanup(server.Close)
+
+		return setupTestAppWithConfig(t, &config.APIConfig{
+			Providers: map[string]config.OpenAICompatibleProviderConfig{
+				"test": {
+					URL: server.URL,
+					Models: []config.ModelMappingConfig{
+						{Name: "echo", Upstream: "echo"},
+					},
+				},
+			},
+		})
+	}
+}
+
+func TestChatCompletionsStructuredOutput(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/chat/completions"
+		// Get this info from the pre-populated test DB
+		userEmail = "test2@example.com"
+
+		schema = `{
+			"type": "object",
+			"properties": {
+				"name": {"type": "string"},
+				"legs": {"type": "integer", "minimum": 0}
+			},
+			"required": ["name", "legs"],
+			"additionalProperties": false
+		}`
+		validAnswer = `{"name": "Octopus", "legs": 8}`
+	)
+
+	recordToken, err := generateRecordToken("users", userEmail)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	requestBody := func(responseFormat string, stream bool) *strings.Reader {
+		body, _ := json.Marshal(map[string]any{
+			"model":           "test:echo",
+			"stream":          stream,
+			"messages":        []map[string]string{{"role": "user", "content": "Describe an octopus"}},
+			"response_format": json.RawMessage(responseFormat),
+			"metadata": map[string]any{
+				"cognos": map[string]string{"agent_id": "cognos:simple-assistant"},
+			},
+		})
+		return strings.NewReader(string(body))
+	}
+	jsonSchemaFormat := `{"type": "json_schema", "json_schema": {"name": "animal", "schema": ` +
+		schema + `}}`
+
+	valid := &jsonUpstream{answers: []string{validAnswer}}
+	corrected := &jsonUpstream{answers: []string{`{"name": "Octopus"}`, validAnswer}}
+	invalid := &jsonUpstream{answers: []string{"An octopus has eight legs"}}
+	streamed := &jsonUpstream{answers: []string{validAnswer}}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:   "answer matches the JSON schema",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(jsonSchemaFormat, false),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"{\"name\": \"Octopus\", \"legs\": 8}"`},
+			ExpectedEvents:  completionEvents(),
+			TestAppFactory:  setupTestAppWithJSONUpstream(valid),
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				requests := valid.received()
+				if len(requests) != 1 {
+					t.Fatalf("Expected 1 upstream request, got %d", len(requests))
+				}
+				req := requests[0]
+				// The upstream is asked for JSON and told the schema
+				if req.ResponseFormat == nil ||
+					req.ResponseFormat.Type != oai.ChatCompletionResponseFormatTypeJSONObject {
+					t.Errorf("Expected the upstream to be asked for JSON, got %+v", req.ResponseFormat)
+				}
+				if !strings.Contains(req.Messages[0].Content, `"additionalProperties":false`) {
+					t.Errorf("Expected the schema in the system message, got %q", req.Messages[0].Content)
+				}
+			},
+		},
+		{
+			Name:   "invalid answer is corrected",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(jsonSchemaFormat, false),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"{\"name\": \"Octopus\", \"legs\": 8}"`},
+			// The usage of both requests is recorded
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 1,
+				"OnModelAfterCreate":  1,
+				"OnModelBeforeUpdate": 1,
+				"OnModelAfterUpdate":  1,
+			},
+			TestAppFactory: setupTestAppWithJSONUpstream(corrected),
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				requests := corrected.received()
+				if len(requests) != 2 {
+					t.Fatalf("Expected 2 upstream requests, got %d", len(requests))
+				}
+				messages := requests[1].Messages
+				correction := messages[len(messages)-1]
+				if !strings.Contains(correction.Content, "missing property 'legs'") {
+					t.Errorf("Expected the model to be told what's wrong, got %q", correction.Content)
+				}
+				if messages[len(messages)-2].Content != `{"name": "Octopus"}` {
+					t.Errorf("Expected the invalid answer before the correction")
+				}
+			},
+		},
+		{
+			Name:   "answer still invalid after correction",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(`{"type": "json_object"}`, false),
+			ExpectedStatus:  http.StatusBadGateway,
+			ExpectedContent: []string{`"message":"The model did not respond in the requested format: expected a JSON object."`},
+			ExpectedEvents: map[string]int{
+				"OnModelBeforeCreate": 1,
+				"OnModelAfterCreate":  1,
+				"OnModelBeforeUpdate": 1,
+				"OnModelAfterUpdate":  1,
+			},
+			TestAppFactory: setupTestAppWithJSONUpstream(invalid),
+		},
+		{
+			Name:   "checked answer is streamed",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:           requestBody(`{"type": "json_object"}`, true),
+			ExpectedStatus: http.StatusOK,
+			ExpectedContent: []string{
+				`"object":"chat.completion.chunk"`,
+				`"content":"{\"name\": \"Octopus\", \"legs\": 8}"`,
+				"data: [DONE]",
+			},
+			ExpectedEvents: completionEvents(),
+			TestAppFactory: setupTestAppWithJSONUpstream(streamed),
+			AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+				for _, req := range streamed.received() {
+					if req.Stream {
+						t.Error("Expected the upstream not to stream, the answer is checked first")
+					}
+				}
+			},
+		},
+		{
+			Name:   "JSON schema that isn't of an object",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: requestBody(
+				`{"type": "json_schema", "json_schema": {"name": "animals", "schema": {"type": "array"}}}`,
+				false,
+			),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid response format."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "JSON schema without a name",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body: requestBody(
+				`{"type": "json_schema", "json_schema": {"schema": `+schema+`}}`,
+				false,
+			),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid response format."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "unsupported response format",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(`{"type": "yaml"}`, false),
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid response format."`},
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+		{
+			Name:   "text response format is passed through",
+			Method: http.MethodPost,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": recordToken,
+			},
+			Body:            requestBody(`{"type": "text"}`, false),
+			ExpectedStatus:  http.StatusOK,
+			ExpectedContent: []string{`"content":"Ahoy"`},
+			ExpectedEvents:  completionEvents(),
+			TestAppFactory:  setupTestAppWithUpstream,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
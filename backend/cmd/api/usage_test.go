@@ -0,0 +1,209 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/usage"
+	"github.com/pocketbase/pocketbase/tests"
+)
+
+// setupTestAppWithSpend records completions for test1 and test2 in July 2024
+func setupTestAppWithSpend(t *testing.T) *tests.TestApp {
+	app := setupTestApp(t)
+
+	day := func(d int) time.Time {
+		return time.Date(2024, time.July, d, 12, 0, 0, 0, time.UTC)
+	}
+	repo := usage.NewPocketBaseTokenUsageRepo(app, app.Logger())
+	for _, completion := range []usage.CompletionUsage{
+		{UserID: "uvi8zmr78j9y5hz", AgentID: "simple-assistant", ModelID: "openai:gpt-4o", PromptTokens: 100, CompletionTokens: 10, Cost: 0.25, Created: day(16)},
+		{UserID: "uvi8zmr78j9y5hz", AgentID: "simple-assistant", ModelID: "openai:gpt-4o", PromptTokens: 200, CompletionTokens: 20, Cost: 0.5, Created: day(16)},
+		{UserID: "uvi8zmr78j9y5hz", AgentID: "test1-private", ModelID: "anthropic:claude-haiku", PromptTokens: 400, CompletionTokens: 40, Cost: 1, Created: day(17)},
+		{UserID: "xq9ndvc2kbrvrng", AgentID: "simple-assistant", ModelID: "openai:gpt-4o", PromptTokens: 50, CompletionTokens: 5, Cost: 0.125, Created: day(16)},
+		// Outside of the reported range
+		{UserID: "uvi8zmr78j9y5hz", AgentID: "simple-assistant", ModelID: "openai:gpt-4o", PromptTokens: 1000, CompletionTokens: 100, Cost: 8, Created: day(31).AddDate(0, 0, 1)},
+	} {
+		if err := repo.RecordUsage(completion); err != nil {
+			t.Fatal(err)
+		}
+	}
+	app.ResetEventCalls()
+
+	return app
+}
+
+func TestUsage(t *testing.T) {
+	t.Parallel()
+
+	const (
+		url = "/v1/usage?from=2024-07-01&to=2024-07-31"
+		// Get this info from the pre-populated test DB
+		test1ID = "uvi8zmr78j9y5hz"
+		test2ID = "xq9ndvc2kbrvrng"
+	)
+
+	test1Token, err := generateRecordToken("users", "test1@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminToken, err := generateAdminToken("cognos+test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenarios := []tests.ApiScenario{
+		{
+			Name:            "guest",
+			Method:          http.MethodGet,
+			Url:             url,
+			ExpectedStatus:  http.StatusUnauthorized,
+			ExpectedContent: []string{`"data":{}`},
+			TestAppFactory:  setupTestAppWithSpend,
+		},
+		{
+			Name:   "user only sees their own spend",
+			Method: http.MethodGet,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": test1Token,
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedContent: []string{
+				`"from":"2024-07-01"`,
+				`"to":"2024-07-31"`,
+				`"total_cost":1.75`,
+				`{"day":"2024-07-16","user":"` + test1ID + `","model":"openai:gpt-4o","agent":"simple-assistant","requests":2,"prompt_tokens":300,"completion_tokens":30,"cost":0.75}`,
+				`{"day":"2024-07-17","user":"` + test1ID + `","model":"anthropic:claude-haiku","agent":"test1-private","requests":1,"prompt_tokens":400,"completion_tokens":40,"cost":1}`,
+			},
+			NotExpectedContent: []string{test2ID, `"2024-08-01"`},
+			TestAppFactory:     setupTestAppWithSpend,
+		},
+		{
+			Name:   "user can't see another user's spend",
+			Method: http.MethodGet,
+			Url:    url + "&user=" + test2ID,
+			RequestHeaders: map[string]string{
+				"Authorization": test1Token,
+			},
+			ExpectedStatus:     http.StatusOK,
+			ExpectedContent:    []string{`"total_cost":1.75`},
+			NotExpectedContent: []string{test2ID},
+			TestAppFactory:     setupTestAppWithSpend,
+		},
+		{
+			Name:   "admin sees every user's spend",
+			Method: http.MethodGet,
+			Url:    url,
+			RequestHeaders: map[string]string{
+				"Authorization": adminToken,
+			},
+			ExpectedStatus: http.StatusOK,
+			ExpectedContent: []string{
+				`"total_cost":1.875`,
+				`"user":"` + test1ID + `"`,
+				`"user":"` + test2ID + `"`,
+			},
+			TestAppFactory: setupTestAppWithSpend,
+		},
+		{
+			Name:   "admin sees a single user's spend",
+			Method: http.MethodGet,
+			Url:    url + "&user=" + test2ID,
+			RequestHeaders: map[string]string{
+				"Authorization": adminToken,
+			},
+			ExpectedStatus:     http.StatusOK,
+			ExpectedContent:    []string{`"total_cost":0.125`, `"user":"` + test2ID + `"`},
+			NotExpectedContent: []string{test1ID},
+			TestAppFactory:     setupTestAppWithSpend,
+		},
+		{
+			Name:   "invalid date",
+			Method: http.MethodGet,
+			Url:    "/v1/usage?from=July",
+			RequestHeaders: map[string]string{
+				"Authorization": test1Token,
+			},
+			ExpectedStatus:  http.StatusBadRequest,
+			ExpectedContent: []string{`"message":"Invalid from date."`},
+			TestAppFactory:  setupTestAppWithSpend,
+		},
+	}
+
+	for _, scenario := range scenarios {
+		scenario.Test(t)
+	}
+}
+
+func TestChatCompletionsRecordsCost(t *testing.T) {
+	t.Parallel()
+
+	recordToken, err := generateRecordToken("users", "test2@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scenario := tests.ApiScenario{
+		Name:   "completion is priced",
+		Method: http.MethodPost,
+		Url:    "/v1/chat/completions",
+		RequestHeaders: map[string]string{
+			"Authorization": recordToken,
+		},
+		Body: strings.NewReader(`{
+			"model": "test:echo",
+			"messages": [{"role": "user", "content": "Hello"}],
+			"metadata": {"cognos": {"agent_id": "cognos:simple-assistant"}}
+		}`),
+		ExpectedStatus:  http.StatusOK,
+		ExpectedContent: []string{`"content":"Ahoy"`},
+		ExpectedEvents:  completionEvents(),
+		TestAppFactory: func(t *testing.T) *tests.TestApp {
+			return setupTestAppWithConfig(t, &config.APIConfig{
+				Providers: map[string]config.OpenAICompatibleProviderConfig{
+					"test": {
+						URL: newFakeUpstream(t, http.StatusOK, fakeUpstreamResponse),
+						Models: []config.ModelMappingConfig{
+							{Name: "echo", Upstream: "echo"},
+						},
+					},
+				},
+				// The fake upstream uses 12 prompt and 3 completion tokens
+				Pricing: map[string][]config.ModelPricingConfig{
+					"test": {{Model: "echo", Prompt: 50_000, Completion: 100_000}},
+				},
+			})
+		},
+		AfterTestFunc: func(t *testing.T, app *tests.TestApp, res *http.Response) {
+			spend, err := usage.NewPocketBaseTokenUsageRepo(app, app.Logger()).
+				Spend(usage.SpendQuery{
+					UserID: "xq9ndvc2kbrvrng",
+					From:   time.Now(),
+					To:     time.Now(),
+				})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expected := []usage.Spend{{
+				Day:              usage.Day(time.Now()),
+				UserID:           "xq9ndvc2kbrvrng",
+				ModelID:          "test:echo",
+				AgentID:          "simple-assistant",
+				Requests:         1,
+				PromptTokens:     12,
+				CompletionTokens: 3,
+				Cost:             0.9,
+			}}
+			if len(spend) != 1 || spend[0] != expected[0] {
+				t.Errorf("Expected spend %+v, got %+v", expected, spend)
+			}
+		},
+	}
+
+	scenario.Test(t)
+}
@@ -0,0 +1,380 @@
+// cognos-keys manages user key pairs offline, e.g. to create test users or to
+// recover a vault. Key pairs are read and written as the JSON of a
+// `user_key_pairs` record.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/crypto"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+)
+
+const usage = `Usage: cognos-keys <command> [flags]
+
+Commands:
+  generate         generate a new key pair wrapped with a vault password
+  wrap             wrap an existing secret key with a vault password
+  unwrap           print the secret key of a key pair
+  verify           check a vault password unlocks a key pair
+  change-password  re-wrap a key pair with a new vault password
+
+Passwords can be set with the COGNOS_VAULT_PASSWORD and
+COGNOS_NEW_VAULT_PASSWORD environment variables instead of flags.
+
+Run "cognos-keys <command> -h" for the flags of a command.
+`
+
+const (
+	passwordEnv    = "COGNOS_VAULT_PASSWORD"
+	newPasswordEnv = "COGNOS_NEW_VAULT_PASSWORD"
+)
+
+var errUsage = errors.New("invalid usage")
+
+// keyPairRecord is a `user_key_pairs` record
+type keyPairRecord struct {
+	User      string `json:"user"`
+	PublicKey string `json:"public_key"`
+	SecretKey string `json:"secret_key"`
+	// The KDF parameters are empty for legacy key pairs, which are salted
+	// with the user email or Ory identity ID
+	KDFAlgorithm  crypto.KDFAlgorithm `json:"kdf_algorithm,omitempty"`
+	KDFSalt       string              `json:"kdf_salt,omitempty"`
+	KDFIterations uint32              `json:"kdf_iterations,omitempty"`
+	KDFMemory     uint32              `json:"kdf_memory,omitempty"`
+	KDFThreads    uint8               `json:"kdf_threads,omitempty"`
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run runs the command in args, writing its output to stdout and the usage and
+// errors to stderr, and returns the exit code
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if err := runCommand(args, stdin, stdout, stderr); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		// The usage has already been written when there's no command
+		if err != errUsage {
+			fmt.Fprintln(stderr, "Error:", err)
+		}
+		return 1
+	}
+
+	return 0
+}
+
+func runCommand(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	if len(args) == 0 {
+		fmt.Fprint(stderr, usage)
+		return errUsage
+	}
+
+	commands := map[string]func([]string, io.Reader, io.Writer, io.Writer) error{
+		"generate":        generate,
+		"wrap":            wrap,
+		"unwrap":          unwrap,
+		"verify":          verify,
+		"change-password": changePassword,
+	}
+
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprint(stderr, usage)
+		return fmt.Errorf("%w: unknown command %q", errUsage, args[0])
+	}
+
+	return command(args[1:], stdin, stdout, stderr)
+}
+
+func generate(args []string, _ io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("generate", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	userID := flags.String("user", "", "ID of the user the key pair belongs to")
+	password := flags.String("password", "", "Vault password used to wrap the secret key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *userID == "" {
+		return fmt.Errorf("%w: -user is required", errUsage)
+	}
+
+	_, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+
+	record, err := wrapKeyPair(*userID, *secretKey, passwordOrEnv(*password, passwordEnv))
+	if err != nil {
+		return err
+	}
+
+	return writeRecord(stdout, record)
+}
+
+func wrap(args []string, _ io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("wrap", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	userID := flags.String("user", "", "ID of the user the key pair belongs to")
+	encodedSecretKey := flags.String("secret-key", "", "Secret key to wrap encoded in base64")
+	password := flags.String("password", "", "Vault password used to wrap the secret key")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *userID == "" || *encodedSecretKey == "" {
+		return fmt.Errorf("%w: -user and -secret-key are required", errUsage)
+	}
+
+	secretKey, err := decodeKey(*encodedSecretKey)
+	if err != nil {
+		return fmt.Errorf("invalid secret key: %w", err)
+	}
+
+	record, err := wrapKeyPair(*userID, secretKey, passwordOrEnv(*password, passwordEnv))
+	if err != nil {
+		return err
+	}
+
+	return writeRecord(stdout, record)
+}
+
+func unwrap(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("unwrap", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	unlock := unlockFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	_, secretKey, err := unlock(stdin)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(stdout, base64.StdEncoding.EncodeToString(secretKey[:]))
+	return err
+}
+
+func verify(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("verify", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	unlock := unlockFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	record, _, err := unlock(stdin)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(stdout, "OK: the vault password unlocks the key pair of user %s\n", record.User)
+	return err
+}
+
+func changePassword(args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	flags := flag.NewFlagSet("change-password", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	unlock := unlockFlags(flags)
+	newPassword := flags.String("new-password", "", "New vault password")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	record, secretKey, err := unlock(stdin)
+	if err != nil {
+		return err
+	}
+
+	// The key pair is re-wrapped with a new salt and the current parameters
+	updated, err := wrapKeyPair(record.User, secretKey, passwordOrEnv(*newPassword, newPasswordEnv))
+	if err != nil {
+		return err
+	}
+
+	return writeRecord(stdout, updated)
+}
+
+// unlockFlags adds the flags needed to unlock a key pair record and returns a
+// func which unlocks it once the flags are parsed
+func unlockFlags(
+	flags *flag.FlagSet,
+) func(stdin io.Reader) (keyPairRecord, [32]byte, error) {
+	recordPath := flags.String("record", "-", "Path to the key pair record JSON, - for stdin")
+	password := flags.String("password", "", "Vault password the secret key is wrapped with")
+	email := flags.String(
+		"email",
+		"",
+		"Salt of legacy key pairs, the user email or the Ory identity ID if created by the web client",
+	)
+
+	return func(stdin io.Reader) (keyPairRecord, [32]byte, error) {
+		record, err := readRecord(*recordPath, stdin)
+		if err != nil {
+			return record, [32]byte{}, err
+		}
+
+		secretKey, err := unlockKeyPair(record, passwordOrEnv(*password, passwordEnv), *email)
+		return record, secretKey, err
+	}
+}
+
+// wrapKeyPair wraps the secret key with the vault password, using a new salt
+// and the default KDF parameters
+func wrapKeyPair(userID string, secretKey [32]byte, password string) (keyPairRecord, error) {
+	if password == "" {
+		return keyPairRecord{}, fmt.Errorf("%w: a vault password is required", errUsage)
+	}
+
+	params, err := crypto.DefaultKDFParams()
+	if err != nil {
+		return keyPairRecord{}, err
+	}
+	key, err := params.DeriveKey(password)
+	if err != nil {
+		return keyPairRecord{}, err
+	}
+	wrapped, err := crypto.WrapSecretKey(key, secretKey)
+	if err != nil {
+		return keyPairRecord{}, err
+	}
+
+	publicKey := publicKeyOf(secretKey)
+
+	return keyPairRecord{
+		User:          userID,
+		PublicKey:     base64.StdEncoding.EncodeToString(publicKey[:]),
+		SecretKey:     base64.StdEncoding.EncodeToString(wrapped),
+		KDFAlgorithm:  params.Algorithm,
+		KDFSalt:       base64.StdEncoding.EncodeToString(params.Salt),
+		KDFIterations: params.Iterations,
+		KDFMemory:     params.Memory,
+		KDFThreads:    params.Threads,
+	}, nil
+}
+
+// unlockKeyPair opens the secret key of the record with the vault password
+// and checks it belongs to the public key
+func unlockKeyPair(record keyPairRecord, password, email string) ([32]byte, error) {
+	var secretKey [32]byte
+	if password == "" {
+		return secretKey, fmt.Errorf("%w: a vault password is required", errUsage)
+	}
+
+	params, err := recordKDFParams(record, email)
+	if err != nil {
+		return secretKey, err
+	}
+	key, err := params.DeriveKey(password)
+	if err != nil {
+		return secretKey, err
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(record.SecretKey)
+	if err != nil {
+		return secretKey, fmt.Errorf("invalid wrapped secret key: %w", err)
+	}
+	secretKey, err = crypto.OpenSecretKey(key, wrapped)
+	if err != nil {
+		return secretKey, errors.New("the vault password doesn't unlock the key pair")
+	}
+
+	publicKey, err := decodeKey(record.PublicKey)
+	if err != nil {
+		return secretKey, fmt.Errorf("invalid public key: %w", err)
+	}
+	if publicKeyOf(secretKey) != publicKey {
+		return secretKey, errors.New("the secret key doesn't belong to the public key")
+	}
+
+	return secretKey, nil
+}
+
+// recordKDFParams returns the KDF parameters stored in the record, or the
+// legacy parameters salted with the email if there are none
+func recordKDFParams(record keyPairRecord, email string) (crypto.KDFParams, error) {
+	if record.KDFAlgorithm == "" {
+		if email == "" {
+			return crypto.KDFParams{}, fmt.Errorf(
+				"%w: -email is required for legacy key pairs",
+				errUsage,
+			)
+		}
+		return crypto.LegacyKDFParams(email), nil
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(record.KDFSalt)
+	if err != nil {
+		return crypto.KDFParams{}, fmt.Errorf("invalid KDF salt: %w", err)
+	}
+
+	return crypto.KDFParams{
+		Algorithm:  record.KDFAlgorithm,
+		Salt:       salt,
+		Iterations: record.KDFIterations,
+		Memory:     record.KDFMemory,
+		Threads:    record.KDFThreads,
+	}, nil
+}
+
+func publicKeyOf(secretKey [32]byte) (publicKey [32]byte) {
+	curve25519.ScalarBaseMult(&publicKey, &secretKey)
+	return publicKey
+}
+
+func decodeKey(encoded string) (key [32]byte, err error) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return key, err
+	}
+	if len(decoded) != len(key) {
+		return key, fmt.Errorf("expected %d bytes, got %d", len(key), len(decoded))
+	}
+
+	copy(key[:], decoded)
+	return key, nil
+}
+
+func passwordOrEnv(password, env string) string {
+	if password != "" {
+		return password
+	}
+	return os.Getenv(env)
+}
+
+func readRecord(path string, stdin io.Reader) (keyPairRecord, error) {
+	var record keyPairRecord
+
+	input := stdin
+	if path != "-" {
+		file, err := os.Open(path)
+		if err != nil {
+			return record, err
+		}
+		defer file.Close()
+		input = file
+	}
+
+	if err := json.NewDecoder(input).Decode(&record); err != nil {
+		return record, fmt.Errorf("invalid key pair record: %w", err)
+	}
+
+	return record, nil
+}
+
+func writeRecord(stdout io.Writer, record keyPairRecord) error {
+	encoder := json.NewEncoder(stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(record)
+}
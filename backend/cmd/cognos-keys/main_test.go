@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/crypto"
+)
+
+const (
+	// A legacy key pair from the pre-populated test DB
+	legacyUserEmail     = "test1@example.com"
+	legacyVaultPassword = "Eegev5eiyahjohghaingahtho8uxu3oh"
+	legacyRecord        = `{
+		"user": "uvi8zmr78j9y5hz",
+		"public_key": "FaTq77hDYWu9pNLMwBlQ4Ks54BAfwz1Y7/nmyZTLkTE=",
+		"secret_key": "xi1EQyn4P+UgOuMKCL3RPtUEMZ43VnHT6XVxH++Dw0Y+OH+gihK/axp4sR7jxWWQzs0BIrq1L77tem6KSZaJGqFNjtjTt89x"
+	}`
+)
+
+// runCLI runs the CLI with the record as stdin, returning stdout, stderr and
+// the exit code
+func runCLI(t *testing.T, stdin string, args ...string) (string, string, int) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return stdout.String(), stderr.String(), code
+}
+
+// mustRun runs the CLI and fails the test unless it succeeds, returning stdout
+func mustRun(t *testing.T, stdin string, args ...string) string {
+	t.Helper()
+
+	stdout, stderr, code := runCLI(t, stdin, args...)
+	if code != 0 {
+		t.Fatalf("Expected %v to succeed, got exit code %d: %s", args, code, stderr)
+	}
+	if stderr != "" {
+		t.Errorf("Expected nothing on stderr, got %q", stderr)
+	}
+	return stdout
+}
+
+// mustFail runs the CLI and fails the test unless it fails with the error
+func mustFail(t *testing.T, stdin, wantErr string, args ...string) {
+	t.Helper()
+
+	stdout, stderr, code := runCLI(t, stdin, args...)
+	if code != 1 {
+		t.Errorf("Expected %v to exit with 1, got %d", args, code)
+	}
+	if stdout != "" {
+		t.Errorf("Expected nothing on stdout, got %q", stdout)
+	}
+	if !strings.Contains(stderr, wantErr) {
+		t.Errorf("Expected %q on stderr, got %q", wantErr, stderr)
+	}
+}
+
+func TestGenerateAndChangePassword(t *testing.T) {
+	generated := mustRun(t, "", "generate", "-user", "testuser", "-password", "first")
+
+	var record keyPairRecord
+	if err := json.Unmarshal([]byte(generated), &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.User != "testuser" || record.KDFAlgorithm != crypto.KDFArgon2id {
+		t.Errorf("Unexpected record %+v", record)
+	}
+	if record.KDFIterations != crypto.MinKDFIterations ||
+		record.KDFMemory != crypto.MinKDFMemory ||
+		record.KDFThreads != crypto.MinKDFThreads {
+		t.Errorf("Expected the default KDF parameters, got %+v", record)
+	}
+
+	verified := mustRun(t, generated, "verify", "-password", "first")
+	if verified != "OK: the vault password unlocks the key pair of user testuser\n" {
+		t.Errorf("Unexpected verify output %q", verified)
+	}
+	mustFail(
+		t,
+		generated,
+		"Error: the vault password doesn't unlock the key pair",
+		"verify", "-password", "second",
+	)
+
+	secretKey := mustRun(t, generated, "unwrap", "-password", "first")
+
+	changed := mustRun(
+		t,
+		generated,
+		"change-password", "-password", "first", "-new-password", "second",
+	)
+
+	var changedRecord keyPairRecord
+	if err := json.Unmarshal([]byte(changed), &changedRecord); err != nil {
+		t.Fatal(err)
+	}
+	if changedRecord.PublicKey != record.PublicKey {
+		t.Error("Expected the key pair to stay the same")
+	}
+	if changedRecord.KDFSalt == record.KDFSalt {
+		t.Error("Expected a new salt")
+	}
+
+	mustFail(
+		t,
+		changed,
+		"Error: the vault password doesn't unlock the key pair",
+		"verify", "-password", "first",
+	)
+	unwrapped := mustRun(t, changed, "unwrap", "-password", "second")
+	if unwrapped != secretKey {
+		t.Error("Expected the same secret key after changing the password")
+	}
+
+	// The secret key can be wrapped again, e.g. for a recovered vault
+	wrapped := mustRun(
+		t,
+		"",
+		"wrap", "-user", "testuser", "-secret-key", strings.TrimSpace(secretKey),
+		"-password", "third",
+	)
+	if !strings.Contains(wrapped, record.PublicKey) {
+		t.Errorf("Expected the wrapped record to have the same public key, got %s", wrapped)
+	}
+}
+
+func TestLegacyKeyPair(t *testing.T) {
+	mustFail(
+		t,
+		legacyRecord,
+		"Error: invalid usage: -email is required for legacy key pairs",
+		"verify", "-password", legacyVaultPassword,
+	)
+
+	mustRun(
+		t,
+		legacyRecord,
+		"verify", "-password", legacyVaultPassword, "-email", legacyUserEmail,
+	)
+
+	// Changing the password upgrades the key pair to a random salt
+	upgraded := mustRun(
+		t,
+		legacyRecord,
+		"change-password",
+		"-password", legacyVaultPassword,
+		"-email", legacyUserEmail,
+		"-new-password", legacyVaultPassword,
+	)
+	mustRun(t, upgraded, "verify", "-password", legacyVaultPassword)
+}
+
+func TestUsage(t *testing.T) {
+	mustFail(t, "", "Usage: cognos-keys <command> [flags]")
+	mustFail(t, "", `Error: invalid usage: unknown command "rotate"`, "rotate")
+	mustFail(t, "", "Error: invalid usage: -user is required", "generate", "-password", "first")
+
+	// Help isn't an error
+	stdout, stderr, code := runCLI(t, "", "verify", "-h")
+	if code != 0 || stdout != "" {
+		t.Errorf("Expected only the help, got exit code %d and %q", code, stdout)
+	}
+	if !strings.Contains(stderr, "Usage of verify") || !strings.Contains(stderr, "-record") {
+		t.Errorf("Expected the flags of the command on stderr, got %q", stderr)
+	}
+}
@@ -0,0 +1,147 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("9iy4obxuf3x94jx")
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal([]byte(`[
+			"CREATE UNIQUE INDEX `+"`"+`idx_wq3hxn7ccv`+"`"+` ON `+"`"+`models`+"`"+` (`+"`"+`provider`+"`"+`, `+"`"+`slug`+"`"+`)"
+		]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		// update
+		edit_slug := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "zf7hlboy",
+			"name": "slug",
+			"type": "text",
+			"required": true,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": "^[a-z0-9]+(?:[-._][a-z0-9]+)*$"
+			}
+		}`), edit_slug); err != nil {
+			return err
+		}
+		collection.Schema.AddField(edit_slug)
+
+		// add
+		new_provider := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "e0wz4ncd",
+			"name": "provider",
+			"type": "text",
+			"required": true,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": "^[a-z0-9]+(?:-[a-z0-9]+)*$"
+			}
+		}`), new_provider); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_provider)
+
+		// add
+		new_upstream_model := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "kfn6mkyw",
+			"name": "upstream_model",
+			"type": "text",
+			"required": true,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": ""
+			}
+		}`), new_upstream_model); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_upstream_model)
+
+		// add
+		new_enabled := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "q8bsu0dm",
+			"name": "enabled",
+			"type": "bool",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {}
+		}`), new_enabled); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_enabled)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("9iy4obxuf3x94jx")
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal([]byte(`[]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		// update
+		edit_slug := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "zf7hlboy",
+			"name": "slug",
+			"type": "text",
+			"required": true,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": "^[a-z0-9]+(?:-[a-z0-9]+)*$"
+			}
+		}`), edit_slug); err != nil {
+			return err
+		}
+		collection.Schema.AddField(edit_slug)
+
+		// remove
+		collection.Schema.RemoveField("e0wz4ncd")
+
+		// remove
+		collection.Schema.RemoveField("kfn6mkyw")
+
+		// remove
+		collection.Schema.RemoveField("q8bsu0dm")
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,238 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Seeds the models collection with the models that were previously hard coded
+// in the proxy package. From here on models are managed in the admin UI.
+func init() {
+	type seedModel struct {
+		Name          string
+		Slug          string
+		Description   string
+		Group         string
+		Provider      string
+		UpstreamModel string
+	}
+
+	seedModels := []seedModel{
+		{
+			Name:          "GPT 3.5 Turbo",
+			Slug:          "gpt-3.5-turbo",
+			Description:   "OpenAI's fast, inexpensive model for general-purpose use.",
+			Group:         "Open AI",
+			Provider:      "openai",
+			UpstreamModel: "gpt-3.5-turbo",
+		},
+		{
+			Name:          "GPT 4 Omni",
+			Slug:          "gpt-4o",
+			Description:   "OpenAI's GPT 4 Omni (GPT4o) model",
+			Group:         "Open AI",
+			Provider:      "openai",
+			UpstreamModel: "gpt-4o",
+		},
+		{
+			Name:          "Claude Sonnet 3.5",
+			Slug:          "claude-sonnet3.5",
+			Description:   "Anthropic's Claude Sonnet 3.5 is the newest model from Anthropic that promises excellent (better than OpenAI GPT4o) performance.",
+			Group:         "Anthropic",
+			Provider:      "anthropic",
+			UpstreamModel: "claude-3-5-sonnet-20240620",
+		},
+		{
+			Name:          "Claude Haiku",
+			Slug:          "claude-haiku",
+			Description:   "Anthropic's Claude Haiku is their fastest general purpose model.",
+			Group:         "Anthropic",
+			Provider:      "anthropic",
+			UpstreamModel: "claude-3-haiku-20240307",
+		},
+		{
+			Name:          "Claude Sonnet",
+			Slug:          "claude-sonnet",
+			Description:   "Anthropic's Claude Sonnet is a mid level general purpose model balancing speed and intelligence.",
+			Group:         "Anthropic",
+			Provider:      "anthropic",
+			UpstreamModel: "claude-3-sonnet-20240229",
+		},
+		{
+			Name:          "Claude Opus",
+			Slug:          "claude-opus",
+			Description:   "Anthropic's Claude Opus is an advanced intelligence general purpose model.",
+			Group:         "Anthropic",
+			Provider:      "anthropic",
+			UpstreamModel: "claude-3-opus-20240229",
+		},
+		{
+			Name:          "Gemini 1.5 Flash",
+			Slug:          "gemini-1.5-flash",
+			Description:   "Google's Gemini 1.5 Flash model is a fast, general-purpose model with a long context.",
+			Group:         "Google",
+			Provider:      "google",
+			UpstreamModel: "models/gemini-1.5-flash",
+		},
+		{
+			Name:          "Gemini 1.5 Pro",
+			Slug:          "gemini-1.5-pro",
+			Description:   "Google's Gemini 1.5 Pro is an advanced, general purpose model with a long context. It is slower than the Flash model but has higher intelligence.",
+			Group:         "Google",
+			Provider:      "google",
+			UpstreamModel: "models/gemini-1.5-pro",
+		},
+		{
+			Name:          "Llama3 8B Instruct",
+			Slug:          "llama-3-8b-instruct",
+			Description:   "Meta's open source LLama3 8B model hosted on the Cloudflare Workers AI infrastructure",
+			Group:         "Other",
+			Provider:      "cloudflare",
+			UpstreamModel: "@cf/meta/llama-3-8b-instruct",
+		},
+		{
+			Name:          "Qwen 1.5 7B Chat",
+			Slug:          "qwen-15-7b-chat",
+			Description:   "Qwen's Qwen 1.5 7B Chat model hosted on the Cloudflare Workers AI infrastructure",
+			Group:         "Other",
+			Provider:      "cloudflare",
+			UpstreamModel: "@cf/qwen/qwen1.5-7b-chat-awq",
+		},
+		{
+			Name:          "Mistral 7B Instruct v0.2",
+			Slug:          "mistral-7b-instruct-v0.2",
+			Description:   "Mistral's Mistral 7B Instruct v0.2 model hosted on the Cloudflare Workers AI infrastructure",
+			Group:         "Mistral",
+			Provider:      "cloudflare",
+			UpstreamModel: "@hf/mistral/mistral-7b-instruct-v0.2",
+		},
+		{
+			Name:          "Deepseek Math 7B Instruct",
+			Slug:          "deepseek-math-7b-instruct",
+			Description:   "Deepseek AI's Deepseek Math 7B Instruct model hosted on the Cloudflare Workers AI infrastructure",
+			Group:         "Other",
+			Provider:      "cloudflare",
+			UpstreamModel: "@cf/deepseek-ai/deepseek-math-7b-instruct",
+		},
+		{
+			Name:          "OpenChat 3.6 8B",
+			Slug:          "openchat-3.6-8b",
+			Description:   "OpenChat is a LLama-3-8B fine-tune that outperforms it on multiple benchmarks.",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "openchat/openchat-3.6-8b",
+		},
+		{
+			Name:          "WizardLM-2 8x22B",
+			Slug:          "wizardlm-2-8x22b",
+			Description:   "Developed at Microsoft, WizardLM-2 is a mixture of experts model that extends Mixtral-8x22B and is capable of general-purpose tasks.",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "microsoft/WizardLM-2-8x22B",
+		},
+		{
+			Name:          "Gemma 1.1 7B IT",
+			Slug:          "gemma-1.1-7b-it",
+			Description:   "Developed by Google, Gemma is an open-source model that leverages the same research and technology as Google Gemini models.",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "google/gemma-1.1-7b-it",
+		},
+		{
+			Name:          "Dolphin 2.6 Mixtral 8x7B",
+			Slug:          "dolphin-2.6-mixtral-8x7b",
+			Description:   "Dolphin is an uncensored model that is capable of general-purpose and coding tasks.",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "cognitivecomputations/dolphin-2.6-mixtral-8x7b",
+		},
+		{
+			Name:          "Chronos Hermes 13B v2",
+			Slug:          "chronos-hermes-13b-v2",
+			Description:   "Optimized for creative writing tasks, Chronos Hermes is focused on chat, role play and story writing, with good reasoning and logic.",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "Austism/chronos-hermes-13b-v2",
+		},
+		{
+			Name:          "Phind CodeLLama 34B v2",
+			Slug:          "phind-codellama-34b-v2",
+			Description:   "Phind CodeLLama is a model optimized for coding tasks and performs well with multiple programming languages including Python, C/C++, TypeScript, Java.",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "Phind/Phind-CodeLlama-34B-v2",
+		},
+		{
+			Name:          "CodeGemma 7B IT",
+			Slug:          "codegemma-7b-it",
+			Description:   "This model is intended to answer questions about code fragments, to generate code from natural language, or to engage in a conversation with the user about programming or technical problems.",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "google/codegemma-7b-it",
+		},
+		{
+			Name:          "LLama 3 8B Instruct",
+			Slug:          "llama-3-8b-instruct",
+			Description:   "Meta's open source LLama3 8B model hosted on the DeepInfra infrastructure",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "meta-llama/Meta-Llama-3-8B-Instruct",
+		},
+		{
+			Name:          "LZLV 70B FP16 HF",
+			Slug:          "lzlv_70b_fp16_hf",
+			Description:   "A mix of models focused on creative writing such as role playing and story telling.",
+			Group:         "Other",
+			Provider:      "deepinfra",
+			UpstreamModel: "lizpreciatior/lzlv_70b_fp16_hf",
+		},
+	}
+
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("9iy4obxuf3x94jx")
+		if err != nil {
+			return err
+		}
+
+		for _, seed := range seedModels {
+			record := models.NewRecord(collection)
+			record.Set("name", seed.Name)
+			record.Set("slug", seed.Slug)
+			record.Set("description", seed.Description)
+			record.Set("group", seed.Group)
+			record.Set("provider", seed.Provider)
+			record.Set("upstream_model", seed.UpstreamModel)
+			record.Set("enabled", true)
+
+			if err := dao.SaveRecord(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		for _, seed := range seedModels {
+			record, err := dao.FindFirstRecordByFilter(
+				"9iy4obxuf3x94jx",
+				"provider = {:provider} && slug = {:slug}",
+				dbx.Params{"provider": seed.Provider, "slug": seed.Slug},
+			)
+			if err != nil {
+				// Already removed in the admin UI
+				continue
+			}
+
+			if err := dao.DeleteRecord(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
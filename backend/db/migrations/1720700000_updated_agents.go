@@ -0,0 +1,227 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("l9i0pyg6kx2m0t5")
+		if err != nil {
+			return err
+		}
+
+		collection.ListRule = types.Pointer("@request.auth.id != \"\"\n&& (\n  visibility = \"public\"\n  || owner = @request.auth.id\n  || (visibility = \"shared\" && shared_with.id ?= @request.auth.id)\n)")
+
+		collection.ViewRule = types.Pointer("@request.auth.id != \"\"\n&& (\n  visibility = \"public\"\n  || owner = @request.auth.id\n  || (visibility = \"shared\" && shared_with.id ?= @request.auth.id)\n)")
+
+		collection.CreateRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.owner = @request.auth.id\n&& @request.data.visibility != \"public\"\n&& @request.data.id:isset = false\n&& @request.data.created:isset = false\n&& @request.data.updated:isset = false")
+
+		collection.UpdateRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& owner = @request.auth.id\n// data validation\n&& @request.data.owner:isset = false\n&& @request.data.visibility != \"public\"\n&& @request.data.created:isset = false\n&& @request.data.updated:isset = false")
+
+		collection.DeleteRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& owner = @request.auth.id")
+
+		if err := json.Unmarshal([]byte(`[
+			"CREATE UNIQUE INDEX `+"`"+`idx_r0fq3vKa`+"`"+` ON `+"`"+`agents`+"`"+` (`+"`"+`slug`+"`"+`)"
+		]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		// add
+		new_system_message := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "h3kq8zvp",
+			"name": "system_message",
+			"type": "text",
+			"required": true,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": ""
+			}
+		}`), new_system_message); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_system_message)
+
+		// add
+		new_examples := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "m2d7rtxa",
+			"name": "examples",
+			"type": "json",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSize": 2000000
+			}
+		}`), new_examples); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_examples)
+
+		// add
+		new_num_tokens := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "w9pfy4ne",
+			"name": "num_tokens",
+			"type": "number",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": 0,
+				"max": null,
+				"noDecimal": true
+			}
+		}`), new_num_tokens); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_num_tokens)
+
+		// add
+		new_allowed_models := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "c5xn1jgu",
+			"name": "allowed_models",
+			"type": "json",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSize": 2000000
+			}
+		}`), new_allowed_models); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_allowed_models)
+
+		// add
+		new_owner := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "t7bl0rqs",
+			"name": "owner",
+			"type": "relation",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"collectionId": "_pb_users_auth_",
+				"cascadeDelete": true,
+				"minSelect": null,
+				"maxSelect": 1,
+				"displayFields": null
+			}
+		}`), new_owner); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_owner)
+
+		// add
+		new_visibility := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "v4kej2hd",
+			"name": "visibility",
+			"type": "select",
+			"required": true,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSelect": 1,
+				"values": [
+					"private",
+					"shared",
+					"public"
+				]
+			}
+		}`), new_visibility); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_visibility)
+
+		// add
+		new_shared_with := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "s1ogu6wf",
+			"name": "shared_with",
+			"type": "relation",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"collectionId": "_pb_users_auth_",
+				"cascadeDelete": false,
+				"minSelect": null,
+				"maxSelect": null,
+				"displayFields": null
+			}
+		}`), new_shared_with); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_shared_with)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("l9i0pyg6kx2m0t5")
+		if err != nil {
+			return err
+		}
+
+		collection.ListRule = nil
+
+		collection.ViewRule = nil
+
+		collection.CreateRule = nil
+
+		collection.UpdateRule = nil
+
+		collection.DeleteRule = nil
+
+		if err := json.Unmarshal([]byte(`[]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		// remove
+		collection.Schema.RemoveField("h3kq8zvp")
+
+		// remove
+		collection.Schema.RemoveField("m2d7rtxa")
+
+		// remove
+		collection.Schema.RemoveField("w9pfy4ne")
+
+		// remove
+		collection.Schema.RemoveField("c5xn1jgu")
+
+		// remove
+		collection.Schema.RemoveField("t7bl0rqs")
+
+		// remove
+		collection.Schema.RemoveField("v4kej2hd")
+
+		// remove
+		collection.Schema.RemoveField("s1ogu6wf")
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,81 @@
+package migrations
+
+import (
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// Seeds the agents collection with the agents that were previously hard coded
+// in the aiagent package. These have no owner and are visible to everyone.
+func init() {
+	type seedAgent struct {
+		Name        string
+		Slug        string
+		Description string
+		Prompt      aiagent.Prompt
+	}
+
+	seedAgents := []seedAgent{
+		{
+			Name:        "Simple Assistant",
+			Slug:        "simple-assistant",
+			Description: "A general purpose assistant that gives accurate, thoughtful answers.",
+			Prompt:      aiagent.SimpleAssistant,
+		},
+		{
+			Name:        "Generate Conversation Title",
+			Slug:        "generate-conversation-agent",
+			Description: "Generates a short title for a conversation from its first message.",
+			Prompt:      aiagent.GenerateConversationAgent,
+		},
+	}
+
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("l9i0pyg6kx2m0t5")
+		if err != nil {
+			return err
+		}
+
+		for _, seed := range seedAgents {
+			record := models.NewRecord(collection)
+			record.Set("name", seed.Name)
+			record.Set("slug", seed.Slug)
+			record.Set("description", seed.Description)
+			record.Set("system_message", seed.Prompt.SystemMessage)
+			record.Set("examples", seed.Prompt.Examples)
+			record.Set("num_tokens", seed.Prompt.NumTokens)
+			record.Set("visibility", string(aiagent.VisibilityPublic))
+
+			if err := dao.SaveRecord(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		for _, seed := range seedAgents {
+			record, err := dao.FindFirstRecordByData(
+				"l9i0pyg6kx2m0t5",
+				"slug",
+				seed.Slug,
+			)
+			if err != nil {
+				// Already removed in the admin UI
+				continue
+			}
+
+			if err := dao.DeleteRecord(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
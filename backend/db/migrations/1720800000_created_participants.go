@@ -0,0 +1,99 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		jsonData := `{
+			"id": "8ofzyq2c0wq5n7d",
+			"created": "2024-07-12 09:20:00.000Z",
+			"updated": "2024-07-12 09:20:00.000Z",
+			"name": "participants",
+			"type": "base",
+			"system": false,
+			"schema": [
+				{
+					"system": false,
+					"id": "ba8hv4fd",
+					"name": "conversation",
+					"type": "relation",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"collectionId": "23wjzzeeb4qilr9",
+						"cascadeDelete": true,
+						"minSelect": null,
+						"maxSelect": 1,
+						"displayFields": null
+					}
+				},
+				{
+					"system": false,
+					"id": "3rnus5de",
+					"name": "user",
+					"type": "relation",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"collectionId": "_pb_users_auth_",
+						"cascadeDelete": true,
+						"minSelect": null,
+						"maxSelect": 1,
+						"displayFields": null
+					}
+				},
+				{
+					"system": false,
+					"id": "fnjvvx46",
+					"name": "role",
+					"type": "select",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"maxSelect": 1,
+						"values": [
+							"Viewer",
+							"Editor",
+							"Admin"
+						]
+					}
+				}
+			],
+			"indexes": [
+				"CREATE UNIQUE INDEX ` + "`" + `idx_eVob3Ru` + "`" + ` ON ` + "`" + `participants` + "`" + ` (\n  ` + "`" + `conversation` + "`" + `,\n  ` + "`" + `user` + "`" + `\n)"
+			],
+			"listRule": "// logged in\n@request.auth.id != \"\"\n// permissions\n&& (user = @request.auth.id || conversation.creator = @request.auth.id)",
+			"viewRule": "// logged in\n@request.auth.id != \"\"\n// permissions\n&& (user = @request.auth.id || conversation.creator = @request.auth.id)",
+			"createRule": "// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.id:isset = false\n&& @request.data.created:isset = false\n&& @request.data.updated:isset = false\n// permissions\n&& @request.data.conversation.creator = @request.auth.id",
+			"updateRule": "// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.conversation:isset = false\n&& @request.data.user:isset = false\n&& @request.data.created:isset = false\n&& @request.data.updated:isset = false\n// permissions\n&& conversation.creator = @request.auth.id",
+			"deleteRule": "// logged in\n@request.auth.id != \"\"\n// permissions\n&& conversation.creator = @request.auth.id",
+			"options": {}
+		}`
+
+		collection := &models.Collection{}
+		if err := json.Unmarshal([]byte(jsonData), &collection); err != nil {
+			return err
+		}
+
+		return daos.New(db).SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("8ofzyq2c0wq5n7d")
+		if err != nil {
+			return err
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
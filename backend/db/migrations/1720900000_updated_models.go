@@ -0,0 +1,103 @@
+package migrations
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	// Context windows of the seeded models in tokens, keyed by `provider:slug`
+	contextWindows := map[string]int{
+		"openai:gpt-3.5-turbo":                 16_385,
+		"openai:gpt-4o":                        128_000,
+		"anthropic:claude-haiku":               200_000,
+		"anthropic:claude-sonnet":              200_000,
+		"anthropic:claude-opus":                200_000,
+		"anthropic:claude-sonnet3.5":           200_000,
+		"google:gemini-1.5-pro":                1_048_576,
+		"google:gemini-1.5-flash":              1_048_576,
+		"cloudflare:llama-3-8b-instruct":       8_192,
+		"cloudflare:mistral-7b-instruct-v0.2":  32_768,
+		"cloudflare:deepseek-math-7b-instruct": 4_096,
+		"cloudflare:qwen-15-7b-chat":           32_768,
+		"deepinfra:openchat-3.6-8b":            8_192,
+		"deepinfra:wizardlm-2-8x22b":           64_000,
+		"deepinfra:gemma-1.1-7b-it":            8_192,
+		"deepinfra:dolphin-2.6-mixtral-8x7b":   16_000,
+		"deepinfra:chronos-hermes-13b-v2":      4_096,
+		"deepinfra:phind-codellama-34b-v2":     4_096,
+		"deepinfra:codegemma-7b-it":            8_192,
+		"deepinfra:llama-3-8b-instruct":        8_192,
+		"deepinfra:lzlv_70b_fp16_hf":           8_192,
+	}
+
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("9iy4obxuf3x94jx")
+		if err != nil {
+			return err
+		}
+
+		// add
+		new_context_window := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "n5rcx2qe",
+			"name": "context_window",
+			"type": "number",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": 0,
+				"max": null,
+				"noDecimal": true
+			}
+		}`), new_context_window); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_context_window)
+
+		if err := dao.SaveCollection(collection); err != nil {
+			return err
+		}
+
+		for modelID, contextWindow := range contextWindows {
+			provider, slug, _ := strings.Cut(modelID, ":")
+			record, err := dao.FindFirstRecordByFilter(
+				collection.Id,
+				"provider = {:provider} && slug = {:slug}",
+				dbx.Params{"provider": provider, "slug": slug},
+			)
+			if err != nil {
+				// Removed in the admin UI
+				continue
+			}
+
+			record.Set("context_window", contextWindow)
+			if err := dao.SaveRecord(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("9iy4obxuf3x94jx")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		collection.Schema.RemoveField("n5rcx2qe")
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,83 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	// Seeded models that are served by more than one provider
+	families := map[string][]string{
+		"llama-3-8b-instruct": {"cloudflare", "deepinfra"},
+	}
+
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("9iy4obxuf3x94jx")
+		if err != nil {
+			return err
+		}
+
+		// add
+		new_family := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "g2xj8wmd",
+			"name": "family",
+			"type": "text",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": "^[a-z0-9]+(?:[-._][a-z0-9]+)*$"
+			}
+		}`), new_family); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_family)
+
+		if err := dao.SaveCollection(collection); err != nil {
+			return err
+		}
+
+		for family, providers := range families {
+			for _, provider := range providers {
+				record, err := dao.FindFirstRecordByFilter(
+					collection.Id,
+					"provider = {:provider} && slug = {:slug}",
+					dbx.Params{"provider": provider, "slug": family},
+				)
+				if err != nil {
+					// Removed in the admin UI
+					continue
+				}
+
+				record.Set("family", family)
+				if err := dao.SaveRecord(record); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("9iy4obxuf3x94jx")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		collection.Schema.RemoveField("g2xj8wmd")
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,150 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		jsonData := `{
+			"id": "q8v2tkn5usg7d1c",
+			"created": "2024-07-16 10:00:00.000Z",
+			"updated": "2024-07-16 10:00:00.000Z",
+			"name": "token_usage",
+			"type": "base",
+			"system": false,
+			"schema": [
+				{
+					"system": false,
+					"id": "u7kq2mzd",
+					"name": "user",
+					"type": "relation",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"collectionId": "_pb_users_auth_",
+						"cascadeDelete": true,
+						"minSelect": null,
+						"maxSelect": 1,
+						"displayFields": null
+					}
+				},
+				{
+					"system": false,
+					"id": "m3dx9wle",
+					"name": "model",
+					"type": "text",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": null,
+						"pattern": ""
+					}
+				},
+				{
+					"system": false,
+					"id": "d4yq8rbn",
+					"name": "day",
+					"type": "text",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": null,
+						"max": null,
+						"pattern": "^\\d{4}-\\d{2}-\\d{2}$"
+					}
+				},
+				{
+					"system": false,
+					"id": "p5tn1kcv",
+					"name": "prompt_tokens",
+					"type": "number",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": 0,
+						"max": null,
+						"noDecimal": true
+					}
+				},
+				{
+					"system": false,
+					"id": "c6tn2jxw",
+					"name": "completion_tokens",
+					"type": "number",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": 0,
+						"max": null,
+						"noDecimal": true
+					}
+				},
+				{
+					"system": false,
+					"id": "t7tn3hyz",
+					"name": "total_tokens",
+					"type": "number",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": 0,
+						"max": null,
+						"noDecimal": true
+					}
+				},
+				{
+					"system": false,
+					"id": "r8qs4gfa",
+					"name": "requests",
+					"type": "number",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": 0,
+						"max": null,
+						"noDecimal": true
+					}
+				}
+			],
+			"indexes": [
+				"CREATE UNIQUE INDEX ` + "`" + `idx_tkUsgDay` + "`" + ` ON ` + "`" + `token_usage` + "`" + ` (\n  ` + "`" + `user` + "`" + `,\n  ` + "`" + `model` + "`" + `,\n  ` + "`" + `day` + "`" + `\n)"
+			],
+			"listRule": "// logged in\n@request.auth.id != \"\"\n// permissions\n&& user = @request.auth.id",
+			"viewRule": "// logged in\n@request.auth.id != \"\"\n// permissions\n&& user = @request.auth.id",
+			"createRule": null,
+			"updateRule": null,
+			"deleteRule": null,
+			"options": {}
+		}`
+
+		collection := &models.Collection{}
+		if err := json.Unmarshal([]byte(jsonData), &collection); err != nil {
+			return err
+		}
+
+		return daos.New(db).SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("q8v2tkn5usg7d1c")
+		if err != nil {
+			return err
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
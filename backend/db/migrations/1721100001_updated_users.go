@@ -0,0 +1,65 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("_pb_users_auth_")
+		if err != nil {
+			return err
+		}
+
+		// The plan is set by admins so users can't change their own quotas
+		collection.CreateRule = types.Pointer("@request.data.plan:isset = false")
+
+		collection.UpdateRule = types.Pointer("id = @request.auth.id\n&& @request.data.plan:isset = false")
+
+		// add
+		new_plan := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "pl4nt13r",
+			"name": "plan",
+			"type": "text",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": "^[a-z0-9]+(?:[-_][a-z0-9]+)*$"
+			}
+		}`), new_plan); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_plan)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("_pb_users_auth_")
+		if err != nil {
+			return err
+		}
+
+		collection.CreateRule = types.Pointer("")
+
+		collection.UpdateRule = types.Pointer("id = @request.auth.id")
+
+		// remove
+		collection.Schema.RemoveField("pl4nt13r")
+
+		return dao.SaveCollection(collection)
+	})
+}
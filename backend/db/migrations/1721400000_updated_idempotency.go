@@ -0,0 +1,116 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("bg088f2xo7gdkm1")
+		if err != nil {
+			return err
+		}
+
+		// remove, streamed responses aren't JSON so can't be stored in it
+		collection.Schema.RemoveField("rca5w7hu")
+
+		// add
+		new_response_body := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "b0dyr3sp",
+			"name": "response_body",
+			"type": "text",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": ""
+			}
+		}`), new_response_body); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_response_body)
+
+		// add
+		new_response_headers := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "h3adr3sp",
+			"name": "response_headers",
+			"type": "json",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSize": 2000000
+			}
+		}`), new_response_headers); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_response_headers)
+
+		// add
+		new_in_flight := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "1nfl1ght",
+			"name": "in_flight",
+			"type": "bool",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {}
+		}`), new_in_flight); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_in_flight)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("bg088f2xo7gdkm1")
+		if err != nil {
+			return err
+		}
+
+		// add
+		del_body := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "rca5w7hu",
+			"name": "body",
+			"type": "json",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSize": 2000000
+			}
+		}`), del_body); err != nil {
+			return err
+		}
+		collection.Schema.AddField(del_body)
+
+		// remove
+		collection.Schema.RemoveField("b0dyr3sp")
+
+		// remove
+		collection.Schema.RemoveField("h3adr3sp")
+
+		// remove
+		collection.Schema.RemoveField("1nfl1ght")
+
+		return dao.SaveCollection(collection)
+	})
+}
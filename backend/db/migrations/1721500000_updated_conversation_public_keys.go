@@ -0,0 +1,89 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("3v0m8v3xtw1286r")
+		if err != nil {
+			return err
+		}
+
+		// The version is assigned by the server
+		collection.CreateRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.id:isset = false\n&& @request.data.public_key:isset = true\n&& @request.data.conversation:isset = true\n&& @request.data.version:isset = false\n&& @request.data.updated:isset = false\n&& @request.data.created:isset = false\n// permissions\n&& conversation.creator = @request.auth.id")
+
+		// add
+		new_version := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "v3rs10nk",
+			"name": "version",
+			"type": "number",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": 1,
+				"max": null,
+				"noDecimal": true
+			}
+		}`), new_version); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_version)
+
+		// Number the existing keys of each conversation from oldest to newest,
+		// before the unique index is created
+		if err := dao.SaveCollection(collection); err != nil {
+			return err
+		}
+		_, err = db.NewQuery(`
+			UPDATE conversation_public_keys
+			SET version = (
+				SELECT COUNT(*) FROM conversation_public_keys AS older
+				WHERE older.conversation = conversation_public_keys.conversation
+				AND (
+					older.created < conversation_public_keys.created
+					OR (older.created = conversation_public_keys.created AND older.id <= conversation_public_keys.id)
+				)
+			)
+		`).Execute()
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal([]byte(`[
+			"CREATE UNIQUE INDEX `+"`"+`idx_cnvKeyVer`+"`"+` ON `+"`"+`conversation_public_keys`+"`"+` (\n  `+"`"+`conversation`+"`"+`,\n  `+"`"+`version`+"`"+`\n)"
+		]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("3v0m8v3xtw1286r")
+		if err != nil {
+			return err
+		}
+
+		collection.CreateRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.id:isset = false\n&& @request.data.public_key:isset = true\n&& @request.data.conversation:isset = true\n&& @request.data.updated:isset = false\n&& @request.data.created:isset = false\n// permissions\n&& conversation.creator = @request.auth.id")
+
+		collection.Indexes = types.JsonArray[string]{}
+
+		// remove
+		collection.Schema.RemoveField("v3rs10nk")
+
+		return dao.SaveCollection(collection)
+	})
+}
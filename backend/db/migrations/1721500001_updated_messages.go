@@ -0,0 +1,75 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("v893vvhgp688kie")
+		if err != nil {
+			return err
+		}
+
+		// The key version changes with the data so can only be set by the server
+		collection.UpdateRule = types.Pointer("@request.auth.id != \"\" \n&& conversation.creator = @request.auth.id\n// Data validation\n&& @request.data.id:isset = false\n&& @request.data.data:isset = false\n&& @request.data.key_version:isset = false\n&& @request.data.conversation:isset = false\n&& @request.data.parent_message:isset = false\n&& @request.data.created:isset = false\n&& @request.data.updated:isset = false\n// Expires can be set or unset")
+
+		// add
+		new_key_version := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "k3yv3rsn",
+			"name": "key_version",
+			"type": "number",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": 1,
+				"max": null,
+				"noDecimal": true
+			}
+		}`), new_key_version); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_key_version)
+
+		if err := dao.SaveCollection(collection); err != nil {
+			return err
+		}
+
+		// Existing messages were sealed with the newest key of the conversation
+		// at the time they were written
+		_, err = db.NewQuery(`
+			UPDATE messages
+			SET key_version = (
+				SELECT MAX(version) FROM conversation_public_keys
+				WHERE conversation_public_keys.conversation = messages.conversation
+				AND conversation_public_keys.created <= messages.created
+			)
+		`).Execute()
+		return err
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("v893vvhgp688kie")
+		if err != nil {
+			return err
+		}
+
+		collection.UpdateRule = types.Pointer("@request.auth.id != \"\" \n&& conversation.creator = @request.auth.id\n// Data validation\n&& @request.data.id:isset = false\n&& @request.data.data:isset = false\n&& @request.data.conversation:isset = false\n&& @request.data.parent_message:isset = false\n&& @request.data.created:isset = false\n&& @request.data.updated:isset = false\n// Expires can be set or unset")
+
+		// remove
+		collection.Schema.RemoveField("k3yv3rsn")
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,110 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		jsonData := `{
+			"id": "k3yr0t4t10n5c0l",
+			"created": "2024-07-20 09:00:00.000Z",
+			"updated": "2024-07-20 09:00:00.000Z",
+			"name": "key_rotations",
+			"type": "base",
+			"system": false,
+			"schema": [
+				{
+					"system": false,
+					"id": "r0tc0nv1",
+					"name": "conversation",
+					"type": "relation",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"collectionId": "23wjzzeeb4qilr9",
+						"cascadeDelete": true,
+						"minSelect": null,
+						"maxSelect": 1,
+						"displayFields": null
+					}
+				},
+				{
+					"system": false,
+					"id": "r0tv3rs2",
+					"name": "key_version",
+					"type": "number",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": 1,
+						"max": null,
+						"noDecimal": true
+					}
+				},
+				{
+					"system": false,
+					"id": "r0tst4t3",
+					"name": "status",
+					"type": "select",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"maxSelect": 1,
+						"values": [
+							"in_progress",
+							"completed"
+						]
+					}
+				},
+				{
+					"system": false,
+					"id": "r0tc0un4",
+					"name": "reencrypted",
+					"type": "number",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": 0,
+						"max": null,
+						"noDecimal": true
+					}
+				}
+			],
+			"indexes": [
+				"CREATE UNIQUE INDEX ` + "`" + `idx_k3yR0tVer` + "`" + ` ON ` + "`" + `key_rotations` + "`" + ` (\n  ` + "`" + `conversation` + "`" + `,\n  ` + "`" + `key_version` + "`" + `\n)"
+			],
+			"listRule": "// logged in\n@request.auth.id != \"\"\n// permissions\n&& conversation.creator = @request.auth.id",
+			"viewRule": "// logged in\n@request.auth.id != \"\"\n// permissions\n&& conversation.creator = @request.auth.id",
+			"createRule": null,
+			"updateRule": null,
+			"deleteRule": null,
+			"options": {}
+		}`
+
+		collection := &models.Collection{}
+		if err := json.Unmarshal([]byte(jsonData), &collection); err != nil {
+			return err
+		}
+
+		return daos.New(db).SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("k3yr0t4t10n5c0l")
+		if err != nil {
+			return err
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
@@ -0,0 +1,126 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("kx3ewd64kz2os37")
+		if err != nil {
+			return err
+		}
+
+		// Users can re-wrap their secret key, e.g. to upgrade the KDF
+		// parameters, but the key pair itself can't change
+		collection.UpdateRule = types.Pointer("@request.auth.id != \"\" && \n@request.auth.id = user.id &&\n// Additional validation\n@request.data.id:isset = false &&\n@request.data.created:isset = false &&\n@request.data.updated:isset = false &&\n@request.data.user:isset = false &&\n@request.data.public_key:isset = false &&\n@request.data.secret_key:isset = true")
+
+		// The KDF parameters are empty for legacy key pairs
+		fields := []string{
+			`{
+				"system": false,
+				"id": "kdf4lg0r",
+				"name": "kdf_algorithm",
+				"type": "select",
+				"required": false,
+				"presentable": false,
+				"unique": false,
+				"options": {
+					"maxSelect": 1,
+					"values": [
+						"argon2id"
+					]
+				}
+			}`,
+			`{
+				"system": false,
+				"id": "kdf5a1tb",
+				"name": "kdf_salt",
+				"type": "text",
+				"required": false,
+				"presentable": false,
+				"unique": false,
+				"options": {
+					"min": null,
+					"max": 88,
+					"pattern": "^(?:[A-Za-z0-9+/]{4})*(?:[A-Za-z0-9+/]{2}==|[A-Za-z0-9+/]{3}=)?$"
+				}
+			}`,
+			`{
+				"system": false,
+				"id": "kdf1t3rs",
+				"name": "kdf_iterations",
+				"type": "number",
+				"required": false,
+				"presentable": false,
+				"unique": false,
+				"options": {
+					"min": null,
+					"max": null,
+					"noDecimal": true
+				}
+			}`,
+			`{
+				"system": false,
+				"id": "kdfm3m0r",
+				"name": "kdf_memory",
+				"type": "number",
+				"required": false,
+				"presentable": false,
+				"unique": false,
+				"options": {
+					"min": null,
+					"max": null,
+					"noDecimal": true
+				}
+			}`,
+			`{
+				"system": false,
+				"id": "kdfthr3d",
+				"name": "kdf_threads",
+				"type": "number",
+				"required": false,
+				"presentable": false,
+				"unique": false,
+				"options": {
+					"min": null,
+					"max": null,
+					"noDecimal": true
+				}
+			}`,
+		}
+		for _, field := range fields {
+			new_field := &schema.SchemaField{}
+			if err := json.Unmarshal([]byte(field), new_field); err != nil {
+				return err
+			}
+			collection.Schema.AddField(new_field)
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("kx3ewd64kz2os37")
+		if err != nil {
+			return err
+		}
+
+		collection.UpdateRule = nil
+
+		// remove
+		for _, id := range []string{"kdf4lg0r", "kdf5a1tb", "kdf1t3rs", "kdfm3m0r", "kdfthr3d"} {
+			collection.Schema.RemoveField(id)
+		}
+
+		return dao.SaveCollection(collection)
+	})
+}
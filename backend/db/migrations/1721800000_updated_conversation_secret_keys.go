@@ -0,0 +1,95 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("zy560w1blembu8s")
+		if err != nil {
+			return err
+		}
+
+		// Every participant can read the secret keys wrapped for them
+		collection.ListRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& user = @request.auth.id")
+
+		// The key version is assigned by the server
+		collection.CreateRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.id:isset = false\n&& @request.data.secret_key:isset = true\n&& @request.data.conversation:isset = true\n&& @request.data.key_version:isset = false\n&& @request.data.updated:isset = false\n&& @request.data.created:isset = false\n&& @request.data.user = @request.auth.id\n// permissions\n&& conversation.creator = @request.auth.id")
+
+		// add
+		new_key_version := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "skk3yv3r",
+			"name": "key_version",
+			"type": "number",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": 1,
+				"max": null,
+				"noDecimal": true
+			}
+		}`), new_key_version); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_key_version)
+
+		// Number the existing keys of each user from oldest to newest, matching
+		// the versions of the public keys, before the unique index is created
+		if err := dao.SaveCollection(collection); err != nil {
+			return err
+		}
+		_, err = db.NewQuery(`
+			UPDATE conversation_secret_keys
+			SET key_version = (
+				SELECT COUNT(*) FROM conversation_secret_keys AS older
+				WHERE older.conversation = conversation_secret_keys.conversation
+				AND older.user = conversation_secret_keys.user
+				AND (
+					older.created < conversation_secret_keys.created
+					OR (older.created = conversation_secret_keys.created AND older.id <= conversation_secret_keys.id)
+				)
+			)
+		`).Execute()
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal([]byte(`[
+			"CREATE UNIQUE INDEX `+"`"+`idx_cnvSecKeyVer`+"`"+` ON `+"`"+`conversation_secret_keys`+"`"+` (\n  `+"`"+`conversation`+"`"+`,\n  `+"`"+`user`+"`"+`,\n  `+"`"+`key_version`+"`"+`\n)"
+		]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("zy560w1blembu8s")
+		if err != nil {
+			return err
+		}
+
+		collection.ListRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& user = @request.auth.id\n&& conversation.creator = @request.auth.id")
+
+		collection.CreateRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.id:isset = false\n&& @request.data.secret_key:isset = true\n&& @request.data.conversation:isset = true\n&& @request.data.updated:isset = false\n&& @request.data.created:isset = false\n&& @request.data.user = @request.auth.id\n// permissions\n&& conversation.creator = @request.auth.id")
+
+		collection.Indexes = types.JsonArray[string]{}
+
+		// remove
+		collection.Schema.RemoveField("skk3yv3r")
+
+		return dao.SaveCollection(collection)
+	})
+}
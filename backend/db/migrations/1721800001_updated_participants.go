@@ -0,0 +1,46 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("8ofzyq2c0wq5n7d")
+		if err != nil {
+			return err
+		}
+
+		// Participants can see who else is in the conversation
+		collection.ListRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& (\n  user = @request.auth.id\n  || conversation.creator = @request.auth.id\n  || conversation.participants_via_conversation.user ?= @request.auth.id\n)")
+		collection.ViewRule = collection.ListRule
+
+		// Participants are managed with the participants API, so the
+		// conversation key is wrapped for them and rotated when they're revoked
+		collection.CreateRule = nil
+		collection.UpdateRule = nil
+		collection.DeleteRule = nil
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("8ofzyq2c0wq5n7d")
+		if err != nil {
+			return err
+		}
+
+		collection.ListRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& (user = @request.auth.id || conversation.creator = @request.auth.id)")
+		collection.ViewRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& (user = @request.auth.id || conversation.creator = @request.auth.id)")
+		collection.CreateRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.id:isset = false\n&& @request.data.created:isset = false\n&& @request.data.updated:isset = false\n// permissions\n&& @request.data.conversation.creator = @request.auth.id")
+		collection.UpdateRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// data validation\n&& @request.data.conversation:isset = false\n&& @request.data.user:isset = false\n&& @request.data.created:isset = false\n&& @request.data.updated:isset = false\n// permissions\n&& conversation.creator = @request.auth.id")
+		collection.DeleteRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& conversation.creator = @request.auth.id")
+
+		return dao.SaveCollection(collection)
+	})
+}
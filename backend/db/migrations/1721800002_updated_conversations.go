@@ -0,0 +1,37 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("23wjzzeeb4qilr9")
+		if err != nil {
+			return err
+		}
+
+		// Participants can read the conversation, only the creator can change it
+		collection.ListRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& (\n  creator = @request.auth.id\n  || participants_via_conversation.user ?= @request.auth.id\n)")
+		collection.ViewRule = collection.ListRule
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("23wjzzeeb4qilr9")
+		if err != nil {
+			return err
+		}
+
+		collection.ListRule = types.Pointer("@request.auth.id != \"\"\n&& creator = @request.auth.id")
+		collection.ViewRule = types.Pointer("@request.auth.id != \"\" \n&& creator = @request.auth.id")
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,36 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("v893vvhgp688kie")
+		if err != nil {
+			return err
+		}
+
+		// Participants can read the messages, they're written by the
+		// completions API
+		collection.ListRule = types.Pointer("@request.auth.id != \"\" \n&& conversation = @request.query.conversation\n&& (\n  conversation.creator = @request.auth.id\n  || conversation.participants_via_conversation.user ?= @request.auth.id\n)")
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("v893vvhgp688kie")
+		if err != nil {
+			return err
+		}
+
+		collection.ListRule = types.Pointer("@request.auth.id != \"\" \n&& conversation = @request.query.conversation\n&& conversation.creator = @request.auth.id")
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,35 @@
+package migrations
+
+import (
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("3v0m8v3xtw1286r")
+		if err != nil {
+			return err
+		}
+
+		// Participants need the public key to open their wrapped secret key
+		collection.ListRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& (\n  conversation.creator = @request.auth.id\n  || conversation.participants_via_conversation.user ?= @request.auth.id\n)")
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("3v0m8v3xtw1286r")
+		if err != nil {
+			return err
+		}
+
+		collection.ListRule = types.Pointer("// logged in\n@request.auth.id != \"\"\n// permissions\n&& conversation.creator = @request.auth.id")
+
+		return dao.SaveCollection(collection)
+	})
+}
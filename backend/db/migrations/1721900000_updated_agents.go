@@ -0,0 +1,76 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("l9i0pyg6kx2m0t5")
+		if err != nil {
+			return err
+		}
+
+		// add
+		new_tools := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "q8tz3mwe",
+			"name": "tools",
+			"type": "json",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSize": 2000000
+			}
+		}`), new_tools); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_tools)
+
+		// add
+		new_max_tool_steps := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "k5rj7dya",
+			"name": "max_tool_steps",
+			"type": "number",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": 0,
+				"max": 20,
+				"noDecimal": true
+			}
+		}`), new_max_tool_steps); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_max_tool_steps)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("l9i0pyg6kx2m0t5")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		collection.Schema.RemoveField("q8tz3mwe")
+
+		// remove
+		collection.Schema.RemoveField("k5rj7dya")
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,131 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		// The files are encrypted by the client, so they're only uploaded and
+		// downloaded through the attachment routes which check the members of
+		// the conversation
+		jsonData := `{
+			"id": "4tt4chm3nts0c0l",
+			"created": "2024-07-22 09:00:00.000Z",
+			"updated": "2024-07-22 09:00:00.000Z",
+			"name": "attachments",
+			"type": "base",
+			"system": false,
+			"schema": [
+				{
+					"system": false,
+					"id": "4ttc0nv1",
+					"name": "conversation",
+					"type": "relation",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"collectionId": "23wjzzeeb4qilr9",
+						"cascadeDelete": true,
+						"minSelect": null,
+						"maxSelect": 1,
+						"displayFields": null
+					}
+				},
+				{
+					"system": false,
+					"id": "4ttmsg02",
+					"name": "message",
+					"type": "relation",
+					"required": false,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"collectionId": "v893vvhgp688kie",
+						"cascadeDelete": true,
+						"minSelect": null,
+						"maxSelect": 1,
+						"displayFields": null
+					}
+				},
+				{
+					"system": false,
+					"id": "4tt0wnr3",
+					"name": "owner",
+					"type": "relation",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"collectionId": "_pb_users_auth_",
+						"cascadeDelete": true,
+						"minSelect": null,
+						"maxSelect": 1,
+						"displayFields": null
+					}
+				},
+				{
+					"system": false,
+					"id": "4ttf1l34",
+					"name": "file",
+					"type": "file",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"mimeTypes": [],
+						"thumbs": [],
+						"maxSelect": 1,
+						"maxSize": 10485800,
+						"protected": true
+					}
+				},
+				{
+					"system": false,
+					"id": "4tts1z35",
+					"name": "size",
+					"type": "number",
+					"required": true,
+					"presentable": false,
+					"unique": false,
+					"options": {
+						"min": 1,
+						"max": null,
+						"noDecimal": true
+					}
+				}
+			],
+			"indexes": [
+				"CREATE INDEX ` + "`" + `idx_4ttC0nvMsg` + "`" + ` ON ` + "`" + `attachments` + "`" + ` (\n  ` + "`" + `conversation` + "`" + `,\n  ` + "`" + `message` + "`" + `\n)"
+			],
+			"listRule": null,
+			"viewRule": null,
+			"createRule": null,
+			"updateRule": null,
+			"deleteRule": null,
+			"options": {}
+		}`
+
+		collection := &models.Collection{}
+		if err := json.Unmarshal([]byte(jsonData), &collection); err != nil {
+			return err
+		}
+
+		return daos.New(db).SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("4tt4chm3nts0c0l")
+		if err != nil {
+			return err
+		}
+
+		return dao.DeleteCollection(collection)
+	})
+}
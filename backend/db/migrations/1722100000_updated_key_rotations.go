@@ -0,0 +1,77 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("k3yr0t4t10n5c0l")
+		if err != nil {
+			return err
+		}
+
+		// update, revoking a participant supersedes an unfinished rotation
+		edit_status := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "r0tst4t3",
+			"name": "status",
+			"type": "select",
+			"required": true,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSelect": 1,
+				"values": [
+					"in_progress",
+					"completed",
+					"superseded"
+				]
+			}
+		}`), edit_status); err != nil {
+			return err
+		}
+		collection.Schema.AddField(edit_status)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("k3yr0t4t10n5c0l")
+		if err != nil {
+			return err
+		}
+
+		// update
+		edit_status := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "r0tst4t3",
+			"name": "status",
+			"type": "select",
+			"required": true,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"maxSelect": 1,
+				"values": [
+					"in_progress",
+					"completed"
+				]
+			}
+		}`), edit_status); err != nil {
+			return err
+		}
+		collection.Schema.AddField(edit_status)
+
+		return dao.SaveCollection(collection)
+	})
+}
@@ -0,0 +1,91 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("q8v2tkn5usg7d1c")
+		if err != nil {
+			return err
+		}
+
+		// Usage is also counted per agent so the spend can be reported by it
+		if err := json.Unmarshal([]byte(`[
+			"CREATE UNIQUE INDEX `+"`"+`idx_tkUsgDay`+"`"+` ON `+"`"+`token_usage`+"`"+` (\n  `+"`"+`user`+"`"+`,\n  `+"`"+`model`+"`"+`,\n  `+"`"+`agent`+"`"+`,\n  `+"`"+`day`+"`"+`\n)"
+		]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		// add
+		new_agent := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "a2gtu5ke",
+			"name": "agent",
+			"type": "text",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": ""
+			}
+		}`), new_agent); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_agent)
+
+		// add, the estimated cost in USD
+		new_cost := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "c9stu6kf",
+			"name": "cost",
+			"type": "number",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": 0,
+				"max": null,
+				"noDecimal": false
+			}
+		}`), new_cost); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_cost)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("q8v2tkn5usg7d1c")
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal([]byte(`[
+			"CREATE UNIQUE INDEX `+"`"+`idx_tkUsgDay`+"`"+` ON `+"`"+`token_usage`+"`"+` (\n  `+"`"+`user`+"`"+`,\n  `+"`"+`model`+"`"+`,\n  `+"`"+`day`+"`"+`\n)"
+		]`), &collection.Indexes); err != nil {
+			return err
+		}
+
+		// remove
+		collection.Schema.RemoveField("a2gtu5ke")
+
+		// remove
+		collection.Schema.RemoveField("c9stu6kf")
+
+		return dao.SaveCollection(collection)
+	})
+}
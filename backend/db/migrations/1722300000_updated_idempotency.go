@@ -0,0 +1,55 @@
+package migrations
+
+import (
+	"encoding/json"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/daos"
+	m "github.com/pocketbase/pocketbase/migrations"
+	"github.com/pocketbase/pocketbase/models/schema"
+)
+
+func init() {
+	m.Register(func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("bg088f2xo7gdkm1")
+		if err != nil {
+			return err
+		}
+
+		// add
+		new_request_hash := &schema.SchemaField{}
+		if err := json.Unmarshal([]byte(`{
+			"system": false,
+			"id": "r3qh4sh0",
+			"name": "request_hash",
+			"type": "text",
+			"required": false,
+			"presentable": false,
+			"unique": false,
+			"options": {
+				"min": null,
+				"max": null,
+				"pattern": ""
+			}
+		}`), new_request_hash); err != nil {
+			return err
+		}
+		collection.Schema.AddField(new_request_hash)
+
+		return dao.SaveCollection(collection)
+	}, func(db dbx.Builder) error {
+		dao := daos.New(db)
+
+		collection, err := dao.FindCollectionByNameOrId("bg088f2xo7gdkm1")
+		if err != nil {
+			return err
+		}
+
+		// remove
+		collection.Schema.RemoveField("r3qh4sh0")
+
+		return dao.SaveCollection(collection)
+	})
+}
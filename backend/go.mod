@@ -3,6 +3,7 @@ module github.com/cognos-io/chat.cognos.io/backend
 go 1.22.5
 
 require (
+	github.com/dlclark/regexp2 v1.11.0
 	github.com/go-co-op/gocron/v2 v2.7.1
 	github.com/google/generative-ai-go v0.14.0
 	github.com/knadh/koanf/parsers/yaml v0.1.0
@@ -11,9 +12,11 @@ require (
 	github.com/knadh/koanf/v2 v2.1.1
 	github.com/labstack/echo/v5 v5.0.0-20230722203903-ec5b858dab61
 	github.com/liushuangls/go-anthropic/v2 v2.3.1
+	github.com/pkoukk/tiktoken-go v0.1.7
 	github.com/pocketbase/dbx v1.10.1
 	github.com/pocketbase/pocketbase v0.22.16
 	github.com/prometheus/client_golang v1.19.1
+	github.com/santhosh-tekuri/jsonschema/v6 v6.0.2
 	github.com/sashabaranov/go-openai v1.24.1
 	golang.org/x/crypto v0.24.0
 	google.golang.org/api v0.187.0
@@ -0,0 +1,29 @@
+package apierror
+
+import (
+	"net/http"
+
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// New builds the body of an error response. The API is OpenAI compatible so
+// its errors have the same shape, whichever route they're from.
+func New(code int, message string) oai.ErrorResponse {
+	var errorType string
+	switch code {
+	case http.StatusBadRequest, http.StatusUnprocessableEntity:
+		errorType = "invalid_request_error"
+	case http.StatusForbidden:
+		errorType = "permission_error"
+	case http.StatusNotFound:
+		errorType = "not_found_error"
+	case http.StatusConflict:
+		errorType = "conflict_error"
+	case http.StatusTooManyRequests:
+		errorType = "rate_limit_error"
+	default:
+		errorType = "api_error"
+	}
+
+	return oai.ErrorResponse{Error: &oai.APIError{Type: errorType, Message: message}}
+}
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/ttlcache"
+)
+
+// CachedKeyPairRepo caches the conversation public keys of another KeyPairRepo
+// for a short time so a completion only looks the key up once.
+type CachedKeyPairRepo struct {
+	repo             KeyPairRepo
+	conversationKeys *ttlcache.Cache[string, ConversationKey]
+}
+
+// ConversationKey returns the cached key for the given conversation, loading
+// it if it isn't cached or has expired.
+func (r *CachedKeyPairRepo) ConversationKey(
+	conversationID string,
+) (ConversationKey, error) {
+	if key, ok := r.conversationKeys.Get(conversationID); ok {
+		return key, nil
+	}
+
+	key, err := r.repo.ConversationKey(conversationID)
+	if err != nil {
+		return key, err
+	}
+
+	r.conversationKeys.Set(conversationID, key)
+	return key, nil
+}
+
+// ConversationPublicKey returns the cached public key for the given conversation.
+func (r *CachedKeyPairRepo) ConversationPublicKey(
+	conversationID string,
+) ([32]byte, error) {
+	key, err := r.ConversationKey(conversationID)
+	return key.PublicKey, err
+}
+
+// UserPublicKey isn't cached as it's rarely needed
+func (r *CachedKeyPairRepo) UserPublicKey(userID string) ([32]byte, error) {
+	return r.repo.UserPublicKey(userID)
+}
+
+// Invalidate forgets the cached key of the conversation e.g. when it's rotated.
+func (r *CachedKeyPairRepo) Invalidate(conversationID string) {
+	r.conversationKeys.Delete(conversationID)
+}
+
+func NewCachedKeyPairRepo(repo KeyPairRepo, ttl time.Duration) *CachedKeyPairRepo {
+	return &CachedKeyPairRepo{
+		repo:             repo,
+		conversationKeys: ttlcache.New[string, ConversationKey](ttl),
+	}
+}
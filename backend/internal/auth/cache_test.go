@@ -0,0 +1,72 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+// countingKeyPairRepo returns a different key for every lookup
+type countingKeyPairRepo struct {
+	lookups int
+	err     error
+}
+
+func (r *countingKeyPairRepo) ConversationKey(string) (ConversationKey, error) {
+	r.lookups++
+	return ConversationKey{Version: r.lookups, PublicKey: [32]byte{byte(r.lookups)}}, r.err
+}
+
+func (r *countingKeyPairRepo) ConversationPublicKey(id string) ([32]byte, error) {
+	key, err := r.ConversationKey(id)
+	return key.PublicKey, err
+}
+
+func (r *countingKeyPairRepo) UserPublicKey(string) ([32]byte, error) {
+	r.lookups++
+	return [32]byte{byte(r.lookups)}, r.err
+}
+
+func TestCachedKeyPairRepo(t *testing.T) {
+	const conversationID = "conversation1"
+
+	now := time.Date(2024, time.July, 18, 9, 0, 0, 0, time.UTC)
+	upstream := &countingKeyPairRepo{}
+	repo := NewCachedKeyPairRepo(upstream, time.Minute)
+	repo.conversationKeys.Now = func() time.Time { return now }
+
+	expectKey := func(t *testing.T, want byte, wantLookups int) {
+		t.Helper()
+		publicKey, err := repo.ConversationPublicKey(conversationID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if publicKey[0] != want {
+			t.Errorf("Expected key %d, got %d", want, publicKey[0])
+		}
+		if upstream.lookups != wantLookups {
+			t.Errorf("Expected %d lookups, got %d", wantLookups, upstream.lookups)
+		}
+	}
+
+	expectKey(t, 1, 1)
+
+	// Cached until the TTL is up
+	now = now.Add(59 * time.Second)
+	expectKey(t, 1, 1)
+
+	now = now.Add(time.Second)
+	expectKey(t, 2, 2)
+
+	// Invalidating loads the key again
+	repo.Invalidate(conversationID)
+	expectKey(t, 3, 3)
+
+	// Errors aren't cached
+	upstream.err = ErrNoKeyPair
+	repo.Invalidate(conversationID)
+	if _, err := repo.ConversationPublicKey(conversationID); err != ErrNoKeyPair {
+		t.Errorf("Expected ErrNoKeyPair, got %v", err)
+	}
+	upstream.err = nil
+	expectKey(t, 5, 5)
+}
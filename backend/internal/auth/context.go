@@ -0,0 +1,37 @@
+package auth
+
+import "github.com/labstack/echo/v5"
+
+const contextConversationKey = "cognos_conversation_key"
+
+type loadedConversationKey struct {
+	conversationID string
+	key            ConversationKey
+}
+
+// SetConversationKey stores the key of the conversation the request is for in
+// the echo.Context.
+func SetConversationKey(
+	c echo.Context,
+	conversationID string,
+	key ConversationKey,
+) {
+	c.Set(contextConversationKey, loadedConversationKey{
+		conversationID: conversationID,
+		key:            key,
+	})
+}
+
+// ExtractConversationKey returns the key of the conversation if it has been
+// loaded into the echo.Context, see middleware.LoadKeyPair.
+func ExtractConversationKey(
+	c echo.Context,
+	conversationID string,
+) (ConversationKey, bool) {
+	loaded, ok := c.Get(contextConversationKey).(loadedConversationKey)
+	if !ok || loaded.conversationID != conversationID {
+		return ConversationKey{}, false
+	}
+
+	return loaded.key, true
+}
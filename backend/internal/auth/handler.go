@@ -0,0 +1,47 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// UserPublicKey is the response of the user public key endpoint
+type UserPublicKey struct {
+	UserID    string `json:"user_id"`
+	PublicKey string `json:"public_key"`
+}
+
+// PublicKeyEchoHandler returns the public key of the user in the `user_id`
+// path param, so a conversation key can be wrapped for them before they're
+// invited.
+func PublicKeyEchoHandler(
+	logger *slog.Logger,
+	keyPairRepo KeyPairRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		userID := c.PathParam("user_id")
+
+		publicKey, err := keyPairRepo.UserPublicKey(userID)
+		if errors.Is(err, ErrNoKeyPair) {
+			return apis.NewNotFoundError("The user has no key pair", nil)
+		}
+		if err != nil {
+			logger.Error("Failed to load user public key", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to load user public key",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusOK, UserPublicKey{
+			UserID:    userID,
+			PublicKey: base64.StdEncoding.EncodeToString(publicKey[:]),
+		})
+	}
+}
@@ -16,7 +16,15 @@ type KeyPair struct {
 	SecretKey string `db:"secret_key"`
 }
 
+// ConversationKey is a version of the public key of a conversation. Conversation
+// keys are rotated by adding a new version, the newest is used for new messages.
+type ConversationKey struct {
+	Version   int
+	PublicKey [32]byte
+}
+
 type KeyPairRepo interface {
+	ConversationKey(conversationID string) (ConversationKey, error)
 	ConversationPublicKey(conversationID string) ([32]byte, error)
 	UserPublicKey(userID string) ([32]byte, error)
 }
@@ -25,25 +33,26 @@ type PocketBaseKeyPairRepo struct {
 	app core.App
 }
 
-// ConversationPublicKey returns the public key for the given conversation.
-func (r *PocketBaseKeyPairRepo) ConversationPublicKey(
+// ConversationKey returns the newest version of the key for the given
+// conversation.
+func (r *PocketBaseKeyPairRepo) ConversationKey(
 	conversationID string,
-) ([32]byte, error) {
+) (ConversationKey, error) {
 	const collectionName = "conversation_public_keys"
 
 	records, err := r.app.Dao().FindRecordsByFilter(collectionName,
 		"conversation = {:conversation_id}", // filter
-		"-updated",                          // sort
+		"-version,-updated",                 // sort
 		1,                                   // limit
 		0,                                   // offset
 		dbx.Params{"conversation_id": conversationID}, // params
 	)
 	if err != nil {
-		return [32]byte{}, err
+		return ConversationKey{}, err
 	}
 
 	if len(records) == 0 {
-		return [32]byte{}, ErrNoKeyPair
+		return ConversationKey{}, ErrNoKeyPair
 	}
 
 	key_pair := records[0]
@@ -51,13 +60,21 @@ func (r *PocketBaseKeyPairRepo) ConversationPublicKey(
 
 	public_key_slice, err := base64.StdEncoding.DecodeString(public_key)
 	if err != nil {
-		return [32]byte{}, err
+		return ConversationKey{}, err
 	}
 
-	var public_key_bytes [32]byte
-	copy(public_key_bytes[:], public_key_slice)
+	key := ConversationKey{Version: key_pair.GetInt("version")}
+	copy(key.PublicKey[:], public_key_slice)
 
-	return public_key_bytes, nil
+	return key, nil
+}
+
+// ConversationPublicKey returns the public key for the given conversation.
+func (r *PocketBaseKeyPairRepo) ConversationPublicKey(
+	conversationID string,
+) ([32]byte, error) {
+	key, err := r.ConversationKey(conversationID)
+	return key.PublicKey, err
 }
 
 // UserPublicKey returns the public key for the given user.
@@ -8,6 +8,8 @@ import (
 type User struct {
 	ID      string
 	IsAdmin bool
+	// Plan decides the user's quotas, empty for the default plan
+	Plan string
 }
 
 // IsAdmin checks if the user authenticated in the given echo.Context is an admin.
@@ -39,10 +41,14 @@ func ExtractUser(c echo.Context) *User {
 	admin := info.Admin       // nil if not authenticated as admin
 	record := info.AuthRecord // nil if not authenticated as regular auth record
 
-	isAdmin := admin != nil
-
-	return &User{
-		ID:      record.Id,
-		IsAdmin: isAdmin,
+	user := &User{
+		IsAdmin: admin != nil,
+	}
+	// Admins aren't users so don't have an ID
+	if record != nil {
+		user.ID = record.Id
+		user.Plan = record.GetString("plan")
 	}
+
+	return user
 }
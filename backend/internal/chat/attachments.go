@@ -0,0 +1,219 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+const (
+	// MaxAttachmentSize is the largest file that can be attached, before it's
+	// encrypted
+	MaxAttachmentSize = 10 << 20
+	// attachmentOverhead is what the client's encryption adds to a file: the
+	// nonce and the secretbox overhead
+	attachmentOverhead = 24 + 16
+
+	attachmentsCollection = "attachments"
+)
+
+var (
+	ErrAttachmentNotFound = errors.New("attachment not found")
+	ErrAttachmentLinked   = errors.New("the attachment already belongs to a message")
+)
+
+// Attachment is a file attached to a conversation. The file is encrypted by
+// the client with a key of its own, which it keeps in the MessageAttachment of
+// the message the file is attached to, so the server only has the ciphertext.
+type Attachment struct {
+	ID             string `json:"id"`
+	ConversationID string `json:"conversation_id"`
+	// MessageID is empty until a message refers to the attachment
+	MessageID string `json:"message_id,omitempty"`
+	OwnerID   string `json:"owner_id"`
+	// Size of the encrypted file in bytes
+	Size    int            `json:"size"`
+	Created types.DateTime `json:"created"`
+}
+
+type AttachmentRepo interface {
+	// Upload saves an encrypted file to the conversation
+	Upload(conversationID, ownerID string, file *filesystem.File) (Attachment, error)
+	// Attachment returns an attachment of the conversation.
+	// Returns ErrAttachmentNotFound if it's not in the conversation.
+	Attachment(conversationID, attachmentID string) (Attachment, error)
+	// Open returns the encrypted file of an attachment of the conversation,
+	// which must be closed.
+	// Returns ErrAttachmentNotFound if it's not in the conversation.
+	Open(conversationID, attachmentID string) (io.ReadCloser, Attachment, error)
+	// LinkToMessage attaches uploaded files to a message, so they're deleted
+	// with it. Returns ErrAttachmentLinked if any of them already belong to
+	// a message.
+	LinkToMessage(conversationID, messageID string, attachmentIDs []string) error
+	// PurgeOrphaned deletes the attachments uploaded before a time that never
+	// made it into a message, returning how many were deleted
+	PurgeOrphaned(before time.Time) (int64, error)
+}
+
+type PocketBaseAttachmentRepo struct {
+	app core.App
+}
+
+func (r *PocketBaseAttachmentRepo) Upload(
+	conversationID, ownerID string,
+	file *filesystem.File,
+) (Attachment, error) {
+	collection, err := r.app.Dao().FindCollectionByNameOrId(attachmentsCollection)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	record := models.NewRecord(collection)
+	form := forms.NewRecordUpsert(r.app, record)
+	err = form.LoadData(map[string]any{
+		"conversation": conversationID,
+		"owner":        ownerID,
+		"size":         file.Size,
+	})
+	if err != nil {
+		return Attachment{}, err
+	}
+	if err := form.AddFiles("file", file); err != nil {
+		return Attachment{}, err
+	}
+	if err := form.Submit(); err != nil {
+		return Attachment{}, err
+	}
+
+	return newAttachment(record), nil
+}
+
+func (r *PocketBaseAttachmentRepo) Attachment(
+	conversationID, attachmentID string,
+) (Attachment, error) {
+	record, err := findAttachment(r.app.Dao(), conversationID, attachmentID)
+	if err != nil {
+		return Attachment{}, err
+	}
+
+	return newAttachment(record), nil
+}
+
+func (r *PocketBaseAttachmentRepo) Open(
+	conversationID, attachmentID string,
+) (io.ReadCloser, Attachment, error) {
+	record, err := findAttachment(r.app.Dao(), conversationID, attachmentID)
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+
+	fs, err := r.app.NewFilesystem()
+	if err != nil {
+		return nil, Attachment{}, err
+	}
+	file, err := fs.GetFile(record.BaseFilesPath() + "/" + record.GetString("file"))
+	if err != nil {
+		fs.Close()
+		return nil, Attachment{}, err
+	}
+
+	return &attachmentReader{ReadCloser: file, fs: fs}, newAttachment(record), nil
+}
+
+func (r *PocketBaseAttachmentRepo) LinkToMessage(
+	conversationID, messageID string,
+	attachmentIDs []string,
+) error {
+	return r.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		for _, attachmentID := range attachmentIDs {
+			record, err := findAttachment(txDao, conversationID, attachmentID)
+			if err != nil {
+				return err
+			}
+			if record.GetString("message") != "" {
+				return ErrAttachmentLinked
+			}
+
+			record.Set("message", messageID)
+			if err := txDao.SaveRecord(record); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (r *PocketBaseAttachmentRepo) PurgeOrphaned(before time.Time) (int64, error) {
+	records, err := r.app.Dao().FindRecordsByFilter(
+		attachmentsCollection,
+		"message = '' && created < {:before}",
+		"",
+		0,
+		0,
+		dbx.Params{"before": before.UTC().Format(types.DefaultDateLayout)},
+	)
+	if err != nil {
+		return 0, err
+	}
+
+	// Deleted one at a time so their files are deleted too
+	var purged int64
+	for _, record := range records {
+		if err := r.app.Dao().DeleteRecord(record); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+
+	return purged, nil
+}
+
+func findAttachment(dao *daos.Dao, conversationID, attachmentID string) (*models.Record, error) {
+	record, err := dao.FindFirstRecordByFilter(
+		attachmentsCollection,
+		"id = {:id} && conversation = {:conversation}",
+		dbx.Params{"id": attachmentID, "conversation": conversationID},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrAttachmentNotFound
+	}
+
+	return record, err
+}
+
+func newAttachment(record *models.Record) Attachment {
+	return Attachment{
+		ID:             record.Id,
+		ConversationID: record.GetString("conversation"),
+		MessageID:      record.GetString("message"),
+		OwnerID:        record.GetString("owner"),
+		Size:           record.GetInt("size"),
+		Created:        record.Created,
+	}
+}
+
+// attachmentReader closes the filesystem of the file along with it
+type attachmentReader struct {
+	io.ReadCloser
+	fs *filesystem.System
+}
+
+func (r *attachmentReader) Close() error {
+	return errors.Join(r.ReadCloser.Close(), r.fs.Close())
+}
+
+func NewPocketBaseAttachmentRepo(app core.App) *PocketBaseAttachmentRepo {
+	return &PocketBaseAttachmentRepo{
+		app: app,
+	}
+}
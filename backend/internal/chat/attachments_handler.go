@@ -0,0 +1,207 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/permissions"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/tools/filesystem"
+)
+
+// MaxAttachmentRequestSize is the largest upload request that should be read,
+// leaving room for the multipart headers around the file. PocketBase reads
+// the whole form when it first looks at the request, so the limit has to be
+// applied before anything else.
+const MaxAttachmentRequestSize = MaxAttachmentSize + attachmentOverhead + 64<<10
+
+// requireConversationWriter checks the user can add messages to the
+// conversation in the `conversation_id` path param and returns its ID
+func requireConversationWriter(
+	c echo.Context,
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+) (string, error) {
+	conversationID := c.PathParam("conversation_id")
+
+	canWrite, _, err := permissionsRepo.HasWritePermission(
+		apis.RequestInfo(c),
+		conversationID,
+	)
+	if err != nil {
+		return "", conversationLookupError(logger, err)
+	}
+	if !canWrite {
+		return "", apis.NewForbiddenError(
+			"You do not have permission to write to this conversation",
+			nil,
+		)
+	}
+
+	return conversationID, nil
+}
+
+// requireConversationViewer checks the user can read the conversation in the
+// `conversation_id` path param and returns its ID
+func requireConversationViewer(
+	c echo.Context,
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+) (string, error) {
+	conversationID := c.PathParam("conversation_id")
+
+	canView, _, err := permissionsRepo.HasViewPermission(
+		apis.RequestInfo(c),
+		conversationsCollection,
+		conversationID,
+	)
+	if err != nil {
+		return "", conversationLookupError(logger, err)
+	}
+	if !canView {
+		return "", apis.NewForbiddenError(
+			"You do not have permission to view this conversation",
+			nil,
+		)
+	}
+
+	return conversationID, nil
+}
+
+// conversationLookupError is returned when the permissions on a conversation
+// couldn't be checked. Only a missing conversation is a 404, anything else is
+// a server error and logged.
+func conversationLookupError(logger *slog.Logger, err error) error {
+	if errors.Is(err, sql.ErrNoRows) {
+		return apis.NewNotFoundError("Conversation not found or unable to load", err)
+	}
+
+	logger.Error("Failed to check conversation permissions", "err", err)
+	return apis.NewApiError(
+		http.StatusInternalServerError,
+		"Failed to check conversation permissions",
+		err,
+	)
+}
+
+// ValidateMessageAttachments checks the attachments a message refers to have
+// an ID, a name and a key to decrypt them with
+func ValidateMessageAttachments(attachments []MessageAttachment) error {
+	for _, attachment := range attachments {
+		if attachment.ID == "" || attachment.Name == "" {
+			return errors.New("every attachment needs an id and name")
+		}
+		key, err := base64.StdEncoding.DecodeString(attachment.Key)
+		if err != nil || len(key) != 32 {
+			return fmt.Errorf("the key of attachment %s must be 32 bytes encoded in base64", attachment.ID)
+		}
+	}
+
+	return nil
+}
+
+// UploadAttachmentEchoHandler saves a file encrypted by the client, sent as the
+// `file` field of a multipart form, to the conversation. It's attached to a
+// message by referring to it in the message, until then only its ID is known.
+func UploadAttachmentEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	attachmentRepo AttachmentRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationWriter(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+		owner := auth.ExtractUser(c)
+		if owner == nil {
+			return apis.NewUnauthorizedError("User not authenticated", nil)
+		}
+
+		tooLarge := apis.NewApiError(
+			http.StatusRequestEntityTooLarge,
+			fmt.Sprintf("The attachment must be at most %d bytes", MaxAttachmentSize),
+			nil,
+		)
+
+		header, err := c.FormFile("file")
+		if errors.Is(err, echo.ErrStatusRequestEntityTooLarge) {
+			return tooLarge
+		}
+		if err != nil {
+			return apis.NewBadRequestError(
+				"The attachment must be the file field of a multipart form",
+				err,
+			)
+		}
+		if header.Size > MaxAttachmentSize+attachmentOverhead {
+			return tooLarge
+		}
+		if header.Size <= attachmentOverhead {
+			return apis.NewBadRequestError("The attachment must be encrypted", nil)
+		}
+
+		file, err := filesystem.NewFileFromMultipart(header)
+		if err != nil {
+			return apis.NewBadRequestError("Failed to read the attachment", err)
+		}
+
+		attachment, err := attachmentRepo.Upload(conversationID, owner.ID, file)
+		if err != nil {
+			logger.Error("Failed to save attachment", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to save attachment",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusCreated, attachment)
+	}
+}
+
+// DownloadAttachmentEchoHandler returns the encrypted file of the attachment
+// in the `attachment_id` path param, for the client to decrypt.
+func DownloadAttachmentEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	attachmentRepo AttachmentRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationViewer(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		file, attachment, err := attachmentRepo.Open(
+			conversationID,
+			c.PathParam("attachment_id"),
+		)
+		if errors.Is(err, ErrAttachmentNotFound) {
+			return apis.NewNotFoundError(err.Error(), nil)
+		}
+		if err != nil {
+			logger.Error("Failed to open attachment", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to open attachment",
+				err,
+			)
+		}
+		defer file.Close()
+
+		header := c.Response().Header()
+		header.Set(echo.HeaderContentLength, strconv.Itoa(attachment.Size))
+		// The file never changes, and is only readable by the members
+		header.Set("Cache-Control", "private, max-age=31536000, immutable")
+
+		return c.Stream(http.StatusOK, "application/octet-stream", file)
+	}
+}
@@ -0,0 +1,79 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/permissions"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// failingPermissionsRepo can't check any permission
+type failingPermissionsRepo struct {
+	err error
+}
+
+func (r failingPermissionsRepo) HasViewPermission(
+	*models.RequestInfo,
+	string,
+	string,
+) (bool, *models.Record, error) {
+	return false, nil, r.err
+}
+
+func (r failingPermissionsRepo) HasWritePermission(
+	*models.RequestInfo,
+	string,
+) (bool, *models.Record, error) {
+	return false, nil, r.err
+}
+
+func (r failingPermissionsRepo) HasAdminPermission(
+	*models.RequestInfo,
+	string,
+) (bool, *models.Record, error) {
+	return false, nil, r.err
+}
+
+func TestRequireConversationPermissionErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		expected int
+	}{
+		{"missing conversation", sql.ErrNoRows, http.StatusNotFound},
+		{"database failure", errors.New("database is locked"), http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := echo.New().NewContext(
+				httptest.NewRequest(http.MethodPost, "/", nil),
+				httptest.NewRecorder(),
+			)
+			repo := failingPermissionsRepo{err: tt.err}
+
+			for _, require := range []func(
+				echo.Context,
+				*slog.Logger,
+				permissions.PermissionsRepo,
+			) (string, error){
+				requireConversationWriter,
+				requireConversationViewer,
+				requireConversationAdmin,
+			} {
+				_, err := require(c, slog.Default(), repo)
+				var apiErr *apis.ApiError
+				if !errors.As(err, &apiErr) || apiErr.Code != tt.expected {
+					t.Errorf("Expected a %d error, got %v", tt.expected, err)
+				}
+			}
+		})
+	}
+}
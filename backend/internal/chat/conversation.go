@@ -6,19 +6,24 @@ import (
 	"time"
 
 	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
+	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase/apis"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
 )
 
 type Conversation struct {
-	ID             string        `json:"id"`
-	PublicKey      [32]byte      `json:"public_key"`
+	ID        string   `json:"id"`
+	PublicKey [32]byte `json:"public_key"`
+	// KeyVersion is the version of the public key, see auth.ConversationKey
+	KeyVersion     int           `json:"key_version"`
 	ExpiryDuration time.Duration `json:"expiry_duration"`
 }
 
 type ConversationRepo interface {
-	ByID(id string) (Conversation, error)
+	// ByID returns a conversation by its ID, using the public key loaded into
+	// the echo.Context if there is one
+	ByID(c echo.Context, id string) (Conversation, error)
 	SetConversationUpdated(conversationID string) error
 }
 
@@ -42,7 +47,10 @@ func (r *PocketBaseConversationRepo) SetConversationUpdated(
 }
 
 // ByID returns a conversation by its ID.
-func (r *PocketBaseConversationRepo) ByID(id string) (Conversation, error) {
+func (r *PocketBaseConversationRepo) ByID(
+	c echo.Context,
+	id string,
+) (Conversation, error) {
 	conversation := Conversation{}
 
 	record, err := r.app.Dao().FindRecordById(r.collection.Name, id)
@@ -58,8 +66,15 @@ func (r *PocketBaseConversationRepo) ByID(id string) (Conversation, error) {
 	}
 	conversation.ExpiryDuration = duration
 
+	// Use the key preloaded by middleware.LoadKeyPair if we can
+	if key, ok := auth.ExtractConversationKey(c, conversation.ID); ok {
+		conversation.PublicKey = key.PublicKey
+		conversation.KeyVersion = key.Version
+		return conversation, nil
+	}
+
 	// Get the public key for the conversation
-	publicKey, err := r.keyPairRepo.ConversationPublicKey(conversation.ID)
+	key, err := r.keyPairRepo.ConversationKey(conversation.ID)
 	if errors.Is(err, auth.ErrNoKeyPair) {
 		return conversation, apis.NewNotFoundError(
 			"Conversation public key not found",
@@ -73,7 +88,8 @@ func (r *PocketBaseConversationRepo) ByID(id string) (Conversation, error) {
 			err,
 		)
 	}
-	conversation.PublicKey = publicKey
+	conversation.PublicKey = key.PublicKey
+	conversation.KeyVersion = key.Version
 
 	return conversation, nil
 }
@@ -0,0 +1,118 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+var ErrUnsupportedEnvelope = errors.New("unsupported message envelope")
+
+// Algorithm used to encrypt the data in an envelope
+type Algorithm string
+
+const (
+	// AlgorithmSealedBox is a NaCl sealed box, X25519 with XSalsa20-Poly1305,
+	// encrypted to the conversation public key
+	AlgorithmSealedBox Algorithm = "x25519-xsalsa20poly1305-sealedbox"
+)
+
+const (
+	// EnvelopeVersionLegacy is the bare base64 sealed box written before
+	// envelopes existed. It's only ever decoded.
+	EnvelopeVersionLegacy = 0
+	EnvelopeVersion1      = 1
+	// CurrentEnvelopeVersion is the version new messages are written with
+	CurrentEnvelopeVersion = EnvelopeVersion1
+)
+
+// envelopeAlgorithms are the algorithms each envelope version can carry. New
+// algorithms (e.g. hybrid post-quantum) are added to a new version so older
+// clients reject, rather than misread, messages they can't open.
+var envelopeAlgorithms = map[int][]Algorithm{
+	EnvelopeVersionLegacy: {AlgorithmSealedBox},
+	EnvelopeVersion1:      {AlgorithmSealedBox},
+}
+
+// Envelope wraps the encrypted data of a message with what's needed to decrypt
+// it. It's stored as JSON in the message `data` field e.g.
+//
+//	{"v":1,"alg":"x25519-xsalsa20poly1305-sealedbox","kid":2,"ct":"<base64>"}
+//
+// Legacy messages are a bare base64 sealed box, which can't start with `{`, so
+// both can be told apart and existing messages never need rewriting.
+type Envelope struct {
+	Version   int       `json:"v"`
+	Algorithm Algorithm `json:"alg"`
+	// KeyID is the version of the conversation key the data was encrypted with,
+	// 0 if unknown
+	KeyID      int    `json:"kid,omitempty"`
+	Ciphertext []byte `json:"ct"`
+}
+
+// Validate checks the envelope version and algorithm are supported
+func (e Envelope) Validate() error {
+	algorithms, ok := envelopeAlgorithms[e.Version]
+	if !ok {
+		return fmt.Errorf("%w: version %d", ErrUnsupportedEnvelope, e.Version)
+	}
+	if !slices.Contains(algorithms, e.Algorithm) {
+		return fmt.Errorf(
+			"%w: algorithm %q in version %d",
+			ErrUnsupportedEnvelope,
+			e.Algorithm,
+			e.Version,
+		)
+	}
+	if len(e.Ciphertext) == 0 {
+		return fmt.Errorf("%w: no ciphertext", ErrUnsupportedEnvelope)
+	}
+
+	return nil
+}
+
+// EncodeEnvelope encodes the envelope to be stored in a message record.
+// Legacy envelopes can't be encoded.
+func EncodeEnvelope(envelope Envelope) (string, error) {
+	if envelope.Version == EnvelopeVersionLegacy {
+		return "", fmt.Errorf("%w: legacy envelopes are read only", ErrUnsupportedEnvelope)
+	}
+	if err := envelope.Validate(); err != nil {
+		return "", err
+	}
+
+	encoded, err := json.Marshal(envelope)
+	return string(encoded), err
+}
+
+// DecodeEnvelope decodes the data of a message record, accepting both
+// envelopes and legacy bare sealed boxes.
+func DecodeEnvelope(data string) (Envelope, error) {
+	var envelope Envelope
+
+	if !strings.HasPrefix(data, "{") {
+		ciphertext, err := base64.StdEncoding.DecodeString(data)
+		if err != nil {
+			return envelope, fmt.Errorf("%w: %w", ErrUnsupportedEnvelope, err)
+		}
+		envelope = Envelope{
+			Version:    EnvelopeVersionLegacy,
+			Algorithm:  AlgorithmSealedBox,
+			Ciphertext: ciphertext,
+		}
+		return envelope, envelope.Validate()
+	}
+
+	if err := json.Unmarshal([]byte(data), &envelope); err != nil {
+		return envelope, fmt.Errorf("%w: %w", ErrUnsupportedEnvelope, err)
+	}
+	// Legacy data is never wrapped in an envelope
+	if envelope.Version == EnvelopeVersionLegacy {
+		return envelope, fmt.Errorf("%w: version %d", ErrUnsupportedEnvelope, envelope.Version)
+	}
+
+	return envelope, envelope.Validate()
+}
@@ -0,0 +1,226 @@
+package chat
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Fixed vectors, the secret key is the bytes 1 to 32 and the ciphertext is a
+// sealed box of testPlaintext to its public key
+const (
+	testSecretKey  = "AQIDBAUGBwgJCgsMDQ4PEBESExQVFhcYGRobHB0eHyA="
+	testPublicKey  = "B6N8vBQgk8i3VdwbEOhstCY3StFqqFPtC9/AsrhtHHw="
+	testCiphertext = "WJT7S6QlYZAoVuXXC1pf6o5TmYH1WlgVS17ePYvlg2hz064Byj0+UUuiCMyB/pC+VkDYw10gva5ijI83z19mPBtep16mommL1erxEqCX2opQOEhWNattF/mLfZILr08/XvwlswAAFg=="
+	testPlaintext  = `{"version":"1","content":"Ahoy","model_id":"test:echo"}`
+
+	testEnvelopeV1 = `{"v":1,"alg":"x25519-xsalsa20poly1305-sealedbox","kid":2,"ct":"` + testCiphertext + `"}`
+)
+
+func testKeys(t *testing.T) (publicKey, secretKey [32]byte) {
+	t.Helper()
+
+	for _, key := range []struct {
+		encoded string
+		dst     *[32]byte
+	}{{testPublicKey, &publicKey}, {testSecretKey, &secretKey}} {
+		decoded, err := base64.StdEncoding.DecodeString(key.encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		copy(key.dst[:], decoded)
+	}
+
+	return publicKey, secretKey
+}
+
+func TestEncodeEnvelope(t *testing.T) {
+	ciphertext, err := base64.StdEncoding.DecodeString(testCiphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		envelope Envelope
+		want     string
+		wantErr  error
+	}{
+		{
+			name: "version 1",
+			envelope: Envelope{
+				Version:    EnvelopeVersion1,
+				Algorithm:  AlgorithmSealedBox,
+				KeyID:      2,
+				Ciphertext: ciphertext,
+			},
+			want: testEnvelopeV1,
+		},
+		{
+			name: "unknown key",
+			envelope: Envelope{
+				Version:    EnvelopeVersion1,
+				Algorithm:  AlgorithmSealedBox,
+				Ciphertext: []byte{1, 2, 3},
+			},
+			want: `{"v":1,"alg":"x25519-xsalsa20poly1305-sealedbox","ct":"AQID"}`,
+		},
+		{
+			name: "legacy is read only",
+			envelope: Envelope{
+				Version:    EnvelopeVersionLegacy,
+				Algorithm:  AlgorithmSealedBox,
+				Ciphertext: ciphertext,
+			},
+			wantErr: ErrUnsupportedEnvelope,
+		},
+		{
+			name: "unknown version",
+			envelope: Envelope{
+				Version:    99,
+				Algorithm:  AlgorithmSealedBox,
+				Ciphertext: ciphertext,
+			},
+			wantErr: ErrUnsupportedEnvelope,
+		},
+		{
+			name: "unknown algorithm",
+			envelope: Envelope{
+				Version:    EnvelopeVersion1,
+				Algorithm:  "rot13",
+				Ciphertext: ciphertext,
+			},
+			wantErr: ErrUnsupportedEnvelope,
+		},
+		{
+			name: "no ciphertext",
+			envelope: Envelope{
+				Version:   EnvelopeVersion1,
+				Algorithm: AlgorithmSealedBox,
+			},
+			wantErr: ErrUnsupportedEnvelope,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := EncodeEnvelope(tt.envelope)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("EncodeEnvelope() error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("EncodeEnvelope() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeEnvelope(t *testing.T) {
+	publicKey, secretKey := testKeys(t)
+
+	tests := []struct {
+		name        string
+		data        string
+		wantVersion int
+		wantKeyID   int
+		wantErr     error
+	}{
+		{
+			name:        "legacy sealed box",
+			data:        testCiphertext,
+			wantVersion: EnvelopeVersionLegacy,
+		},
+		{
+			name:        "version 1",
+			data:        testEnvelopeV1,
+			wantVersion: EnvelopeVersion1,
+			wantKeyID:   2,
+		},
+		{
+			name:    "not base64",
+			data:    "not encrypted",
+			wantErr: ErrUnsupportedEnvelope,
+		},
+		{
+			name:    "invalid JSON",
+			data:    `{"v":1,`,
+			wantErr: ErrUnsupportedEnvelope,
+		},
+		{
+			name:    "legacy in an envelope",
+			data:    `{"v":0,"alg":"x25519-xsalsa20poly1305-sealedbox","ct":"AQID"}`,
+			wantErr: ErrUnsupportedEnvelope,
+		},
+		{
+			name:    "future version",
+			data:    `{"v":2,"alg":"x25519-mlkem768-hybrid","kid":3,"ct":"AQID"}`,
+			wantErr: ErrUnsupportedEnvelope,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			envelope, err := DecodeEnvelope(tt.data)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("DecodeEnvelope() error = %v, want %v", err, tt.wantErr)
+			}
+			if tt.wantErr != nil {
+				return
+			}
+
+			if envelope.Version != tt.wantVersion {
+				t.Errorf("Version = %d, want %d", envelope.Version, tt.wantVersion)
+			}
+			if envelope.Algorithm != AlgorithmSealedBox {
+				t.Errorf("Algorithm = %s, want %s", envelope.Algorithm, AlgorithmSealedBox)
+			}
+			if envelope.KeyID != tt.wantKeyID {
+				t.Errorf("KeyID = %d, want %d", envelope.KeyID, tt.wantKeyID)
+			}
+
+			plaintext, ok := box.OpenAnonymous(nil, envelope.Ciphertext, &publicKey, &secretKey)
+			if !ok {
+				t.Fatal("Failed to open the sealed box")
+			}
+			if string(plaintext) != testPlaintext {
+				t.Errorf("Plaintext = %s, want %s", plaintext, testPlaintext)
+			}
+		})
+	}
+}
+
+func TestEncryptMessageData(t *testing.T) {
+	publicKey, secretKey := testKeys(t)
+
+	encoded, err := EncryptMessageData(
+		MessageRecordData{Content: "Ahoy", ModelID: "test:echo"},
+		publicKey,
+		2,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envelope, err := DecodeEnvelope(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Version != CurrentEnvelopeVersion || envelope.KeyID != 2 {
+		t.Errorf("Expected a version %d envelope for key 2, got %+v", CurrentEnvelopeVersion, envelope)
+	}
+
+	plaintext, ok := box.OpenAnonymous(nil, envelope.Ciphertext, &publicKey, &secretKey)
+	if !ok {
+		t.Fatal("Failed to open the sealed box")
+	}
+	var message MessageRecordData
+	if err := json.Unmarshal(plaintext, &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Version != CurrentMessageDataVersion || message.Content != "Ahoy" {
+		t.Errorf("Unexpected message %+v", message)
+	}
+}
@@ -1,5 +1,11 @@
 package chat
 
+import oai "github.com/sashabaranov/go-openai"
+
+// CurrentMessageDataVersion is the version of MessageRecordData written by the
+// backend, it's independent of the Envelope version
+const CurrentMessageDataVersion = "1"
+
 // MessageRecordData represents the data of a message record.
 // Ensure this matches the interface in the frontend.
 type MessageRecordData struct {
@@ -10,4 +16,34 @@ type MessageRecordData struct {
 	OwnerID string `json:"owner_id,omitempty"`
 	AgentID string `json:"agent_id,omitempty"`
 	ModelID string `json:"model_id,omitempty"`
+	// ToolCalls the agent made to the built-in tools run by the backend, the
+	// results are each in a message with their ToolCallID
+	ToolCalls  []oai.ToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+	// Images sent with the message, the data URLs are kept as is so the image
+	// is encrypted with the message
+	Images []MessageImage `json:"images,omitempty"`
+	// Attachments of the message, see Attachment
+	Attachments []MessageAttachment `json:"attachments,omitempty"`
+}
+
+// MessageImage is an image sent with a message, either a base64 data URL or
+// a link to the image
+type MessageImage struct {
+	URL    string `json:"url"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// MessageAttachment refers to an encrypted file attached to the conversation.
+// The key of the file is kept here, so it's encrypted with the message and
+// re-encrypted with it when the conversation key is rotated.
+type MessageAttachment struct {
+	// ID of the Attachment
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	MediaType string `json:"media_type,omitempty"`
+	// Size of the file in bytes, before it was encrypted
+	Size int `json:"size,omitempty"`
+	// Key the file was encrypted with, 32 bytes encoded in base64
+	Key string `json:"key"`
 }
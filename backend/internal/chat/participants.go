@@ -0,0 +1,371 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/permissions"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+var (
+	ErrAlreadyParticipant = errors.New("the user is already a participant of the conversation")
+	ErrNotParticipant     = errors.New("the user isn't a participant of the conversation")
+	ErrStaleKeyVersion    = errors.New("the conversation key has been rotated since it was wrapped")
+	ErrMemberKeysMismatch = errors.New("the new key must be wrapped for every remaining member exactly once")
+)
+
+// Participant is a member of a conversation. The creator is a member without a
+// participant record and can always manage the conversation.
+type Participant struct {
+	UserID  string           `json:"user_id"`
+	Role    permissions.Role `json:"role"`
+	Creator bool             `json:"creator,omitempty"`
+	// PublicKey of the user, used to wrap the conversation secret key for them
+	PublicKey string `json:"public_key"`
+}
+
+// WrappedKey is the conversation secret key wrapped for a member. It's sealed
+// with the key shared between the conversation secret key and the member's
+// public key, prefixed with its nonce, so the member opens it with their
+// secret key and the conversation public key.
+type WrappedKey struct {
+	UserID    string `json:"user_id"`
+	SecretKey string `json:"secret_key"`
+}
+
+type ParticipantRepo interface {
+	// Members returns the creator and the participants of the conversation
+	Members(conversationID string) ([]Participant, error)
+	// Invite adds a participant with the conversation secret key wrapped for
+	// them. Returns ErrStaleKeyVersion if keyVersion isn't the newest version
+	// of the conversation key, and auth.ErrNoKeyPair if the user has no key
+	// pair to wrap it with.
+	Invite(
+		conversationID string,
+		role permissions.Role,
+		secretKey WrappedKey,
+		keyVersion int,
+	) (Participant, error)
+	// SetRole changes the role of a participant
+	SetRole(conversationID, userID string, role permissions.Role) (Participant, error)
+	// Revoke removes a participant and their secret keys, and rotates the
+	// conversation key to publicKey so they can't read new messages. The new
+	// secret key must be wrapped for every remaining member. A rotation in
+	// progress is superseded by the new one.
+	Revoke(
+		conversationID, userID, publicKey string,
+		secretKeys []WrappedKey,
+	) (KeyRotation, error)
+}
+
+type PocketBaseParticipantRepo struct {
+	app         core.App
+	keyPairRepo auth.KeyPairRepo
+}
+
+const (
+	participantsCollection           = "participants"
+	conversationsCollection          = "conversations"
+	conversationSecretKeysCollection = "conversation_secret_keys"
+)
+
+func (r *PocketBaseParticipantRepo) Members(conversationID string) ([]Participant, error) {
+	conversation, err := r.app.Dao().FindRecordById(conversationsCollection, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	records, err := r.app.Dao().FindRecordsByFilter(participantsCollection,
+		"conversation = {:conversation_id}", // filter
+		"created",                           // sort
+		0,                                   // limit
+		0,                                   // offset
+		dbx.Params{"conversation_id": conversationID}, // params
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []Participant{{
+		UserID:  conversation.GetString("creator"),
+		Role:    permissions.RoleAdmin,
+		Creator: true,
+	}}
+	for _, record := range records {
+		members = append(members, newParticipant(record))
+	}
+
+	for i, member := range members {
+		publicKey, err := r.keyPairRepo.UserPublicKey(member.UserID)
+		if errors.Is(err, auth.ErrNoKeyPair) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		members[i].PublicKey = base64.StdEncoding.EncodeToString(publicKey[:])
+	}
+
+	return members, nil
+}
+
+func (r *PocketBaseParticipantRepo) Invite(
+	conversationID string,
+	role permissions.Role,
+	secretKey WrappedKey,
+	keyVersion int,
+) (Participant, error) {
+	var participant Participant
+
+	publicKey, err := r.keyPairRepo.UserPublicKey(secretKey.UserID)
+	if err != nil {
+		return participant, err
+	}
+
+	err = r.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		isMember, err := isMember(txDao, conversationID, secretKey.UserID)
+		if err != nil {
+			return err
+		}
+		if isMember {
+			return ErrAlreadyParticipant
+		}
+
+		latest, err := LatestKeyVersion(txDao.DB(), conversationID)
+		if err != nil {
+			return err
+		}
+		if latest != keyVersion {
+			return ErrStaleKeyVersion
+		}
+
+		collection, err := txDao.FindCollectionByNameOrId(participantsCollection)
+		if err != nil {
+			return err
+		}
+		record := models.NewRecord(collection)
+		record.Set("conversation", conversationID)
+		record.Set("user", secretKey.UserID)
+		record.Set("role", string(role))
+		if err := txDao.SaveRecord(record); err != nil {
+			return err
+		}
+
+		if err := saveWrappedKey(txDao, conversationID, secretKey, keyVersion); err != nil {
+			return err
+		}
+
+		participant = newParticipant(record)
+		participant.PublicKey = base64.StdEncoding.EncodeToString(publicKey[:])
+		return nil
+	})
+
+	return participant, err
+}
+
+func (r *PocketBaseParticipantRepo) SetRole(
+	conversationID, userID string,
+	role permissions.Role,
+) (Participant, error) {
+	record, err := findParticipant(r.app.Dao(), conversationID, userID)
+	if err != nil {
+		return Participant{}, err
+	}
+
+	record.Set("role", string(role))
+	if err := r.app.Dao().SaveRecord(record); err != nil {
+		return Participant{}, err
+	}
+
+	participant := newParticipant(record)
+	publicKey, err := r.keyPairRepo.UserPublicKey(userID)
+	if err == nil {
+		participant.PublicKey = base64.StdEncoding.EncodeToString(publicKey[:])
+	}
+
+	return participant, nil
+}
+
+func (r *PocketBaseParticipantRepo) Revoke(
+	conversationID, userID, publicKey string,
+	secretKeys []WrappedKey,
+) (KeyRotation, error) {
+	var rotation KeyRotation
+
+	err := r.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		participant, err := findParticipant(txDao, conversationID, userID)
+		if err != nil {
+			return err
+		}
+
+		// Every remaining member needs the new key, and only them
+		members, err := memberIDs(txDao, conversationID)
+		if err != nil {
+			return err
+		}
+		delete(members, userID)
+		if err := checkMemberKeys(members, secretKeys); err != nil {
+			return err
+		}
+
+		// The revoked participant mustn't read new messages, so revoking
+		// can't wait for an earlier rotation to be finished
+		rotation, err = rotateKey(txDao, conversationID, publicKey, true)
+		if err != nil {
+			return err
+		}
+
+		if err := txDao.DeleteRecord(participant); err != nil {
+			return err
+		}
+		revokedKeys, err := txDao.FindRecordsByFilter(conversationSecretKeysCollection,
+			"conversation = {:conversation_id} && user = {:user_id}", // filter
+			"", // sort
+			0,  // limit
+			0,  // offset
+			dbx.Params{"conversation_id": conversationID, "user_id": userID}, // params
+		)
+		if err != nil {
+			return err
+		}
+		for _, record := range revokedKeys {
+			if err := txDao.DeleteRecord(record); err != nil {
+				return err
+			}
+		}
+
+		return saveWrappedKeys(txDao, conversationID, secretKeys, rotation.KeyVersion)
+	})
+
+	return rotation, err
+}
+
+// findParticipant finds the participant record of the user, returning
+// ErrNotParticipant if there isn't one
+func findParticipant(dao *daos.Dao, conversationID, userID string) (*models.Record, error) {
+	record, err := dao.FindFirstRecordByFilter(
+		participantsCollection,
+		"conversation = {:conversation_id} && user = {:user_id}",
+		dbx.Params{"conversation_id": conversationID, "user_id": userID},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotParticipant
+	}
+
+	return record, err
+}
+
+// isMember checks if the user is the creator or a participant of the
+// conversation
+func isMember(dao *daos.Dao, conversationID, userID string) (bool, error) {
+	members, err := memberIDs(dao, conversationID)
+	if err != nil {
+		return false, err
+	}
+
+	_, ok := members[userID]
+	return ok, nil
+}
+
+// memberIDs returns the IDs of the creator and participants of the
+// conversation
+func memberIDs(dao *daos.Dao, conversationID string) (map[string]struct{}, error) {
+	conversation, err := dao.FindRecordById(conversationsCollection, conversationID)
+	if err != nil {
+		return nil, err
+	}
+
+	participants, err := dao.FindRecordsByExpr(
+		participantsCollection,
+		dbx.HashExp{"conversation": conversationID},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	members := map[string]struct{}{conversation.GetString("creator"): {}}
+	for _, participant := range participants {
+		members[participant.GetString("user")] = struct{}{}
+	}
+
+	return members, nil
+}
+
+// checkMemberKeys returns ErrMemberKeysMismatch unless there's exactly one
+// wrapped key for each of the members
+func checkMemberKeys(members map[string]struct{}, secretKeys []WrappedKey) error {
+	if len(secretKeys) != len(members) {
+		return ErrMemberKeysMismatch
+	}
+
+	wrapped := map[string]struct{}{}
+	for _, secretKey := range secretKeys {
+		if _, ok := members[secretKey.UserID]; !ok {
+			return ErrMemberKeysMismatch
+		}
+		if _, ok := wrapped[secretKey.UserID]; ok {
+			return ErrMemberKeysMismatch
+		}
+		wrapped[secretKey.UserID] = struct{}{}
+	}
+
+	return nil
+}
+
+func saveWrappedKeys(
+	dao *daos.Dao,
+	conversationID string,
+	secretKeys []WrappedKey,
+	keyVersion int,
+) error {
+	for _, secretKey := range secretKeys {
+		if err := saveWrappedKey(dao, conversationID, secretKey, keyVersion); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func saveWrappedKey(
+	dao *daos.Dao,
+	conversationID string,
+	secretKey WrappedKey,
+	keyVersion int,
+) error {
+	collection, err := dao.FindCollectionByNameOrId(conversationSecretKeysCollection)
+	if err != nil {
+		return err
+	}
+
+	record := models.NewRecord(collection)
+	record.Set("conversation", conversationID)
+	record.Set("user", secretKey.UserID)
+	record.Set("secret_key", secretKey.SecretKey)
+	record.Set("key_version", keyVersion)
+
+	return dao.SaveRecord(record)
+}
+
+func newParticipant(record *models.Record) Participant {
+	return Participant{
+		UserID: record.GetString("user"),
+		Role:   permissions.Role(record.GetString("role")),
+	}
+}
+
+func NewPocketBaseParticipantRepo(
+	app core.App,
+	keyPairRepo auth.KeyPairRepo,
+) *PocketBaseParticipantRepo {
+	return &PocketBaseParticipantRepo{
+		app:         app,
+		keyPairRepo: keyPairRepo,
+	}
+}
@@ -0,0 +1,239 @@
+package chat
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/permissions"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// wrappedKeySize is the size of a wrapped conversation secret key: the nonce,
+// the secretbox overhead and the 32 byte key
+const wrappedKeySize = 24 + 16 + 32
+
+var roles = []permissions.Role{
+	permissions.RoleViewer,
+	permissions.RoleEditor,
+	permissions.RoleAdmin,
+}
+
+// Participants is the response of the participants endpoint
+type Participants struct {
+	Object string        `json:"object"`
+	Data   []Participant `json:"data"`
+}
+
+func validateRole(role permissions.Role) error {
+	if !slices.Contains(roles, role) {
+		return apis.NewBadRequestError("The role must be Viewer, Editor or Admin", nil)
+	}
+
+	return nil
+}
+
+func validateWrappedKey(secretKey WrappedKey) error {
+	if secretKey.UserID == "" {
+		return apis.NewBadRequestError("Every secret key needs a user_id", nil)
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(secretKey.SecretKey)
+	if err != nil || len(wrapped) != wrappedKeySize {
+		return apis.NewBadRequestError(
+			"The secret key must be a wrapped 32 byte key encoded in base64",
+			err,
+		)
+	}
+
+	return nil
+}
+
+// ParticipantsEchoHandler lists the members of the conversation with their
+// roles and public keys, so the conversation key can be wrapped for them.
+func ParticipantsEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	participantRepo ParticipantRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationAdmin(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		members, err := participantRepo.Members(conversationID)
+		if err != nil {
+			logger.Error("Failed to load participants", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to load participants",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusOK, Participants{Object: "list", Data: members})
+	}
+}
+
+// InviteParticipantEchoHandler adds a participant to the conversation with a
+// role. The client wraps the current conversation secret key for the invitee
+// as only it has the key.
+func InviteParticipantEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	participantRepo ParticipantRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationAdmin(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		var body struct {
+			WrappedKey
+			Role permissions.Role `json:"role"`
+			// KeyVersion is the version of the conversation key which was wrapped
+			KeyVersion int `json:"key_version"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("Failed to read request data", err)
+		}
+		if err := validateRole(body.Role); err != nil {
+			return err
+		}
+		if err := validateWrappedKey(body.WrappedKey); err != nil {
+			return err
+		}
+
+		participant, err := participantRepo.Invite(
+			conversationID,
+			body.Role,
+			body.WrappedKey,
+			body.KeyVersion,
+		)
+		if errors.Is(err, auth.ErrNoKeyPair) {
+			return apis.NewBadRequestError("The user has no key pair", nil)
+		}
+		if errors.Is(err, ErrAlreadyParticipant) || errors.Is(err, ErrStaleKeyVersion) {
+			return apis.NewApiError(http.StatusConflict, err.Error(), nil)
+		}
+		if err != nil {
+			logger.Error("Failed to invite participant", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to invite participant",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusCreated, participant)
+	}
+}
+
+// UpdateParticipantEchoHandler changes the role of the participant in the
+// `user_id` path param.
+func UpdateParticipantEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	participantRepo ParticipantRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationAdmin(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		var body struct {
+			Role permissions.Role `json:"role"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("Failed to read request data", err)
+		}
+		if err := validateRole(body.Role); err != nil {
+			return err
+		}
+
+		participant, err := participantRepo.SetRole(
+			conversationID,
+			c.PathParam("user_id"),
+			body.Role,
+		)
+		if errors.Is(err, ErrNotParticipant) {
+			return apis.NewNotFoundError(err.Error(), nil)
+		}
+		if err != nil {
+			logger.Error("Failed to update participant", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to update participant",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusOK, participant)
+	}
+}
+
+// RevokeParticipantEchoHandler removes the participant in the `user_id` path
+// param and rotates the conversation key. The client generates the new key,
+// sends its `public_key` and wraps the secret key for every remaining member,
+// then re-encrypts the older messages as with RotateKeyEchoHandler.
+func RevokeParticipantEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	participantRepo ParticipantRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationAdmin(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		var body struct {
+			PublicKey  string       `json:"public_key"`
+			SecretKeys []WrappedKey `json:"secret_keys"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("Failed to read request data", err)
+		}
+		publicKey, err := base64.StdEncoding.DecodeString(body.PublicKey)
+		if err != nil || len(publicKey) != 32 {
+			return apis.NewBadRequestError(
+				"The public key must be 32 bytes encoded in base64",
+				err,
+			)
+		}
+		for _, secretKey := range body.SecretKeys {
+			if err := validateWrappedKey(secretKey); err != nil {
+				return err
+			}
+		}
+
+		rotation, err := participantRepo.Revoke(
+			conversationID,
+			c.PathParam("user_id"),
+			body.PublicKey,
+			body.SecretKeys,
+		)
+		if errors.Is(err, ErrNotParticipant) {
+			return apis.NewNotFoundError(err.Error(), nil)
+		}
+		if errors.Is(err, ErrMemberKeysMismatch) {
+			return apis.NewBadRequestError(err.Error(), nil)
+		}
+		if err != nil {
+			logger.Error("Failed to revoke participant", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to revoke participant",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusCreated, rotation)
+	}
+}
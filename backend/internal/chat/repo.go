@@ -2,7 +2,6 @@ package chat
 
 import (
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
 	"time"
 
@@ -14,14 +13,19 @@ import (
 	"github.com/pocketbase/pocketbase/tools/list"
 )
 
-// EncryptMessageData encrypts a plain text message using symmetric and asymmetric encryption.
-// It takes the plain text message and the receiver's public key as input parameters.
-// The function returns the base64 encoded encrypted message and the base64 encoded encrypted symmetric key.
+// EncryptMessageData encrypts a plain text message to the conversation key.
+// It takes the message and the receiver's public key, and its version, as input parameters.
+// The function returns the encrypted message wrapped in an Envelope, ready to be stored.
 // If an error occurs during the encryption process, it returns an empty string and the error.
 func EncryptMessageData(
 	message MessageRecordData,
 	receiverPublicKey [32]byte,
-) (base64EncryptedMessage string, err error) {
+	keyVersion int,
+) (encodedEnvelope string, err error) {
+	if message.Version == "" {
+		message.Version = CurrentMessageDataVersion
+	}
+
 	// Turn our message into bytes of the JSON representation
 	messageBytes, err := json.Marshal(message)
 	if err != nil {
@@ -37,9 +41,12 @@ func EncryptMessageData(
 		return
 	}
 
-	// Return the base64 encoded encrypted message
-	base64EncryptedMessage = base64.StdEncoding.EncodeToString(cipherText)
-	return
+	return EncodeEnvelope(Envelope{
+		Version:    CurrentEnvelopeVersion,
+		Algorithm:  AlgorithmSealedBox,
+		KeyID:      keyVersion,
+		Ciphertext: cipherText,
+	})
 }
 
 type MessageRepo interface {
@@ -65,20 +72,25 @@ func (r *PocketBaseMessageRepo) EncryptAndPersistMessage(
 	parentMessageID string,
 	message MessageRecordData,
 ) (error, *models.Record) {
-	base64EncryptedMessage, err := EncryptMessageData(
+	encryptedMessage, err := EncryptMessageData(
 		message,
 		conversation.PublicKey,
+		conversation.KeyVersion,
 	)
 	if err != nil {
 		return err, nil
 	}
 
 	formData := map[string]any{
-		"data":           base64EncryptedMessage,
+		"data":           encryptedMessage,
 		"conversation":   conversation.ID,
 		"parent_message": parentMessageID,
 	}
 
+	if conversation.KeyVersion != 0 {
+		formData["key_version"] = conversation.KeyVersion
+	}
+
 	if conversation.ExpiryDuration != 0 {
 		formData["expires"] = time.Now().UTC().Add(conversation.ExpiryDuration)
 	}
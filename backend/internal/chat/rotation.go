@@ -0,0 +1,359 @@
+package chat
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+var (
+	ErrRotationInProgress = errors.New("the conversation key is already being rotated")
+	ErrNoRotation         = errors.New("the conversation key isn't being rotated")
+	ErrWrongKeyVersion    = errors.New("the message isn't sealed with the key being rotated to")
+)
+
+type KeyRotationStatus string
+
+const (
+	KeyRotationInProgress KeyRotationStatus = "in_progress"
+	KeyRotationCompleted  KeyRotationStatus = "completed"
+	// KeyRotationSuperseded is a rotation replaced by a newer one before it
+	// was completed, which re-encrypts the messages it had left
+	KeyRotationSuperseded KeyRotationStatus = "superseded"
+)
+
+// KeyRotation tracks the re-encryption of the messages of a conversation with a
+// new version of its key. Only clients hold the secret keys so they do the
+// re-encryption, in batches, and can resume where they left off.
+type KeyRotation struct {
+	ID             string            `json:"id"`
+	ConversationID string            `json:"conversation_id"`
+	KeyVersion     int               `json:"key_version"`
+	Status         KeyRotationStatus `json:"status"`
+	Reencrypted    int               `json:"reencrypted"`
+	// Remaining is the number of messages still sealed with an older key
+	Remaining int `json:"remaining"`
+}
+
+// SealedMessage is the encrypted data of a message and the version of the
+// conversation key it was sealed with
+type SealedMessage struct {
+	ID         string `json:"id"`
+	Data       string `json:"data"`
+	KeyVersion int    `json:"key_version,omitempty"`
+}
+
+type KeyRotationRepo interface {
+	// RotateKey adds a new version of the conversation key, which is used for
+	// new messages, and starts a rotation to re-encrypt the older messages.
+	// The new secret key must be wrapped for every member, or
+	// ErrMemberKeysMismatch is returned. Returns ErrRotationInProgress if the
+	// previous rotation isn't finished.
+	RotateKey(
+		conversationID, publicKey string,
+		secretKeys []WrappedKey,
+	) (KeyRotation, error)
+	// CurrentRotation returns the latest rotation of the conversation.
+	// Returns ErrNoRotation if the key has never been rotated.
+	CurrentRotation(conversationID string) (KeyRotation, error)
+	// PendingMessages returns the next messages that are sealed with an older
+	// version of the key than the current rotation.
+	PendingMessages(conversationID string, limit int) ([]SealedMessage, error)
+	// SaveReencrypted replaces the data of messages which have been re-encrypted
+	// with the new key, completing the rotation once there are none left.
+	// Messages that aren't pending are ignored so batches can be retried.
+	// Returns ErrWrongKeyVersion if a message envelope isn't for the new key.
+	SaveReencrypted(conversationID string, messages []SealedMessage) (KeyRotation, error)
+}
+
+type PocketBaseKeyRotationRepo struct {
+	app core.App
+}
+
+const (
+	keyRotationsCollection     = "key_rotations"
+	conversationKeysCollection = "conversation_public_keys"
+	messagesCollection         = "messages"
+)
+
+func (r *PocketBaseKeyRotationRepo) RotateKey(
+	conversationID, publicKey string,
+	secretKeys []WrappedKey,
+) (KeyRotation, error) {
+	var rotation KeyRotation
+
+	err := r.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		// Every member needs the new key to read the messages sealed with it
+		members, err := memberIDs(txDao, conversationID)
+		if err != nil {
+			return err
+		}
+		if err := checkMemberKeys(members, secretKeys); err != nil {
+			return err
+		}
+
+		rotation, err = rotateKey(txDao, conversationID, publicKey, false)
+		if err != nil {
+			return err
+		}
+
+		return saveWrappedKeys(txDao, conversationID, secretKeys, rotation.KeyVersion)
+	})
+
+	return rotation, err
+}
+
+func (r *PocketBaseKeyRotationRepo) CurrentRotation(
+	conversationID string,
+) (KeyRotation, error) {
+	record, err := latestRotation(r.app.Dao(), conversationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return KeyRotation{}, ErrNoRotation
+	}
+	if err != nil {
+		return KeyRotation{}, err
+	}
+
+	remaining, err := countPending(r.app.Dao(), conversationID, record.GetInt("key_version"))
+	if err != nil {
+		return KeyRotation{}, err
+	}
+
+	return newKeyRotation(record, remaining), nil
+}
+
+func (r *PocketBaseKeyRotationRepo) PendingMessages(
+	conversationID string,
+	limit int,
+) ([]SealedMessage, error) {
+	rotation, err := latestRotation(r.app.Dao(), conversationID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNoRotation
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	messages := []SealedMessage{}
+	err = r.app.Dao().DB().
+		Select("id", "data", "COALESCE([[key_version]], 0) AS key_version").
+		From(messagesCollection).
+		Where(pendingExp(conversationID, rotation.GetInt("key_version"))).
+		OrderBy("created ASC", "id ASC").
+		Limit(int64(limit)).
+		All(&messages)
+
+	return messages, err
+}
+
+func (r *PocketBaseKeyRotationRepo) SaveReencrypted(
+	conversationID string,
+	messages []SealedMessage,
+) (KeyRotation, error) {
+	var rotation KeyRotation
+
+	err := r.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		record, err := latestRotation(txDao, conversationID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoRotation
+		}
+		if err != nil {
+			return err
+		}
+		keyVersion := record.GetInt("key_version")
+
+		// Data sealed with another key, e.g. by a client that missed a newer
+		// rotation, couldn't be opened once marked as re-encrypted
+		for _, message := range messages {
+			envelope, err := DecodeEnvelope(message.Data)
+			if err != nil {
+				return err
+			}
+			if envelope.KeyID != keyVersion {
+				return fmt.Errorf("%w: message %s", ErrWrongKeyVersion, message.ID)
+			}
+		}
+
+		reencrypted := 0
+		for _, message := range messages {
+			result, err := txDao.DB().
+				Update(
+					messagesCollection,
+					dbx.Params{
+						"data":        message.Data,
+						"key_version": keyVersion,
+						"updated":     types.NowDateTime().String(),
+					},
+					dbx.And(
+						dbx.HashExp{"id": message.ID},
+						pendingExp(conversationID, keyVersion),
+					),
+				).
+				Execute()
+			if err != nil {
+				return err
+			}
+			updated, err := result.RowsAffected()
+			if err != nil {
+				return err
+			}
+			reencrypted += int(updated)
+		}
+
+		remaining, err := countPending(txDao, conversationID, keyVersion)
+		if err != nil {
+			return err
+		}
+
+		record.Set("reencrypted", record.GetInt("reencrypted")+reencrypted)
+		if remaining == 0 {
+			record.Set("status", string(KeyRotationCompleted))
+		}
+		if err := txDao.SaveRecord(record); err != nil {
+			return err
+		}
+
+		rotation = newKeyRotation(record, remaining)
+		return nil
+	})
+
+	return rotation, err
+}
+
+// rotateKey adds the new version of the key and starts its rotation within a
+// transaction, so other changes such as revoking a participant can be made
+// with it. An unfinished rotation is marked as superseded if supersede is set,
+// the new rotation re-encrypts every message sealed with an older key so
+// it picks up the messages it had left.
+func rotateKey(
+	txDao *daos.Dao,
+	conversationID, publicKey string,
+	supersede bool,
+) (KeyRotation, error) {
+	latest, err := latestRotation(txDao, conversationID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return KeyRotation{}, err
+	}
+	if latest != nil &&
+		KeyRotationStatus(latest.GetString("status")) == KeyRotationInProgress {
+		if !supersede {
+			return KeyRotation{}, ErrRotationInProgress
+		}
+
+		latest.Set("status", string(KeyRotationSuperseded))
+		if err := txDao.SaveRecord(latest); err != nil {
+			return KeyRotation{}, err
+		}
+	}
+
+	keysCollection, err := txDao.FindCollectionByNameOrId(conversationKeysCollection)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	key := models.NewRecord(keysCollection)
+	key.Set("conversation", conversationID)
+	key.Set("public_key", publicKey)
+	// The version is assigned by hooks.ConversationKeyVersion
+	if err := txDao.SaveRecord(key); err != nil {
+		return KeyRotation{}, err
+	}
+
+	rotationsCollection, err := txDao.FindCollectionByNameOrId(keyRotationsCollection)
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	record := models.NewRecord(rotationsCollection)
+	record.Set("conversation", conversationID)
+	record.Set("key_version", key.GetInt("version"))
+	record.Set("status", string(KeyRotationInProgress))
+	record.Set("reencrypted", 0)
+
+	remaining, err := countPending(txDao, conversationID, key.GetInt("version"))
+	if err != nil {
+		return KeyRotation{}, err
+	}
+	if remaining == 0 {
+		record.Set("status", string(KeyRotationCompleted))
+	}
+	if err := txDao.SaveRecord(record); err != nil {
+		return KeyRotation{}, err
+	}
+
+	return newKeyRotation(record, remaining), nil
+}
+
+// LatestKeyVersion returns the version of the newest public key of the
+// conversation, or 0 if it has none
+func LatestKeyVersion(db dbx.Builder, conversationID string) (int, error) {
+	latest := 0
+	err := db.
+		Select("COALESCE(MAX([[version]]), 0)").
+		From(conversationKeysCollection).
+		Where(dbx.HashExp{"conversation": conversationID}).
+		Row(&latest)
+
+	return latest, err
+}
+
+// latestRotation finds the newest rotation of the conversation
+func latestRotation(dao *daos.Dao, conversationID string) (*models.Record, error) {
+	records, err := dao.FindRecordsByFilter(keyRotationsCollection,
+		"conversation = {:conversation_id}", // filter
+		"-key_version",                      // sort
+		1,                                   // limit
+		0,                                   // offset
+		dbx.Params{"conversation_id": conversationID}, // params
+	)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, sql.ErrNoRows
+	}
+
+	return records[0], nil
+}
+
+// pendingExp matches the messages of the conversation sealed with an older
+// version of the key
+func pendingExp(conversationID string, keyVersion int) dbx.Expression {
+	return dbx.And(
+		dbx.HashExp{"conversation": conversationID},
+		dbx.NewExp(
+			"COALESCE([[key_version]], 0) < {:key_version}",
+			dbx.Params{"key_version": keyVersion},
+		),
+	)
+}
+
+func countPending(dao *daos.Dao, conversationID string, keyVersion int) (int, error) {
+	count := 0
+	err := dao.DB().
+		Select("COUNT(*)").
+		From(messagesCollection).
+		Where(pendingExp(conversationID, keyVersion)).
+		Row(&count)
+
+	return count, err
+}
+
+func newKeyRotation(record *models.Record, remaining int) KeyRotation {
+	return KeyRotation{
+		ID:             record.Id,
+		ConversationID: record.GetString("conversation"),
+		KeyVersion:     record.GetInt("key_version"),
+		Status:         KeyRotationStatus(record.GetString("status")),
+		Reencrypted:    record.GetInt("reencrypted"),
+		Remaining:      remaining,
+	}
+}
+
+func NewPocketBaseKeyRotationRepo(app core.App) *PocketBaseKeyRotationRepo {
+	return &PocketBaseKeyRotationRepo{app: app}
+}
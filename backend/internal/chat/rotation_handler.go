@@ -0,0 +1,228 @@
+package chat
+
+import (
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/permissions"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+const (
+	defaultReencryptBatchSize = 50
+	maxReencryptBatchSize     = 200
+)
+
+// PendingMessages is the response of the pending messages endpoint
+type PendingMessages struct {
+	Object string          `json:"object"`
+	Data   []SealedMessage `json:"data"`
+}
+
+// requireConversationAdmin checks the user can manage the conversation in the
+// `conversation_id` path param and returns its ID
+func requireConversationAdmin(
+	c echo.Context,
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+) (string, error) {
+	conversationID := c.PathParam("conversation_id")
+
+	canManage, _, err := permissionsRepo.HasAdminPermission(
+		apis.RequestInfo(c),
+		conversationID,
+	)
+	if err != nil {
+		return "", conversationLookupError(logger, err)
+	}
+	if !canManage {
+		return "", apis.NewForbiddenError(
+			"You do not have permission to manage this conversation",
+			nil,
+		)
+	}
+
+	return conversationID, nil
+}
+
+// RotateKeyEchoHandler adds a new version of the conversation key from the
+// `public_key` in the request body, with its secret key wrapped for every
+// member in `secret_keys`. New messages are sealed with it straight away and
+// the client re-encrypts the older ones, see ReencryptEchoHandler.
+func RotateKeyEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	rotationRepo KeyRotationRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationAdmin(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		var body struct {
+			PublicKey  string       `json:"public_key"`
+			SecretKeys []WrappedKey `json:"secret_keys"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("Failed to read request data", err)
+		}
+		publicKey, err := base64.StdEncoding.DecodeString(body.PublicKey)
+		if err != nil || len(publicKey) != 32 {
+			return apis.NewBadRequestError(
+				"The public key must be 32 bytes encoded in base64",
+				err,
+			)
+		}
+		for _, secretKey := range body.SecretKeys {
+			if err := validateWrappedKey(secretKey); err != nil {
+				return err
+			}
+		}
+
+		rotation, err := rotationRepo.RotateKey(
+			conversationID,
+			body.PublicKey,
+			body.SecretKeys,
+		)
+		if errors.Is(err, ErrRotationInProgress) {
+			return apis.NewApiError(http.StatusConflict, err.Error(), nil)
+		}
+		if errors.Is(err, ErrMemberKeysMismatch) {
+			return apis.NewBadRequestError(err.Error(), nil)
+		}
+		if err != nil {
+			logger.Error("Failed to rotate conversation key", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to rotate conversation key",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusCreated, rotation)
+	}
+}
+
+// KeyRotationEchoHandler returns the progress of the latest key rotation of the
+// conversation.
+func KeyRotationEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	rotationRepo KeyRotationRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationAdmin(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		rotation, err := rotationRepo.CurrentRotation(conversationID)
+		if errors.Is(err, ErrNoRotation) {
+			return apis.NewNotFoundError(err.Error(), nil)
+		}
+		if err != nil {
+			logger.Error("Failed to load key rotation", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to load key rotation",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusOK, rotation)
+	}
+}
+
+// PendingMessagesEchoHandler returns the next batch of messages, up to the
+// `limit` query param, which still need to be re-encrypted with the new key.
+func PendingMessagesEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	rotationRepo KeyRotationRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationAdmin(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		limit := defaultReencryptBatchSize
+		if param := c.QueryParam("limit"); param != "" {
+			limit, err = strconv.Atoi(param)
+			if err != nil || limit < 1 || limit > maxReencryptBatchSize {
+				return apis.NewBadRequestError("Invalid limit", err)
+			}
+		}
+
+		messages, err := rotationRepo.PendingMessages(conversationID, limit)
+		if errors.Is(err, ErrNoRotation) {
+			return apis.NewNotFoundError(err.Error(), nil)
+		}
+		if err != nil {
+			logger.Error("Failed to load pending messages", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to load pending messages",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusOK, PendingMessages{Object: "list", Data: messages})
+	}
+}
+
+// ReencryptEchoHandler saves a batch of messages re-encrypted with the new key
+// and returns the progress of the rotation.
+func ReencryptEchoHandler(
+	logger *slog.Logger,
+	permissionsRepo permissions.PermissionsRepo,
+	rotationRepo KeyRotationRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		conversationID, err := requireConversationAdmin(c, logger, permissionsRepo)
+		if err != nil {
+			return err
+		}
+
+		var body struct {
+			Messages []SealedMessage `json:"messages"`
+		}
+		if err := c.Bind(&body); err != nil {
+			return apis.NewBadRequestError("Failed to read request data", err)
+		}
+		if len(body.Messages) > maxReencryptBatchSize {
+			return apis.NewBadRequestError("Too many messages in the batch", nil)
+		}
+		for _, message := range body.Messages {
+			if message.ID == "" || message.Data == "" {
+				return apis.NewBadRequestError("Every message needs an id and data", nil)
+			}
+			if _, err := DecodeEnvelope(message.Data); err != nil {
+				return apis.NewBadRequestError("Invalid message data", err)
+			}
+		}
+
+		rotation, err := rotationRepo.SaveReencrypted(conversationID, body.Messages)
+		if errors.Is(err, ErrNoRotation) {
+			return apis.NewNotFoundError(err.Error(), nil)
+		}
+		if errors.Is(err, ErrWrongKeyVersion) {
+			return apis.NewBadRequestError(err.Error(), nil)
+		}
+		if err != nil {
+			logger.Error("Failed to save re-encrypted messages", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to save re-encrypted messages",
+				err,
+			)
+		}
+
+		return c.JSON(http.StatusOK, rotation)
+	}
+}
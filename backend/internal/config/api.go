@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"time"
 
 	"github.com/knadh/koanf/parsers/yaml"
 	"github.com/knadh/koanf/providers/env"
@@ -36,6 +37,115 @@ type APIConfig struct {
 	// DeepInfra
 	DeepInfraAPIURL string `koanf:"deepinfra.url"`
 	DeepInfraAPIKey string `koanf:"deepinfra.api_key"`
+	// Additional OpenAI compatible providers keyed by provider name
+	// e.g. `groq` or `together`
+	Providers map[string]OpenAICompatibleProviderConfig `koanf:"-"`
+	// Token quotas keyed by plan name e.g. `free` or `pro`. Users without a
+	// plan, or with an unknown plan, get the `default` plan.
+	Quotas map[string]QuotaConfig `koanf:"-"`
+	// Prices of the models keyed by provider name
+	Pricing map[string][]ModelPricingConfig `koanf:"-"`
+	// Rate limits keyed by route name e.g. `completions` and then plan name
+	RateLimits map[string]map[string]RateLimitConfig `koanf:"-"`
+	// TrustedProxies are the IP ranges (CIDR) of the reverse proxies in front
+	// of the API, which set the `X-Forwarded-For` header of requests
+	TrustedProxies []string `koanf:"trusted_proxies"`
+}
+
+// DefaultPlan is the plan used for users without one
+const DefaultPlan = "default"
+
+// QuotaConfig limits the number of tokens, prompt and completion, a user can
+// use. Zero means unlimited.
+type QuotaConfig struct {
+	DailyTokens   int `koanf:"daily_tokens"`
+	MonthlyTokens int `koanf:"monthly_tokens"`
+}
+
+// ModelPricingConfig is the price of a model in USD per million tokens.
+// Like ModelMappingConfig this is a list so model names can contain `.`
+type ModelPricingConfig struct {
+	Model      string  `koanf:"model"`
+	Prompt     float64 `koanf:"prompt"`
+	Completion float64 `koanf:"completion"`
+}
+
+// Price returns the price of the provider's model, false if it hasn't been
+// priced.
+func (c *APIConfig) Price(provider, model string) (ModelPricingConfig, bool) {
+	for _, price := range c.Pricing[provider] {
+		if price.Model == model {
+			return price, true
+		}
+	}
+	return ModelPricingConfig{}, false
+}
+
+// RateLimitConfig allows a number of requests per fixed window of time.
+// Zero requests means unlimited.
+type RateLimitConfig struct {
+	Requests int           `koanf:"requests"`
+	Window   time.Duration `koanf:"window"`
+}
+
+// DefaultRateLimit is used for routes without a configured rate limit
+var DefaultRateLimit = RateLimitConfig{Requests: 60, Window: time.Hour}
+
+// RateLimit returns the rate limit of the route for the given plan, falling
+// back to the default plan and then DefaultRateLimit.
+func (c *APIConfig) RateLimit(route, plan string) RateLimitConfig {
+	limits, ok := c.RateLimits[route]
+	if !ok {
+		return DefaultRateLimit
+	}
+	if limit, ok := limits[plan]; ok {
+		return limit
+	}
+	if limit, ok := limits[DefaultPlan]; ok {
+		return limit
+	}
+	return DefaultRateLimit
+}
+
+// LongestRateLimitWindow returns the longest window of any rate limit, a
+// window which started longer ago than this has ended for every limit.
+func (c *APIConfig) LongestRateLimitWindow() time.Duration {
+	longest := DefaultRateLimit.Window
+	for _, limits := range c.RateLimits {
+		for _, limit := range limits {
+			longest = max(longest, limit.Window)
+		}
+	}
+	return longest
+}
+
+// Quota returns the quota of the given plan, falling back to the default plan.
+// Unlimited if neither are configured.
+func (c *APIConfig) Quota(plan string) QuotaConfig {
+	if quota, ok := c.Quotas[plan]; ok {
+		return quota
+	}
+	return c.Quotas[DefaultPlan]
+}
+
+// OpenAICompatibleProviderConfig declares an upstream provider which implements
+// the OpenAI chat completions API.
+type OpenAICompatibleProviderConfig struct {
+	URL    string               `koanf:"url"`
+	APIKey string               `koanf:"api_key"`
+	Models []ModelMappingConfig `koanf:"models"`
+	// StreamUsage asks the provider for the token usage of streams with
+	// `stream_options`, which not every provider accepts. Without it the
+	// usage of a stream is estimated.
+	StreamUsage bool `koanf:"stream_usage"`
+}
+
+// ModelMappingConfig maps our internal model name to the upstream model name.
+// This is a list rather than a map as model names often contain the `.`
+// delimiter which koanf would split into nested keys.
+type ModelMappingConfig struct {
+	Name     string `koanf:"name"`
+	Upstream string `koanf:"upstream"`
 }
 
 // MustLoadAPIConfig loads the API configuration or panics if an error occurs.
@@ -77,5 +187,46 @@ func MustLoadAPIConfig(logger *slog.Logger) *APIConfig {
 	if err != nil {
 		panic(err)
 	}
+
+	// Providers are nested so can't be unpacked with flat paths
+	err = k.UnmarshalWithConf(
+		"providers",
+		&c.Providers,
+		koanf.UnmarshalConf{Tag: "koanf"},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	// Same for quotas
+	err = k.UnmarshalWithConf(
+		"quotas",
+		&c.Quotas,
+		koanf.UnmarshalConf{Tag: "koanf"},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	// And pricing
+	err = k.UnmarshalWithConf(
+		"pricing",
+		&c.Pricing,
+		koanf.UnmarshalConf{Tag: "koanf"},
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	// And rate limits
+	err = k.UnmarshalWithConf(
+		"rate_limits",
+		&c.RateLimits,
+		koanf.UnmarshalConf{Tag: "koanf"},
+	)
+	if err != nil {
+		panic(err)
+	}
+
 	return &c
 }
@@ -0,0 +1,82 @@
+package crypto
+
+import (
+	"errors"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// The server never decrypts user data, these are the counterparts of the
+// encrypt functions for tests and tooling that act as a client.
+
+var ErrDecryptionFailed = errors.New("failed to decrypt the ciphertext")
+
+const nonceSize = 24
+
+// AsymmetricDecrypt opens a sealed box created by AsymmetricEncrypt using the
+// recipient's key pair.
+func AsymmetricDecrypt(
+	recipientPublicKey [32]byte,
+	recipientSecretKey [32]byte,
+	ciphertext []byte,
+) (message []byte, err error) {
+	message, ok := box.OpenAnonymous(
+		[]byte{},
+		ciphertext,
+		&recipientPublicKey,
+		&recipientSecretKey,
+	)
+	if !ok {
+		return nil, ErrDecryptionFailed
+	}
+
+	return message, nil
+}
+
+// SymmetricDecrypt opens a NaCl secretbox which is prefixed with its nonce, as
+// created by SymmetricEncrypt. This is also how the clients wrap the user
+// secret key with their vault password key.
+func SymmetricDecrypt(
+	symmetricKey [32]byte,
+	ciphertext []byte,
+) (message []byte, err error) {
+	if len(ciphertext) < nonceSize+secretbox.Overhead {
+		return nil, ErrDecryptionFailed
+	}
+
+	var nonce [nonceSize]byte
+	copy(nonce[:], ciphertext[:nonceSize])
+
+	message, ok := secretbox.Open([]byte{}, ciphertext[nonceSize:], &nonce, &symmetricKey)
+	if !ok {
+		return nil, ErrDecryptionFailed
+	}
+
+	return message, nil
+}
+
+// SharedKey precomputes the key shared by a public key and a secret key. The
+// clients wrap the conversation secret key for a user in a box with the shared
+// key of the conversation public key and the user secret key, which is opened
+// with SymmetricDecrypt.
+func SharedKey(publicKey [32]byte, secretKey [32]byte) (sharedKey [32]byte) {
+	box.Precompute(&sharedKey, &publicKey, &secretKey)
+	return sharedKey
+}
+
+// OpenSecretKey decrypts a wrapped secret key, e.g. a user secret key wrapped
+// with their vault password key or a conversation secret key wrapped with a
+// shared key.
+func OpenSecretKey(key [32]byte, wrappedSecretKey []byte) (secretKey [32]byte, err error) {
+	decrypted, err := SymmetricDecrypt(key, wrappedSecretKey)
+	if err != nil {
+		return secretKey, err
+	}
+	if len(decrypted) != len(secretKey) {
+		return secretKey, ErrDecryptionFailed
+	}
+
+	copy(secretKey[:], decrypted)
+	return secretKey, nil
+}
@@ -0,0 +1,120 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+func TestAsymmetricDecrypt(t *testing.T) {
+	publicKey, secretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message := []byte("Ahoy")
+
+	ciphertext, err := AsymmetricEncrypt(*publicKey, message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := AsymmetricDecrypt(*publicKey, *secretKey, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, message) {
+		t.Errorf("AsymmetricDecrypt() = %s, want %s", decrypted, message)
+	}
+
+	// Another key pair can't open it
+	otherPublicKey, otherSecretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = AsymmetricDecrypt(*otherPublicKey, *otherSecretKey, ciphertext)
+	if !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed with another key pair, got %v", err)
+	}
+}
+
+func TestSymmetricDecrypt(t *testing.T) {
+	message := []byte("Ahoy")
+
+	symmetricKey, ciphertext, err := SymmetricEncrypt(message)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decrypted, err := SymmetricDecrypt(symmetricKey, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decrypted, message) {
+		t.Errorf("SymmetricDecrypt() = %s, want %s", decrypted, message)
+	}
+
+	tampered := bytes.Clone(ciphertext)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name       string
+		key        [32]byte
+		ciphertext []byte
+	}{
+		{name: "wrong key", key: [32]byte{1}, ciphertext: ciphertext},
+		{name: "tampered", key: symmetricKey, ciphertext: tampered},
+		{name: "too short", key: symmetricKey, ciphertext: ciphertext[:nonceSize]},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := SymmetricDecrypt(tt.key, tt.ciphertext)
+			if !errors.Is(err, ErrDecryptionFailed) {
+				t.Errorf("Expected ErrDecryptionFailed, got %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenSecretKey(t *testing.T) {
+	userPublicKey, userSecretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conversationPublicKey, conversationSecretKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The conversation secret key is wrapped the same way as the clients, in a
+	// box with the shared key of the conversation and the user
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sharedKey [32]byte
+	box.Precompute(&sharedKey, conversationPublicKey, userSecretKey)
+	wrapped := box.SealAfterPrecomputation(nonce[:], conversationSecretKey[:], &nonce, &sharedKey)
+
+	opened, err := OpenSecretKey(SharedKey(*conversationPublicKey, *userSecretKey), wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != *conversationSecretKey {
+		t.Error("Expected the conversation secret key to be opened")
+	}
+
+	// Only a 32 byte key can be opened
+	nonce, err = NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	notAKey := secretbox.Seal(nonce[:], userPublicKey[:16], &nonce, &sharedKey)
+	if _, err := OpenSecretKey(sharedKey, notAKey); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed for a short key, got %v", err)
+	}
+}
@@ -0,0 +1,148 @@
+package crypto
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+var ErrInvalidKDFParams = errors.New("invalid KDF parameters")
+
+// KDFAlgorithm is the key derivation function used to turn a vault password
+// into the key that wraps a user secret key
+type KDFAlgorithm string
+
+const (
+	KDFArgon2id KDFAlgorithm = "argon2id"
+)
+
+// KDFSaltSize is the size of the random salts generated for new key pairs
+const KDFSaltSize = 16
+
+// Minimum cost of the KDF, using the OWASP recommendations for Argon2id
+// https://cheatsheetseries.owasp.org/cheatsheets/Password_Storage_Cheat_Sheet.html
+const (
+	MinKDFIterations = 2
+	MinKDFMemory     = 19 * 1024 // KiB
+	MinKDFThreads    = 1
+)
+
+// Maximum cost of the KDF, so a client can't be made to derive a key with
+// parameters it can't afford
+const (
+	MaxKDFIterations = 16
+	MaxKDFMemory     = 1024 * 1024 // KiB
+	MaxKDFThreads    = 16
+)
+
+// KDFParams are the parameters used to derive the vault password key. They're
+// stored with the wrapped secret key so they can change over time.
+type KDFParams struct {
+	Algorithm  KDFAlgorithm
+	Salt       []byte
+	Iterations uint32
+	// Memory in KiB
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultKDFParams returns the parameters new key pairs are wrapped with and
+// a new random salt
+func DefaultKDFParams() (KDFParams, error) {
+	salt := make([]byte, KDFSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return KDFParams{}, err
+	}
+
+	return KDFParams{
+		Algorithm:  KDFArgon2id,
+		Salt:       salt,
+		Iterations: MinKDFIterations,
+		Memory:     MinKDFMemory,
+		Threads:    MinKDFThreads,
+	}, nil
+}
+
+// LegacyKDFParams returns the parameters of key pairs which were wrapped
+// before they were stored, the salt is the user email address
+func LegacyKDFParams(email string) KDFParams {
+	return KDFParams{
+		Algorithm:  KDFArgon2id,
+		Salt:       []byte(email),
+		Iterations: MinKDFIterations,
+		Memory:     MinKDFMemory,
+		Threads:    MinKDFThreads,
+	}
+}
+
+// Validate checks the parameters are supported and within the allowed cost
+func (p KDFParams) Validate() error {
+	if p.Algorithm != KDFArgon2id {
+		return fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidKDFParams, p.Algorithm)
+	}
+	// Legacy salts aren't random so only new salts are checked for their size
+	if len(p.Salt) == 0 {
+		return fmt.Errorf("%w: a salt is required", ErrInvalidKDFParams)
+	}
+	if p.Iterations < MinKDFIterations || p.Iterations > MaxKDFIterations {
+		return fmt.Errorf(
+			"%w: iterations must be between %d and %d",
+			ErrInvalidKDFParams,
+			MinKDFIterations,
+			MaxKDFIterations,
+		)
+	}
+	if p.Memory < MinKDFMemory || p.Memory > MaxKDFMemory {
+		return fmt.Errorf(
+			"%w: memory must be between %d and %d KiB",
+			ErrInvalidKDFParams,
+			MinKDFMemory,
+			MaxKDFMemory,
+		)
+	}
+	if p.Threads < MinKDFThreads || p.Threads > MaxKDFThreads {
+		return fmt.Errorf(
+			"%w: threads must be between %d and %d",
+			ErrInvalidKDFParams,
+			MinKDFThreads,
+			MaxKDFThreads,
+		)
+	}
+
+	return nil
+}
+
+// DeriveKey derives the key that wraps a user secret key from their vault
+// password.
+func (p KDFParams) DeriveKey(password string) (key [32]byte, err error) {
+	if err := p.Validate(); err != nil {
+		return key, err
+	}
+
+	derived := argon2.IDKey(
+		[]byte(password),
+		p.Salt,
+		p.Iterations,
+		p.Memory,
+		p.Threads,
+		uint32(len(key)),
+	)
+	copy(key[:], derived)
+
+	return key, nil
+}
+
+// WrapSecretKey encrypts a secret key with a key derived from a vault password
+// in a NaCl secretbox prefixed with its nonce. It's opened with OpenSecretKey.
+func WrapSecretKey(key [32]byte, secretKey [32]byte) ([]byte, error) {
+	nonce, err := NewNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	return secretbox.Seal(nonce[:], secretKey[:], &nonce, &key), nil
+}
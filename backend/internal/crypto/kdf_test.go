@@ -0,0 +1,94 @@
+package crypto
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestKDFParamsValidate(t *testing.T) {
+	valid := LegacyKDFParams("test1@example.com")
+
+	tests := []struct {
+		name    string
+		modify  func(p *KDFParams)
+		wantErr bool
+	}{
+		{name: "valid", modify: func(p *KDFParams) {}},
+		{name: "unknown algorithm", modify: func(p *KDFParams) { p.Algorithm = "scrypt" }, wantErr: true},
+		{name: "no salt", modify: func(p *KDFParams) { p.Salt = nil }, wantErr: true},
+		{name: "too few iterations", modify: func(p *KDFParams) { p.Iterations = 1 }, wantErr: true},
+		{name: "too many iterations", modify: func(p *KDFParams) { p.Iterations = MaxKDFIterations + 1 }, wantErr: true},
+		{name: "too little memory", modify: func(p *KDFParams) { p.Memory = 1024 }, wantErr: true},
+		{name: "too much memory", modify: func(p *KDFParams) { p.Memory = MaxKDFMemory + 1 }, wantErr: true},
+		{name: "no threads", modify: func(p *KDFParams) { p.Threads = 0 }, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			params := valid
+			tt.modify(&params)
+
+			err := params.Validate()
+			if tt.wantErr != errors.Is(err, ErrInvalidKDFParams) {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDefaultKDFParams(t *testing.T) {
+	first, err := DefaultKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := DefaultKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := first.Validate(); err != nil {
+		t.Errorf("Expected the default parameters to be valid, got %v", err)
+	}
+	if len(first.Salt) != KDFSaltSize || bytes.Equal(first.Salt, second.Salt) {
+		t.Error("Expected a new random salt each time")
+	}
+}
+
+func TestWrapSecretKey(t *testing.T) {
+	params, err := DefaultKDFParams()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := params.DeriveKey("vault password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretKey, err := NewSymmetricKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wrapped, err := WrapSecretKey(key, secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, err := OpenSecretKey(key, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != secretKey {
+		t.Error("Expected the secret key to be opened")
+	}
+
+	// The same password with another salt derives another key
+	params.Salt[0] ^= 1
+	otherKey, err := params.DeriveKey("vault password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSecretKey(otherKey, wrapped); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed with another salt, got %v", err)
+	}
+}
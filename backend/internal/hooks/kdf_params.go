@@ -0,0 +1,103 @@
+package hooks
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/crypto"
+	"github.com/pocketbase/pocketbase/apis"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+var errMissingKDFParams = errors.New(
+	"kdf_algorithm, kdf_salt, kdf_iterations, kdf_memory and kdf_threads are required",
+)
+
+// UserKeyPairKDFParams validates the KDF parameters stored with a wrapped user
+// secret key. New key pairs must have a random salt, legacy key pairs without
+// parameters are upgraded by re-wrapping the secret key, which needs a new salt
+// and can't lower the cost.
+func UserKeyPairKDFParams(app core.App) {
+	app.OnRecordBeforeCreateRequest("user_key_pairs").Add(func(e *core.RecordCreateEvent) error {
+		if _, err := recordKDFParams(e.Record); err != nil {
+			return invalidKDFParamsError(err)
+		}
+		return nil
+	})
+
+	app.OnRecordBeforeUpdateRequest("user_key_pairs").Add(func(e *core.RecordUpdateEvent) error {
+		params, err := recordKDFParams(e.Record)
+		if err != nil {
+			return invalidKDFParamsError(err)
+		}
+
+		original := e.Record.OriginalCopy()
+		if original.GetString("kdf_salt") == "" {
+			// Upgrading a legacy key pair
+			return nil
+		}
+		if original.GetString("kdf_salt") == e.Record.GetString("kdf_salt") {
+			return invalidKDFParamsError(
+				errors.New("the secret key must be re-wrapped with a new salt"),
+			)
+		}
+		if params.Iterations < uint32(original.GetInt("kdf_iterations")) ||
+			params.Memory < uint32(original.GetInt("kdf_memory")) ||
+			params.Threads < uint8(original.GetInt("kdf_threads")) {
+			return invalidKDFParamsError(errors.New("the cost can't be lowered"))
+		}
+
+		return nil
+	})
+}
+
+// recordKDFParams returns the KDF parameters of a user key pair record if
+// they're all set and valid
+func recordKDFParams(record *models.Record) (crypto.KDFParams, error) {
+	for _, field := range []string{
+		"kdf_algorithm",
+		"kdf_salt",
+		"kdf_iterations",
+		"kdf_memory",
+		"kdf_threads",
+	} {
+		if record.GetString(field) == "" || record.GetString(field) == "0" {
+			return crypto.KDFParams{}, errMissingKDFParams
+		}
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(record.GetString("kdf_salt"))
+	if err != nil {
+		return crypto.KDFParams{}, err
+	}
+	if len(salt) < crypto.KDFSaltSize {
+		return crypto.KDFParams{}, fmt.Errorf(
+			"the salt must be at least %d random bytes",
+			crypto.KDFSaltSize,
+		)
+	}
+
+	params := crypto.KDFParams{
+		Algorithm:  crypto.KDFAlgorithm(record.GetString("kdf_algorithm")),
+		Salt:       salt,
+		Iterations: uint32(record.GetInt("kdf_iterations")),
+		Memory:     uint32(record.GetInt("kdf_memory")),
+		Threads:    uint8(record.GetInt("kdf_threads")),
+	}
+	// Out of range values wrap around when converted
+	if int(params.Threads) != record.GetInt("kdf_threads") ||
+		int(params.Memory) != record.GetInt("kdf_memory") ||
+		int(params.Iterations) != record.GetInt("kdf_iterations") {
+		return params, fmt.Errorf("%w: out of range", crypto.ErrInvalidKDFParams)
+	}
+
+	return params, params.Validate()
+}
+
+func invalidKDFParamsError(err error) error {
+	message := strings.TrimPrefix(err.Error(), crypto.ErrInvalidKDFParams.Error()+": ")
+	return apis.NewBadRequestError(fmt.Sprintf("Invalid KDF parameters: %s.", message), nil)
+}
@@ -0,0 +1,44 @@
+package hooks
+
+import (
+	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// ConversationKeyVersion numbers the keys of each conversation so messages can
+// record which key they were sealed with. The first key is version 1 and every
+// rotation adds one. Secret keys wrapped for a participant are given the
+// version of the newest public key unless it's set.
+func ConversationKeyVersion(app core.App) {
+	app.OnModelBeforeCreate("conversation_public_keys").Add(func(e *core.ModelEvent) error {
+		record := e.Model.(*models.Record)
+		if record.GetInt("version") != 0 {
+			return nil
+		}
+
+		latest, err := chat.LatestKeyVersion(e.Dao.DB(), record.GetString("conversation"))
+		if err != nil {
+			return err
+		}
+
+		record.Set("version", latest+1)
+		return nil
+	})
+
+	app.OnModelBeforeCreate("conversation_secret_keys").Add(func(e *core.ModelEvent) error {
+		record := e.Model.(*models.Record)
+		if record.GetInt("key_version") != 0 {
+			return nil
+		}
+
+		latest, err := chat.LatestKeyVersion(e.Dao.DB(), record.GetString("conversation"))
+		if err != nil {
+			return err
+		}
+
+		// Keys created before the conversation has a public key are version 1
+		record.Set("key_version", max(latest, 1))
+		return nil
+	})
+}
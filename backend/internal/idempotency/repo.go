@@ -1,12 +1,39 @@
 package idempotency
 
 import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
 	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/core"
-	"github.com/pocketbase/pocketbase/forms"
+	"github.com/pocketbase/pocketbase/daos"
 	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/types"
 )
 
+// ErrRequestInFlight is returned when a request with the same idempotency key
+// is still being processed
+var ErrRequestInFlight = errors.New("request with the same idempotency key is in progress")
+
+// ErrRequestMismatch is returned when the idempotency key was used by a
+// request with a different body
+var ErrRequestMismatch = errors.New("idempotency key was used by a different request")
+
+// InFlightLease is how long a request keeps its idempotency key reserved. A
+// key still in flight after this was left by a request that never finished,
+// e.g. because the server stopped, so it can be reserved again.
+const InFlightLease = 10 * time.Minute
+
+// Response is the saved response of an idempotent request
+type Response struct {
+	StatusCode int
+	Headers    http.Header
+	Body       []byte
+}
+
 // IdempotencyRepo keeps track of idempotent requests to avoid duplicate processing.
 // It works by storing the response of a request and the status code in a database
 // for a given user and idempotency key. When a new request comes in with the same
@@ -15,73 +42,139 @@ import (
 // This matches similar functionality in the Stripe API:
 // https://docs.stripe.com/api/idempotent_requests
 type IdempotencyRepo interface {
-	SaveIdempotentRequest(
-		userID, idempotencyKey string,
-		statusCode int,
-		responseBodyJSON []byte,
-	) error
-	CheckForIdempotentRequest(
-		userID, idempotencyKey string,
-	) (ok bool, statusCode int, responseBodyJSON []byte)
+	// Reserve claims the idempotency key for a new request with the given
+	// hash of its body. If the key has already been used it returns the saved
+	// response instead, ErrRequestMismatch if it was used by a request with a
+	// different hash, or ErrRequestInFlight if the first request hasn't
+	// finished yet and is within its InFlightLease.
+	Reserve(userID, idempotencyKey, requestHash string) (*Response, error)
+	// SaveResponse saves the response of the request that reserved the key
+	SaveResponse(userID, idempotencyKey string, response Response) error
+	// Release frees the key without saving a response so the request can be
+	// retried e.g. when it failed
+	Release(userID, idempotencyKey string) error
+	// PurgeExpired deletes the keys reserved before the given time
+	PurgeExpired(before time.Time) (int64, error)
 }
 
 type PocketBaseIdempotencyRepo struct {
 	app core.App
 }
 
-func (r *PocketBaseIdempotencyRepo) SaveIdempotentRequest(
+const collectionName = "idempotency"
+
+func (r *PocketBaseIdempotencyRepo) findRecord(
+	dao *daos.Dao,
 	userID, idempotencyKey string,
-	statusCode int,
-	responseBodyJSON []byte,
+) (*models.Record, error) {
+	return dao.FindFirstRecordByFilter(collectionName,
+		"user = {:user_id} && idempotency_key = {:idempotency_key}",
+		dbx.Params{"user_id": userID, "idempotency_key": idempotencyKey},
+	)
+}
+
+func (r *PocketBaseIdempotencyRepo) Reserve(
+	userID, idempotencyKey, requestHash string,
+) (*Response, error) {
+	var saved *Response
+
+	// Check and reserve in a transaction so only one of several concurrent
+	// requests with the same key gets it
+	err := r.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		record, err := r.findRecord(txDao, userID, idempotencyKey)
+		if errors.Is(err, sql.ErrNoRows) {
+			collection, err := txDao.FindCollectionByNameOrId(collectionName)
+			if err != nil {
+				return err
+			}
+
+			record = models.NewRecord(collection)
+			record.Set("user", userID)
+			record.Set("idempotency_key", idempotencyKey)
+			record.Set("request_hash", requestHash)
+			record.Set("in_flight", true)
+			return txDao.SaveRecord(record)
+		}
+		if err != nil {
+			return err
+		}
+
+		// Keys reserved before the hash was stored don't have one
+		savedHash := record.GetString("request_hash")
+		if savedHash != "" && savedHash != requestHash {
+			return ErrRequestMismatch
+		}
+
+		if record.GetBool("in_flight") {
+			reservedAt := record.GetDateTime("updated").Time()
+			if time.Since(reservedAt) < InFlightLease {
+				return ErrRequestInFlight
+			}
+			// Take over the abandoned key, saving it renews the lease
+			return txDao.SaveRecord(record)
+		}
+
+		saved = &Response{
+			StatusCode: record.GetInt("status_code"),
+			Body:       []byte(record.GetString("response_body")),
+		}
+		return record.UnmarshalJSONField("response_headers", &saved.Headers)
+	})
+
+	return saved, err
+}
+
+func (r *PocketBaseIdempotencyRepo) SaveResponse(
+	userID, idempotencyKey string,
+	response Response,
 ) error {
-	const collectionName = "idempotency"
+	record, err := r.findRecord(r.app.Dao(), userID, idempotencyKey)
+	if err != nil {
+		return err
+	}
 
-	collection, err := r.app.Dao().FindCollectionByNameOrId(collectionName)
+	headers, err := json.Marshal(response.Headers)
 	if err != nil {
 		return err
 	}
 
-	record := models.NewRecord(collection)
+	record.Set("in_flight", false)
+	record.Set("status_code", response.StatusCode)
+	record.Set("response_headers", types.JsonRaw(headers))
+	record.Set("response_body", string(response.Body))
 
-	form := forms.NewRecordUpsert(r.app, record)
+	return r.app.Dao().SaveRecord(record)
+}
 
-	err = form.LoadData(map[string]any{
-		"user":            userID,
-		"idempotency_key": idempotencyKey,
-		"status_code":     statusCode,
-		"body":            responseBodyJSON,
-	})
+func (r *PocketBaseIdempotencyRepo) Release(userID, idempotencyKey string) error {
+	record, err := r.findRecord(r.app.Dao(), userID, idempotencyKey)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	return form.Submit()
+	return r.app.Dao().DeleteRecord(record)
 }
 
-func (r *PocketBaseIdempotencyRepo) CheckForIdempotentRequest(
-	userID, idempotencyKey string,
-) (ok bool, statusCode int, responseBodyJSON []byte) {
-	const collectionName = "idempotency"
-
-	records, err := r.app.Dao().FindRecordsByFilter(collectionName,
-		"user = {:user_id} AND idempotency_key = {:idempotency_key}",
-		"-updated",
-		1,
-		0,
-		dbx.Params{"user_id": userID, "idempotency_key": idempotencyKey},
-	)
+func (r *PocketBaseIdempotencyRepo) PurgeExpired(before time.Time) (int64, error) {
+	beforeDateTime, err := types.ParseDateTime(before)
 	if err != nil {
-		return false, 0, nil
+		return 0, err
 	}
 
-	if len(records) == 0 {
-		return false, 0, nil
+	result, err := r.app.Dao().DB().
+		Delete(collectionName, dbx.NewExp(
+			"[[created]] < {:before}",
+			dbx.Params{"before": beforeDateTime.String()},
+		)).
+		Execute()
+	if err != nil {
+		return 0, err
 	}
 
-	record := records[0]
-	statusCode = record.GetInt("status_code")
-	responseBodyJSON, ok = record.Get("response_body_json").([]byte)
-	return ok, statusCode, responseBodyJSON
+	return result.RowsAffected()
 }
 
 func NewPocketBaseIdempotencyRepo(app core.App) *PocketBaseIdempotencyRepo {
@@ -2,56 +2,146 @@ package middleware
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"io"
+	"log/slog"
 	"net/http"
 
+	"github.com/cognos-io/chat.cognos.io/backend/internal/apierror"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/idempotency"
 	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
 )
 
+const (
+	HeaderIdempotencyKey = "Idempotency-Key"
+	// Set on replayed responses, matches the Stripe API
+	HeaderIdempotentReplayed = "Idempotent-Replayed"
+)
+
+// Headers that describe the current request rather than the saved response so
+// aren't replayed
+var notReplayedHeaders = []string{
+	HeaderRateLimitLimit,
+	HeaderRateLimitRemaining,
+	HeaderRateLimitReset,
+	"Retry-After",
+}
+
 type bodyDumpResponseWriter struct {
 	io.Writer
 	http.ResponseWriter
+	logger *slog.Logger
 }
 
 func (w *bodyDumpResponseWriter) Write(b []byte) (int, error) {
 	return w.Writer.Write(b)
 }
 
-func Idempotency(repo idempotency.IdempotencyRepo) echo.MiddlewareFunc {
+// Flush sends streamed responses to the client as they are written
+func (w *bodyDumpResponseWriter) Flush() {
+	// The client may have gone away, which the handler finds out when it
+	// next writes
+	if err := http.NewResponseController(w.ResponseWriter).Flush(); err != nil {
+		w.logger.Warn("Failed to flush response", "err", err)
+	}
+}
+
+func (w *bodyDumpResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Idempotency saves the response of requests with an `Idempotency-Key` header
+// and replays it when the request is retried with the same key, so retrying a
+// completion doesn't generate, and pay for, it twice. Only successful responses
+// are saved, failed requests can be retried.
+func Idempotency(
+	repo idempotency.IdempotencyRepo,
+	logger *slog.Logger,
+) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			// Get the user ID and idempotency key from the request and
 			// if we have both, check if we have a response for this
 			owner := auth.ExtractUser(c)
-			idempotencyKey := c.Request().Header.Get("Idempotency-Key")
+			idempotencyKey := c.Request().Header.Get(HeaderIdempotencyKey)
 
 			// If we don't have a user ID or idempotency key, we can't
 			// check for idempotency, so we just call the next handler.
-			if owner == nil || idempotencyKey == "" {
+			if owner == nil || owner.ID == "" || idempotencyKey == "" {
 				return next(c)
 			}
 
-			ok, statusCode, responseBodyJSON := repo.CheckForIdempotentRequest(
-				owner.ID,
-				idempotencyKey,
-			)
-			if ok {
+			// The key may only be reused by a retry of the same request
+			reqBody, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return apis.NewBadRequestError("Failed to read the request body", err)
+			}
+			c.Request().Body = io.NopCloser(bytes.NewReader(reqBody))
+			reqHash := sha256.Sum256(reqBody)
+
+			saved, err := repo.Reserve(owner.ID, idempotencyKey, hex.EncodeToString(reqHash[:]))
+			if errors.Is(err, idempotency.ErrRequestMismatch) {
+				return c.JSON(
+					http.StatusUnprocessableEntity,
+					apierror.New(
+						http.StatusUnprocessableEntity,
+						"The idempotency key was already used by a request with a different body",
+					),
+				)
+			}
+			if errors.Is(err, idempotency.ErrRequestInFlight) {
+				return c.JSON(
+					http.StatusConflict,
+					apierror.New(
+						http.StatusConflict,
+						"A request with the same idempotency key is still in progress",
+					),
+				)
+			}
+			if err != nil {
+				logger.Error("Failed to check idempotency key", "err", err)
+				return apis.NewApiError(
+					http.StatusInternalServerError,
+					"Failed to check idempotency key",
+					err,
+				)
+			}
+			if saved != nil {
 				// If we have a response, we return it to the client.
-				c.Response().WriteHeader(statusCode)
-				_, err := c.Response().Write(responseBodyJSON)
+				for name, values := range saved.Headers {
+					c.Response().Header()[name] = values
+				}
+				c.Response().Header().Set(HeaderIdempotentReplayed, "true")
+				c.Response().WriteHeader(saved.StatusCode)
+				_, err := c.Response().Write(saved.Body)
 				return err
 			}
 
 			// Response
 			resBody := new(bytes.Buffer)
-			mw := io.MultiWriter(c.Response().Writer, resBody)
-			writer := &bodyDumpResponseWriter{
-				ResponseWriter: c.Response().Writer,
-				Writer:         mw,
+			originalWriter := c.Response().Writer
+			c.Response().Writer = &bodyDumpResponseWriter{
+				ResponseWriter: originalWriter,
+				Writer:         io.MultiWriter(originalWriter, resBody),
+				logger:         logger,
 			}
-			c.Response().Writer = writer
+			defer func() {
+				c.Response().Writer = originalWriter
+			}()
+			// Free the key if the handler panics, otherwise retries are
+			// refused until its lease runs out
+			defer func() {
+				if r := recover(); r != nil {
+					if err := repo.Release(owner.ID, idempotencyKey); err != nil {
+						logger.Error("Failed to release idempotency key", "err", err)
+					}
+					panic(r)
+				}
+			}()
 
 			// If we don't have a response, we call the next handler.
 			if err := next(c); err != nil {
@@ -61,14 +151,28 @@ func Idempotency(repo idempotency.IdempotencyRepo) echo.MiddlewareFunc {
 			// After the next handler has been called, we can save the
 			// response and status code in the database.
 			response := c.Response()
-			responseBodyJSON = resBody.Bytes()
-			statusCode = response.Status
-			return repo.SaveIdempotentRequest(
-				owner.ID,
-				idempotencyKey,
-				statusCode,
-				responseBodyJSON,
-			)
+			if response.Status < http.StatusOK ||
+				response.Status >= http.StatusMultipleChoices {
+				if err := repo.Release(owner.ID, idempotencyKey); err != nil {
+					logger.Error("Failed to release idempotency key", "err", err)
+				}
+				return nil
+			}
+
+			headers := response.Header().Clone()
+			for _, name := range notReplayedHeaders {
+				headers.Del(name)
+			}
+			err = repo.SaveResponse(owner.ID, idempotencyKey, idempotency.Response{
+				StatusCode: response.Status,
+				Headers:    headers,
+				Body:       resBody.Bytes(),
+			})
+			if err != nil {
+				// The response has already been sent so all we can do is log
+				logger.Error("Failed to save idempotent response", "err", err)
+			}
+			return nil
 		}
 	}
 }
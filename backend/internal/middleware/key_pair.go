@@ -1,10 +1,61 @@
 package middleware
 
-import "github.com/labstack/echo/v5"
+import (
+	"errors"
+	"log/slog"
 
-// LoadKeyPair is a middleware that loads the relevant key pairs into the request context.
-func LoadKeyPair(next echo.HandlerFunc) echo.HandlerFunc {
-	return func(c echo.Context) error {
-		return next(c)
+	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// LoadKeyPair is a middleware that loads the key of the conversation the
+// request is for into the request context, so it's only looked up once per
+// request. The conversation is taken from the `conversation_id` path parameter
+// or the `cognos` metadata of the request body.
+// Requests without a conversation, or whose key can't be loaded, are passed
+// through untouched and left for the handler to deal with.
+func LoadKeyPair(
+	keyPairRepo auth.KeyPairRepo,
+	logger *slog.Logger,
+) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			conversationID := requestConversationID(c)
+			if conversationID == "" {
+				return next(c)
+			}
+
+			key, err := keyPairRepo.ConversationKey(conversationID)
+			if err != nil {
+				if !errors.Is(err, auth.ErrNoKeyPair) {
+					logger.Error(
+						"Failed to load conversation public key",
+						"conversation_id", conversationID,
+						"err", err,
+					)
+				}
+				return next(c)
+			}
+
+			auth.SetConversationKey(c, conversationID, key)
+			return next(c)
+		}
+	}
+}
+
+// requestConversationID returns the ID of the conversation the request is for,
+// or an empty string if it isn't for a conversation.
+func requestConversationID(c echo.Context) string {
+	if conversationID := c.PathParam("conversation_id"); conversationID != "" {
+		return conversationID
 	}
+
+	// The body can be read again by the handler
+	data := apis.RequestInfo(c).Data
+	metadata, _ := data["metadata"].(map[string]any)
+	cognos, _ := metadata["cognos"].(map[string]any)
+	conversationID, _ := cognos["conversation_id"].(string)
+
+	return conversationID
 }
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/apierror"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/ratelimit"
+	"github.com/labstack/echo/v5"
+)
+
+const (
+	HeaderRateLimitLimit     = "X-RateLimit-Limit"
+	HeaderRateLimitRemaining = "X-RateLimit-Remaining"
+	HeaderRateLimitReset     = "X-RateLimit-Reset"
+)
+
+// IPExtractor returns how to find the IP address of the client, which guests
+// are rate limited by. Anyone can set the `X-Forwarded-For` header so it's only
+// read when the request comes from one of the trusted proxies, given as CIDR
+// ranges. Otherwise it's the address the request came from.
+func IPExtractor(trustedProxies []string) (echo.IPExtractor, error) {
+	if len(trustedProxies) == 0 {
+		return echo.ExtractIPDirect(), nil
+	}
+
+	options := []echo.TrustOption{
+		echo.TrustLoopback(false),
+		echo.TrustLinkLocal(false),
+		echo.TrustPrivateNet(false),
+	}
+	for _, trustedProxy := range trustedProxies {
+		_, ipRange, err := net.ParseCIDR(trustedProxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", trustedProxy, err)
+		}
+		options = append(options, echo.TrustIPRange(ipRange))
+	}
+
+	return echo.ExtractIPFromXFFHeader(options...), nil
+}
+
+// RateLimit limits the number of requests each user, or IP address for guests,
+// can make to the route. The IP address comes from the IPExtractor of the
+// router. The limit depends on the route and the user's plan.
+func RateLimit(
+	route string,
+	cfg *config.APIConfig,
+	store ratelimit.Store,
+	logger *slog.Logger,
+) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identifier := "ip:" + c.RealIP()
+			plan := config.DefaultPlan
+			if user := auth.ExtractUser(c); user != nil && user.ID != "" {
+				identifier = "user:" + user.ID
+				plan = user.Plan
+			}
+
+			limit := cfg.RateLimit(route, plan)
+			if limit.Requests <= 0 || limit.Window <= 0 {
+				return next(c)
+			}
+
+			now := time.Now()
+			result, err := store.Allow(route+":"+identifier, limit, now)
+			if err != nil {
+				// Better to let requests through than take the route down
+				logger.Error("Failed to check rate limit", "route", route, "err", err)
+				return next(c)
+			}
+
+			header := c.Response().Header()
+			header.Set(HeaderRateLimitLimit, strconv.Itoa(result.Limit))
+			header.Set(HeaderRateLimitRemaining, strconv.Itoa(result.Remaining))
+			header.Set(HeaderRateLimitReset, strconv.FormatInt(result.ResetsAt.Unix(), 10))
+
+			if !result.Allowed {
+				retryAfter := int(result.ResetsAt.Sub(now).Seconds()) + 1
+				header.Set("Retry-After", strconv.Itoa(retryAfter))
+				return c.JSON(
+					http.StatusTooManyRequests,
+					apierror.New(
+						http.StatusTooManyRequests,
+						"Too many requests, please retry after "+strconv.Itoa(retryAfter)+" seconds",
+					),
+				)
+			}
+
+			return next(c)
+		}
+	}
+}
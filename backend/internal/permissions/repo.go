@@ -1,10 +1,27 @@
 package permissions
 
 import (
+	"database/sql"
+	"errors"
+	"slices"
+
+	"github.com/pocketbase/dbx"
 	"github.com/pocketbase/pocketbase/core"
 	"github.com/pocketbase/pocketbase/models"
 )
 
+// Role of a participant in a conversation
+type Role string
+
+const (
+	RoleViewer Role = "Viewer"
+	RoleEditor Role = "Editor"
+	RoleAdmin  Role = "Admin"
+)
+
+// writeRoles are the participant roles that can add messages to a conversation
+var writeRoles = []Role{RoleEditor, RoleAdmin}
+
 type PermissionsRepo interface {
 	// HasViewPermission checks if a user has permission to access a record
 	// referred to by it's ID.
@@ -13,6 +30,22 @@ type PermissionsRepo interface {
 		info *models.RequestInfo,
 		collectionName, recordID string,
 	) (bool, *models.Record, error)
+	// HasWritePermission checks if a user has permission to add messages to a
+	// conversation. The creator can always write, other participants need the
+	// Editor or Admin role.
+	// If they do it returns true, and the conversation record for convenience
+	HasWritePermission(
+		info *models.RequestInfo,
+		conversationID string,
+	) (bool, *models.Record, error)
+	// HasAdminPermission checks if a user can manage a conversation e.g. rotate
+	// its key. The creator can always manage it, other participants need the
+	// Admin role.
+	// If they do it returns true, and the conversation record for convenience
+	HasAdminPermission(
+		info *models.RequestInfo,
+		conversationID string,
+	) (bool, *models.Record, error)
 }
 
 type PocketBasePermissionsRepo struct {
@@ -33,6 +66,58 @@ func (r *PocketBasePermissionsRepo) HasViewPermission(
 	return canAccess, record, err
 }
 
+func (r *PocketBasePermissionsRepo) HasWritePermission(
+	info *models.RequestInfo,
+	conversationID string,
+) (bool, *models.Record, error) {
+	return r.hasConversationRole(info, conversationID, writeRoles)
+}
+
+func (r *PocketBasePermissionsRepo) HasAdminPermission(
+	info *models.RequestInfo,
+	conversationID string,
+) (bool, *models.Record, error) {
+	return r.hasConversationRole(info, conversationID, []Role{RoleAdmin})
+}
+
+// hasConversationRole checks if the user is the creator of the conversation,
+// or a participant with one of the roles
+func (r *PocketBasePermissionsRepo) hasConversationRole(
+	info *models.RequestInfo,
+	conversationID string,
+	roles []Role,
+) (bool, *models.Record, error) {
+	record, err := r.app.Dao().FindRecordById("conversations", conversationID)
+	if err != nil {
+		return false, nil, err
+	}
+
+	if info.Admin != nil {
+		return true, record, nil
+	}
+	if info.AuthRecord == nil {
+		return false, record, nil
+	}
+	if record.GetString("creator") == info.AuthRecord.Id {
+		return true, record, nil
+	}
+
+	participant, err := r.app.Dao().FindFirstRecordByFilter(
+		"participants",
+		"conversation = {:conversation} && user = {:user}",
+		dbx.Params{"conversation": record.Id, "user": info.AuthRecord.Id},
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, record, nil
+	}
+	if err != nil {
+		return false, record, err
+	}
+
+	role := Role(participant.GetString("role"))
+	return slices.Contains(roles, role), record, nil
+}
+
 func NewPocketBasePermissionsRepo(app core.App) *PocketBasePermissionsRepo {
 	return &PocketBasePermissionsRepo{
 		app: app,
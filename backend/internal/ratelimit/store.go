@@ -0,0 +1,168 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+	"github.com/pocketbase/pocketbase/tools/security"
+	"github.com/pocketbase/pocketbase/tools/types"
+)
+
+// Result of counting a request against a rate limit
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	ResetsAt  time.Time
+}
+
+// Store counts the requests made by each key, e.g. route and user, in fixed
+// windows of time.
+type Store interface {
+	// Allow counts the request against the key's limit for the window the
+	// given time is in.
+	Allow(key string, limit config.RateLimitConfig, now time.Time) (Result, error)
+	// PurgeExpired deletes the counts of the windows which started before the
+	// given time
+	PurgeExpired(before time.Time) (int64, error)
+}
+
+// newResult builds the result for the count of requests in the window
+func newResult(
+	limit config.RateLimitConfig,
+	windowStart time.Time,
+	count int,
+) Result {
+	return Result{
+		Allowed:   count <= limit.Requests,
+		Limit:     limit.Requests,
+		Remaining: max(limit.Requests-count, 0),
+		ResetsAt:  windowStart.Add(limit.Window),
+	}
+}
+
+// InMemoryStore keeps the counts in memory so they are lost on restart.
+// Useful for tests and tooling where there is no database.
+type InMemoryStore struct {
+	mu      sync.Mutex
+	windows map[string]time.Time
+	counts  map[string]int
+}
+
+func (s *InMemoryStore) Allow(
+	key string,
+	limit config.RateLimitConfig,
+	now time.Time,
+) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	windowStart := now.UTC().Truncate(limit.Window)
+	if !s.windows[key].Equal(windowStart) {
+		s.windows[key] = windowStart
+		s.counts[key] = 0
+	}
+	s.counts[key]++
+
+	return newResult(limit, windowStart, s.counts[key]), nil
+}
+
+func (s *InMemoryStore) PurgeExpired(before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var purged int64
+	for key, windowStart := range s.windows {
+		if windowStart.Before(before) {
+			delete(s.windows, key)
+			delete(s.counts, key)
+			purged++
+		}
+	}
+
+	return purged, nil
+}
+
+func NewInMemoryStore() *InMemoryStore {
+	return &InMemoryStore{
+		windows: make(map[string]time.Time),
+		counts:  make(map[string]int),
+	}
+}
+
+// PocketBaseStore keeps the counts in the `rate_limits` collection so limits
+// survive restarts. There is a single record per key which is reset when a new
+// window starts.
+type PocketBaseStore struct {
+	app core.App
+}
+
+func (s *PocketBaseStore) Allow(
+	key string,
+	limit config.RateLimitConfig,
+	now time.Time,
+) (Result, error) {
+	windowStart := now.UTC().Truncate(limit.Window)
+	windowStartDateTime, err := types.ParseDateTime(windowStart)
+	if err != nil {
+		return Result{}, err
+	}
+	nowDateTime, err := types.ParseDateTime(now)
+	if err != nil {
+		return Result{}, err
+	}
+
+	// A single upsert so concurrent requests can't both take the last slot.
+	// Written with SQL rather than the DAO as it runs on every request and
+	// shouldn't fire any model hooks.
+	count := 0
+	err = s.app.Dao().DB().NewQuery(`
+		INSERT INTO {{rate_limits}} ([[id]], [[key]], [[window_start]], [[count]], [[created]], [[updated]])
+		VALUES ({:id}, {:key}, {:window_start}, 1, {:now}, {:now})
+		ON CONFLICT ([[key]]) DO UPDATE SET
+			[[count]] = CASE WHEN [[window_start]] = excluded.[[window_start]] THEN [[count]] + 1 ELSE 1 END,
+			[[window_start]] = excluded.[[window_start]],
+			[[updated]] = excluded.[[updated]]
+		RETURNING [[count]]
+	`).Bind(dbx.Params{
+		"id": security.RandomStringWithAlphabet(
+			models.DefaultIdLength,
+			models.DefaultIdAlphabet,
+		),
+		"key":          key,
+		"window_start": windowStartDateTime.String(),
+		"now":          nowDateTime.String(),
+	}).Row(&count)
+	if err != nil {
+		return Result{}, err
+	}
+
+	return newResult(limit, windowStart, count), nil
+}
+
+func (s *PocketBaseStore) PurgeExpired(before time.Time) (int64, error) {
+	beforeDateTime, err := types.ParseDateTime(before)
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := s.app.Dao().DB().
+		Delete("rate_limits", dbx.NewExp(
+			"[[window_start]] < {:before}",
+			dbx.Params{"before": beforeDateTime.String()},
+		)).
+		Execute()
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func NewPocketBaseStore(app core.App) *PocketBaseStore {
+	return &PocketBaseStore{app: app}
+}
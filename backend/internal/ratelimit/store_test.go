@@ -0,0 +1,48 @@
+package ratelimit_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/ratelimit"
+)
+
+func TestInMemoryStore(t *testing.T) {
+	store := ratelimit.NewInMemoryStore()
+	limit := config.RateLimitConfig{Requests: 2, Window: time.Minute}
+	start := time.Date(2024, time.July, 18, 9, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name          string
+		key           string
+		at            time.Time
+		wantAllowed   bool
+		wantRemaining int
+		wantResetsAt  time.Time
+	}{
+		{"first request", "user1", start, true, 1, start.Add(time.Minute)},
+		{"last request", "user1", start.Add(10 * time.Second), true, 0, start.Add(time.Minute)},
+		{"over the limit", "user1", start.Add(59 * time.Second), false, 0, start.Add(time.Minute)},
+		{"other key", "user2", start.Add(59 * time.Second), true, 1, start.Add(time.Minute)},
+		{"next window", "user1", start.Add(time.Minute), true, 1, start.Add(2 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := store.Allow(tt.key, limit, tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Allowed != tt.wantAllowed {
+				t.Errorf("Allowed = %v, want %v", result.Allowed, tt.wantAllowed)
+			}
+			if result.Remaining != tt.wantRemaining {
+				t.Errorf("Remaining = %d, want %d", result.Remaining, tt.wantRemaining)
+			}
+			if !result.ResetsAt.Equal(tt.wantResetsAt) {
+				t.Errorf("ResetsAt = %s, want %s", result.ResetsAt, tt.wantResetsAt)
+			}
+		})
+	}
+}
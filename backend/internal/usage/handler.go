@@ -0,0 +1,85 @@
+package usage
+
+import (
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
+	"github.com/labstack/echo/v5"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// SpendReport is the response of the usage endpoint
+type SpendReport struct {
+	Object    string  `json:"object"`
+	From      string  `json:"from"`
+	To        string  `json:"to"`
+	TotalCost float64 `json:"total_cost"`
+	Data      []Spend `json:"data"`
+}
+
+// EchoHandler reports the spend of the authenticated user by day, model and
+// agent. Admins see every user, or a single user with the `user` query param.
+// The `from` and `to` query params are days e.g. `2024-07-01` and default to
+// the current month.
+func EchoHandler(
+	logger *slog.Logger,
+	tokenUsageRepo TokenUsageRepo,
+) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		user := auth.ExtractUser(c)
+		if user == nil {
+			return apis.NewUnauthorizedError("User not authenticated", nil)
+		}
+
+		now := time.Now().UTC()
+		query := SpendQuery{
+			UserID: user.ID,
+			From:   time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC),
+			To:     now,
+		}
+		if user.IsAdmin {
+			query.UserID = c.QueryParam("user")
+		}
+
+		var err error
+		if from := c.QueryParam("from"); from != "" {
+			query.From, err = time.Parse(dayFormat, from)
+			if err != nil {
+				return apis.NewBadRequestError("Invalid from date", err)
+			}
+		}
+		if to := c.QueryParam("to"); to != "" {
+			query.To, err = time.Parse(dayFormat, to)
+			if err != nil {
+				return apis.NewBadRequestError("Invalid to date", err)
+			}
+		}
+		if query.To.Before(query.From) {
+			return apis.NewBadRequestError("The to date must be after the from date", nil)
+		}
+
+		spend, err := tokenUsageRepo.Spend(query)
+		if err != nil {
+			logger.Error("Failed to load spend", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to load usage",
+				err,
+			)
+		}
+
+		report := SpendReport{
+			Object: "list",
+			From:   Day(query.From),
+			To:     Day(query.To),
+			Data:   spend,
+		}
+		for _, s := range spend {
+			report.TotalCost += s.Cost
+		}
+
+		return c.JSON(http.StatusOK, report)
+	}
+}
@@ -0,0 +1,73 @@
+package usage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+)
+
+// QuotaExceededError is returned when a user has used up their tokens for the
+// day or month.
+type QuotaExceededError struct {
+	Period   string // `daily` or `monthly`
+	Limit    int
+	Used     int
+	ResetsAt time.Time
+}
+
+func (e *QuotaExceededError) Error() string {
+	return fmt.Sprintf(
+		"%s token quota of %d exceeded, resets at %s",
+		e.Period,
+		e.Limit,
+		e.ResetsAt.Format(time.RFC3339),
+	)
+}
+
+// CheckQuota returns a QuotaExceededError if the user has already used all the
+// tokens allowed by their quota for the day or month of the given time.
+// Usage is only known once a completion has finished, so the last completion
+// before the limit can take the user over it.
+func CheckQuota(
+	repo TokenUsageRepo,
+	userID string,
+	quota config.QuotaConfig,
+	now time.Time,
+) error {
+	now = now.UTC()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	if quota.DailyTokens > 0 {
+		used, err := repo.TotalTokens(userID, startOfDay, now)
+		if err != nil {
+			return err
+		}
+		if used >= quota.DailyTokens {
+			return &QuotaExceededError{
+				Period:   "daily",
+				Limit:    quota.DailyTokens,
+				Used:     used,
+				ResetsAt: startOfDay.AddDate(0, 0, 1),
+			}
+		}
+	}
+
+	if quota.MonthlyTokens > 0 {
+		used, err := repo.TotalTokens(userID, startOfMonth, now)
+		if err != nil {
+			return err
+		}
+		if used >= quota.MonthlyTokens {
+			return &QuotaExceededError{
+				Period:   "monthly",
+				Limit:    quota.MonthlyTokens,
+				Used:     used,
+				ResetsAt: startOfMonth.AddDate(0, 1, 0),
+			}
+		}
+	}
+
+	return nil
+}
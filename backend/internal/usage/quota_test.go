@@ -0,0 +1,74 @@
+package usage_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/usage"
+)
+
+func TestCheckQuota(t *testing.T) {
+	now := time.Date(2024, time.July, 16, 15, 0, 0, 0, time.UTC)
+
+	repo := usage.NewInMemoryTokenUsageRepo()
+	for _, completion := range []usage.CompletionUsage{
+		// Earlier in the month
+		{UserID: "user1", ModelID: "openai:gpt-4o", PromptTokens: 600, CompletionTokens: 200, Created: now.AddDate(0, 0, -3)},
+		// Today
+		{UserID: "user1", ModelID: "openai:gpt-4o", PromptTokens: 60, CompletionTokens: 20, Created: now},
+		{UserID: "user1", ModelID: "anthropic:claude-3-haiku", PromptTokens: 15, CompletionTokens: 5, Created: now},
+		// Last month doesn't count
+		{UserID: "user1", ModelID: "openai:gpt-4o", PromptTokens: 5000, CompletionTokens: 0, Created: now.AddDate(0, -1, 0)},
+	} {
+		if err := repo.RecordUsage(completion); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name           string
+		quota          config.QuotaConfig
+		expectedPeriod string // empty if within quota
+		expectedReset  time.Time
+	}{
+		{"unlimited", config.QuotaConfig{}, "", time.Time{}},
+		{"within quota", config.QuotaConfig{DailyTokens: 101, MonthlyTokens: 901}, "", time.Time{}},
+		{
+			"daily quota used up",
+			config.QuotaConfig{DailyTokens: 100},
+			"daily",
+			time.Date(2024, time.July, 17, 0, 0, 0, 0, time.UTC),
+		},
+		{
+			"monthly quota used up",
+			config.QuotaConfig{DailyTokens: 1000, MonthlyTokens: 900},
+			"monthly",
+			time.Date(2024, time.August, 1, 0, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := usage.CheckQuota(repo, "user1", tt.quota, now)
+
+			var quotaErr *usage.QuotaExceededError
+			if tt.expectedPeriod == "" {
+				if err != nil {
+					t.Fatalf("Expected no error, got %v", err)
+				}
+				return
+			}
+			if !errors.As(err, &quotaErr) {
+				t.Fatalf("Expected QuotaExceededError, got %v", err)
+			}
+			if quotaErr.Period != tt.expectedPeriod {
+				t.Errorf("Expected %s quota to be exceeded, got %s", tt.expectedPeriod, quotaErr.Period)
+			}
+			if !quotaErr.ResetsAt.Equal(tt.expectedReset) {
+				t.Errorf("Expected quota to reset at %s, got %s", tt.expectedReset, quotaErr.ResetsAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,271 @@
+package usage
+
+import (
+	"cmp"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/daos"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+// dayFormat is how the day of the usage is stored, sorting as text also sorts
+// by date so ranges of days can be queried
+const dayFormat = time.DateOnly
+
+// Day returns the UTC day the usage at the given time is counted against
+func Day(t time.Time) string {
+	return t.UTC().Format(dayFormat)
+}
+
+// TokenUsage is the number of tokens a user has sent to, and received from, a
+// model with an agent on a given day, and their estimated cost.
+type TokenUsage struct {
+	UserID           string  `json:"user"`
+	ModelID          string  `json:"model"`
+	AgentID          string  `json:"agent"`
+	Day              string  `json:"day"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	Requests         int     `json:"requests"`
+	Cost             float64 `json:"cost"` // USD
+}
+
+// CompletionUsage is the tokens used, and the estimated cost, of a single
+// completion.
+type CompletionUsage struct {
+	UserID           string
+	AgentID          string
+	ModelID          string
+	PromptTokens     int
+	CompletionTokens int
+	Cost             float64 // USD
+	Created          time.Time
+}
+
+type TokenUsageRepo interface {
+	// RecordUsage adds the tokens used by a completion, and their cost, to the
+	// user's usage of the model and agent for the day it was created, or today
+	// if that isn't set.
+	RecordUsage(usage CompletionUsage) error
+	// TotalTokens returns the total number of tokens the user has used across
+	// all models between the two days, inclusive.
+	TotalTokens(userID string, from, to time.Time) (int, error)
+	// Spend returns the spend grouped by day, user, model and agent, ordered
+	// by day.
+	Spend(query SpendQuery) ([]Spend, error)
+}
+
+// InMemoryTokenUsageRepo keeps usage in memory.
+// Useful for tests and tooling where there is no database.
+type InMemoryTokenUsageRepo struct {
+	mu    sync.Mutex
+	usage map[[4]string]TokenUsage
+}
+
+func (r *InMemoryTokenUsageRepo) RecordUsage(completion CompletionUsage) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key := [4]string{
+		completion.UserID,
+		completion.ModelID,
+		completion.AgentID,
+		Day(createdOrNow(completion.Created)),
+	}
+	usage := r.usage[key]
+	usage.UserID, usage.ModelID, usage.AgentID, usage.Day = key[0], key[1], key[2], key[3]
+	usage.PromptTokens += completion.PromptTokens
+	usage.CompletionTokens += completion.CompletionTokens
+	usage.TotalTokens += completion.PromptTokens + completion.CompletionTokens
+	usage.Requests++
+	usage.Cost += completion.Cost
+	r.usage[key] = usage
+
+	return nil
+}
+
+func (r *InMemoryTokenUsageRepo) TotalTokens(
+	userID string,
+	from, to time.Time,
+) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	total := 0
+	for _, usage := range r.usage {
+		if usage.UserID == userID && usage.Day >= Day(from) && usage.Day <= Day(to) {
+			total += usage.TotalTokens
+		}
+	}
+	return total, nil
+}
+
+func (r *InMemoryTokenUsageRepo) Spend(query SpendQuery) ([]Spend, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spend := []Spend{}
+	for _, usage := range r.usage {
+		if usage.Day < Day(query.From) || usage.Day > Day(query.To) ||
+			(query.UserID != "" && usage.UserID != query.UserID) {
+			continue
+		}
+
+		spend = append(spend, Spend{
+			Day:              usage.Day,
+			UserID:           usage.UserID,
+			ModelID:          usage.ModelID,
+			AgentID:          usage.AgentID,
+			Requests:         usage.Requests,
+			PromptTokens:     usage.PromptTokens,
+			CompletionTokens: usage.CompletionTokens,
+			Cost:             usage.Cost,
+		})
+	}
+
+	slices.SortFunc(spend, func(a, b Spend) int {
+		return cmp.Or(
+			strings.Compare(a.Day, b.Day),
+			strings.Compare(a.UserID, b.UserID),
+			strings.Compare(a.ModelID, b.ModelID),
+			strings.Compare(a.AgentID, b.AgentID),
+		)
+	})
+	return spend, nil
+}
+
+func NewInMemoryTokenUsageRepo() *InMemoryTokenUsageRepo {
+	return &InMemoryTokenUsageRepo{
+		usage: make(map[[4]string]TokenUsage),
+	}
+}
+
+// PocketBaseTokenUsageRepo stores usage in the `token_usage` collection with a
+// record per user, model, agent and day.
+type PocketBaseTokenUsageRepo struct {
+	app        core.App
+	collection *models.Collection
+	logger     *slog.Logger
+}
+
+func (r *PocketBaseTokenUsageRepo) RecordUsage(completion CompletionUsage) error {
+	day := Day(createdOrNow(completion.Created))
+
+	// Read and update in a transaction so concurrent completions for the same
+	// user and model don't lose each other's tokens
+	return r.app.Dao().RunInTransaction(func(txDao *daos.Dao) error {
+		record, err := txDao.FindFirstRecordByFilter(
+			r.collection.Name,
+			"user = {:user} && model = {:model} && agent = {:agent} && day = {:day}",
+			dbx.Params{
+				"user":  completion.UserID,
+				"model": completion.ModelID,
+				"agent": completion.AgentID,
+				"day":   day,
+			},
+		)
+		if errors.Is(err, sql.ErrNoRows) {
+			record = models.NewRecord(r.collection)
+			record.Set("user", completion.UserID)
+			record.Set("model", completion.ModelID)
+			record.Set("agent", completion.AgentID)
+			record.Set("day", day)
+		} else if err != nil {
+			return err
+		}
+
+		record.Set(
+			"prompt_tokens",
+			record.GetInt("prompt_tokens")+completion.PromptTokens,
+		)
+		record.Set(
+			"completion_tokens",
+			record.GetInt("completion_tokens")+completion.CompletionTokens,
+		)
+		record.Set(
+			"total_tokens",
+			record.GetInt("total_tokens")+completion.PromptTokens+completion.CompletionTokens,
+		)
+		record.Set("requests", record.GetInt("requests")+1)
+		record.Set("cost", record.GetFloat("cost")+completion.Cost)
+
+		return txDao.SaveRecord(record)
+	})
+}
+
+func (r *PocketBaseTokenUsageRepo) TotalTokens(
+	userID string,
+	from, to time.Time,
+) (int, error) {
+	total := 0
+	err := r.app.Dao().
+		RecordQuery(r.collection).
+		Select("COALESCE(SUM([[total_tokens]]), 0)").
+		AndWhere(dbx.HashExp{"user": userID}).
+		AndWhere(dbx.Between("day", Day(from), Day(to))).
+		Row(&total)
+	if err != nil {
+		r.logger.Error("Failed to sum token usage", "err", err)
+	}
+	return total, err
+}
+
+func (r *PocketBaseTokenUsageRepo) Spend(query SpendQuery) ([]Spend, error) {
+	q := r.app.Dao().
+		RecordQuery(r.collection).
+		Select(
+			"[[day]] AS day",
+			"[[user]] AS user",
+			"[[model]] AS model",
+			"[[agent]] AS agent",
+			"COALESCE(SUM([[requests]]), 0) AS requests",
+			"COALESCE(SUM([[prompt_tokens]]), 0) AS prompt_tokens",
+			"COALESCE(SUM([[completion_tokens]]), 0) AS completion_tokens",
+			"COALESCE(SUM([[cost]]), 0) AS cost",
+		).
+		AndWhere(dbx.Between("day", Day(query.From), Day(query.To))).
+		GroupBy("day", "user", "model", "agent").
+		OrderBy("day", "user", "model", "agent")
+	if query.UserID != "" {
+		q = q.AndWhere(dbx.HashExp{"user": query.UserID})
+	}
+
+	spend := []Spend{}
+	if err := q.All(&spend); err != nil {
+		r.logger.Error("Failed to query spend", "err", err)
+		return nil, err
+	}
+	return spend, nil
+}
+
+// createdOrNow is when a completion was created, now if it isn't set
+func createdOrNow(created time.Time) time.Time {
+	if created.IsZero() {
+		return time.Now()
+	}
+	return created
+}
+
+func NewPocketBaseTokenUsageRepo(
+	app core.App,
+	logger *slog.Logger,
+) *PocketBaseTokenUsageRepo {
+	collection, err := app.Dao().FindCollectionByNameOrId("token_usage")
+	if err != nil {
+		panic(err)
+	}
+	return &PocketBaseTokenUsageRepo{
+		app:        app,
+		collection: collection,
+		logger:     logger,
+	}
+}
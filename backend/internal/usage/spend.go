@@ -0,0 +1,35 @@
+package usage
+
+import (
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+)
+
+// Cost estimates the cost in USD of the tokens at the given price.
+func Cost(price config.ModelPricingConfig, promptTokens, completionTokens int) float64 {
+	// Sum before dividing to keep the rounding errors down
+	return (float64(promptTokens)*price.Prompt +
+		float64(completionTokens)*price.Completion) / 1_000_000
+}
+
+// Spend is the usage and cost of a user's completions grouped by day, model
+// and agent.
+type Spend struct {
+	Day              string  `db:"day"               json:"day"`
+	UserID           string  `db:"user"              json:"user"`
+	ModelID          string  `db:"model"             json:"model"`
+	AgentID          string  `db:"agent"             json:"agent"`
+	Requests         int     `db:"requests"          json:"requests"`
+	PromptTokens     int     `db:"prompt_tokens"     json:"prompt_tokens"`
+	CompletionTokens int     `db:"completion_tokens" json:"completion_tokens"`
+	Cost             float64 `db:"cost"              json:"cost"`
+}
+
+// SpendQuery selects the completions to report on.
+type SpendQuery struct {
+	// Empty for every user
+	UserID string
+	// Days to report on, inclusive
+	From, To time.Time
+}
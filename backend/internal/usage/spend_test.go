@@ -0,0 +1,32 @@
+package usage_test
+
+import (
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/usage"
+)
+
+func TestCost(t *testing.T) {
+	tests := []struct {
+		name             string
+		price            config.ModelPricingConfig
+		promptTokens     int
+		completionTokens int
+		want             float64
+	}{
+		{"unpriced", config.ModelPricingConfig{}, 1000, 1000, 0},
+		{"million tokens", config.ModelPricingConfig{Prompt: 5, Completion: 15}, 1_000_000, 1_000_000, 20},
+		{"prompt only", config.ModelPricingConfig{Prompt: 0.5, Completion: 1.5}, 200_000, 0, 0.1},
+		{"small completion", config.ModelPricingConfig{Prompt: 3, Completion: 15}, 1200, 300, 0.0081},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := usage.Cost(tt.price, tt.promptTokens, tt.completionTokens)
+			if got != tt.want {
+				t.Errorf("Cost() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,9 +1,16 @@
 package aiagent
 
 import (
+	"database/sql"
 	"errors"
 	"log/slog"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/ttlcache"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
 	oai "github.com/sashabaranov/go-openai"
 )
 
@@ -64,26 +71,103 @@ var hardCodedPrompts = map[string]Prompt{
 	"cognos:generate-conversation-agent": GenerateConversationAgent,
 }
 
+// agentNamespace prefixes the agent slug in requests e.g. `cognos:simple-assistant`
+const agentNamespace = "cognos:"
+
+// Visibility controls who can use an agent
+type Visibility string
+
+const (
+	// VisibilityPrivate agents can only be used by their owner
+	VisibilityPrivate Visibility = "private"
+	// VisibilityShared agents can be used by their owner and the users they are shared with
+	VisibilityShared Visibility = "shared"
+	// VisibilityPublic agents can be used by everyone
+	VisibilityPublic Visibility = "public"
+)
+
 type Prompt struct {
 	SystemMessage string                      `json:"system_message"`
 	Examples      []oai.ChatCompletionMessage `json:"examples"`
 	NumTokens     int                         `json:"num_tokens"`
 }
 
+type Agent struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Slug        string `json:"slug"`
+	Description string `json:"description"`
+	Prompt      Prompt `json:"prompt"`
+	// Models the agent can be used with in the format `provider:model`.
+	// An empty list means the agent can be used with any model.
+	AllowedModels []string `json:"allowed_models"`
+	// User that created the agent, empty for system agents
+	OwnerID    string     `json:"owner_id"`
+	Visibility Visibility `json:"visibility"`
+	// Users that can use a shared agent
+	SharedWith []string `json:"shared_with"`
+	// Tools are the names of the built-in tools the backend runs for the
+	// agent when the model calls them
+	Tools []string `json:"tools"`
+	// MaxToolSteps is the most times the model can call tools before it has
+	// to answer, 0 for DefaultMaxToolSteps
+	MaxToolSteps int `json:"max_tool_steps"`
+}
+
+// DefaultMaxToolSteps is the tool step limit of agents which don't set one
+const DefaultMaxToolSteps = 5
+
+// AllowsModel checks if the agent can be used with the given model
+// in the format `provider:model`.
+func (a Agent) AllowsModel(modelID string) bool {
+	if len(a.AllowedModels) == 0 {
+		return true
+	}
+	return slices.Contains(a.AllowedModels, modelID)
+}
+
+// ToolSteps returns the most times the model can call tools before it has to
+// answer
+func (a Agent) ToolSteps() int {
+	if a.MaxToolSteps <= 0 {
+		return DefaultMaxToolSteps
+	}
+	return a.MaxToolSteps
+}
+
+// CanAccess checks if the user is allowed to use the agent
+func (a Agent) CanAccess(userID string) bool {
+	switch a.Visibility {
+	case VisibilityPublic:
+		return true
+	case VisibilityShared:
+		return a.OwnerID == userID || slices.Contains(a.SharedWith, userID)
+	default:
+		return a.OwnerID != "" && a.OwnerID == userID
+	}
+}
+
 type AIAgentRepo interface {
-	LookupPrompt(agentID string) (Prompt, error)
+	// LookupAgent returns the agent by its slug, optionally prefixed
+	// with the `cognos:` namespace.
+	LookupAgent(agentID string) (Agent, error)
 }
 
 type InMemoryAIAgentRepo struct {
 	logger *slog.Logger
 }
 
-func (r *InMemoryAIAgentRepo) LookupPrompt(agentID string) (Prompt, error) {
-	if prompt, ok := hardCodedPrompts[agentID]; ok {
-		return prompt, nil
+func (r *InMemoryAIAgentRepo) LookupAgent(agentID string) (Agent, error) {
+	slug := agentSlug(agentID)
+	if prompt, ok := hardCodedPrompts[agentNamespace+slug]; ok {
+		return Agent{
+			Slug:       slug,
+			Prompt:     prompt,
+			Visibility: VisibilityPublic,
+		}, nil
 	}
 
-	return Prompt{}, ErrAgentNotFound
+	return Agent{}, ErrAgentNotFound
 }
 
 func NewInMemoryAIAgentRepo(
@@ -93,3 +177,115 @@ func NewInMemoryAIAgentRepo(
 		logger: logger,
 	}
 }
+
+// How long an agent is cached for before it's looked up again. Changes made
+// through PocketBase clear the cache straight away so this only matters for
+// changes made directly to the database.
+const agentCacheTTL = 5 * time.Minute
+
+// PocketBaseAIAgentRepo serves the agents stored in the `agents` collection.
+// Agents are looked up on every request so they are cached in process, the
+// cache is cleared whenever an agent is created, updated or deleted.
+type PocketBaseAIAgentRepo struct {
+	app        core.App
+	collection *models.Collection
+	cache      *ttlcache.Cache[string, Agent]
+	logger     *slog.Logger
+}
+
+func (r *PocketBaseAIAgentRepo) LookupAgent(agentID string) (Agent, error) {
+	slug := agentSlug(agentID)
+	if agent, ok := r.cache.Get(slug); ok {
+		return agent, nil
+	}
+
+	record, err := r.app.Dao().
+		FindFirstRecordByData(r.collection.Name, "slug", slug)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Agent{}, ErrAgentNotFound
+	}
+	if err != nil {
+		r.logger.Error("Failed to lookup agent", "err", err)
+		return Agent{}, err
+	}
+
+	agent, err := recordToAgent(record)
+	if err != nil {
+		r.logger.Error("Failed to read agent", "agent", slug, "err", err)
+		return Agent{}, err
+	}
+
+	r.cache.Set(slug, agent)
+	return agent, nil
+}
+
+func recordToAgent(record *models.Record) (Agent, error) {
+	agent := Agent{
+		ID:          record.Id,
+		Name:        record.GetString("name"),
+		Slug:        record.GetString("slug"),
+		Description: record.GetString("description"),
+		Prompt: Prompt{
+			SystemMessage: record.GetString("system_message"),
+			NumTokens:     record.GetInt("num_tokens"),
+		},
+		OwnerID:      record.GetString("owner"),
+		Visibility:   Visibility(record.GetString("visibility")),
+		SharedWith:   record.GetStringSlice("shared_with"),
+		MaxToolSteps: record.GetInt("max_tool_steps"),
+	}
+
+	if err := unmarshalJSONField(record, "examples", &agent.Prompt.Examples); err != nil {
+		return agent, err
+	}
+	if err := unmarshalJSONField(record, "allowed_models", &agent.AllowedModels); err != nil {
+		return agent, err
+	}
+	if err := unmarshalJSONField(record, "tools", &agent.Tools); err != nil {
+		return agent, err
+	}
+
+	return agent, nil
+}
+
+// unmarshalJSONField is like record.UnmarshalJSONField but leaves the result
+// untouched when the field hasn't been set.
+func unmarshalJSONField(record *models.Record, key string, result any) error {
+	if raw := record.GetString(key); raw == "" || raw == "null" {
+		return nil
+	}
+	return record.UnmarshalJSONField(key, result)
+}
+
+func NewPocketBaseAIAgentRepo(
+	app core.App,
+	logger *slog.Logger,
+) *PocketBaseAIAgentRepo {
+	collection, err := app.Dao().FindCollectionByNameOrId("agents")
+	if err != nil {
+		panic(err)
+	}
+
+	repo := &PocketBaseAIAgentRepo{
+		app:        app,
+		collection: collection,
+		cache:      ttlcache.New[string, Agent](agentCacheTTL),
+		logger:     logger,
+	}
+
+	// Clear the cache on any change as the slug of an agent can change
+	clearCache := func(e *core.ModelEvent) error {
+		repo.cache.Clear()
+		return nil
+	}
+	app.OnModelAfterCreate(collection.Name).Add(clearCache)
+	app.OnModelAfterUpdate(collection.Name).Add(clearCache)
+	app.OnModelAfterDelete(collection.Name).Add(clearCache)
+
+	return repo
+}
+
+// agentSlug strips the optional namespace from the agent ID
+func agentSlug(agentID string) string {
+	return strings.TrimPrefix(agentID, agentNamespace)
+}
@@ -0,0 +1,84 @@
+package aiagent_test
+
+import (
+	"errors"
+	"log/slog"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+)
+
+func TestInMemoryAIAgentRepoLookupAgent(t *testing.T) {
+	repo := aiagent.NewInMemoryAIAgentRepo(slog.Default())
+
+	tt := []struct {
+		Name string
+
+		AgentID      string
+		ExpectedSlug string
+		ExpectedErr  error
+	}{
+		{
+			Name:         "With namespace",
+			AgentID:      "cognos:simple-assistant",
+			ExpectedSlug: "simple-assistant",
+		},
+		{
+			Name:         "Without namespace",
+			AgentID:      "generate-conversation-agent",
+			ExpectedSlug: "generate-conversation-agent",
+		},
+		{
+			Name:        "Unknown agent",
+			AgentID:     "cognos:pirate",
+			ExpectedErr: aiagent.ErrAgentNotFound,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			agent, err := repo.LookupAgent(tc.AgentID)
+			if !errors.Is(err, tc.ExpectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.ExpectedErr, err)
+			}
+			if agent.Slug != tc.ExpectedSlug {
+				t.Errorf("Expected slug %s, got %s", tc.ExpectedSlug, agent.Slug)
+			}
+		})
+	}
+}
+
+func TestAgentAllowsModel(t *testing.T) {
+	tt := []struct {
+		Name string
+
+		AllowedModels []string
+		Model         string
+		Expected      bool
+	}{
+		{
+			Name:     "No restrictions",
+			Model:    "openai:gpt-4o",
+			Expected: true,
+		},
+		{
+			Name:          "Allowed model",
+			AllowedModels: []string{"openai:gpt-4o", "anthropic:claude-haiku"},
+			Model:         "anthropic:claude-haiku",
+			Expected:      true,
+		},
+		{
+			Name:          "Model not allowed",
+			AllowedModels: []string{"openai:gpt-4o"},
+			Model:         "openai:gpt-3.5-turbo",
+			Expected:      false,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			agent := aiagent.Agent{AllowedModels: tc.AllowedModels}
+			if got := agent.AllowsModel(tc.Model); got != tc.Expected {
+				t.Errorf("Expected %t, got %t", tc.Expected, got)
+			}
+		})
+	}
+}
@@ -1,3 +1,180 @@
 package aimodel
 
-type AIModelRepo interface{}
+import (
+	"errors"
+	"log/slog"
+
+	"github.com/pocketbase/dbx"
+	"github.com/pocketbase/pocketbase/core"
+	"github.com/pocketbase/pocketbase/models"
+)
+
+var (
+	ErrModelNotFound = errors.New("model not found")
+	ErrModelDisabled = errors.New("model disabled")
+)
+
+// Model is an AI model that is available through one of our upstream providers.
+// The slug is our internal model name, e.g. `gpt-4o`, which is combined with the
+// provider in requests, e.g. `openai:gpt-4o`.
+type Model struct {
+	ID            string `json:"id"`
+	Name          string `json:"name"`
+	Slug          string `json:"slug"`
+	Description   string `json:"description"`
+	Group         string `json:"group"`
+	Provider      string `json:"provider"`
+	UpstreamModel string `json:"upstream_model"`
+	Enabled       bool   `json:"enabled"`
+	// Maximum number of tokens the model accepts, 0 if unknown
+	ContextWindow int `json:"context_window"`
+	// Models in the same family are interchangeable and are used as
+	// fallbacks for each other when a provider fails
+	Family string `json:"family"`
+}
+
+// ModelID returns the ID used in requests e.g. `openai:gpt-4o`
+func (m Model) ModelID() string {
+	return m.Provider + ":" + m.Slug
+}
+
+type AIModelRepo interface {
+	// LookupModel returns the model for the given provider and internal model name.
+	// Returns ErrModelDisabled if the model exists but has been retired.
+	LookupModel(provider, slug string) (Model, error)
+	// Fallbacks returns the other enabled models in the same family as the
+	// given model, in the order they were added.
+	Fallbacks(model Model) ([]Model, error)
+}
+
+// InMemoryAIModelRepo serves a fixed list of models.
+// Useful for tests and tooling where there is no database.
+type InMemoryAIModelRepo struct {
+	models []Model
+}
+
+func (r *InMemoryAIModelRepo) LookupModel(provider, slug string) (Model, error) {
+	for _, model := range r.models {
+		if model.Provider != provider || model.Slug != slug {
+			continue
+		}
+		if !model.Enabled {
+			return model, ErrModelDisabled
+		}
+		return model, nil
+	}
+
+	return Model{}, ErrModelNotFound
+}
+
+func (r *InMemoryAIModelRepo) Fallbacks(model Model) ([]Model, error) {
+	var fallbacks []Model
+	if model.Family == "" {
+		return fallbacks, nil
+	}
+
+	for _, candidate := range r.models {
+		if candidate.Family != model.Family || !candidate.Enabled ||
+			candidate.ModelID() == model.ModelID() {
+			continue
+		}
+		fallbacks = append(fallbacks, candidate)
+	}
+
+	return fallbacks, nil
+}
+
+func NewInMemoryAIModelRepo(models []Model) *InMemoryAIModelRepo {
+	return &InMemoryAIModelRepo{
+		models: models,
+	}
+}
+
+// PocketBaseAIModelRepo serves the models stored in the `models` collection.
+// Models are looked up on every request so changes made in the admin UI take
+// effect immediately.
+type PocketBaseAIModelRepo struct {
+	app        core.App
+	collection *models.Collection
+	logger     *slog.Logger
+}
+
+func (r *PocketBaseAIModelRepo) LookupModel(provider, slug string) (Model, error) {
+	records, err := r.app.Dao().FindRecordsByFilter(r.collection.Name,
+		"provider = {:provider} && slug = {:slug}", // filter
+		"-updated", // sort
+		1,          // limit
+		0,          // offset
+		dbx.Params{"provider": provider, "slug": slug}, // params
+	)
+	if err != nil {
+		r.logger.Error("Failed to lookup model", "err", err)
+		return Model{}, err
+	}
+
+	if len(records) == 0 {
+		return Model{}, ErrModelNotFound
+	}
+
+	model := recordToModel(records[0])
+	if !model.Enabled {
+		return model, ErrModelDisabled
+	}
+
+	return model, nil
+}
+
+func (r *PocketBaseAIModelRepo) Fallbacks(model Model) ([]Model, error) {
+	var fallbacks []Model
+	if model.Family == "" {
+		return fallbacks, nil
+	}
+
+	records, err := r.app.Dao().FindRecordsByFilter(r.collection.Name,
+		"family = {:family} && enabled = true && id != {:id}", // filter
+		"created", // sort
+		0,         // limit
+		0,         // offset
+		dbx.Params{"family": model.Family, "id": model.ID}, // params
+	)
+	if err != nil {
+		r.logger.Error("Failed to lookup fallback models", "err", err)
+		return fallbacks, err
+	}
+
+	for _, record := range records {
+		fallbacks = append(fallbacks, recordToModel(record))
+	}
+
+	return fallbacks, nil
+}
+
+func recordToModel(record *models.Record) Model {
+	return Model{
+		ID:            record.Id,
+		Name:          record.GetString("name"),
+		Slug:          record.GetString("slug"),
+		Description:   record.GetString("description"),
+		Group:         record.GetString("group"),
+		Provider:      record.GetString("provider"),
+		UpstreamModel: record.GetString("upstream_model"),
+		Enabled:       record.GetBool("enabled"),
+		ContextWindow: record.GetInt("context_window"),
+		Family:        record.GetString("family"),
+	}
+}
+
+func NewPocketBaseAIModelRepo(
+	app core.App,
+	logger *slog.Logger,
+) *PocketBaseAIModelRepo {
+	collection, err := app.Dao().FindCollectionByNameOrId("models")
+	if err != nil {
+		panic(err)
+	}
+	return &PocketBaseAIModelRepo{
+		app:        app,
+		collection: collection,
+		logger:     logger,
+	}
+}
@@ -0,0 +1,218 @@
+package aitool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode"
+
+	oai "github.com/sashabaranov/go-openai"
+)
+
+var ErrInvalidExpression = errors.New("invalid expression")
+
+// Calculator evaluates arithmetic expressions, which models often get wrong
+type Calculator struct{}
+
+func (Calculator) Definition() oai.FunctionDefinition {
+	return oai.FunctionDefinition{
+		Name:        "calculator",
+		Description: "Evaluate an arithmetic expression with +, -, *, /, % (remainder), ^ (power) and parentheses, e.g. (2 + 3) * 4.5",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"expression": {"type": "string", "description": "The expression to evaluate"}
+			},
+			"required": ["expression"]
+		}`),
+	}
+}
+
+func (Calculator) Call(_ context.Context, _ Env, arguments string) (string, error) {
+	var args struct {
+		Expression string `json:"expression"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidArguments, err)
+	}
+
+	result, err := Evaluate(args.Expression)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidArguments, err)
+	}
+
+	return strconv.FormatFloat(result, 'g', -1, 64), nil
+}
+
+// Evaluate evaluates an arithmetic expression. Powers are right associative
+// and bind tighter than a unary minus, so -2^2 is -4.
+func Evaluate(expression string) (float64, error) {
+	p := &expressionParser{input: []rune(expression)}
+
+	result, err := p.parseSum()
+	if err != nil {
+		return 0, err
+	}
+	p.skipSpaces()
+	if p.pos < len(p.input) {
+		return 0, fmt.Errorf("%w: unexpected %q", ErrInvalidExpression, p.input[p.pos])
+	}
+	if math.IsInf(result, 0) || math.IsNaN(result) {
+		return 0, fmt.Errorf("%w: the result isn't a number", ErrInvalidExpression)
+	}
+
+	return result, nil
+}
+
+// expressionParser is a recursive descent parser of
+//
+//	sum     = product { ("+" | "-") product }
+//	product = unary { ("*" | "/" | "%") unary }
+//	unary   = "-" unary | "+" unary | power
+//	power   = operand [ "^" unary ]
+//	operand = number | "(" sum ")"
+type expressionParser struct {
+	input []rune
+	pos   int
+}
+
+func (p *expressionParser) skipSpaces() {
+	for p.pos < len(p.input) && unicode.IsSpace(p.input[p.pos]) {
+		p.pos++
+	}
+}
+
+// next returns the next operator or parenthesis without consuming it
+func (p *expressionParser) next() rune {
+	p.skipSpaces()
+	if p.pos >= len(p.input) {
+		return 0
+	}
+	return p.input[p.pos]
+}
+
+func (p *expressionParser) parseSum() (float64, error) {
+	result, err := p.parseProduct()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		operator := p.next()
+		if operator != '+' && operator != '-' {
+			return result, nil
+		}
+		p.pos++
+
+		operand, err := p.parseProduct()
+		if err != nil {
+			return 0, err
+		}
+		if operator == '+' {
+			result += operand
+		} else {
+			result -= operand
+		}
+	}
+}
+
+func (p *expressionParser) parseProduct() (float64, error) {
+	result, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		operator := p.next()
+		if operator != '*' && operator != '/' && operator != '%' {
+			return result, nil
+		}
+		p.pos++
+
+		operand, err := p.parseUnary()
+		if err != nil {
+			return 0, err
+		}
+		switch operator {
+		case '*':
+			result *= operand
+		case '/':
+			if operand == 0 {
+				return 0, fmt.Errorf("%w: division by zero", ErrInvalidExpression)
+			}
+			result /= operand
+		case '%':
+			if operand == 0 {
+				return 0, fmt.Errorf("%w: division by zero", ErrInvalidExpression)
+			}
+			result = math.Mod(result, operand)
+		}
+	}
+}
+
+func (p *expressionParser) parseUnary() (float64, error) {
+	switch p.next() {
+	case '-':
+		p.pos++
+		result, err := p.parseUnary()
+		return -result, err
+	case '+':
+		p.pos++
+		return p.parseUnary()
+	}
+
+	return p.parsePower()
+}
+
+func (p *expressionParser) parsePower() (float64, error) {
+	base, err := p.parseOperand()
+	if err != nil {
+		return 0, err
+	}
+	if p.next() != '^' {
+		return base, nil
+	}
+	p.pos++
+
+	exponent, err := p.parseUnary()
+	if err != nil {
+		return 0, err
+	}
+	return math.Pow(base, exponent), nil
+}
+
+func (p *expressionParser) parseOperand() (float64, error) {
+	switch next := p.next(); {
+	case next == 0:
+		return 0, fmt.Errorf("%w: unexpected end", ErrInvalidExpression)
+	case next == '(':
+		p.pos++
+		result, err := p.parseSum()
+		if err != nil {
+			return 0, err
+		}
+		if p.next() != ')' {
+			return 0, fmt.Errorf("%w: missing )", ErrInvalidExpression)
+		}
+		p.pos++
+		return result, nil
+	}
+
+	start := p.pos
+	for p.pos < len(p.input) &&
+		(unicode.IsDigit(p.input[p.pos]) || p.input[p.pos] == '.') {
+		p.pos++
+	}
+	if start == p.pos {
+		return 0, fmt.Errorf("%w: unexpected %q", ErrInvalidExpression, p.input[p.pos])
+	}
+
+	number, err := strconv.ParseFloat(string(p.input[start:p.pos]), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q isn't a number", ErrInvalidExpression, string(p.input[start:p.pos]))
+	}
+	return number, nil
+}
@@ -0,0 +1,67 @@
+package aitool_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aitool"
+)
+
+func TestEvaluate(t *testing.T) {
+	tt := []struct {
+		Expression  string
+		Expected    float64
+		ExpectedErr error
+	}{
+		{Expression: "1 + 2", Expected: 3},
+		{Expression: "2 + 3 * 4", Expected: 14},
+		{Expression: "(2 + 3) * 4.5", Expected: 22.5},
+		{Expression: "10 / 4", Expected: 2.5},
+		{Expression: "10 % 4", Expected: 2},
+		{Expression: "2 ^ 3 ^ 2", Expected: 512},
+		{Expression: "-2 ^ 2", Expected: -4},
+		{Expression: "2 ^ -1", Expected: 0.5},
+		{Expression: "--3", Expected: 3},
+		{Expression: " 7 ", Expected: 7},
+		{Expression: "1 / 0", ExpectedErr: aitool.ErrInvalidExpression},
+		{Expression: "(1 + 2", ExpectedErr: aitool.ErrInvalidExpression},
+		{Expression: "1 +", ExpectedErr: aitool.ErrInvalidExpression},
+		{Expression: "1 2", ExpectedErr: aitool.ErrInvalidExpression},
+		{Expression: "1..2", ExpectedErr: aitool.ErrInvalidExpression},
+		{Expression: "two + 2", ExpectedErr: aitool.ErrInvalidExpression},
+		{Expression: "", ExpectedErr: aitool.ErrInvalidExpression},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Expression, func(t *testing.T) {
+			result, err := aitool.Evaluate(tc.Expression)
+			if !errors.Is(err, tc.ExpectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.ExpectedErr, err)
+			}
+			if result != tc.Expected {
+				t.Errorf("Expected %v, got %v", tc.Expected, result)
+			}
+		})
+	}
+}
+
+func TestCalculatorCall(t *testing.T) {
+	result, err := aitool.Calculator{}.Call(
+		context.Background(),
+		aitool.Env{},
+		`{"expression": "1.5 * 4"}`,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "6" {
+		t.Errorf("Expected 6, got %s", result)
+	}
+
+	for _, arguments := range []string{`{"expression":`, `{"expression": "1 / 0"}`} {
+		_, err = aitool.Calculator{}.Call(context.Background(), aitool.Env{}, arguments)
+		if !errors.Is(err, aitool.ErrInvalidArguments) {
+			t.Errorf("Expected ErrInvalidArguments for %s, got %v", arguments, err)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package aitool
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+	// The server may not have the time zone database installed
+	_ "time/tzdata"
+
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// CurrentTime tells the model the date and time, which it otherwise only
+// knows up to its training cut off
+type CurrentTime struct {
+	Now func() time.Time
+}
+
+func (CurrentTime) Definition() oai.FunctionDefinition {
+	return oai.FunctionDefinition{
+		Name:        "current_time",
+		Description: "Get the current date and time, in UTC unless a time zone is given",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"timezone": {"type": "string", "description": "IANA time zone e.g. Europe/London"}
+			}
+		}`),
+	}
+}
+
+func (t CurrentTime) Call(_ context.Context, _ Env, arguments string) (string, error) {
+	var args struct {
+		Timezone string `json:"timezone"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidArguments, err)
+	}
+
+	location := time.UTC
+	if args.Timezone != "" {
+		var err error
+		location, err = time.LoadLocation(args.Timezone)
+		if err != nil {
+			return "", fmt.Errorf("%w: unknown time zone %s", ErrInvalidArguments, args.Timezone)
+		}
+	}
+
+	now := t.Now().In(location)
+	return fmt.Sprintf("%s, %s (%s)", now.Weekday(), now.Format(time.RFC3339), location), nil
+}
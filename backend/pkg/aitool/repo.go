@@ -0,0 +1,74 @@
+package aitool
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	oai "github.com/sashabaranov/go-openai"
+)
+
+var ErrToolNotFound = errors.New("tool not found")
+
+// ErrInvalidArguments is wrapped by the errors a tool returns for arguments the
+// model can correct
+var ErrInvalidArguments = errors.New("invalid arguments")
+
+// Env is the request a tool is called in
+type Env struct {
+	// Messages the client sent in plain text, before any were trimmed to fit
+	// the context window. The backend can't read the persisted messages so
+	// this is all of the conversation it has.
+	Messages []oai.ChatCompletionMessage
+}
+
+// Tool is a built-in tool the backend runs for an agent when the model calls
+// it, the result is sent back to the model.
+type Tool interface {
+	// Definition describes the function to the model
+	Definition() oai.FunctionDefinition
+	// Call runs the tool with the JSON arguments chosen by the model.
+	// Errors wrapping ErrInvalidArguments are sent to the model so it can
+	// correct its arguments, it's only told the tool failed for the others.
+	Call(ctx context.Context, env Env, arguments string) (string, error)
+}
+
+type AIToolRepo interface {
+	// LookupTool returns the built-in tool by its name
+	LookupTool(name string) (Tool, error)
+}
+
+type InMemoryAIToolRepo struct {
+	tools  map[string]Tool
+	logger *slog.Logger
+}
+
+func (r *InMemoryAIToolRepo) LookupTool(name string) (Tool, error) {
+	tool, ok := r.tools[name]
+	if !ok {
+		return nil, ErrToolNotFound
+	}
+	return tool, nil
+}
+
+// NewInMemoryAIToolRepo returns a repo of the built-in tools
+func NewInMemoryAIToolRepo(
+	logger *slog.Logger,
+) *InMemoryAIToolRepo {
+	tools := []Tool{
+		Calculator{},
+		CurrentTime{Now: time.Now},
+		ConversationSearch{},
+	}
+
+	repo := &InMemoryAIToolRepo{
+		tools:  make(map[string]Tool, len(tools)),
+		logger: logger,
+	}
+	for _, tool := range tools {
+		repo.tools[tool.Definition().Name] = tool
+	}
+
+	return repo
+}
@@ -0,0 +1,113 @@
+package aitool_test
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aitool"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+func TestInMemoryAIToolRepoLookupTool(t *testing.T) {
+	repo := aitool.NewInMemoryAIToolRepo(slog.Default())
+
+	for _, name := range []string{"calculator", "current_time", "search_conversation"} {
+		tool, err := repo.LookupTool(name)
+		if err != nil {
+			t.Fatalf("Expected tool %s, got %v", name, err)
+		}
+		if tool.Definition().Name != name {
+			t.Errorf("Expected tool %s, got %s", name, tool.Definition().Name)
+		}
+	}
+
+	if _, err := repo.LookupTool("rm"); !errors.Is(err, aitool.ErrToolNotFound) {
+		t.Errorf("Expected ErrToolNotFound, got %v", err)
+	}
+}
+
+func TestCurrentTimeCall(t *testing.T) {
+	tool := aitool.CurrentTime{Now: func() time.Time {
+		return time.Date(2024, time.July, 20, 12, 30, 0, 0, time.UTC)
+	}}
+
+	tt := []struct {
+		Name      string
+		Arguments string
+		Expected  string
+		Err       bool
+	}{
+		{
+			Name:      "UTC by default",
+			Arguments: `{}`,
+			Expected:  "Saturday, 2024-07-20T12:30:00Z (UTC)",
+		},
+		{
+			Name:      "Time zone",
+			Arguments: `{"timezone": "Asia/Tokyo"}`,
+			Expected:  "Saturday, 2024-07-20T21:30:00+09:00 (Asia/Tokyo)",
+		},
+		{
+			Name:      "Unknown time zone",
+			Arguments: `{"timezone": "Mars/Olympus_Mons"}`,
+			Err:       true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			result, err := tool.Call(context.Background(), aitool.Env{}, tc.Arguments)
+			if errors.Is(err, aitool.ErrInvalidArguments) != tc.Err {
+				t.Fatalf("Expected error %v, got %v", tc.Err, err)
+			}
+			if result != tc.Expected {
+				t.Errorf("Expected %q, got %q", tc.Expected, result)
+			}
+		})
+	}
+}
+
+func TestSearchMessages(t *testing.T) {
+	messages := []oai.ChatCompletionMessage{
+		{Role: "system", Content: "The cat is a secret"},
+		{Role: "user", Content: "My cat is called Miso"},
+		{Role: "assistant", Content: "Miso is a lovely name for a cat!"},
+		{Role: "user", Content: "What should I cook tonight?"},
+		{Role: "user", Content: strings.Repeat("filler ", 100) + "The dog is called Rex"},
+	}
+
+	results, err := aitool.SearchMessages(messages, "Cat's name, Miso?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// System messages aren't searched, the best and most recent match first
+	if len(results) != 2 || results[0].Index != 2 || results[1].Index != 1 {
+		t.Fatalf("Expected messages 2 and 1, got %+v", results)
+	}
+	if results[0].Role != "assistant" || results[0].Content != messages[2].Content {
+		t.Errorf("Unexpected result %+v", results[0])
+	}
+
+	results, err = aitool.SearchMessages(messages, "rex")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Long messages are shortened around the match
+	if len(results) != 1 ||
+		!strings.HasPrefix(results[0].Content, "…") ||
+		!strings.HasSuffix(results[0].Content, "The dog is called Rex") {
+		t.Errorf("Expected an excerpt of message 4, got %+v", results)
+	}
+
+	results, err = aitool.SearchMessages(messages, "giraffe")
+	if err != nil || len(results) != 0 {
+		t.Errorf("Expected no results, got %+v %v", results, err)
+	}
+
+	if _, err := aitool.SearchMessages(messages, "?!"); err == nil {
+		t.Error("Expected an error for a query without words")
+	}
+}
@@ -0,0 +1,171 @@
+package aitool
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// conversationSearchResults is the most messages a search returns
+	conversationSearchResults = 5
+	// conversationSearchExcerpt is the most characters returned of a message
+	conversationSearchExcerpt = 500
+)
+
+// ConversationSearch finds the messages of the conversation that mention the
+// query, so the model can look back further than its context window. It only
+// searches the text of the messages the client sent with the request.
+type ConversationSearch struct{}
+
+// SearchResult is a message that matched a search
+type SearchResult struct {
+	// Index of the message in the conversation, starting at 0
+	Index   int    `json:"index"`
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+func (ConversationSearch) Definition() oai.FunctionDefinition {
+	return oai.FunctionDefinition{
+		Name:        "search_conversation",
+		Description: "Search the earlier messages of this conversation for words, returns the best matching messages",
+		Parameters: json.RawMessage(`{
+			"type": "object",
+			"properties": {
+				"query": {"type": "string", "description": "The words to search for"}
+			},
+			"required": ["query"]
+		}`),
+	}
+}
+
+func (ConversationSearch) Call(_ context.Context, env Env, arguments string) (string, error) {
+	var args struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidArguments, err)
+	}
+
+	results, err := SearchMessages(env.Messages, args.Query)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidArguments, err)
+	}
+	if len(results) == 0 {
+		return "No messages found", nil
+	}
+
+	encoded, err := json.Marshal(results)
+	return string(encoded), err
+}
+
+// SearchMessages ranks the user and assistant messages by how many of the
+// words in the query they contain, ignoring case
+func SearchMessages(
+	messages []oai.ChatCompletionMessage,
+	query string,
+) ([]SearchResult, error) {
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, errors.New("the query has no words to search for")
+	}
+
+	type match struct {
+		result SearchResult
+		score  int
+		// offset of the first term found, the excerpt starts near it
+		offset int
+	}
+
+	var matches []match
+	for index, message := range messages {
+		if message.Role != oai.ChatMessageRoleUser &&
+			message.Role != oai.ChatMessageRoleAssistant {
+			continue
+		}
+
+		text := proxy.MessageText(message)
+		content := strings.ToLower(text)
+		m := match{
+			result: SearchResult{Index: index, Role: message.Role},
+			offset: len(content),
+		}
+		for _, term := range terms {
+			offset := strings.Index(content, term)
+			if offset < 0 {
+				continue
+			}
+			m.score++
+			m.offset = min(m.offset, offset)
+		}
+		if m.score == 0 {
+			continue
+		}
+
+		m.result.Content = excerpt(text, m.offset)
+		matches = append(matches, m)
+	}
+
+	// The best matches first, the most recent first when they match as well
+	sort.SliceStable(matches, func(i, j int) bool {
+		if matches[i].score != matches[j].score {
+			return matches[i].score > matches[j].score
+		}
+		return matches[i].result.Index > matches[j].result.Index
+	})
+
+	results := make([]SearchResult, 0, min(len(matches), conversationSearchResults))
+	for _, m := range matches[:min(len(matches), conversationSearchResults)] {
+		results = append(results, m.result)
+	}
+
+	return results, nil
+}
+
+// searchTerms splits the query into its lower case words, leaving out single
+// letters which would match almost every message
+func searchTerms(query string) []string {
+	words := strings.FieldsFunc(strings.ToLower(query), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+
+	terms := make([]string, 0, len(words))
+	seen := map[string]bool{}
+	for _, word := range words {
+		if len([]rune(word)) > 1 && !seen[word] {
+			seen[word] = true
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// excerpt shortens the content of a long message, starting a little before
+// the offset of the match in its lower case content
+func excerpt(content string, offset int) string {
+	runes := []rune(content)
+	if len(runes) <= conversationSearchExcerpt {
+		return content
+	}
+
+	// Lower casing can change the byte length so count the runes before it
+	start := len([]rune(strings.ToLower(content)[:offset])) - conversationSearchExcerpt/4
+	start = max(0, min(start, len(runes)-conversationSearchExcerpt))
+
+	result := string(runes[start : start+conversationSearchExcerpt])
+	if start > 0 {
+		result = "…" + result
+	}
+	if start+conversationSearchExcerpt < len(runes) {
+		result += "…"
+	}
+	return result
+}
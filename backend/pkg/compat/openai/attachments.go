@@ -0,0 +1,49 @@
+package openai
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
+	"github.com/pocketbase/pocketbase/apis"
+)
+
+// checkAttachments checks the attachments the request message refers to were
+// uploaded to the conversation and aren't attached to another message yet
+func checkAttachments(
+	attachmentRepo chat.AttachmentRepo,
+	conversationID string,
+	attachments []chat.MessageAttachment,
+) error {
+	if err := chat.ValidateMessageAttachments(attachments); err != nil {
+		return apis.NewBadRequestError("Invalid attachment", err)
+	}
+
+	for _, messageAttachment := range attachments {
+		attachment, err := attachmentRepo.Attachment(conversationID, messageAttachment.ID)
+		if errors.Is(err, chat.ErrAttachmentNotFound) {
+			return apis.NewBadRequestError("Invalid attachment", err)
+		}
+		if err != nil {
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to load attachment",
+				err,
+			)
+		}
+		if attachment.MessageID != "" {
+			return apis.NewApiError(http.StatusConflict, chat.ErrAttachmentLinked.Error(), nil)
+		}
+	}
+
+	return nil
+}
+
+// attachmentIDs returns the IDs of the attachments
+func attachmentIDs(attachments []chat.MessageAttachment) []string {
+	ids := make([]string, 0, len(attachments))
+	for _, attachment := range attachments {
+		ids = append(ids, attachment.ID)
+	}
+	return ids
+}
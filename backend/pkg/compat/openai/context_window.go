@@ -0,0 +1,319 @@
+package openai
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/pkoukk/tiktoken-go"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+var ErrContextWindowExceeded = errors.New("messages do not fit in the model context window")
+
+// ContextStrategy decides what happens to the oldest messages of a conversation
+// when it no longer fits in the context window of the model.
+type ContextStrategy string
+
+const (
+	// ContextStrategyTruncate drops the oldest messages, this is the default
+	ContextStrategyTruncate ContextStrategy = "truncate"
+	// ContextStrategySummarise replaces the oldest messages with a summary
+	ContextStrategySummarise ContextStrategy = "summarise"
+	// ContextStrategyNone sends the messages untouched
+	ContextStrategyNone ContextStrategy = "none"
+)
+
+// ParseContextStrategy returns the strategy, defaulting to truncation if unset.
+func ParseContextStrategy(strategy string) (ContextStrategy, error) {
+	switch ContextStrategy(strategy) {
+	case "", ContextStrategyTruncate:
+		return ContextStrategyTruncate, nil
+	case ContextStrategySummarise, ContextStrategyNone:
+		return ContextStrategy(strategy), nil
+	default:
+		return "", fmt.Errorf("invalid context strategy: %s", strategy)
+	}
+}
+
+const (
+	// Tokens kept free for the response when the request doesn't set max_tokens
+	defaultCompletionTokens = 1024
+	// Tokens kept free for the summary of the dropped messages
+	summaryTokens = 256
+	// Each message costs a few extra tokens for the role and separators
+	// https://cookbook.openai.com/examples/how_to_count_tokens_with_tiktoken
+	tokensPerMessage = 4
+	// Every reply is primed with `<|start|>assistant<|message|>`
+	tokensPerReply = 3
+)
+
+// Tokenizer counts the number of tokens in a piece of text
+type Tokenizer interface {
+	CountTokens(text string) int
+}
+
+// ApproxTokenizer estimates the number of tokens for models whose vocabulary
+// isn't public, see TokenizerForModel. It errs on the side of over counting so
+// trimmed messages fit whichever model they are sent to.
+type ApproxTokenizer struct{}
+
+func (ApproxTokenizer) CountTokens(text string) int {
+	// Roughly 4 characters, or 3/4 of a word, per token for English text
+	// https://help.openai.com/en/articles/4936856-what-are-tokens-and-how-to-count-them
+	byChars := (utf8.RuneCountInString(text) + 3) / 4
+	byWords := (len(strings.Fields(text))*4 + 2) / 3
+	return max(byChars, byWords)
+}
+
+// bpeTokenizer counts tokens exactly with the byte pair encoding of an OpenAI
+// model
+type bpeTokenizer struct {
+	encoding *tiktoken.Tiktoken
+}
+
+func (t bpeTokenizer) CountTokens(text string) int {
+	return len(t.encoding.EncodeOrdinary(text))
+}
+
+// bpeEncodings loads each encoding once, as the vocabulary is downloaded the
+// first time it's used. A failed load is kept too, so an unreachable
+// vocabulary doesn't slow down every request.
+var bpeEncodings sync.Map // encoding name -> func() (*tiktoken.Tiktoken, error)
+
+// TokenizerForModel returns the tokenizer for the upstream model. The OpenAI
+// models are counted with their own encoding, the others, or an OpenAI model
+// whose encoding can't be loaded, fall back to ApproxTokenizer.
+func TokenizerForModel(logger *slog.Logger, model string) Tokenizer {
+	encodingName, ok := tiktoken.MODEL_TO_ENCODING[model]
+	if !ok {
+		for prefix, name := range tiktoken.MODEL_PREFIX_TO_ENCODING {
+			if strings.HasPrefix(model, prefix) {
+				encodingName, ok = name, true
+				break
+			}
+		}
+	}
+	if !ok {
+		return ApproxTokenizer{}
+	}
+
+	load, _ := bpeEncodings.LoadOrStore(
+		encodingName,
+		sync.OnceValues(func() (*tiktoken.Tiktoken, error) {
+			encoding, err := tiktoken.GetEncoding(encodingName)
+			if err != nil {
+				logger.Error(
+					"Failed to load the token encoding, estimating tokens instead",
+					"encoding", encodingName,
+					"err", err,
+				)
+			}
+			return encoding, err
+		}),
+	)
+	encoding, err := load.(func() (*tiktoken.Tiktoken, error))()
+	if err != nil {
+		return ApproxTokenizer{}
+	}
+
+	return bpeTokenizer{encoding: encoding}
+}
+
+// Summariser summarises the messages that no longer fit in the context window
+type Summariser func(messages []oai.ChatCompletionMessage) (string, error)
+
+// ContextBudget returns how many tokens the messages can use for a model with
+// the given context window, leaving room for the response.
+// Returns 0 if the context window is unknown.
+func ContextBudget(contextWindow, maxTokens int) int {
+	if contextWindow <= 0 {
+		return 0
+	}
+	if maxTokens <= 0 {
+		maxTokens = min(defaultCompletionTokens, contextWindow/4)
+	}
+	return max(contextWindow-maxTokens-tokensPerReply, 0)
+}
+
+// FitContextWindow drops, or summarises, the oldest messages until the messages
+// fit in the budget. Expects the messages to have been through AddSystemMessage
+// so the system message and agent examples are at the start, these and the
+// latest message are always kept.
+func FitContextWindow(
+	messages []oai.ChatCompletionMessage,
+	agent aiagent.Prompt,
+	strategy ContextStrategy,
+	budget int,
+	tokenizer Tokenizer,
+	summarise Summariser,
+) ([]oai.ChatCompletionMessage, error) {
+	if strategy == ContextStrategyNone || budget <= 0 || len(messages) == 0 {
+		return messages, nil
+	}
+
+	if strategy == ContextStrategySummarise {
+		budget -= summaryTokens
+	}
+
+	prefix, history := splitPrompt(messages, agent)
+	used := promptTokens(prefix, agent, tokenizer)
+
+	// Walk back from the latest message keeping as many as fit
+	keepFrom := len(history)
+	for keepFrom > 0 {
+		start := toolCallStart(history, keepFrom-1)
+		groupTokens := 0
+		for _, message := range history[start:keepFrom] {
+			groupTokens += countMessageTokens(tokenizer, message)
+		}
+		// The latest message is always needed
+		if used+groupTokens > budget && keepFrom != len(history) {
+			break
+		}
+		used += groupTokens
+		keepFrom = start
+	}
+	if used > budget {
+		return nil, ErrContextWindowExceeded
+	}
+
+	dropped := history[:keepFrom]
+	if len(dropped) == 0 {
+		return messages, nil
+	}
+
+	trimmed := append(
+		append([]oai.ChatCompletionMessage{}, prefix...),
+		history[keepFrom:]...,
+	)
+
+	if strategy != ContextStrategySummarise || summarise == nil ||
+		len(prefix) == 0 || prefix[0].Role != oai.ChatMessageRoleSystem {
+		return trimmed, nil
+	}
+
+	summary, err := summarise(dropped)
+	if err != nil {
+		// Still usable without the summary, just forgetful
+		return trimmed, nil
+	}
+	// Fold the summary into the system message as some providers only
+	// support a single system message
+	trimmed[0].Content = fmt.Sprintf(
+		"%s\n\nSummary of the earlier conversation:\n%s",
+		trimmed[0].Content,
+		summary,
+	)
+
+	return trimmed, nil
+}
+
+// splitPrompt splits the messages into the agent prompt (system message and
+// examples) and the conversation history.
+func splitPrompt(
+	messages []oai.ChatCompletionMessage,
+	agent aiagent.Prompt,
+) (prefix, history []oai.ChatCompletionMessage) {
+	prefixLen := 0
+	if messages[0].Role == oai.ChatMessageRoleSystem {
+		prefixLen = 1 + len(agent.Examples)
+	}
+	// Always leave the latest message in the history
+	prefixLen = min(prefixLen, len(messages)-1)
+
+	return messages[:prefixLen], messages[prefixLen:]
+}
+
+// toolCallStart returns the assistant message calling tools if the message at
+// i is one of their results, so they are kept or dropped together. Upstreams
+// reject tool results without the call they answer. Otherwise returns i.
+func toolCallStart(history []oai.ChatCompletionMessage, i int) int {
+	start := i
+	for start > 0 && history[start].Role == oai.ChatMessageRoleTool {
+		start--
+	}
+	if start < i && history[start].Role == oai.ChatMessageRoleAssistant &&
+		len(history[start].ToolCalls) > 0 {
+		return start
+	}
+
+	return i
+}
+
+// promptTokens counts the tokens used by the agent prompt, using the recorded
+// token count of the agent when it's the agent's own system message.
+func promptTokens(
+	prefix []oai.ChatCompletionMessage,
+	agent aiagent.Prompt,
+	tokenizer Tokenizer,
+) int {
+	if len(prefix) > 0 && agent.NumTokens > 0 &&
+		prefix[0].Content == agent.SystemMessage {
+		return agent.NumTokens + tokensPerMessage*len(prefix)
+	}
+
+	tokens := 0
+	for _, message := range prefix {
+		tokens += countMessageTokens(tokenizer, message)
+	}
+	return tokens
+}
+
+func countMessageTokens(tokenizer Tokenizer, message oai.ChatCompletionMessage) int {
+	return tokensPerMessage +
+		tokenizer.CountTokens(proxy.MessageText(message)) +
+		imageTokens*countImages(message)
+}
+
+// EstimateUsage estimates the tokens used by a completion for providers that
+// don't report their usage.
+func EstimateUsage(
+	tokenizer Tokenizer,
+	messages []oai.ChatCompletionMessage,
+	response string,
+) oai.Usage {
+	promptTokens := tokensPerReply
+	for _, message := range messages {
+		promptTokens += countMessageTokens(tokenizer, message)
+	}
+	completionTokens := tokenizer.CountTokens(response)
+
+	return oai.Usage{
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		TotalTokens:      promptTokens + completionTokens,
+	}
+}
+
+// summaryRequest builds a request asking the model to summarise the messages
+func summaryRequest(
+	req oai.ChatCompletionRequest,
+	messages []oai.ChatCompletionMessage,
+) oai.ChatCompletionRequest {
+	var transcript strings.Builder
+	for _, message := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", message.Role, proxy.MessageText(message))
+	}
+
+	return oai.ChatCompletionRequest{
+		Model:     req.Model,
+		User:      req.User,
+		MaxTokens: summaryTokens,
+		Messages: []oai.ChatCompletionMessage{
+			{
+				Role:    oai.ChatMessageRoleSystem,
+				Content: "Summarise the following conversation in a few sentences. Keep any names, facts and decisions that later messages may refer to.",
+			},
+			{
+				Role:    oai.ChatMessageRoleUser,
+				Content: transcript.String(),
+			},
+		},
+	}
+}
@@ -0,0 +1,333 @@
+package openai_test
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/compat/openai"
+	"github.com/pkoukk/tiktoken-go"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// wordTokenizer counts every word as a token to keep the maths simple
+type wordTokenizer struct{}
+
+func (wordTokenizer) CountTokens(text string) int {
+	return len(strings.Fields(text))
+}
+
+func message(role, content string) oai.ChatCompletionMessage {
+	return oai.ChatCompletionMessage{Role: role, Content: content}
+}
+
+func TestFitContextWindow(t *testing.T) {
+	agent := aiagent.Prompt{
+		SystemMessage: "be helpful",
+		Examples: []oai.ChatCompletionMessage{
+			message("user", "hi"),
+			message("assistant", "hello"),
+		},
+	}
+	// Every message costs 4 tokens on top of its words
+	messages := []oai.ChatCompletionMessage{
+		message("system", "be helpful"),      // 6
+		message("user", "hi"),                // 5
+		message("assistant", "hello"),        // 5
+		message("user", "one two three"),     // 7
+		message("assistant", "four five"),    // 6
+		message("user", "six seven eight"),   // 7
+		message("assistant", "nine"),         // 5
+		message("user", "ten eleven twelve"), // 7
+	}
+
+	summarise := func(messages []oai.ChatCompletionMessage) (string, error) {
+		return "they counted", nil
+	}
+
+	tt := []struct {
+		Name string
+
+		Strategy         openai.ContextStrategy
+		Budget           int
+		Summarise        openai.Summariser
+		ExpectedMessages []oai.ChatCompletionMessage
+		ExpectedErr      error
+	}{
+		{
+			Name:             "Fits without trimming",
+			Strategy:         openai.ContextStrategyTruncate,
+			Budget:           100,
+			ExpectedMessages: messages,
+		},
+		{
+			Name:             "Unknown context window",
+			Strategy:         openai.ContextStrategyTruncate,
+			Budget:           0,
+			ExpectedMessages: messages,
+		},
+		{
+			Name:     "Drops the oldest messages",
+			Strategy: openai.ContextStrategyTruncate,
+			Budget:   35,
+			ExpectedMessages: []oai.ChatCompletionMessage{
+				message("system", "be helpful"),
+				message("user", "hi"),
+				message("assistant", "hello"),
+				message("user", "six seven eight"),
+				message("assistant", "nine"),
+				message("user", "ten eleven twelve"),
+			},
+		},
+		{
+			Name:             "Strategy none leaves the messages untouched",
+			Strategy:         openai.ContextStrategyNone,
+			Budget:           35,
+			ExpectedMessages: messages,
+		},
+		{
+			Name:        "Latest message does not fit",
+			Strategy:    openai.ContextStrategyTruncate,
+			Budget:      20,
+			ExpectedErr: openai.ErrContextWindowExceeded,
+		},
+		{
+			Name:      "Summarises the dropped messages",
+			Strategy:  openai.ContextStrategySummarise,
+			Budget:    35 + 256,
+			Summarise: summarise,
+			ExpectedMessages: []oai.ChatCompletionMessage{
+				message(
+					"system",
+					"be helpful\n\nSummary of the earlier conversation:\nthey counted",
+				),
+				message("user", "hi"),
+				message("assistant", "hello"),
+				message("user", "six seven eight"),
+				message("assistant", "nine"),
+				message("user", "ten eleven twelve"),
+			},
+		},
+		{
+			Name:     "Falls back to truncating when the summary fails",
+			Strategy: openai.ContextStrategySummarise,
+			Budget:   35 + 256,
+			Summarise: func(messages []oai.ChatCompletionMessage) (string, error) {
+				return "", errors.New("upstream unavailable")
+			},
+			ExpectedMessages: []oai.ChatCompletionMessage{
+				message("system", "be helpful"),
+				message("user", "hi"),
+				message("assistant", "hello"),
+				message("user", "six seven eight"),
+				message("assistant", "nine"),
+				message("user", "ten eleven twelve"),
+			},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			original := slices.Clone(messages)
+
+			trimmed, err := openai.FitContextWindow(
+				messages,
+				agent,
+				tc.Strategy,
+				tc.Budget,
+				wordTokenizer{},
+				tc.Summarise,
+			)
+			if !errors.Is(err, tc.ExpectedErr) {
+				t.Fatalf("Expected error %v, got %v", tc.ExpectedErr, err)
+			}
+			if !reflect.DeepEqual(trimmed, tc.ExpectedMessages) {
+				t.Errorf("Expected messages %v, got %v", tc.ExpectedMessages, trimmed)
+			}
+			if !reflect.DeepEqual(messages, original) {
+				t.Error("Expected the original messages to be left untouched")
+			}
+		})
+	}
+}
+
+func TestFitContextWindowToolCalls(t *testing.T) {
+	agent := aiagent.Prompt{SystemMessage: "be helpful"}
+	toolCall := oai.ChatCompletionMessage{
+		Role: oai.ChatMessageRoleAssistant,
+		ToolCalls: []oai.ToolCall{
+			{ID: "call_1", Type: oai.ToolTypeFunction},
+			{ID: "call_2", Type: oai.ToolTypeFunction},
+		},
+	}
+	toolResult := func(id, content string) oai.ChatCompletionMessage {
+		return oai.ChatCompletionMessage{
+			Role:       oai.ChatMessageRoleTool,
+			Content:    content,
+			ToolCallID: id,
+		}
+	}
+	messages := []oai.ChatCompletionMessage{
+		message("system", "be helpful"),        // 6
+		message("user", "what is the weather"), // 8
+		toolCall,                               // 4
+		toolResult("call_1", "sunny"),          // 5
+		toolResult("call_2", "warm"),           // 5
+		message("assistant", "it is sunny"),    // 7
+		message("user", "thanks"),              // 5
+	}
+
+	tt := []struct {
+		Name string
+
+		Budget           int
+		ExpectedMessages []oai.ChatCompletionMessage
+	}{
+		{
+			Name:   "Drops the tool call with its results",
+			Budget: 25,
+			ExpectedMessages: []oai.ChatCompletionMessage{
+				message("system", "be helpful"),
+				message("assistant", "it is sunny"),
+				message("user", "thanks"),
+			},
+		},
+		{
+			Name:   "Keeps the tool call with its results",
+			Budget: 32,
+			ExpectedMessages: []oai.ChatCompletionMessage{
+				message("system", "be helpful"),
+				toolCall,
+				toolResult("call_1", "sunny"),
+				toolResult("call_2", "warm"),
+				message("assistant", "it is sunny"),
+				message("user", "thanks"),
+			},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			trimmed, err := openai.FitContextWindow(
+				messages,
+				agent,
+				openai.ContextStrategyTruncate,
+				tc.Budget,
+				wordTokenizer{},
+				nil,
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(trimmed, tc.ExpectedMessages) {
+				t.Errorf("Expected messages %v, got %v", tc.ExpectedMessages, trimmed)
+			}
+		})
+	}
+}
+
+// fakeBpeLoader is a tiny vocabulary of every byte, along with `he` and `ll`,
+// so the tests don't download the real one
+type fakeBpeLoader struct{}
+
+func (fakeBpeLoader) LoadTiktokenBpe(string) (map[string]int, error) {
+	ranks := make(map[string]int, 258)
+	for b := 0; b < 256; b++ {
+		ranks[string([]byte{byte(b)})] = b
+	}
+	ranks["he"] = 256
+	ranks["ll"] = 257
+	return ranks, nil
+}
+
+func TestTokenizerForModel(t *testing.T) {
+	tiktoken.SetBpeLoader(fakeBpeLoader{})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	// he + ll + o
+	if tokens := openai.TokenizerForModel(logger, "gpt-4o").CountTokens("hello"); tokens != 3 {
+		t.Errorf("Expected 3 tokens for an OpenAI model, got %d", tokens)
+	}
+	if tokens := openai.TokenizerForModel(logger, "gpt-4o-mini").CountTokens("hello"); tokens != 3 {
+		t.Errorf("Expected 3 tokens for a dated OpenAI model, got %d", tokens)
+	}
+
+	tokenizer := openai.TokenizerForModel(logger, "claude-3-5-sonnet-20240620")
+	if _, ok := tokenizer.(openai.ApproxTokenizer); !ok {
+		t.Errorf("Expected to estimate the tokens of other models, got %T", tokenizer)
+	}
+}
+
+func TestContextBudget(t *testing.T) {
+	tt := []struct {
+		Name string
+
+		ContextWindow  int
+		MaxTokens      int
+		ExpectedBudget int
+	}{
+		{
+			Name:           "Unknown context window",
+			ContextWindow:  0,
+			ExpectedBudget: 0,
+		},
+		{
+			Name:           "Reserves the requested max tokens",
+			ContextWindow:  8192,
+			MaxTokens:      2000,
+			ExpectedBudget: 8192 - 2000 - 3,
+		},
+		{
+			Name:           "Reserves default tokens for the response",
+			ContextWindow:  8192,
+			ExpectedBudget: 8192 - 1024 - 3,
+		},
+		{
+			Name:           "Reserves a quarter of a small context window",
+			ContextWindow:  2048,
+			ExpectedBudget: 2048 - 512 - 3,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			budget := openai.ContextBudget(tc.ContextWindow, tc.MaxTokens)
+			if budget != tc.ExpectedBudget {
+				t.Errorf("Expected budget %d, got %d", tc.ExpectedBudget, budget)
+			}
+		})
+	}
+}
+
+func TestEstimateUsageImages(t *testing.T) {
+	messages := []oai.ChatCompletionMessage{
+		message(oai.ChatMessageRoleSystem, "be brief"),
+		{
+			Role: oai.ChatMessageRoleUser,
+			MultiContent: []oai.ChatMessagePart{
+				{Type: oai.ChatMessagePartTypeText, Text: "what are these"},
+				{
+					Type:     oai.ChatMessagePartTypeImageURL,
+					ImageURL: &oai.ChatMessageImageURL{URL: "https://example.com/a.png"},
+				},
+				{
+					Type:     oai.ChatMessagePartTypeImageURL,
+					ImageURL: &oai.ChatMessageImageURL{URL: "https://example.com/b.png"},
+				},
+			},
+		},
+	}
+
+	usage := openai.EstimateUsage(wordTokenizer{}, messages, "two cats")
+
+	// 3 to prime the reply, 4 per message, the words and 765 per image
+	expectedPromptTokens := 3 + 4 + 2 + 4 + 3 + 2*765
+	if usage.PromptTokens != expectedPromptTokens {
+		t.Errorf("Expected %d prompt tokens, got %d", expectedPromptTokens, usage.PromptTokens)
+	}
+	if usage.CompletionTokens != 2 {
+		t.Errorf("Expected 2 completion tokens, got %d", usage.CompletionTokens)
+	}
+}
@@ -0,0 +1,55 @@
+package openai
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aitool"
+	"github.com/labstack/echo/v5"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// ValidateStructuredOutput checks the answer is in the response format, as it
+// would be before it's sent to the client
+func ValidateStructuredOutput(format *ResponseFormat, answer string) error {
+	output, err := parseResponseFormat(slog.Default(), format)
+	if err != nil || output == nil {
+		return err
+	}
+	return output.validate(answer)
+}
+
+// CallTool runs the tool as the tool loop does, returning what the model is
+// sent
+func CallTool(tool aitool.Tool, arguments string) string {
+	loop := &toolLoop{logger: slog.Default()}
+	c := echo.New().NewContext(
+		httptest.NewRequest(http.MethodPost, "/", nil),
+		httptest.NewRecorder(),
+	)
+	return loop.callTool(c, tool, oai.ToolCall{
+		Function: oai.FunctionCall{Name: tool.Definition().Name, Arguments: arguments},
+	})
+}
+
+type ToolStream = toolStream
+
+// NewToolStream puts a toolStream in front of the response, as the tool loop
+// does when the client asks for a stream
+func NewToolStream(c echo.Context, keepAliveInterval time.Duration) *ToolStream {
+	return newToolStream(c, keepAliveInterval)
+}
+
+func (s *toolStream) GatheredToolCalls() []oai.ToolCall {
+	return s.gatheredToolCalls()
+}
+
+func (s *toolStream) Discard() {
+	s.discard()
+}
+
+func (s *toolStream) Close(c echo.Context) error {
+	return s.close(c)
+}
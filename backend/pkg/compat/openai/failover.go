@@ -0,0 +1,108 @@
+package openai
+
+import (
+	"log/slog"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/labstack/echo/v5"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// Response header with the model that actually handled the request, useful
+// for streams where the response metadata isn't sent
+const headerCognosModel = "X-Cognos-Model"
+
+// completionTarget is a provider and model the request can be sent to
+type completionTarget struct {
+	Provider      string
+	Model         string // Our internal model name
+	UpstreamModel string
+	Upstream      proxy.Upstream
+}
+
+// ModelID returns the ID used in requests e.g. `openai:gpt-4o`
+func (t completionTarget) ModelID() string {
+	return t.Provider + modelDelimiter + t.Model
+}
+
+// fallbackTargets returns the equivalent models on other providers to try if
+// the provider of the requested model fails. Models the agent isn't allowed to
+// use are left out.
+func fallbackTargets(
+	logger *slog.Logger,
+	modelRepo aimodel.AIModelRepo,
+	upstreamRepo proxy.UpstreamRepo,
+	agent aiagent.Agent,
+	provider, model string,
+) []completionTarget {
+	var targets []completionTarget
+
+	modelInfo, err := modelRepo.LookupModel(provider, model)
+	if err != nil {
+		// Not in the catalogue e.g. only declared in the config
+		return targets
+	}
+	fallbacks, err := modelRepo.Fallbacks(modelInfo)
+	if err != nil {
+		return targets
+	}
+
+	for _, fallback := range fallbacks {
+		if !agent.AllowsModel(fallback.ModelID()) {
+			continue
+		}
+		upstream, err := upstreamRepo.Provider(fallback.Provider)
+		if err != nil {
+			logger.Warn(
+				"Fallback model provider not available",
+				"model", fallback.ModelID(),
+				"err", err,
+			)
+			continue
+		}
+		targets = append(targets, completionTarget{
+			Provider:      fallback.Provider,
+			Model:         fallback.Slug,
+			UpstreamModel: fallback.UpstreamModel,
+			Upstream:      upstream,
+		})
+	}
+
+	return targets
+}
+
+// chatCompletionWithFailover sends the request to each target in turn until one
+// succeeds. It only moves on when the provider is unavailable and nothing has
+// been written to the client yet, a half streamed response can't be retried.
+func chatCompletionWithFailover(
+	c echo.Context,
+	logger *slog.Logger,
+	req proxy.ChatCompletionRequest,
+	targets []completionTarget,
+) (resp oai.ChatCompletionResponse, plainTextResponseMessage string, target completionTarget, err error) {
+	for i, target := range targets {
+		req.Model = target.UpstreamModel
+		c.Response().Header().Set(headerCognosModel, target.ModelID())
+
+		resp, plainTextResponseMessage, err = target.Upstream.ChatCompletion(c, req)
+		if err == nil {
+			return resp, plainTextResponseMessage, target, nil
+		}
+
+		isLastTarget := i == len(targets)-1
+		if isLastTarget || c.Response().Committed || !proxy.IsRetryable(err) {
+			return resp, plainTextResponseMessage, target, err
+		}
+
+		logger.Warn(
+			"Upstream failed, trying fallback model",
+			"model", target.ModelID(),
+			"fallback", targets[i+1].ModelID(),
+			"err", err,
+		)
+	}
+
+	return resp, plainTextResponseMessage, target, err
+}
@@ -0,0 +1,91 @@
+package openai
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// maxImagesPerRequest is the most images accepted in a request, Anthropic's
+	// limit as it's the lowest of the providers
+	maxImagesPerRequest = 20
+	// imageTokens is roughly what an image costs, the providers charge by its
+	// dimensions but we don't decode the images to find them. This is what
+	// OpenAI charges for a 1024x1024 image in high detail.
+	imageTokens = 765
+)
+
+// validateImages checks the images in the messages before anything is sent
+// upstream. Images can only be sent by the user, either as a base64 data URL
+// of a supported format and size or as an https URL which is checked when the
+// provider, or the proxy on its behalf, downloads it.
+func validateImages(messages []oai.ChatCompletionMessage) error {
+	images := 0
+	for _, message := range messages {
+		for _, part := range message.MultiContent {
+			if part.Type != oai.ChatMessagePartTypeImageURL {
+				continue
+			}
+			if message.Role != oai.ChatMessageRoleUser {
+				return fmt.Errorf("%w: only user messages can have images", proxy.ErrInvalidImage)
+			}
+			if part.ImageURL == nil {
+				return fmt.Errorf("%w: missing image_url", proxy.ErrInvalidImage)
+			}
+
+			images++
+			if images > maxImagesPerRequest {
+				return fmt.Errorf(
+					"%w: more than %d images",
+					proxy.ErrInvalidImage,
+					maxImagesPerRequest,
+				)
+			}
+
+			url := part.ImageURL.URL
+			switch {
+			case strings.HasPrefix(url, "data:"):
+				if _, err := proxy.ParseDataURL(url); err != nil {
+					return err
+				}
+			case strings.HasPrefix(url, "https://"):
+			default:
+				return fmt.Errorf(
+					"%w: images must be a data URL or https URL",
+					proxy.ErrInvalidImage,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// messageImages returns the images of a message to be persisted with it
+func messageImages(message oai.ChatCompletionMessage) []chat.MessageImage {
+	var images []chat.MessageImage
+	for _, part := range message.MultiContent {
+		if part.Type == oai.ChatMessagePartTypeImageURL && part.ImageURL != nil {
+			images = append(images, chat.MessageImage{
+				URL:    part.ImageURL.URL,
+				Detail: string(part.ImageURL.Detail),
+			})
+		}
+	}
+	return images
+}
+
+// countImages counts the image parts of a message
+func countImages(message oai.ChatCompletionMessage) int {
+	images := 0
+	for _, part := range message.MultiContent {
+		if part.Type == oai.ChatMessagePartTypeImageURL {
+			images++
+		}
+	}
+	return images
+}
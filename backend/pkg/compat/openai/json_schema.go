@@ -0,0 +1,129 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dlclark/regexp2"
+	"github.com/santhosh-tekuri/jsonschema/v6"
+)
+
+// jsonSchemaURL identifies the schema of the response, it isn't loaded from
+// anywhere
+const jsonSchemaURL = "urn:cognos:response-schema"
+
+// patternTimeout stops a pattern which backtracks badly from holding up the
+// request, the schema comes from the client
+const patternTimeout = 100 * time.Millisecond
+
+// jsonSchema is a JSON schema the response of a model can be checked against
+type jsonSchema struct {
+	schema *jsonschema.Schema
+}
+
+// parseJSONSchema compiles a JSON schema, which defaults to draft 2020-12.
+// References can only be to the schema itself, nothing is loaded from files or
+// the network.
+func parseJSONSchema(data []byte) (*jsonSchema, error) {
+	doc, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+
+	compiler := jsonschema.NewCompiler()
+	compiler.DefaultDraft(jsonschema.Draft2020)
+	compiler.UseLoader(jsonschema.SchemeURLLoader{})
+	compiler.UseRegexpEngine(compileECMAScriptPattern)
+	if err := compiler.AddResource(jsonSchemaURL, doc); err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+	schema, err := compiler.Compile(jsonSchemaURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON schema: %w", err)
+	}
+
+	return &jsonSchema{schema: schema}, nil
+}
+
+// isObject checks the schema only allows JSON objects
+func (s *jsonSchema) isObject() bool {
+	return s.schema.Types != nil &&
+		slices.Equal(s.schema.Types.ToStrings(), []string{"object"})
+}
+
+// validateJSON checks the JSON document matches the schema
+func (s *jsonSchema) validateJSON(data []byte) error {
+	value, err := jsonschema.UnmarshalJSON(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+
+	err = s.schema.Validate(value)
+	var validationErr *jsonschema.ValidationError
+	if !errors.As(err, &validationErr) {
+		return err
+	}
+
+	// Only the errors themselves, the model is told what to fix and doesn't
+	// need the schema they come from
+	var messages []string
+	var collect func(err *jsonschema.ValidationError)
+	collect = func(err *jsonschema.ValidationError) {
+		if len(err.Causes) == 0 {
+			messages = append(messages, err.Error())
+		}
+		for _, cause := range err.Causes {
+			collect(cause)
+		}
+	}
+	collect(validationErr)
+
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// ecmaScriptPattern matches patterns as JavaScript does, which JSON schemas
+// are written for, rather than the RE2 syntax of Go
+type ecmaScriptPattern struct {
+	*regexp2.Regexp
+}
+
+func (p ecmaScriptPattern) MatchString(s string) bool {
+	// A pattern which times out doesn't match
+	matched, err := p.Regexp.MatchString(s)
+	return err == nil && matched
+}
+
+func compileECMAScriptPattern(pattern string) (jsonschema.Regexp, error) {
+	re, err := regexp2.Compile(pattern, regexp2.ECMAScript)
+	if err != nil {
+		return nil, err
+	}
+	re.MatchTimeout = patternTimeout
+
+	return ecmaScriptPattern{Regexp: re}, nil
+}
+
+// isJSONObject checks if the text is a JSON object, and nothing else
+func isJSONObject(text string) error {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") {
+		return errors.New("expected a JSON object")
+	}
+
+	decoder := json.NewDecoder(strings.NewReader(text))
+	var object map[string]any
+	if err := decoder.Decode(&object); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	if _, err := decoder.Token(); !errors.Is(err, io.EOF) {
+		return errors.New("expected only a JSON object")
+	}
+
+	return nil
+}
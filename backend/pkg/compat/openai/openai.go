@@ -4,15 +4,25 @@
 package openai
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/cognos-io/chat.cognos.io/backend/internal/apierror"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/auth"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/chat"
 	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/permissions"
+	"github.com/cognos-io/chat.cognos.io/backend/internal/usage"
 	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aitool"
 	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
 	"github.com/labstack/echo/v5"
 	"github.com/pocketbase/pocketbase/apis"
@@ -34,6 +44,12 @@ type RequestMetadata struct {
 		ConversationID  string `json:"conversation_id,omitempty"`
 		AgentID         string `json:"agent_id,omitempty"`
 		RequestID       string `json:"request_id,omitempty"` // Arbitrary ID for frontend to track requests
+		// How to handle messages that don't fit in the model context window,
+		// one of `truncate` (default), `summarise` or `none`
+		ContextStrategy string `json:"context_strategy,omitempty"`
+		// Attachments uploaded to the conversation that the message refers to,
+		// they're kept with the request message
+		Attachments []chat.MessageAttachment `json:"attachments,omitempty"`
 	} `json:"cognos,omitempty"`
 }
 
@@ -46,6 +62,10 @@ type CognosResponseMetadata struct {
 	ResponseRecordID string `json:"response_record_id,omitempty"`
 	// When the messages will expire
 	ExpiresAt string `json:"expires_at,omitempty"`
+	// Provider and model that handled the request, these differ from the
+	// request if the provider failed and an equivalent model was used
+	Provider string `json:"provider,omitempty"`
+	ModelID  string `json:"model_id,omitempty"`
 }
 
 type ResponseMetadata struct {
@@ -54,7 +74,10 @@ type ResponseMetadata struct {
 
 type ChatCompletionRequestWithMetadata struct {
 	oai.ChatCompletionRequest
-	Metadata RequestMetadata `json:"metadata,omitempty"`
+	// ResponseFormat replaces the one of the embedded request, which can't
+	// have a JSON schema
+	ResponseFormat *ResponseFormat `json:"response_format,omitempty"`
+	Metadata       RequestMetadata `json:"metadata,omitempty"`
 }
 
 type ChatCompletionResponseWithMetadata struct {
@@ -62,20 +85,6 @@ type ChatCompletionResponseWithMetadata struct {
 	Metadata ResponseMetadata `json:"metadata,omitempty"`
 }
 
-func NewError(code int, message string) oai.ErrorResponse {
-	var errorType string
-	switch code {
-	case http.StatusBadRequest:
-		errorType = "invalid_request_error"
-	case http.StatusNotFound:
-		errorType = "not_found_error"
-	default:
-		errorType = "api_error"
-	}
-
-	return oai.ErrorResponse{Error: &oai.APIError{Type: errorType, Message: message}}
-}
-
 func EchoHandler(
 	config *config.APIConfig,
 	logger *slog.Logger,
@@ -83,7 +92,12 @@ func EchoHandler(
 	messageRepo chat.MessageRepo,
 	keyPairRepo auth.KeyPairRepo,
 	agentRepo aiagent.AIAgentRepo,
+	toolRepo aitool.AIToolRepo,
 	conversationRepo chat.ConversationRepo,
+	permissionsRepo permissions.PermissionsRepo,
+	modelRepo aimodel.AIModelRepo,
+	usageRepo usage.TokenUsageRepo,
+	attachmentRepo chat.AttachmentRepo,
 ) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		// -------------------------------------------------------
@@ -102,11 +116,27 @@ func EchoHandler(
 		// Add the user ID to the request. It's nothing personal but is used to help
 		// identify abuse of our AI providers
 		req.User = owner.ID
+		// The built-in tools can search all of the plain text messages the
+		// client sent, even those trimmed to fit the context window
+		toolEnv := aitool.Env{Messages: req.Messages}
 
 		// Validate the incoming request
 		if req.Metadata.Cognos.AgentID == "" {
 			return apis.NewBadRequestError("Agent ID is required", nil)
 		}
+		if err := validateImages(req.Messages); err != nil {
+			return apis.NewBadRequestError("Invalid image", err)
+		}
+		structuredOutput, err := parseResponseFormat(logger, req.ResponseFormat)
+		if err != nil {
+			return apis.NewBadRequestError("Invalid response format", err)
+		}
+		contextStrategy, err := ParseContextStrategy(
+			req.Metadata.Cognos.ContextStrategy,
+		)
+		if err != nil {
+			return apis.NewBadRequestError("Invalid context strategy", err)
+		}
 		// Extract the upstream based on the model
 		modelParts := strings.Split(req.Model, modelDelimiter)
 		if len(modelParts) != 2 {
@@ -123,29 +153,144 @@ func EchoHandler(
 		if err != nil {
 			return apis.NewBadRequestError("Invalid model name", err)
 		}
+		// If there is no conversation ID then we don't encrypt and persist the message.
+		// This could be useful if:
+		// - The user is using their own frontend which doesn't support conversation IDs
+		// - The message is temporary and shouldn't be persisted
+		// - The message is used to generate conversation titles
+		shouldPersist := req.Metadata.Cognos.ConversationID != ""
+
 		// Check the user has permission to write to this conversation
+		if shouldPersist {
+			canWrite, _, err := permissionsRepo.HasWritePermission(
+				apis.RequestInfo(c),
+				req.Metadata.Cognos.ConversationID,
+			)
+			if errors.Is(err, sql.ErrNoRows) {
+				return apis.NewNotFoundError(
+					"Conversation not found or unable to load",
+					err,
+				)
+			}
+			if err != nil {
+				logger.Error("Failed to check conversation permissions", "err", err)
+				return apis.NewApiError(
+					http.StatusInternalServerError,
+					"Failed to check conversation permissions",
+					err,
+				)
+			}
+			if !canWrite {
+				return c.JSON(
+					http.StatusForbidden,
+					apierror.New(
+						http.StatusForbidden,
+						"You do not have permission to write to this conversation",
+					),
+				)
+			}
+		}
+
+		attachments := req.Metadata.Cognos.Attachments
+		if len(attachments) > 0 {
+			if !shouldPersist {
+				return apis.NewBadRequestError("Attachments need a conversation", nil)
+			}
+			err := checkAttachments(
+				attachmentRepo,
+				req.Metadata.Cognos.ConversationID,
+				attachments,
+			)
+			if err != nil {
+				return err
+			}
+		}
 
 		// Lookup the agent
-		agent, err := agentRepo.LookupPrompt(req.Metadata.Cognos.AgentID)
+		agent, err := agentRepo.LookupAgent(req.Metadata.Cognos.AgentID)
 		if err != nil {
 			return apis.NewBadRequestError("Invalid agent ID", err)
 		}
 		// Check user has permission to access the agent
+		if !agent.CanAccess(owner.ID) {
+			return c.JSON(
+				http.StatusForbidden,
+				apierror.New(
+					http.StatusForbidden,
+					"You do not have permission to use this agent",
+				),
+			)
+		}
+		if !agent.AllowsModel(strings.Join(modelParts, modelDelimiter)) {
+			return apis.NewBadRequestError("Model not allowed for agent", nil)
+		}
+		agentTools, err := lookupAgentTools(toolRepo, agent)
+		if err != nil {
+			return apis.NewBadRequestError("Invalid agent tool", err)
+		}
+
+		// Check the user has tokens left
+		err = usage.CheckQuota(usageRepo, owner.ID, config.Quota(owner.Plan), time.Now())
+		var quotaErr *usage.QuotaExceededError
+		if errors.As(err, &quotaErr) {
+			c.Response().Header().Set(
+				"Retry-After",
+				strconv.Itoa(int(time.Until(quotaErr.ResetsAt).Seconds())+1),
+			)
+			resp := apierror.New(http.StatusTooManyRequests, quotaErr.Error())
+			resp.Error.Code = "insufficient_quota"
+			return c.JSON(http.StatusTooManyRequests, resp)
+		}
+		if err != nil {
+			logger.Error("Failed to check quota", "err", err)
+			return apis.NewApiError(
+				http.StatusInternalServerError,
+				"Failed to check quota",
+				err,
+			)
+		}
+		// Record the tokens used, and what they cost, for every upstream
+		// request including summaries
+		recordUsage := func(
+			target completionTarget,
+			messages []oai.ChatCompletionMessage,
+			resp oai.ChatCompletionResponse,
+			plainTextResponseMessage string,
+		) {
+			tokens := resp.Usage
+			if tokens.TotalTokens == 0 {
+				// Not every provider reports usage, especially when streaming
+				tokens = EstimateUsage(
+					TokenizerForModel(logger, target.UpstreamModel),
+					messages,
+					plainTextResponseMessage,
+				)
+			}
+			price, ok := config.Price(target.Provider, target.Model)
+			if !ok {
+				logger.Warn("No price for model", "model", target.ModelID())
+			}
+			err := usageRepo.RecordUsage(usage.CompletionUsage{
+				UserID:           owner.ID,
+				AgentID:          agent.Slug,
+				ModelID:          target.ModelID(),
+				PromptTokens:     tokens.PromptTokens,
+				CompletionTokens: tokens.CompletionTokens,
+				Cost:             usage.Cost(price, tokens.PromptTokens, tokens.CompletionTokens),
+			})
+			if err != nil {
+				logger.Error("Failed to record token usage", "err", err)
+			}
+		}
 
 		// -------------------------------------------------------
 		// 2. Process the request
 		// -------------------------------------------------------
 
-		// If there is no conversation ID then we don't encrypt and persist the message.
-		// This could be useful if:
-		// - The user is using their own frontend which doesn't support conversation IDs
-		// - The message is temporary and shouldn't be persisted
-		// - The message is used to generate conversation titles
-		shouldPersist := req.Metadata.Cognos.ConversationID != ""
-
 		var conversation chat.Conversation
 		if shouldPersist {
 			conversation, err = conversationRepo.ByID(
+				c,
 				req.Metadata.Cognos.ConversationID,
 			)
 			if err != nil {
@@ -159,14 +304,58 @@ func EchoHandler(
 		var messageRecord, responseRecord *models.Record
 
 		// Add the agent prompt system message to the conversation
-		req.Messages = AddSystemMessage(req.Messages, agent)
+		req.Messages = AddSystemMessage(req.Messages, agent.Prompt)
+		if structuredOutput != nil {
+			req.ChatCompletionRequest = structuredOutput.apply(req.ChatCompletionRequest)
+		}
+
+		// Make sure the conversation fits in the model context window
+		contextWindow := 0
+		if modelInfo, err := modelRepo.LookupModel(provider, model); err == nil {
+			contextWindow = modelInfo.ContextWindow
+		}
+		req.Messages, err = FitContextWindow(
+			req.Messages,
+			agent.Prompt,
+			contextStrategy,
+			ContextBudget(contextWindow, req.MaxTokens),
+			TokenizerForModel(logger, req.Model),
+			func(messages []oai.ChatCompletionMessage) (string, error) {
+				summaryReq := summaryRequest(req.ChatCompletionRequest, messages)
+				resp, summary, err := upstream.ChatCompletion(
+					c,
+					proxy.ChatCompletionRequest{ChatCompletionRequest: summaryReq},
+				)
+				if err != nil {
+					logger.Error("Failed to summarise messages", "err", err)
+					return summary, err
+				}
+				recordUsage(
+					completionTarget{Provider: provider, Model: model, UpstreamModel: req.Model},
+					summaryReq.Messages,
+					resp,
+					summary,
+				)
+				return summary, nil
+			},
+		)
+		if err != nil {
+			return apis.NewBadRequestError(
+				"Messages do not fit in the model context window",
+				err,
+			)
+		}
 
 		// Encrypt and persist the incoming message
-		plainTextRequestMessage := req.Messages[len(req.Messages)-1].Content // Use the last message as there could be system and previous system & user messages
+		lastMessage := req.Messages[len(req.Messages)-1] // Use the last message as there could be system and previous system & user messages
+		plainTextRequestMessage := proxy.MessageText(lastMessage)
 
 		requestMessage := chat.MessageRecordData{
 			OwnerID: owner.ID,
 			Content: plainTextRequestMessage,
+			Images:  messageImages(lastMessage),
+			// The client inlines the attachments in the messages it sends
+			Attachments: attachments,
 		}
 
 		if shouldPersist {
@@ -183,20 +372,138 @@ func EchoHandler(
 					err,
 				)
 			}
+
+			if len(attachments) > 0 {
+				err := attachmentRepo.LinkToMessage(
+					conversation.ID,
+					messageRecord.Id,
+					attachmentIDs(attachments),
+				)
+				if err != nil {
+					logger.Error("Failed to attach files to message", "err", err)
+					if err := messageRepo.DeleteMessage(messageRecord.Id); err != nil {
+						logger.Error("Failed to clean up message record", "err", err)
+					}
+					if errors.Is(err, chat.ErrAttachmentLinked) {
+						return apis.NewApiError(http.StatusConflict, err.Error(), nil)
+					}
+					return apis.NewApiError(
+						http.StatusInternalServerError,
+						"Failed to attach files to message",
+						err,
+					)
+				}
+			}
 		}
 
 		// -------------------------------------------------------
 		// 3. Use the selected model and agent to generate the response
 		// -------------------------------------------------------
-		resp, plainTextResponseMessage, err := upstream.ChatCompletion(
-			c,
-			req.ChatCompletionRequest,
+		// Equivalent models on other providers are tried if the provider fails
+		targets := append(
+			[]completionTarget{{
+				Provider:      provider,
+				Model:         model,
+				UpstreamModel: req.Model,
+				Upstream:      upstream,
+			}},
+			fallbackTargets(logger, modelRepo, upstreamRepo, agent, provider, model)...,
 		)
-		if err != nil && messageRecord != nil {
+		var (
+			resp                     oai.ChatCompletionResponse
+			plainTextResponseMessage string
+			target                   completionTarget
+		)
+		var loop *toolLoop
+		if len(agentTools) > 0 {
+			loop = &toolLoop{
+				logger:            logger,
+				tools:             agentTools,
+				env:               toolEnv,
+				maxSteps:          agent.ToolSteps(),
+				keepAliveInterval: toolKeepAliveInterval,
+				onResponse:        recordUsage,
+				onToolCalls: func(
+					target completionTarget,
+					call oai.ChatCompletionMessage,
+					results []oai.ChatCompletionMessage,
+				) error {
+					if !shouldPersist {
+						return nil
+					}
+
+					// The tool calls and results are kept with the request
+					// message, so they're deleted with it
+					messages := []chat.MessageRecordData{{
+						Content:   call.Content,
+						AgentID:   req.Metadata.Cognos.AgentID,
+						ModelID:   target.ModelID(),
+						ToolCalls: call.ToolCalls,
+					}}
+					for _, result := range results {
+						messages = append(messages, chat.MessageRecordData{
+							Content:    result.Content,
+							AgentID:    req.Metadata.Cognos.AgentID,
+							ToolCallID: result.ToolCallID,
+						})
+					}
+					for _, message := range messages {
+						err, _ := messageRepo.EncryptAndPersistMessage(
+							conversation,
+							messageRecord.Id,
+							message,
+						)
+						if err != nil {
+							return fmt.Errorf("failed to save tool call message: %w", err)
+						}
+					}
+
+					return nil
+				},
+			}
+		}
+		complete := func(completionReq proxy.ChatCompletionRequest) (
+			oai.ChatCompletionResponse,
+			string,
+			completionTarget,
+			error,
+		) {
+			if loop != nil {
+				return loop.run(c, completionReq, targets)
+			}
+
+			resp, plainTextResponseMessage, target, err := chatCompletionWithFailover(
+				c,
+				logger,
+				completionReq,
+				targets,
+			)
+			if err == nil {
+				recordUsage(target, completionReq.Messages, resp, plainTextResponseMessage)
+			}
+			return resp, plainTextResponseMessage, target, err
+		}
+		upstreamReq := proxy.ChatCompletionRequest{ChatCompletionRequest: req.ChatCompletionRequest}
+		if structuredOutput != nil {
+			upstreamReq.ResponseSchema = structuredOutput.responseSchema()
+			resp, plainTextResponseMessage, target, err = structuredOutput.run(
+				c,
+				upstreamReq,
+				complete,
+			)
+		} else {
+			resp, plainTextResponseMessage, target, err = complete(upstreamReq)
+		}
+		if err != nil {
 			logger.Error("Failed to process request", "err", err)
 			// Try to clean up the originally saved message
-			if err := messageRepo.DeleteMessage(messageRecord.Id); err != nil {
-				logger.Error("Failed to clean up message record", "err", err)
+			if messageRecord != nil {
+				if err := messageRepo.DeleteMessage(messageRecord.Id); err != nil {
+					logger.Error("Failed to clean up message record", "err", err)
+				}
+			}
+			if errors.Is(err, ErrInvalidStructuredOutput) {
+				return apis.NewApiError(http.StatusBadGateway, err.Error(), nil)
 			}
 			return apis.NewApiError(
 				http.StatusInternalServerError,
@@ -211,10 +518,7 @@ func EchoHandler(
 		responseMessage := chat.MessageRecordData{
 			Content: plainTextResponseMessage,
 			AgentID: req.Metadata.Cognos.AgentID,
-			ModelID: strings.Join(
-				modelParts,
-				modelDelimiter,
-			), // rejoin the model parts to store the full model name
+			ModelID: target.ModelID(), // the model that actually responded
 		}
 
 		if shouldPersist {
@@ -233,10 +537,17 @@ func EchoHandler(
 			}
 		}
 
+		// Streamed responses have already been sent to the client
+		if c.Response().Committed {
+			return nil
+		}
+
 		var extendedResponse ChatCompletionResponseWithMetadata
 		extendedResponse.ChatCompletionResponse = resp
 		extendedResponse.Metadata.Cognos = CognosResponseMetadata{
 			RequestID: req.Metadata.Cognos.RequestID,
+			Provider:  target.Provider,
+			ModelID:   target.ModelID(),
 		}
 
 		if conversation.ExpiryDuration > 0 {
@@ -285,11 +596,11 @@ func AddSystemMessage(
 			Role:    "system",
 			Content: agent.SystemMessage,
 		}
-		// TODO(ewan): we may also need to trim the message by the number of tokens in the prompt to fit it within the model context window
 	}
 
 	return append(
 		[]oai.ChatCompletionMessage{systemMessage},
-		append(agent.Examples, newMessages...)...,
+		// Clone so we never write into the backing array of the shared examples
+		append(slices.Clone(agent.Examples), newMessages...)...,
 	)
 }
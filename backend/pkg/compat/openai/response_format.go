@@ -0,0 +1,242 @@
+package openai
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/labstack/echo/v5"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// Response format types, go-openai doesn't know about JSON schemas yet
+const (
+	responseFormatText       = "text"
+	responseFormatJSONObject = "json_object"
+	responseFormatJSONSchema = "json_schema"
+)
+
+// ErrInvalidStructuredOutput is returned when the model still doesn't answer
+// in the requested format after being asked to correct itself
+var ErrInvalidStructuredOutput = errors.New("the model did not respond in the requested format")
+
+var responseFormatNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ResponseFormat is the `response_format` of the request, which can also be a
+// JSON schema the response must match
+type ResponseFormat struct {
+	Type       string                    `json:"type"`
+	JSONSchema *ResponseFormatJSONSchema `json:"json_schema,omitempty"`
+}
+
+type ResponseFormatJSONSchema struct {
+	Name        string          `json:"name"`
+	Description string          `json:"description,omitempty"`
+	Schema      json.RawMessage `json:"schema,omitempty"`
+	// Strict is accepted for compatibility, the response is always checked
+	// against the schema
+	Strict bool `json:"strict,omitempty"`
+}
+
+// structuredOutput checks the answer of the model is in the response format
+// the client asked for. Not every upstream can be made to answer in JSON, so
+// the answer is checked and the model asked once to correct it.
+type structuredOutput struct {
+	logger *slog.Logger
+	format ResponseFormat
+	// schema is only set for the `json_schema` format
+	schema *jsonSchema
+}
+
+// parseResponseFormat checks the response format of the request. There's
+// nothing to check for a plain text response, so nil is returned.
+func parseResponseFormat(
+	logger *slog.Logger,
+	format *ResponseFormat,
+) (*structuredOutput, error) {
+	if format == nil {
+		return nil, nil
+	}
+
+	switch format.Type {
+	case "", responseFormatText:
+		return nil, nil
+	case responseFormatJSONObject:
+		return &structuredOutput{logger: logger, format: *format}, nil
+	case responseFormatJSONSchema:
+	default:
+		return nil, fmt.Errorf("unsupported response format type %q", format.Type)
+	}
+
+	jsonSchema := format.JSONSchema
+	if jsonSchema == nil {
+		return nil, errors.New("the json_schema response format needs a json_schema")
+	}
+	if !responseFormatNamePattern.MatchString(jsonSchema.Name) {
+		return nil, errors.New(
+			"the name of the JSON schema must be up to 64 letters, digits, underscores or dashes",
+		)
+	}
+	if len(jsonSchema.Schema) == 0 {
+		return nil, errors.New("the json_schema response format needs a schema")
+	}
+
+	schema, err := parseJSONSchema(jsonSchema.Schema)
+	if err != nil {
+		return nil, err
+	}
+	// The response is always a JSON object, as it is with OpenAI
+	if !schema.isObject() {
+		return nil, errors.New("the JSON schema must be of an object")
+	}
+
+	return &structuredOutput{logger: logger, format: *format, schema: schema}, nil
+}
+
+// instructions tell the model how to answer. OpenAI refuses JSON mode unless
+// the messages ask for JSON, and the other upstreams need telling anyway.
+func (s *structuredOutput) instructions() string {
+	if s.schema == nil {
+		return "Respond with only a JSON object."
+	}
+
+	instructions := "Respond with only a JSON object that matches the JSON schema " +
+		s.format.JSONSchema.Name
+	if s.format.JSONSchema.Description != "" {
+		instructions += " (" + s.format.JSONSchema.Description + ")"
+	}
+
+	return instructions + ":\n" + string(s.format.JSONSchema.Schema)
+}
+
+// apply adds the instructions to the system message and asks the upstreams
+// for JSON, which the ones with a JSON mode use
+func (s *structuredOutput) apply(req oai.ChatCompletionRequest) oai.ChatCompletionRequest {
+	req.ResponseFormat = &oai.ChatCompletionResponseFormat{
+		Type: oai.ChatCompletionResponseFormatTypeJSONObject,
+	}
+
+	instructions := s.instructions()
+	req.Messages = slices.Clone(req.Messages)
+	if len(req.Messages) == 0 || req.Messages[0].Role != oai.ChatMessageRoleSystem {
+		req.Messages = append([]oai.ChatCompletionMessage{{
+			Role:    oai.ChatMessageRoleSystem,
+			Content: instructions,
+		}}, req.Messages...)
+		return req
+	}
+
+	system := req.Messages[0]
+	if len(system.MultiContent) > 0 {
+		system.MultiContent = append(slices.Clone(system.MultiContent), oai.ChatMessagePart{
+			Type: oai.ChatMessagePartTypeText,
+			Text: "\n\n" + instructions,
+		})
+	} else {
+		system.Content += "\n\n" + instructions
+	}
+	req.Messages[0] = system
+
+	return req
+}
+
+// responseSchema is the JSON schema for the upstreams which can constrain
+// their output to one, nil for the `json_object` format
+func (s *structuredOutput) responseSchema() json.RawMessage {
+	if s.schema == nil {
+		return nil
+	}
+
+	return s.format.JSONSchema.Schema
+}
+
+// validate checks the answer is a JSON object, matching the schema if there
+// is one
+func (s *structuredOutput) validate(answer string) error {
+	if err := isJSONObject(answer); err != nil {
+		return err
+	}
+	if s.schema == nil {
+		return nil
+	}
+
+	return s.schema.validateJSON([]byte(answer))
+}
+
+// run completes the request, checking the answer. An invalid answer is sent
+// back to the model to correct, once. The answer can only be checked once
+// it's complete, so if the client asked for a stream it's sent as one at the
+// end.
+//
+// A response which calls the client's tools isn't an answer yet, so it's
+// returned as it is.
+func (s *structuredOutput) run(
+	c echo.Context,
+	req proxy.ChatCompletionRequest,
+	complete func(req proxy.ChatCompletionRequest) (
+		oai.ChatCompletionResponse,
+		string,
+		completionTarget,
+		error,
+	),
+) (resp oai.ChatCompletionResponse, plainTextResponseMessage string, target completionTarget, err error) {
+	clientWantsStream := req.Stream
+	req.Stream = false
+
+	for attempt := 0; ; attempt++ {
+		resp, plainTextResponseMessage, target, err = complete(req)
+		if err != nil {
+			return resp, plainTextResponseMessage, target, err
+		}
+		if len(resp.Choices) > 0 && len(resp.Choices[0].Message.ToolCalls) > 0 {
+			break
+		}
+
+		invalid := s.validate(plainTextResponseMessage)
+		if invalid == nil {
+			break
+		}
+		if attempt > 0 {
+			return resp, plainTextResponseMessage, target, fmt.Errorf(
+				"%w: %v",
+				ErrInvalidStructuredOutput,
+				invalid,
+			)
+		}
+
+		s.logger.Warn(
+			"Invalid structured output, asking the model to correct it",
+			"model", target.ModelID(),
+			"err", invalid,
+		)
+		req.Messages = slices.Clone(req.Messages)
+		// Some upstreams reject empty messages
+		if plainTextResponseMessage != "" {
+			req.Messages = append(req.Messages, oai.ChatCompletionMessage{
+				Role:    oai.ChatMessageRoleAssistant,
+				Content: plainTextResponseMessage,
+			})
+		}
+		req.Messages = append(req.Messages, oai.ChatCompletionMessage{
+			Role: oai.ChatMessageRoleUser,
+			Content: fmt.Sprintf(
+				"Your response is invalid: %v. %s",
+				invalid,
+				s.instructions(),
+			),
+		})
+	}
+
+	if clientWantsStream {
+		if err := proxy.WriteStreamResponse(c, resp); err != nil {
+			s.logger.Error("Failed to write to response", "err", err)
+			return resp, plainTextResponseMessage, target, err
+		}
+	}
+
+	return resp, plainTextResponseMessage, target, nil
+}
@@ -0,0 +1,150 @@
+package openai_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/compat/openai"
+)
+
+func TestValidateStructuredOutput(t *testing.T) {
+	const schema = `{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string", "minLength": 1, "pattern": "^[A-Z]"},
+			"legs": {"type": "integer", "minimum": 0, "maximum": 10},
+			"habitat": {"enum": ["sea", "land"]},
+			"diet": {"type": ["string", "null"]},
+			"tag": {"type": "string", "pattern": "^(?=.*[0-9])[a-z0-9]+$"},
+			"friends": {
+				"type": "array",
+				"items": {"$ref": "#/$defs/animal"},
+				"maxItems": 2
+			}
+		},
+		"required": ["name", "legs"],
+		"additionalProperties": false,
+		"$defs": {
+			"animal": {
+				"type": "object",
+				"properties": {"name": {"type": "string"}},
+				"required": ["name"]
+			}
+		}
+	}`
+	jsonSchema := &openai.ResponseFormat{
+		Type: "json_schema",
+		JSONSchema: &openai.ResponseFormatJSONSchema{
+			Name:   "animal",
+			Schema: json.RawMessage(schema),
+		},
+	}
+	jsonObject := &openai.ResponseFormat{Type: "json_object"}
+
+	tests := []struct {
+		name    string
+		format  *openai.ResponseFormat
+		answer  string
+		wantErr string
+	}{
+		{"plain text", nil, "Eight legs", ""},
+		{"object", jsonObject, ` {"legs": 8} `, ""},
+		{"not JSON", jsonObject, "Eight legs", "expected a JSON object"},
+		{"array", jsonObject, `[8]`, "expected a JSON object"},
+		{"trailing text", jsonObject, `{"legs": 8} Hope that helps!`, "expected only a JSON object"},
+		{"truncated", jsonObject, `{"legs": 8`, "invalid JSON: unexpected EOF"},
+		{
+			"matches the schema",
+			jsonSchema,
+			`{"name": "Octopus", "legs": 8, "habitat": "sea", "diet": null, "tag": "o8", "friends": [{"name": "Crab"}]}`,
+			"",
+		},
+		{"missing property", jsonSchema, `{"name": "Octopus"}`, "at '': missing property 'legs'"},
+		{"wrong type", jsonSchema, `{"name": "Octopus", "legs": "eight"}`, "at '/legs': got string, want integer"},
+		{"not an integer", jsonSchema, `{"name": "Octopus", "legs": 8.5}`, "at '/legs': got number, want integer"},
+		{"too many", jsonSchema, `{"name": "Octopus", "legs": 80}`, "at '/legs': maximum: got 80, want 10"},
+		{"too short", jsonSchema, `{"name": "", "legs": 8}`,
+			"at '/name': minLength: got 0, want 1; at '/name': '' does not match pattern '^[A-Z]'"},
+		{"pattern", jsonSchema, `{"name": "octopus", "legs": 8}`, "at '/name': 'octopus' does not match pattern '^[A-Z]'"},
+		{
+			"JavaScript pattern",
+			jsonSchema,
+			`{"name": "Octopus", "legs": 8, "tag": "octopus"}`,
+			"at '/tag': 'octopus' does not match pattern '^(?=.*[0-9])[a-z0-9]+$'",
+		},
+		{
+			"not in the enum",
+			jsonSchema,
+			`{"name": "Octopus", "legs": 8, "habitat": "sky"}`,
+			"at '/habitat': value must be one of 'sea', 'land'",
+		},
+		{
+			"additional property",
+			jsonSchema,
+			`{"name": "Octopus", "legs": 8, "arms": 8}`,
+			"at '': additional properties 'arms' not allowed",
+		},
+		{
+			"referenced definition",
+			jsonSchema,
+			`{"name": "Octopus", "legs": 8, "friends": [{"legs": 10}]}`,
+			"at '/friends/0': missing property 'name'",
+		},
+		{
+			"too many items",
+			jsonSchema,
+			`{"name": "Octopus", "legs": 8, "friends": [{"name": "A"}, {"name": "B"}, {"name": "C"}]}`,
+			"at '/friends': maxItems: got 3, want 2",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := openai.ValidateStructuredOutput(tt.format, tt.answer)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("Expected the answer to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("Expected %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestParseResponseFormat(t *testing.T) {
+	jsonSchema := func(name, schema string) *openai.ResponseFormat {
+		return &openai.ResponseFormat{
+			Type: "json_schema",
+			JSONSchema: &openai.ResponseFormatJSONSchema{
+				Name:   name,
+				Schema: json.RawMessage(schema),
+			},
+		}
+	}
+
+	tests := []struct {
+		name   string
+		format *openai.ResponseFormat
+	}{
+		{"unsupported type", &openai.ResponseFormat{Type: "yaml"}},
+		{"missing json_schema", &openai.ResponseFormat{Type: "json_schema"}},
+		{"invalid name", jsonSchema("an animal", `{"type": "object"}`)},
+		{"missing schema", jsonSchema("animal", ``)},
+		{"not an object", jsonSchema("animal", `{"type": "string"}`)},
+		{"unknown type", jsonSchema("animal", `{"type": "object", "properties": {"a": {"type": "int"}}}`)},
+		{"invalid pattern", jsonSchema("animal", `{"type": "object", "properties": {"a": {"pattern": "("}}}`)},
+		{"remote reference", jsonSchema("animal", `{"type": "object", "properties": {"a": {"$ref": "https://example.com/a.json"}}}`)},
+		{"file reference", jsonSchema("animal", `{"type": "object", "properties": {"a": {"$ref": "file:///etc/passwd"}}}`)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := openai.ValidateStructuredOutput(tt.format, "{}"); err == nil {
+				t.Error("Expected the response format to be invalid")
+			}
+		})
+	}
+}
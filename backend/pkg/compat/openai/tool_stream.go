@@ -0,0 +1,240 @@
+package openai
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v5"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// toolKeepAliveInterval is how often a streaming client is sent a comment
+// while the tools run, so the connection isn't closed for being idle
+const toolKeepAliveInterval = 15 * time.Second
+
+var (
+	sseEventEnd      = []byte("\n\n")
+	sseData          = []byte("data:")
+	sseDone          = []byte("[DONE]")
+	keepAliveComment = []byte(": keep-alive\n\n")
+)
+
+// toolStream sits in front of the response while the tool loop streams its
+// steps to the client. The content of a step is passed through as it's
+// written, but once the model calls a tool the rest of the step is held back:
+// the loop runs the built-in tools itself and only the calls of the client's
+// tools are released to it.
+//
+// Comments are sent while nothing else is, once the response has started, so
+// the client knows the request is still running.
+type toolStream struct {
+	http.ResponseWriter
+
+	mu sync.Mutex
+	// started is set once the headers have been written
+	started bool
+	// lastWrite is when the client was last sent something
+	lastWrite time.Time
+	// partial is the start of an event that hasn't been completely written
+	partial []byte
+	// holding is set once the model calls a tool, the events since are held
+	holding bool
+	held    []byte
+	// toolCalls are gathered from the held events
+	toolCalls []oai.ToolCall
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newToolStream puts the stream in front of the response, sending keep-alive
+// comments every interval until it's closed
+func newToolStream(c echo.Context, interval time.Duration) *toolStream {
+	s := &toolStream{
+		ResponseWriter: c.Response().Writer,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	c.Response().Writer = s
+
+	go s.keepAlive(interval)
+
+	return s
+}
+
+// close stops the keep-alive comments and takes the stream out of the
+// response, releasing anything still held
+func (s *toolStream) close(c echo.Context) error {
+	close(s.stop)
+	<-s.done
+	c.Response().Writer = s.ResponseWriter
+
+	return s.release()
+}
+
+func (s *toolStream) keepAlive(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		s.mu.Lock()
+		if s.started && time.Since(s.lastWrite) >= interval {
+			// A failed write shows up on the next write of the response
+			_ = s.write(keepAliveComment)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *toolStream) WriteHeader(statusCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.started = true
+	s.lastWrite = time.Now()
+	s.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Write passes through or holds each complete event
+func (s *toolStream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.started = true
+	s.partial = append(s.partial, p...)
+	for {
+		end := bytes.Index(s.partial, sseEventEnd)
+		if end < 0 {
+			break
+		}
+		event := s.partial[:end+len(sseEventEnd)]
+		s.partial = s.partial[end+len(sseEventEnd):]
+
+		s.gatherToolCalls(event)
+		if s.holding {
+			s.held = append(s.held, event...)
+			continue
+		}
+		if err := s.write(event); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+func (s *toolStream) Flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.holding {
+		s.flush()
+	}
+}
+
+func (s *toolStream) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// gatherToolCalls adds the tool calls of the event, which starts holding the
+// stream back
+func (s *toolStream) gatherToolCalls(event []byte) {
+	data, ok := bytes.CutPrefix(event, sseData)
+	if !ok || bytes.Equal(bytes.TrimSpace(data), sseDone) {
+		return
+	}
+	var chunk oai.ChatCompletionStreamResponse
+	if err := json.Unmarshal(data, &chunk); err != nil {
+		return
+	}
+
+	for _, choice := range chunk.Choices {
+		if choice.Index != 0 {
+			continue
+		}
+		for _, delta := range choice.Delta.ToolCalls {
+			s.holding = true
+
+			i := len(s.toolCalls)
+			if delta.Index != nil {
+				i = *delta.Index
+			}
+			for len(s.toolCalls) <= i {
+				s.toolCalls = append(s.toolCalls, oai.ToolCall{})
+			}
+
+			toolCall := &s.toolCalls[i]
+			if delta.ID != "" {
+				toolCall.ID = delta.ID
+			}
+			if delta.Type != "" {
+				toolCall.Type = delta.Type
+			}
+			if delta.Function.Name != "" {
+				toolCall.Function.Name = delta.Function.Name
+			}
+			toolCall.Function.Arguments += delta.Function.Arguments
+		}
+	}
+}
+
+// gatheredToolCalls returns the tool calls the model has made in the step
+func (s *toolStream) gatheredToolCalls() []oai.ToolCall {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return slices.Clone(s.toolCalls)
+}
+
+// discard drops the events held back in the step, as the built-in tools it
+// calls are run by the loop, and starts the next step
+func (s *toolStream) discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.partial = nil
+	s.holding = false
+	s.held = nil
+	s.toolCalls = nil
+}
+
+// release sends the held events to the client
+func (s *toolStream) release() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.holding = false
+	held := s.held
+	s.held = nil
+	if len(held) == 0 {
+		return nil
+	}
+
+	return s.write(held)
+}
+
+// write sends the bytes to the client, expects the lock to be held
+func (s *toolStream) write(p []byte) error {
+	if _, err := s.ResponseWriter.Write(p); err != nil {
+		return err
+	}
+	s.lastWrite = time.Now()
+	s.flush()
+
+	return nil
+}
+
+func (s *toolStream) flush() {
+	_ = http.NewResponseController(s.ResponseWriter).Flush()
+}
@@ -0,0 +1,208 @@
+package openai
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aiagent"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aitool"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/labstack/echo/v5"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// lookupAgentTools returns the built-in tools of the agent
+func lookupAgentTools(toolRepo aitool.AIToolRepo, agent aiagent.Agent) ([]aitool.Tool, error) {
+	tools := make([]aitool.Tool, 0, len(agent.Tools))
+	for _, name := range agent.Tools {
+		tool, err := toolRepo.LookupTool(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		tools = append(tools, tool)
+	}
+
+	return tools, nil
+}
+
+// toolLoop runs the built-in tools of an agent. The request is sent upstream,
+// the tools the model calls are run and their results sent back, until the
+// model answers or runs out of steps.
+type toolLoop struct {
+	logger   *slog.Logger
+	tools    []aitool.Tool
+	env      aitool.Env
+	maxSteps int
+	// keepAliveInterval is how often a streaming client is sent a comment
+	// while nothing else is sent, see toolStream
+	keepAliveInterval time.Duration
+	// onResponse is called with every upstream response, so its usage can
+	// be recorded
+	onResponse func(
+		target completionTarget,
+		messages []oai.ChatCompletionMessage,
+		resp oai.ChatCompletionResponse,
+		plainTextResponseMessage string,
+	)
+	// onToolCalls is called with the model message calling the tools and
+	// the messages with their results, so they can be persisted
+	onToolCalls func(
+		target completionTarget,
+		call oai.ChatCompletionMessage,
+		results []oai.ChatCompletionMessage,
+	) error
+}
+
+// run sends the request to the targets as chatCompletionWithFailover does,
+// returning the final answer. If the client asked for a stream every step is
+// streamed through a toolStream: the answer reaches the client as it's
+// written, while the calls of built-in tools are held back and run here. When
+// the model is out of steps it isn't given a choice and has to answer.
+//
+// A response that calls tools the client sent, rather than built-in tools,
+// is returned to the client to run them.
+func (l *toolLoop) run(
+	c echo.Context,
+	req proxy.ChatCompletionRequest,
+	targets []completionTarget,
+) (resp oai.ChatCompletionResponse, plainTextResponseMessage string, target completionTarget, err error) {
+	tools := make(map[string]aitool.Tool, len(l.tools))
+	req.Tools = slices.Clone(req.Tools)
+	for _, tool := range l.tools {
+		definition := tool.Definition()
+		tools[definition.Name] = tool
+		req.Tools = append(req.Tools, oai.Tool{
+			Type:     oai.ToolTypeFunction,
+			Function: &definition,
+		})
+	}
+	// The tool calls and results are added to the messages at each step
+	req.Messages = slices.Clone(req.Messages)
+
+	var stream *toolStream
+	if req.Stream {
+		stream = newToolStream(c, l.keepAliveInterval)
+		defer func() {
+			// Releases the calls of the client's tools
+			if closeErr := stream.close(c); closeErr != nil && err == nil {
+				l.logger.Error("Failed to write to response", "err", closeErr)
+				err = closeErr
+			}
+		}()
+	}
+
+	for step := 0; ; step++ {
+		isLastStep := step == l.maxSteps
+
+		stepReq := req
+		if isLastStep {
+			stepReq.ToolChoice = "none"
+		}
+
+		resp, plainTextResponseMessage, target, err = chatCompletionWithFailover(
+			c,
+			l.logger,
+			stepReq,
+			targets,
+		)
+		if err != nil {
+			return resp, plainTextResponseMessage, target, err
+		}
+		if stream != nil {
+			resp = withStreamedToolCalls(resp, plainTextResponseMessage, stream.gatheredToolCalls())
+		}
+		l.onResponse(target, stepReq.Messages, resp, plainTextResponseMessage)
+
+		if isLastStep || !callsOnlyTools(resp, tools) {
+			break
+		}
+		if stream != nil {
+			stream.discard()
+		}
+
+		call := resp.Choices[0].Message
+		results := make([]oai.ChatCompletionMessage, 0, len(call.ToolCalls))
+		for _, toolCall := range call.ToolCalls {
+			results = append(results, oai.ChatCompletionMessage{
+				Role:       oai.ChatMessageRoleTool,
+				Content:    l.callTool(c, tools[toolCall.Function.Name], toolCall),
+				ToolCallID: toolCall.ID,
+			})
+		}
+
+		if err := l.onToolCalls(target, call, results); err != nil {
+			return resp, plainTextResponseMessage, target, err
+		}
+
+		req.Messages = append(req.Messages, call)
+		req.Messages = append(req.Messages, results...)
+	}
+
+	// Not every upstream can stream
+	if stream != nil && !c.Response().Committed {
+		if err := proxy.WriteStreamResponse(c, resp); err != nil {
+			l.logger.Error("Failed to write to response", "err", err)
+			return resp, plainTextResponseMessage, target, err
+		}
+	}
+
+	return resp, plainTextResponseMessage, target, nil
+}
+
+// callTool runs the tool, returning its result for the model. The model is
+// told what's wrong with its arguments so it can correct them, but the
+// details of any other error stay in the logs.
+func (l *toolLoop) callTool(c echo.Context, tool aitool.Tool, toolCall oai.ToolCall) string {
+	result, err := tool.Call(c.Request().Context(), l.env, toolCall.Function.Arguments)
+	if err == nil {
+		return result
+	}
+	if errors.Is(err, aitool.ErrInvalidArguments) {
+		return "Error: " + err.Error()
+	}
+
+	l.logger.Error("Tool failed", "tool", toolCall.Function.Name, "err", err)
+	return "Error: the tool failed"
+}
+
+// withStreamedToolCalls adds the tool calls gathered from a streamed response
+// to it, as the streams only return the usage
+func withStreamedToolCalls(
+	resp oai.ChatCompletionResponse,
+	plainTextResponseMessage string,
+	toolCalls []oai.ToolCall,
+) oai.ChatCompletionResponse {
+	if len(toolCalls) == 0 {
+		return resp
+	}
+
+	resp.Choices = []oai.ChatCompletionChoice{{
+		Message: oai.ChatCompletionMessage{
+			Role:      oai.ChatMessageRoleAssistant,
+			Content:   plainTextResponseMessage,
+			ToolCalls: toolCalls,
+		},
+		FinishReason: oai.FinishReasonToolCalls,
+	}}
+
+	return resp
+}
+
+// callsOnlyTools checks if the response calls tools, and all of them are in
+// the tools
+func callsOnlyTools(resp oai.ChatCompletionResponse, tools map[string]aitool.Tool) bool {
+	if len(resp.Choices) == 0 || len(resp.Choices[0].Message.ToolCalls) == 0 {
+		return false
+	}
+
+	for _, toolCall := range resp.Choices[0].Message.ToolCalls {
+		if _, ok := tools[toolCall.Function.Name]; !ok {
+			return false
+		}
+	}
+
+	return true
+}
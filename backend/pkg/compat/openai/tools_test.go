@@ -0,0 +1,167 @@
+package openai_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aitool"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/compat/openai"
+	"github.com/labstack/echo/v5"
+	oai "github.com/sashabaranov/go-openai"
+)
+
+// brokenTool fails with an error the model shouldn't see
+type brokenTool struct{}
+
+func (brokenTool) Definition() oai.FunctionDefinition {
+	return oai.FunctionDefinition{Name: "broken"}
+}
+
+func (brokenTool) Call(context.Context, aitool.Env, string) (string, error) {
+	return "", errors.New("dial tcp 10.0.0.3:5432: connection refused")
+}
+
+func TestCallTool(t *testing.T) {
+	tests := []struct {
+		name      string
+		tool      aitool.Tool
+		arguments string
+		expected  string
+	}{
+		{"result", aitool.Calculator{}, `{"expression": "2 * 3"}`, "6"},
+		{
+			"invalid arguments",
+			aitool.Calculator{},
+			`{"expression": "1 / 0"}`,
+			"Error: invalid arguments: invalid expression: division by zero",
+		},
+		{"internal error", brokenTool{}, `{}`, "Error: the tool failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if result := openai.CallTool(tt.tool, tt.arguments); result != tt.expected {
+				t.Errorf("Expected %q, got %q", tt.expected, result)
+			}
+		})
+	}
+}
+
+func streamEvent(delta oai.ChatCompletionStreamChoiceDelta, finishReason oai.FinishReason) string {
+	return fmt.Sprintf(
+		`data: {"object":"chat.completion.chunk","choices":[{"index":0,"delta":%s,"finish_reason":"%s"}]}`+"\n\n",
+		mustMarshal(delta),
+		finishReason,
+	)
+}
+
+func mustMarshal(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+func TestToolStream(t *testing.T) {
+	index := 0
+	preamble := streamEvent(oai.ChatCompletionStreamChoiceDelta{Content: "Let me check"}, "")
+	toolCall := streamEvent(oai.ChatCompletionStreamChoiceDelta{ToolCalls: []oai.ToolCall{{
+		Index:    &index,
+		ID:       "call_1",
+		Type:     oai.ToolTypeFunction,
+		Function: oai.FunctionCall{Name: "calculator", Arguments: `{"expression":`},
+	}}}, "")
+	arguments := streamEvent(oai.ChatCompletionStreamChoiceDelta{ToolCalls: []oai.ToolCall{{
+		Index:    &index,
+		Function: oai.FunctionCall{Arguments: ` "2 * 3"}`},
+	}}}, "")
+	toolCallsDone := streamEvent(oai.ChatCompletionStreamChoiceDelta{}, oai.FinishReasonToolCalls)
+	answer := streamEvent(oai.ChatCompletionStreamChoiceDelta{Content: "It's 6"}, oai.FinishReasonStop)
+	done := "data: [DONE]\n\n"
+
+	newContext := func() (echo.Context, *httptest.ResponseRecorder) {
+		recorder := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodPost, "/", nil), recorder)
+		return c, recorder
+	}
+
+	t.Run("built-in tool calls are held back", func(t *testing.T) {
+		c, recorder := newContext()
+		stream := openai.NewToolStream(c, time.Hour)
+
+		// Events can be split across writes
+		for _, p := range []string{preamble, toolCall[:20], toolCall[20:] + arguments, toolCallsDone, done} {
+			if _, err := c.Response().Write([]byte(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if recorder.Body.String() != preamble {
+			t.Errorf("Expected only the content before the tool call, got %q", recorder.Body)
+		}
+
+		toolCalls := stream.GatheredToolCalls()
+		if len(toolCalls) != 1 || toolCalls[0].ID != "call_1" ||
+			toolCalls[0].Function.Name != "calculator" ||
+			toolCalls[0].Function.Arguments != `{"expression": "2 * 3"}` {
+			t.Errorf("Expected the calculator call, got %+v", toolCalls)
+		}
+
+		stream.Discard()
+		for _, p := range []string{answer, done} {
+			if _, err := c.Response().Write([]byte(p)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := stream.Close(c); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Body.String() != preamble+answer+done {
+			t.Errorf("Expected the answer to be passed through, got %q", recorder.Body)
+		}
+	})
+
+	t.Run("client tool calls are released", func(t *testing.T) {
+		c, recorder := newContext()
+		stream := openai.NewToolStream(c, time.Hour)
+
+		if _, err := c.Response().Write([]byte(toolCall + toolCallsDone + done)); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Body.Len() != 0 {
+			t.Errorf("Expected the tool call to be held, got %q", recorder.Body)
+		}
+		if err := stream.Close(c); err != nil {
+			t.Fatal(err)
+		}
+		if recorder.Body.String() != toolCall+toolCallsDone+done {
+			t.Errorf("Expected the tool call to be released, got %q", recorder.Body)
+		}
+	})
+
+	t.Run("keep-alive comments once the response has started", func(t *testing.T) {
+		c, recorder := newContext()
+		stream := openai.NewToolStream(c, time.Millisecond)
+
+		time.Sleep(20 * time.Millisecond)
+		c.Response().WriteHeader(http.StatusOK)
+		time.Sleep(20 * time.Millisecond)
+		if err := stream.Close(c); err != nil {
+			t.Fatal(err)
+		}
+
+		if !strings.HasPrefix(recorder.Body.String(), ": keep-alive\n\n") {
+			t.Errorf("Expected keep-alive comments, got %q", recorder.Body)
+		}
+		if c.Response().Writer != recorder {
+			t.Error("Expected the response writer to be restored")
+		}
+	})
+}
@@ -1,11 +1,14 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"strings"
 	"time"
 
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
 	"github.com/labstack/echo/v5"
 	"github.com/liushuangls/go-anthropic/v2"
 	"github.com/sashabaranov/go-openai"
@@ -13,15 +16,8 @@ import (
 
 const anthropicMaxTokens = 4096
 
-var anthropicModelMapping = map[string]string{
-	"claude-haiku":     anthropic.ModelClaude3Haiku20240307,
-	"claude-sonnet":    anthropic.ModelClaude3Sonnet20240229,
-	"claude-opus":      anthropic.ModelClaude3Opus20240229,
-	"claude-sonnet3.5": anthropic.ModelClaude3Dot5Sonnet20240620,
-}
-
 var anthropicStopReasonToOpenAI = map[anthropic.MessagesStopReason]openai.FinishReason{
-	anthropic.MessagesStopReasonEndTurn:      openai.FinishReasonNull,
+	anthropic.MessagesStopReasonEndTurn:      openai.FinishReasonStop,
 	anthropic.MessagesStopReasonStopSequence: openai.FinishReasonStop,
 	anthropic.MessagesStopReasonMaxTokens:    openai.FinishReasonLength,
 	anthropic.MessagesStopReasonToolUse:      openai.FinishReasonToolCalls,
@@ -31,19 +27,20 @@ var anthropicStopReasonToOpenAI = map[anthropic.MessagesStopReason]openai.Finish
 var _ Upstream = (*Anthropic)(nil)
 
 type Anthropic struct {
-	client *anthropic.Client
-	logger *slog.Logger
+	client    *anthropic.Client
+	modelRepo aimodel.AIModelRepo
+	logger    *slog.Logger
 }
 
 func (a *Anthropic) LookupModel(
 	internalModel string,
 ) (string, error) {
-	return AnthropicModelMapper(internalModel)
+	return lookupUpstreamModel(a.modelRepo, ProviderAnthropic, internalModel)
 }
 
 func (a *Anthropic) ChatCompletion(
 	c echo.Context,
-	req openai.ChatCompletionRequest,
+	req ChatCompletionRequest,
 ) (response openai.ChatCompletionResponse, plainTextResponseMessage string, err error) {
 	anthropicReq := anthropic.MessagesRequest{
 		Model:       req.Model,
@@ -59,28 +56,47 @@ func (a *Anthropic) ChatCompletion(
 	}
 
 	for _, message := range req.Messages {
-		if message.Role == "system" {
-			anthropicReq.System = message.Content
-			continue
-		}
-
-		if message.Role == "user" {
+		switch message.Role {
+		case "system":
+			anthropicReq.System = MessageText(message)
+		case "user":
+			userMessage, err := anthropicUserMessage(c.Request().Context(), message)
+			if err != nil {
+				return response, plainTextResponseMessage, err
+			}
+			anthropicReq.Messages = append(anthropicReq.Messages, userMessage)
+		case "assistant":
 			anthropicReq.Messages = append(
 				anthropicReq.Messages,
-				anthropic.NewUserTextMessage(message.Content),
+				anthropicAssistantMessage(message),
 			)
-		}
-
-		if message.Role == "assistant" {
-			anthropicReq.Messages = append(
+		case "tool":
+			anthropicReq.Messages = appendAnthropicToolResult(
 				anthropicReq.Messages,
-				anthropic.NewAssistantTextMessage(message.Content),
+				message,
 			)
 		}
 	}
 
+	anthropicReq.Tools, anthropicReq.ToolChoice, err = anthropicTools(req.ChatCompletionRequest)
+	if err != nil {
+		return response, plainTextResponseMessage, err
+	}
+
+	// Anthropic has no JSON mode, starting its answer with the opening brace
+	// leaves it no choice but to write the object. It couldn't call the
+	// tools though, so a request with tools is left to the instructions.
+	prefill := ""
+	if wantsJSON(req.ChatCompletionRequest) && len(anthropicReq.Tools) == 0 {
+		prefill = anthropicJSONPrefill
+		anthropicReq.Messages = append(
+			anthropicReq.Messages,
+			anthropic.NewAssistantTextMessage(prefill),
+		)
+	}
+
 	if req.Stream {
-		// TODO(ewan): Implement streaming
+		return StreamAnthropicResponse(c, anthropicReq, prefill, a.logger, a.client)
 	}
 
 	resp, err := a.client.CreateMessages(
@@ -92,6 +108,7 @@ func (a *Anthropic) ChatCompletion(
 	}
 
 	sb := strings.Builder{}
+	sb.WriteString(prefill)
 
 	for _, message := range resp.Content {
 		if message.Type == "text" {
@@ -99,24 +116,332 @@ func (a *Anthropic) ChatCompletion(
 		}
 	}
 
-	return AnthropicResponseToOpenAIResponse(resp), sb.String(), nil
+	response = AnthropicResponseToOpenAIResponse(resp)
+	if prefill != "" {
+		response.Choices[0].Message.Content = prefill + response.Choices[0].Message.Content
+	}
+
+	return response, sb.String(), nil
+}
+
+// anthropicUserMessage translates the text and image parts of a user message
+// to Anthropic content blocks. Anthropic only accepts image data, so images
+// sent by URL are downloaded.
+func anthropicUserMessage(
+	ctx context.Context,
+	message openai.ChatCompletionMessage,
+) (anthropic.Message, error) {
+	if len(message.MultiContent) == 0 {
+		return anthropic.NewUserTextMessage(message.Content), nil
+	}
+
+	userMessage := anthropic.Message{Role: anthropic.RoleUser}
+	for _, part := range message.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			userMessage.Content = append(
+				userMessage.Content,
+				anthropic.NewTextMessageContent(part.Text),
+			)
+		case openai.ChatMessagePartTypeImageURL:
+			if part.ImageURL == nil {
+				return userMessage, fmt.Errorf("%w: missing image_url", ErrInvalidImage)
+			}
+			image, err := loadImage(ctx, part.ImageURL.URL)
+			if err != nil {
+				return userMessage, err
+			}
+			userMessage.Content = append(
+				userMessage.Content,
+				anthropic.NewImageMessageContent(anthropic.MessageContentImageSource{
+					Type:      "base64",
+					MediaType: image.MediaType,
+					Data:      image.Base64(),
+				}),
+			)
+		}
+	}
+
+	return userMessage, nil
+}
+
+// anthropicAssistantMessage translates an assistant message to Anthropic,
+// with a tool use block for each of its tool calls
+func anthropicAssistantMessage(message openai.ChatCompletionMessage) anthropic.Message {
+	if len(message.ToolCalls) == 0 {
+		return anthropic.NewAssistantTextMessage(message.Content)
+	}
+
+	// Anthropic rejects empty text blocks
+	assistantMessage := anthropic.Message{Role: anthropic.RoleAssistant}
+	if message.Content != "" {
+		assistantMessage.Content = append(
+			assistantMessage.Content,
+			anthropic.NewTextMessageContent(message.Content),
+		)
+	}
+	for _, toolCall := range message.ToolCalls {
+		assistantMessage.Content = append(
+			assistantMessage.Content,
+			anthropic.NewToolUseMessageContent(
+				toolCall.ID,
+				toolCall.Function.Name,
+				toolArguments(toolCall),
+			),
+		)
+	}
+
+	return assistantMessage
+}
+
+// appendAnthropicToolResult adds the result of a tool call as a user message.
+// The results of parallel tool calls must all be in the same user message so
+// consecutive results are merged.
+func appendAnthropicToolResult(
+	messages []anthropic.Message,
+	message openai.ChatCompletionMessage,
+) []anthropic.Message {
+	result := anthropic.NewToolResultMessageContent(message.ToolCallID, message.Content, false)
+
+	if len(messages) > 0 {
+		last := &messages[len(messages)-1]
+		if last.Role == anthropic.RoleUser &&
+			last.GetFirstContent().Type == anthropic.MessagesContentTypeToolResult {
+			last.Content = append(last.Content, result)
+			return messages
+		}
+	}
+
+	return append(messages, anthropic.Message{
+		Role:    anthropic.RoleUser,
+		Content: []anthropic.MessageContent{result},
+	})
+}
+
+// anthropicTools translates the OpenAI tools and tool choice of the request.
+// Anthropic can't be told not to use the tools so they aren't sent at all
+// when the tool choice is none.
+func anthropicTools(
+	req openai.ChatCompletionRequest,
+) ([]anthropic.ToolDefinition, *anthropic.ToolChoice, error) {
+	mode, function, err := parseToolChoice(req.ToolChoice)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(req.Tools) == 0 || mode == toolChoiceNone {
+		return nil, nil, nil
+	}
+
+	tools := make([]anthropic.ToolDefinition, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		if tool.Type != openai.ToolTypeFunction || tool.Function == nil {
+			return nil, nil, fmt.Errorf("unsupported tool type: %q", tool.Type)
+		}
+
+		// The input schema is required, even if the function has no parameters
+		var inputSchema any = tool.Function.Parameters
+		if inputSchema == nil {
+			inputSchema = json.RawMessage(`{"type":"object","properties":{}}`)
+		}
+
+		tools = append(tools, anthropic.ToolDefinition{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			InputSchema: inputSchema,
+		})
+	}
+
+	var toolChoice *anthropic.ToolChoice
+	switch mode {
+	case toolChoiceAuto:
+		toolChoice = &anthropic.ToolChoice{Type: "auto"}
+	case toolChoiceRequired:
+		toolChoice = &anthropic.ToolChoice{Type: "any"}
+	case toolChoiceFunction:
+		toolChoice = &anthropic.ToolChoice{Type: "tool", Name: function}
+	}
+
+	return tools, toolChoice, nil
 }
 
 func NewAnthropic(
 	client *anthropic.Client,
+	modelRepo aimodel.AIModelRepo,
 	logger *slog.Logger,
 ) (*Anthropic, error) {
 	return &Anthropic{
-		logger: logger,
-		client: client,
+		logger:    logger,
+		client:    client,
+		modelRepo: modelRepo,
 	}, nil
 }
 
-func AnthropicModelMapper(model string) (string, error) {
-	if mappedModel, ok := anthropicModelMapping[model]; ok {
-		return mappedModel, nil
+// StreamAnthropicResponse streams the Anthropic message events back to the client
+// as OpenAI compatible `chat.completion.chunk` server-sent events. Tool use
+// blocks are streamed as tool call deltas, their input as the arguments.
+// The full text of the response is gathered so it can be encrypted and saved.
+// The prefill the answer was started with, if any, is sent first as it's part
+// of the answer.
+func StreamAnthropicResponse(
+	c echo.Context,
+	req anthropic.MessagesRequest,
+	prefill string,
+	logger *slog.Logger,
+	client *anthropic.Client,
+) (response openai.ChatCompletionResponse, plainTextResponseMessage string, err error) {
+	emptyResponse := openai.ChatCompletionResponse{}
+
+	// The stream callbacks can't return errors so if we fail to write to the
+	// client we keep hold of the error and cancel the upstream request.
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	defer cancel()
+	var writeErr error
+
+	sb := strings.Builder{}
+
+	var (
+		id      string
+		model   string
+		created = time.Now().Unix()
+		// toolCallIndexes maps the index of each tool use block to the index
+		// of its tool call, as text blocks are also counted by Anthropic
+		toolCallIndexes = map[int]int{}
+	)
+
+	writeChunk := func(
+		delta openai.ChatCompletionStreamChoiceDelta,
+		finishReason openai.FinishReason,
+	) {
+		if writeErr != nil {
+			return
+		}
+
+		writeErr = writeStreamChunk(c, openai.ChatCompletionStreamResponse{
+			ID:      id,
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   model,
+			Choices: []openai.ChatCompletionStreamChoice{
+				{
+					Index:        0,
+					Delta:        delta,
+					FinishReason: finishReason,
+				},
+			},
+		})
+		if writeErr != nil {
+			logger.Error("Failed to write to response", "err", writeErr)
+			cancel()
+		}
 	}
-	return "", fmt.Errorf("invalid model name: %s", model)
+
+	streamResp, err := client.CreateMessagesStream(ctx, anthropic.MessagesStreamRequest{
+		MessagesRequest: req,
+		OnMessageStart: func(data anthropic.MessagesEventMessageStartData) {
+			// Only set the headers once we know the upstream has accepted the
+			// request so any earlier errors can still be returned as JSON
+			setStreamHeaders(c)
+
+			id = data.Message.ID
+			model = data.Message.Model
+			writeChunk(
+				openai.ChatCompletionStreamChoiceDelta{Role: "assistant"},
+				openai.FinishReasonNull,
+			)
+			if prefill != "" {
+				sb.WriteString(prefill)
+				writeChunk(
+					openai.ChatCompletionStreamChoiceDelta{Content: prefill},
+					openai.FinishReasonNull,
+				)
+			}
+		},
+		OnContentBlockStart: func(data anthropic.MessagesEventContentBlockStartData) {
+			if data.ContentBlock.Type != anthropic.MessagesContentTypeToolUse {
+				return
+			}
+
+			index := len(toolCallIndexes)
+			toolCallIndexes[data.Index] = index
+			writeChunk(
+				openai.ChatCompletionStreamChoiceDelta{
+					ToolCalls: []openai.ToolCall{
+						{
+							Index: &index,
+							ID:    data.ContentBlock.ID,
+							Type:  openai.ToolTypeFunction,
+							Function: openai.FunctionCall{
+								Name: data.ContentBlock.Name,
+							},
+						},
+					},
+				},
+				openai.FinishReasonNull,
+			)
+		},
+		OnContentBlockDelta: func(data anthropic.MessagesEventContentBlockDeltaData) {
+			if data.Delta.Type == anthropic.MessagesContentTypeInputJsonDelta {
+				index, ok := toolCallIndexes[data.Index]
+				if !ok || data.Delta.PartialJson == nil {
+					return
+				}
+
+				writeChunk(
+					openai.ChatCompletionStreamChoiceDelta{
+						ToolCalls: []openai.ToolCall{
+							{
+								Index: &index,
+								Function: openai.FunctionCall{
+									Arguments: *data.Delta.PartialJson,
+								},
+							},
+						},
+					},
+					openai.FinishReasonNull,
+				)
+				return
+			}
+
+			if data.Delta.Type != anthropic.MessagesContentTypeTextDelta ||
+				data.Delta.Text == nil {
+				return
+			}
+
+			// Construct our plaintext response that will be encrypted and saved
+			sb.WriteString(*data.Delta.Text)
+
+			writeChunk(
+				openai.ChatCompletionStreamChoiceDelta{Content: *data.Delta.Text},
+				openai.FinishReasonNull,
+			)
+		},
+		OnMessageDelta: func(data anthropic.MessagesEventMessageDeltaData) {
+			writeChunk(
+				openai.ChatCompletionStreamChoiceDelta{},
+				AnthropicStopReasonToOpenAI(data.Delta.StopReason),
+			)
+		},
+	})
+	if writeErr != nil {
+		return emptyResponse, plainTextResponseMessage, writeErr
+	}
+	if err != nil {
+		logger.Error("Failed to read from stream", "err", err)
+		return emptyResponse, plainTextResponseMessage, err
+	}
+
+	// stream has finished
+	if err := writeStreamDone(c); err != nil {
+		logger.Error("Failed to write to response", "err", err)
+		return emptyResponse, plainTextResponseMessage, err
+	}
+
+	plainTextResponseMessage = sb.String()
+	// The input tokens are sent at the start of the stream and the output
+	// tokens at the end, the client gathers both
+	response.Usage = AnthropicUsageToOpenAI(streamResp.Usage)
+
+	return response, plainTextResponseMessage, nil
 }
 
 func AnthropicResponseToOpenAIResponse(
@@ -126,22 +451,36 @@ func AnthropicResponseToOpenAIResponse(
 	openAIResponse := openai.ChatCompletionResponse{
 		ID:      anthropicResp.ID,
 		Created: time.Now().Unix(),
+		Usage:   AnthropicUsageToOpenAI(anthropicResp.Usage),
 	}
 
-	for _, message := range anthropicResp.Content {
-		if message.Type == "text" {
-			openAIResponse.Choices = append(
-				openAIResponse.Choices,
-				openai.ChatCompletionChoice{
-					FinishReason: AnthropicStopReasonToOpenAI(anthropicResp.StopReason),
-					Message: openai.ChatCompletionMessage{
-						Content: message.GetText(),
-						Role:    "assistant",
-					},
+	// The text and tool use blocks are all part of the one message
+	message := openai.ChatCompletionMessage{Role: "assistant"}
+	sb := strings.Builder{}
+
+	for _, content := range anthropicResp.Content {
+		switch content.Type {
+		case anthropic.MessagesContentTypeText:
+			sb.WriteString(content.GetText())
+		case anthropic.MessagesContentTypeToolUse:
+			message.ToolCalls = append(message.ToolCalls, openai.ToolCall{
+				ID:   content.ID,
+				Type: openai.ToolTypeFunction,
+				Function: openai.FunctionCall{
+					Name:      content.Name,
+					Arguments: string(content.Input),
 				},
-			)
+			})
 		}
 	}
+	message.Content = sb.String()
+
+	openAIResponse.Choices = []openai.ChatCompletionChoice{
+		{
+			FinishReason: AnthropicStopReasonToOpenAI(anthropicResp.StopReason),
+			Message:      message,
+		},
+	}
 
 	return openAIResponse
 }
@@ -154,3 +493,11 @@ func AnthropicStopReasonToOpenAI(
 	}
 	return openai.FinishReasonNull
 }
+
+func AnthropicUsageToOpenAI(usage anthropic.MessagesUsage) openai.Usage {
+	return openai.Usage{
+		PromptTokens:     usage.InputTokens,
+		CompletionTokens: usage.OutputTokens,
+		TotalTokens:      usage.InputTokens + usage.OutputTokens,
+	}
+}
@@ -0,0 +1,396 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/labstack/echo/v5"
+	"github.com/liushuangls/go-anthropic/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+var anthropicStreamEvents = []struct {
+	Event string
+	Data  string
+}{
+	{
+		"message_start",
+		`{"type":"message_start","message":{"id":"msg_1","type":"message","role":"assistant","content":[],"model":"claude-3-haiku-20240307","usage":{"input_tokens":10,"output_tokens":1}}}`,
+	},
+	{
+		"content_block_start",
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+	},
+	{"ping", `{"type":"ping"}`},
+	{
+		"content_block_delta",
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}`,
+	},
+	{
+		"content_block_delta",
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" world"}}`,
+	},
+	{"content_block_stop", `{"type":"content_block_stop","index":0}`},
+	{
+		"message_delta",
+		`{"type":"message_delta","delta":{"stop_reason":"end_turn","stop_sequence":null},"usage":{"output_tokens":2}}`,
+	},
+	{"message_stop", `{"type":"message_stop"}`},
+}
+
+var anthropicToolUseStreamEvents = []struct {
+	Event string
+	Data  string
+}{
+	{
+		"message_start",
+		`{"type":"message_start","message":{"id":"msg_2","type":"message","role":"assistant","content":[],"model":"claude-3-haiku-20240307","usage":{"input_tokens":50,"output_tokens":1}}}`,
+	},
+	{
+		"content_block_start",
+		`{"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}`,
+	},
+	{
+		"content_block_delta",
+		`{"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Checking"}}`,
+	},
+	{"content_block_stop", `{"type":"content_block_stop","index":0}`},
+	{
+		"content_block_start",
+		`{"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{}}}`,
+	},
+	{
+		"content_block_delta",
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"city\": "}}`,
+	},
+	{
+		"content_block_delta",
+		`{"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"\"Paris\"}"}}`,
+	},
+	{"content_block_stop", `{"type":"content_block_stop","index":1}`},
+	{
+		"message_delta",
+		`{"type":"message_delta","delta":{"stop_reason":"tool_use","stop_sequence":null},"usage":{"output_tokens":20}}`,
+	},
+	{"message_stop", `{"type":"message_stop"}`},
+}
+
+func newAnthropicStreamServer(
+	t *testing.T,
+	events []struct {
+		Event string
+		Data  string
+	},
+) *httptest.Server {
+	t.Helper()
+
+	return httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, event := range events {
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, event.Data)
+			}
+		}),
+	)
+}
+
+func TestAnthropicChatCompletionStream(t *testing.T) {
+	server := newAnthropicStreamServer(t, anthropicStreamEvents)
+	defer server.Close()
+
+	upstream, err := proxy.NewAnthropic(
+		anthropic.NewClient("test", anthropic.WithBaseURL(server.URL)),
+		aimodel.NewInMemoryAIModelRepo(nil),
+		slog.Default(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	resp, plainTextResponseMessage, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model:  anthropic.ModelClaude3Haiku20240307,
+				Stream: true,
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "user", Content: "Hi"},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plainTextResponseMessage != "Hello world" {
+		t.Errorf(
+			"Expected plain text response %q, got %q",
+			"Hello world",
+			plainTextResponseMessage,
+		)
+	}
+
+	// Input tokens come from the start of the stream, output from the end
+	expectedUsage := openai.Usage{PromptTokens: 10, CompletionTokens: 2, TotalTokens: 12}
+	if resp.Usage != expectedUsage {
+		t.Errorf("Expected usage %+v, got %+v", expectedUsage, resp.Usage)
+	}
+
+	contentType := rec.Header().Get(echo.HeaderContentType)
+	if contentType != "text/event-stream" {
+		t.Errorf("Expected content type text/event-stream, got %s", contentType)
+	}
+
+	body := rec.Body.String()
+	expectedContent := []string{
+		`"object":"chat.completion.chunk"`,
+		`"id":"msg_1"`,
+		`"delta":{"role":"assistant"}`,
+		`"delta":{"content":"Hello"}`,
+		`"delta":{"content":" world"}`,
+		`"finish_reason":"stop"`,
+	}
+	for _, expected := range expectedContent {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s in response body:\n%s", expected, body)
+		}
+	}
+
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("Expected response body to end with [DONE]:\n%s", body)
+	}
+}
+
+var weatherTool = openai.Tool{
+	Type: openai.ToolTypeFunction,
+	Function: &openai.FunctionDefinition{
+		Name:        "get_weather",
+		Description: "Get the weather in a city",
+		Parameters: json.RawMessage(
+			`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`,
+		),
+	},
+}
+
+func TestAnthropicChatCompletionStreamToolUse(t *testing.T) {
+	server := newAnthropicStreamServer(t, anthropicToolUseStreamEvents)
+	defer server.Close()
+
+	upstream, err := proxy.NewAnthropic(
+		anthropic.NewClient("test", anthropic.WithBaseURL(server.URL)),
+		aimodel.NewInMemoryAIModelRepo(nil),
+		slog.Default(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	_, plainTextResponseMessage, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model:  anthropic.ModelClaude3Haiku20240307,
+				Stream: true,
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "user", Content: "What's the weather in Paris?"},
+				},
+				Tools: []openai.Tool{weatherTool},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plainTextResponseMessage != "Checking" {
+		t.Errorf(
+			"Expected plain text response %q, got %q",
+			"Checking",
+			plainTextResponseMessage,
+		)
+	}
+
+	// The text block is index 0 upstream but the tool call is the first one
+	body := rec.Body.String()
+	expectedContent := []string{
+		`"delta":{"content":"Checking"}`,
+		`"delta":{"tool_calls":[{"index":0,"id":"toolu_1","type":"function","function":{"name":"get_weather"}}]}`,
+		`"delta":{"tool_calls":[{"index":0,"id":"","type":"","function":{"arguments":"{\"city\": "}}]}`,
+		`"delta":{"tool_calls":[{"index":0,"id":"","type":"","function":{"arguments":"\"Paris\"}"}}]}`,
+		`"finish_reason":"tool_calls"`,
+	}
+	for _, expected := range expectedContent {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s in response body:\n%s", expected, body)
+		}
+	}
+}
+
+func TestAnthropicChatCompletionTools(t *testing.T) {
+	var upstreamReq map[string]any
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&upstreamReq); err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{
+				"id": "msg_3",
+				"type": "message",
+				"role": "assistant",
+				"model": "claude-3-haiku-20240307",
+				"content": [
+					{"type": "text", "text": "Let me check both"},
+					{"type": "tool_use", "id": "toolu_3", "name": "get_weather", "input": {"city": "Rome"}}
+				],
+				"stop_reason": "tool_use",
+				"usage": {"input_tokens": 80, "output_tokens": 30}
+			}`))
+		}),
+	)
+	defer server.Close()
+
+	upstream, err := proxy.NewAnthropic(
+		anthropic.NewClient("test", anthropic.WithBaseURL(server.URL)),
+		aimodel.NewInMemoryAIModelRepo(nil),
+		slog.Default(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	resp, plainTextResponseMessage, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model: anthropic.ModelClaude3Haiku20240307,
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "system", Content: "Be helpful"},
+					{Role: "user", Content: "What's the weather in Paris and London?"},
+					{
+						Role: "assistant",
+						ToolCalls: []openai.ToolCall{
+							{
+								ID:   "toolu_1",
+								Type: openai.ToolTypeFunction,
+								Function: openai.FunctionCall{
+									Name:      "get_weather",
+									Arguments: `{"city":"Paris"}`,
+								},
+							},
+							{
+								ID:   "toolu_2",
+								Type: openai.ToolTypeFunction,
+								Function: openai.FunctionCall{
+									Name:      "get_weather",
+									Arguments: `{"city":"London"}`,
+								},
+							},
+						},
+					},
+					{Role: "tool", ToolCallID: "toolu_1", Content: "Sunny"},
+					{Role: "tool", ToolCallID: "toolu_2", Content: "Rainy"},
+				},
+				Tools: []openai.Tool{weatherTool},
+				// As bound from the JSON of a request
+				ToolChoice: map[string]any{
+					"type":     "function",
+					"function": map[string]any{"name": "get_weather"},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tool results are merged into one user message
+	expectedMessages := `[
+		{"role":"user","content":[{"type":"text","text":"What's the weather in Paris and London?"}]},
+		{"role":"assistant","content":[
+			{"type":"tool_use","id":"toolu_1","name":"get_weather","input":{"city":"Paris"}},
+			{"type":"tool_use","id":"toolu_2","name":"get_weather","input":{"city":"London"}}
+		]},
+		{"role":"user","content":[
+			{"type":"tool_result","tool_use_id":"toolu_1","content":[{"type":"text","text":"Sunny"}],"is_error":false},
+			{"type":"tool_result","tool_use_id":"toolu_2","content":[{"type":"text","text":"Rainy"}],"is_error":false}
+		]}
+	]`
+	assertJSONEqual(t, "messages", expectedMessages, upstreamReq["messages"])
+	assertJSONEqual(
+		t,
+		"tools",
+		`[{"name":"get_weather","description":"Get the weather in a city","input_schema":{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}}]`,
+		upstreamReq["tools"],
+	)
+	assertJSONEqual(
+		t,
+		"tool_choice",
+		`{"type":"tool","name":"get_weather"}`,
+		upstreamReq["tool_choice"],
+	)
+
+	if plainTextResponseMessage != "Let me check both" {
+		t.Errorf(
+			"Expected plain text response %q, got %q",
+			"Let me check both",
+			plainTextResponseMessage,
+		)
+	}
+
+	if len(resp.Choices) != 1 {
+		t.Fatalf("Expected 1 choice, got %d", len(resp.Choices))
+	}
+	choice := resp.Choices[0]
+	if choice.FinishReason != openai.FinishReasonToolCalls {
+		t.Errorf("Expected finish reason tool_calls, got %s", choice.FinishReason)
+	}
+	expectedToolCalls := []openai.ToolCall{
+		{
+			ID:   "toolu_3",
+			Type: openai.ToolTypeFunction,
+			Function: openai.FunctionCall{
+				Name:      "get_weather",
+				Arguments: `{"city": "Rome"}`,
+			},
+		},
+	}
+	if !reflect.DeepEqual(choice.Message.ToolCalls, expectedToolCalls) {
+		t.Errorf("Expected tool calls %+v, got %+v", expectedToolCalls, choice.Message.ToolCalls)
+	}
+}
+
+// assertJSONEqual compares a decoded JSON value with the expected JSON
+func assertJSONEqual(t *testing.T, name, expected string, actual any) {
+	t.Helper()
+
+	var expectedValue any
+	if err := json.Unmarshal([]byte(expected), &expectedValue); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(expectedValue, actual) {
+		actualJSON, _ := json.Marshal(actual)
+		t.Errorf("Expected %s %s, got %s", name, expected, actualJSON)
+	}
+}
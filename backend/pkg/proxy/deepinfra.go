@@ -1,27 +1,15 @@
 package proxy
 
 import (
-	"fmt"
 	"log/slog"
 
 	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
 	"github.com/labstack/echo/v5"
 	"github.com/sashabaranov/go-openai"
 )
 
 // https://deepinfra.com/models/text-generation
-var deepInfraModelMapping = map[string]string{
-	"openchat-3.6-8b":          "openchat/openchat-3.6-8b",
-	"wizardlm-2-8x22b":         "microsoft/WizardLM-2-8x22B",                     // https://deepinfra.com/microsoft/WizardLM-2-8x22B
-	"gemma-1.1-7b-it":          "google/gemma-1.1-7b-it",                         // https://deepinfra.com/google/gemma-1.1-7b-it
-	"dolphin-2.6-mixtral-8x7b": "cognitivecomputations/dolphin-2.6-mixtral-8x7b", // https://deepinfra.com/cognitivecomputations/dolphin-2.6-mixtral-8x7b
-	"chronos-hermes-13b-v2":    "Austism/chronos-hermes-13b-v2",                  // https://deepinfra.com/Austism/chronos-hermes-13b-v2
-	"phind-codellama-34b-v2":   "Phind/Phind-CodeLlama-34B-v2",                   // https://deepinfra.com/Phind/Phind-CodeLlama-34B-v2
-	"codegemma-7b-it":          "google/codegemma-7b-it",                         // https://deepinfra.com/google/codegemma-7b-it
-	"llama-3-8b-instruct":      "meta-llama/Meta-Llama-3-8B-Instruct",            // https://deepinfra.com/meta-llama/Meta-Llama-3-8B-Instruct
-	"lzlv_70b_fp16_hf":         "lizpreciatior/lzlv_70b_fp16_hf",                 // https://deepinfra.com/lizpreciatior/lzlv_70b_fp16_hf
-}
-
 var _ Upstream = (*DeepInfra)(nil)
 
 func NewDeepInfraOpenAIClient(config *config.APIConfig) *openai.Client {
@@ -31,36 +19,35 @@ func NewDeepInfraOpenAIClient(config *config.APIConfig) *openai.Client {
 }
 
 type DeepInfra struct {
-	client *openai.Client
-	logger *slog.Logger
+	client    *openai.Client
+	modelRepo aimodel.AIModelRepo
+	logger    *slog.Logger
 }
 
 func (d *DeepInfra) LookupModel(
 	internalModel string,
 ) (string, error) {
-	return DeepInfraModelMapper(internalModel)
+	return lookupUpstreamModel(d.modelRepo, ProviderDeepInfra, internalModel)
 }
 
 func (d *DeepInfra) ChatCompletion(
 	c echo.Context,
-	req openai.ChatCompletionRequest,
+	req ChatCompletionRequest,
 ) (response openai.ChatCompletionResponse, plainTextResponseMessage string, err error) {
 	if req.Stream {
-		return StreamOpenAIResponse(c, req, d.logger, d.client)
+		return StreamOpenAIResponse(c, req.ChatCompletionRequest, d.logger, d.client, false)
 	}
-	return ForwardOpenAIResponse(c, req, d.logger, d.client)
+	return ForwardOpenAIResponse(c, req.ChatCompletionRequest, d.logger, d.client)
 }
 
-func NewDeepInfra(client *openai.Client, logger *slog.Logger) (*DeepInfra, error) {
+func NewDeepInfra(
+	client *openai.Client,
+	modelRepo aimodel.AIModelRepo,
+	logger *slog.Logger,
+) (*DeepInfra, error) {
 	return &DeepInfra{
-		client: client,
-		logger: logger,
+		client:    client,
+		modelRepo: modelRepo,
+		logger:    logger,
 	}, nil
 }
-
-func DeepInfraModelMapper(model string) (string, error) {
-	if mappedModel, ok := deepInfraModelMapping[model]; ok {
-		return mappedModel, nil
-	}
-	return "", fmt.Errorf("invalid model name: %s", model)
-}
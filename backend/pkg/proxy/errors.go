@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+
+	"github.com/liushuangls/go-anthropic/v2"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+)
+
+// IsRetryable checks if an upstream error is worth retrying on another
+// provider i.e. the provider is down, overloaded or rate limiting us. Errors
+// caused by the request itself would fail on any provider.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var openAIAPIErr *openai.APIError
+	if errors.As(err, &openAIAPIErr) {
+		return isRetryableStatus(openAIAPIErr.HTTPStatusCode)
+	}
+	var openAIRequestErr *openai.RequestError
+	if errors.As(err, &openAIRequestErr) {
+		return isRetryableStatus(openAIRequestErr.HTTPStatusCode)
+	}
+
+	var anthropicAPIErr *anthropic.APIError
+	if errors.As(err, &anthropicAPIErr) {
+		switch anthropicAPIErr.Type {
+		case anthropic.ErrTypeRateLimit, anthropic.ErrTypeApi, anthropic.ErrTypeOverloaded:
+			return true
+		default:
+			return false
+		}
+	}
+	var anthropicRequestErr *anthropic.RequestError
+	if errors.As(err, &anthropicRequestErr) {
+		return isRetryableStatus(anthropicRequestErr.StatusCode)
+	}
+
+	var googleErr *googleapi.Error
+	if errors.As(err, &googleErr) {
+		return isRetryableStatus(googleErr.Code)
+	}
+
+	// Couldn't reach the provider at all
+	var netErr net.Error
+	return errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded)
+}
+
+func isRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests ||
+		statusCode >= http.StatusInternalServerError
+}
@@ -0,0 +1,52 @@
+package proxy_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/liushuangls/go-anthropic/v2"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"openai rate limited", &openai.APIError{HTTPStatusCode: 429}, true},
+		{"openai unavailable", &openai.APIError{HTTPStatusCode: 503}, true},
+		{"openai bad request", &openai.APIError{HTTPStatusCode: 400}, false},
+		{"openai request error", &openai.RequestError{HTTPStatusCode: 502}, true},
+		{
+			"anthropic overloaded",
+			fmt.Errorf("stream: %w", &anthropic.APIError{Type: anthropic.ErrTypeOverloaded}),
+			true,
+		},
+		{
+			"anthropic invalid request",
+			fmt.Errorf("stream: %w", &anthropic.APIError{Type: anthropic.ErrTypeInvalidRequest}),
+			false,
+		},
+		{"google internal error", &googleapi.Error{Code: 500}, true},
+		{"google not found", &googleapi.Error{Code: 404}, false},
+		{"connection refused", &net.OpError{Op: "dial", Err: errors.New("refused")}, true},
+		{"deadline exceeded", context.DeadlineExceeded, true},
+		{"cancelled by client", context.Canceled, false},
+		{"unknown", errors.New("something went wrong"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := proxy.IsRetryable(tt.err); got != tt.want {
+				t.Errorf("IsRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
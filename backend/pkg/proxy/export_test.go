@@ -0,0 +1,21 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+)
+
+// SetImageTransport replaces the transport of the client downloading images
+// for the duration of a test, e.g. to trust a test server's certificate. The
+// redirects are still checked.
+func SetImageTransport(transport http.RoundTripper) (restore func()) {
+	previous := imageClient
+	client := *imageClient
+	client.Transport = transport
+	imageClient = &client
+	return func() { imageClient = previous }
+}
+
+func LoadImage(ctx context.Context, imageURL string) (Image, error) {
+	return loadImage(ctx, imageURL)
+}
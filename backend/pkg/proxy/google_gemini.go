@@ -1,23 +1,21 @@
 package proxy
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"strings"
 	"time"
 
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
 	"github.com/google/generative-ai-go/genai"
 	"github.com/labstack/echo/v5"
 	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/iterator"
 )
 
-// Maps from our internal model names to the model names used by Google
-// Model list: https://ai.google.dev/gemini-api/docs/models/gemini
-var googleGeminiAIModelMapping = map[string]string{
-	"gemini-1.5-pro":   "models/gemini-1.5-pro",
-	"gemini-1.5-flash": "models/gemini-1.5-flash",
-}
-
 // compile time type checking
 var _ Upstream = (*GoogleGemini)(nil)
 
@@ -31,8 +29,9 @@ var googleGeminiFinishReasonToOpenAI = map[genai.FinishReason]openai.FinishReaso
 }
 
 type GoogleGemini struct {
-	client *genai.Client
-	logger *slog.Logger
+	client    *genai.Client
+	modelRepo aimodel.AIModelRepo
+	logger    *slog.Logger
 }
 
 func (g *GoogleGemini) LookupModel(
@@ -40,55 +39,50 @@ func (g *GoogleGemini) LookupModel(
 ) (string, error) {
 	// Google doesn't just use strings as model names, instead requires a genai.GenerativeModel struct
 	// Here we validate if the model name is valid and then return the corresponding google model name
-	return GoogleGeminiModelMapper(internalModel)
+	// Model list: https://ai.google.dev/gemini-api/docs/models/gemini
+	return lookupUpstreamModel(g.modelRepo, ProviderGoogleGemini, internalModel)
 }
 
 func (g *GoogleGemini) ChatCompletion(
 	c echo.Context,
-	req openai.ChatCompletionRequest,
+	req ChatCompletionRequest,
 ) (response openai.ChatCompletionResponse, plainTextResponseMessage string, err error) {
 	model := g.client.GenerativeModel(req.Model)
 
-	cs := model.StartChat()
-	cs.History = []*genai.Content{}
-
-	for idx, message := range req.Messages {
-
-		if idx == len(req.Messages)-1 {
-			// Skip the last message as it will be sent as the main message
-			break
-		}
+	model.Tools, model.ToolConfig, err = geminiTools(req.ChatCompletionRequest)
+	if err != nil {
+		return response, plainTextResponseMessage, err
+	}
 
-		content := genai.Content{
-			Parts: []genai.Part{
-				genai.Text(message.Content),
-			},
-		}
+	// Gemini can't call functions when it answers in JSON, so a request with
+	// tools is left to the instructions
+	if wantsJSON(req.ChatCompletionRequest) && len(model.Tools) == 0 {
+		model.ResponseMIMEType = "application/json"
+		model.ResponseSchema = g.responseSchema(req.ResponseSchema)
+	}
 
-		if message.Role == "system" {
-			model.SystemInstruction = &content
-			continue
-		}
+	var contents []*genai.Content
+	model.SystemInstruction, contents, err = geminiContents(c.Request().Context(), req.Messages)
+	if err != nil {
+		return response, plainTextResponseMessage, err
+	}
+	if len(contents) == 0 {
+		return response, plainTextResponseMessage, fmt.Errorf("no messages to send")
+	}
 
-		if message.Role == "user" {
-			content.Role = "user"
-		}
+	cs := model.StartChat()
+	cs.History = contents[:len(contents)-1]
 
-		if message.Role == "assistant" {
-			content.Role = "model"
-		}
-
-		cs.History = append(cs.History, &content)
-	}
+	// Send the last message as the main message
+	message := contents[len(contents)-1].Parts
 
 	if req.Stream {
-		// TODO(ewan): Implement streaming
+		return StreamGeminiResponse(c, req.ChatCompletionRequest, g.logger, cs, message...)
 	}
 
 	resp, err := cs.SendMessage(
 		c.Request().Context(),
-		// Send the last message as the main message
-		genai.Text(req.Messages[len(req.Messages)-1].Content),
+		message...,
 	)
 	if err != nil {
 		return openai.ChatCompletionResponse{}, "", err
@@ -104,30 +98,179 @@ func (g *GoogleGemini) ChatCompletion(
 
 	for _, cand := range resp.Candidates {
 		if cand.Content != nil {
-			for _, part := range cand.Content.Parts {
-				sb.WriteString(fmt.Sprint(part))
-			}
+			sb.WriteString(geminiText(cand.Content.Parts))
 		}
 	}
 
 	return GeminiResponseToOpenAIResponse(resp), sb.String(), nil
 }
 
+// responseSchema translates the JSON schema the response must match, if there
+// is one. Gemini only supports a subset of JSON schema, when the schema can't
+// be translated the answer is only checked against it.
+func (g *GoogleGemini) responseSchema(schema json.RawMessage) *genai.Schema {
+	if schema == nil {
+		return nil
+	}
+
+	geminiResponseSchema, err := geminiSchema(schema)
+	if err != nil {
+		g.logger.Warn("Response schema not supported by Gemini", "err", err)
+		return nil
+	}
+
+	return geminiResponseSchema
+}
+
 func NewGoogleGemini(
 	client *genai.Client,
+	modelRepo aimodel.AIModelRepo,
 	logger *slog.Logger,
 ) (*GoogleGemini, error) {
 	return &GoogleGemini{
-		logger: logger,
-		client: client,
+		logger:    logger,
+		client:    client,
+		modelRepo: modelRepo,
 	}, nil
 }
 
-func GoogleGeminiModelMapper(model string) (string, error) {
-	if mappedModel, ok := googleGeminiAIModelMapping[model]; ok {
-		return mappedModel, nil
+// StreamGeminiResponse sends the message to the chat session and streams the
+// response back to the client as OpenAI compatible `chat.completion.chunk`
+// server-sent events. Function calls are streamed whole as tool call deltas.
+// The full text of the response is gathered so it can be encrypted and saved.
+func StreamGeminiResponse(
+	c echo.Context,
+	req openai.ChatCompletionRequest,
+	logger *slog.Logger,
+	cs *genai.ChatSession,
+	parts ...genai.Part,
+) (response openai.ChatCompletionResponse, plainTextResponseMessage string, err error) {
+	emptyResponse := openai.ChatCompletionResponse{}
+
+	iter := cs.SendMessageStream(c.Request().Context(), parts...)
+
+	sb := strings.Builder{}
+
+	created := time.Now().Unix()
+	newChunk := func(
+		index int,
+		delta openai.ChatCompletionStreamChoiceDelta,
+		finishReason openai.FinishReason,
+	) openai.ChatCompletionStreamResponse {
+		return openai.ChatCompletionStreamResponse{
+			Object:  "chat.completion.chunk",
+			Created: created,
+			Model:   req.Model,
+			Choices: []openai.ChatCompletionStreamChoice{
+				{
+					Index:        index,
+					Delta:        delta,
+					FinishReason: finishReason,
+				},
+			},
+		}
+	}
+
+	var (
+		hasStarted   bool
+		finishReason = genai.FinishReasonUnspecified
+		usage        *genai.UsageMetadata
+		toolCalls    int
+	)
+
+	for {
+		resp, err := iter.Next()
+		if errors.Is(err, iterator.Done) {
+			break
+		}
+
+		if err != nil {
+			// stream has errored
+			logger.Error("Failed to read from stream", "err", err)
+			return emptyResponse, plainTextResponseMessage, err
+		}
+
+		if !hasStarted {
+			// Only set the headers once we know the upstream has accepted the
+			// request so any earlier errors can still be returned as JSON
+			setStreamHeaders(c)
+
+			chunk := newChunk(
+				0,
+				openai.ChatCompletionStreamChoiceDelta{Role: "assistant"},
+				openai.FinishReasonNull,
+			)
+			if err := writeStreamChunk(c, chunk); err != nil {
+				logger.Error("Failed to write to response", "err", err)
+				return emptyResponse, plainTextResponseMessage, err
+			}
+			hasStarted = true
+		}
+
+		// Each chunk has the usage so far, the last one has the total
+		if resp.UsageMetadata != nil {
+			usage = resp.UsageMetadata
+		}
+
+		for _, cand := range resp.Candidates {
+			if cand.FinishReason != genai.FinishReasonUnspecified {
+				finishReason = cand.FinishReason
+			}
+
+			if cand.Content == nil {
+				continue
+			}
+
+			chunkText := geminiText(cand.Content.Parts)
+
+			// Construct our plaintext response that will be encrypted and saved
+			sb.WriteString(chunkText)
+
+			delta := openai.ChatCompletionStreamChoiceDelta{Content: chunkText}
+			for _, call := range cand.FunctionCalls() {
+				index := toolCalls
+				toolCalls++
+				delta.ToolCalls = append(delta.ToolCalls, geminiToolCall(call, &index))
+			}
+
+			chunk := newChunk(int(cand.Index), delta, openai.FinishReasonNull)
+			if err := writeStreamChunk(c, chunk); err != nil {
+				logger.Error("Failed to write to response", "err", err)
+				return emptyResponse, plainTextResponseMessage, err
+			}
+		}
 	}
-	return "", fmt.Errorf("invalid model name: %s", model)
+
+	if !hasStarted {
+		// Assume this was filtered due to safety concerns
+		return emptyResponse, plainTextResponseMessage, fmt.Errorf(
+			"no candidates returned",
+		)
+	}
+
+	// stream has finished
+	chunk := newChunk(
+		0,
+		openai.ChatCompletionStreamChoiceDelta{},
+		geminiToolCallsFinishReason(
+			GeminiFinishReasonToOpenAI(finishReason),
+			toolCalls > 0,
+		),
+	)
+	if err := writeStreamChunk(c, chunk); err != nil {
+		logger.Error("Failed to write to response", "err", err)
+		return emptyResponse, plainTextResponseMessage, err
+	}
+
+	if err := writeStreamDone(c); err != nil {
+		logger.Error("Failed to write to response", "err", err)
+		return emptyResponse, plainTextResponseMessage, err
+	}
+
+	plainTextResponseMessage = sb.String()
+	response.Usage = GeminiUsageToOpenAI(usage)
+
+	return response, plainTextResponseMessage, nil
 }
 
 func GeminiResponseToOpenAIResponse(
@@ -135,24 +278,28 @@ func GeminiResponseToOpenAIResponse(
 ) openai.ChatCompletionResponse {
 	openAIResponse := openai.ChatCompletionResponse{
 		Created: time.Now().Unix(),
+		Usage:   GeminiUsageToOpenAI(geminiResp.UsageMetadata),
 	}
 
 	for _, cand := range geminiResp.Candidates {
 		if cand.Content != nil {
 			var choice openai.ChatCompletionChoice
-			sb := strings.Builder{}
 
 			choice.Index = int(cand.Index)
-			choice.FinishReason = GeminiFinishReasonToOpenAI(cand.FinishReason)
-
-			for _, part := range cand.Content.Parts {
-				sb.WriteString(fmt.Sprint(part))
-			}
-
 			choice.Message = openai.ChatCompletionMessage{
-				Content: sb.String(),
+				Content: geminiText(cand.Content.Parts),
 				Role:    "assistant",
 			}
+			for _, call := range cand.FunctionCalls() {
+				choice.Message.ToolCalls = append(
+					choice.Message.ToolCalls,
+					geminiToolCall(call, nil),
+				)
+			}
+			choice.FinishReason = geminiToolCallsFinishReason(
+				GeminiFinishReasonToOpenAI(cand.FinishReason),
+				len(choice.Message.ToolCalls) > 0,
+			)
 
 			openAIResponse.Choices = append(openAIResponse.Choices, choice)
 		}
@@ -161,6 +308,333 @@ func GeminiResponseToOpenAIResponse(
 	return openAIResponse
 }
 
+// geminiText joins the text parts of a response, leaving out function calls
+func geminiText(parts []genai.Part) string {
+	sb := strings.Builder{}
+	for _, part := range parts {
+		if text, ok := part.(genai.Text); ok {
+			sb.WriteString(string(text))
+		}
+	}
+	return sb.String()
+}
+
+// geminiToolCall translates a function call to an OpenAI tool call. Gemini
+// doesn't identify its function calls so they're given a new ID. The index is
+// only set when streaming.
+func geminiToolCall(call genai.FunctionCall, index *int) openai.ToolCall {
+	arguments := []byte("{}")
+	if call.Args != nil {
+		// The args are decoded from JSON so can always be encoded again
+		arguments, _ = json.Marshal(call.Args)
+	}
+
+	return openai.ToolCall{
+		Index: index,
+		ID:    newToolCallID(),
+		Type:  openai.ToolTypeFunction,
+		Function: openai.FunctionCall{
+			Name:      call.Name,
+			Arguments: string(arguments),
+		},
+	}
+}
+
+// geminiToolCallsFinishReason reports tool calls as the finish reason, as
+// Gemini stops as normal after calling functions
+func geminiToolCallsFinishReason(
+	finishReason openai.FinishReason,
+	hasToolCalls bool,
+) openai.FinishReason {
+	if hasToolCalls && finishReason == openai.FinishReasonStop {
+		return openai.FinishReasonToolCalls
+	}
+	return finishReason
+}
+
+// geminiContents translates the messages to Gemini contents, returning the
+// system message separately as it's an instruction of the model
+func geminiContents(
+	ctx context.Context,
+	messages []openai.ChatCompletionMessage,
+) (system *genai.Content, contents []*genai.Content, err error) {
+	// Gemini function responses are matched to the calls by name rather than
+	// the tool call ID
+	functionNames := map[string]string{}
+
+	for _, message := range messages {
+		switch message.Role {
+		case "system":
+			system = &genai.Content{Parts: []genai.Part{genai.Text(MessageText(message))}}
+		case "user":
+			parts, err := geminiUserParts(ctx, message)
+			if err != nil {
+				return nil, nil, err
+			}
+			// Only unsupported parts leave nothing to send, and Gemini
+			// rejects contents without parts
+			if len(parts) == 0 {
+				continue
+			}
+			contents = append(contents, &genai.Content{Role: "user", Parts: parts})
+		case "assistant":
+			content := &genai.Content{Role: "model"}
+			if message.Content != "" || len(message.ToolCalls) == 0 {
+				content.Parts = append(content.Parts, genai.Text(message.Content))
+			}
+			for _, toolCall := range message.ToolCalls {
+				var args map[string]any
+				if err := json.Unmarshal(toolArguments(toolCall), &args); err != nil {
+					return nil, nil, fmt.Errorf(
+						"invalid arguments of tool call %s: %w",
+						toolCall.ID,
+						err,
+					)
+				}
+				functionNames[toolCall.ID] = toolCall.Function.Name
+				content.Parts = append(content.Parts, genai.FunctionCall{
+					Name: toolCall.Function.Name,
+					Args: args,
+				})
+			}
+			contents = append(contents, content)
+		case "tool":
+			name := message.Name
+			if name == "" {
+				name = functionNames[message.ToolCallID]
+			}
+			part := genai.FunctionResponse{
+				Name:     name,
+				Response: geminiFunctionResponse(message.Content),
+			}
+
+			// The responses to parallel function calls must all be in the
+			// same content
+			if len(contents) > 0 {
+				last := contents[len(contents)-1]
+				if len(last.Parts) > 0 {
+					if _, ok := last.Parts[0].(genai.FunctionResponse); ok {
+						last.Parts = append(last.Parts, part)
+						continue
+					}
+				}
+			}
+			contents = append(contents, &genai.Content{
+				Role:  "user",
+				Parts: []genai.Part{part},
+			})
+		}
+	}
+
+	return system, contents, nil
+}
+
+// geminiUserParts translates the text and image parts of a user message to
+// Gemini parts. Gemini only accepts image data, or files it stores, so images
+// sent by URL are downloaded.
+func geminiUserParts(
+	ctx context.Context,
+	message openai.ChatCompletionMessage,
+) ([]genai.Part, error) {
+	if len(message.MultiContent) == 0 {
+		return []genai.Part{genai.Text(message.Content)}, nil
+	}
+
+	parts := make([]genai.Part, 0, len(message.MultiContent))
+	for _, part := range message.MultiContent {
+		switch part.Type {
+		case openai.ChatMessagePartTypeText:
+			parts = append(parts, genai.Text(part.Text))
+		case openai.ChatMessagePartTypeImageURL:
+			if part.ImageURL == nil {
+				return nil, fmt.Errorf("%w: missing image_url", ErrInvalidImage)
+			}
+			image, err := loadImage(ctx, part.ImageURL.URL)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, genai.Blob{MIMEType: image.MediaType, Data: image.Data})
+		}
+	}
+
+	return parts, nil
+}
+
+// geminiFunctionResponse returns the result of a tool call as an object, as
+// Gemini function responses must be objects while OpenAI tool results can be
+// any text
+func geminiFunctionResponse(content string) map[string]any {
+	var response map[string]any
+	if err := json.Unmarshal([]byte(content), &response); err == nil && response != nil {
+		return response
+	}
+	return map[string]any{"content": content}
+}
+
+// geminiTools translates the OpenAI tools and tool choice of the request to
+// Gemini function declarations and function calling config
+func geminiTools(req openai.ChatCompletionRequest) ([]*genai.Tool, *genai.ToolConfig, error) {
+	mode, function, err := parseToolChoice(req.ToolChoice)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(req.Tools) == 0 {
+		return nil, nil, nil
+	}
+
+	declarations := make([]*genai.FunctionDeclaration, 0, len(req.Tools))
+	for _, tool := range req.Tools {
+		if tool.Type != openai.ToolTypeFunction || tool.Function == nil {
+			return nil, nil, fmt.Errorf("unsupported tool type: %q", tool.Type)
+		}
+
+		parameters, err := geminiSchema(tool.Function.Parameters)
+		if err != nil {
+			return nil, nil, fmt.Errorf(
+				"invalid parameters of function %s: %w",
+				tool.Function.Name,
+				err,
+			)
+		}
+		// Gemini rejects objects without properties, functions without
+		// parameters have none instead
+		if parameters != nil &&
+			parameters.Type == genai.TypeObject &&
+			len(parameters.Properties) == 0 {
+			parameters = nil
+		}
+
+		declarations = append(declarations, &genai.FunctionDeclaration{
+			Name:        tool.Function.Name,
+			Description: tool.Function.Description,
+			Parameters:  parameters,
+		})
+	}
+	tools := []*genai.Tool{{FunctionDeclarations: declarations}}
+
+	var config *genai.FunctionCallingConfig
+	switch mode {
+	case toolChoiceNone:
+		config = &genai.FunctionCallingConfig{Mode: genai.FunctionCallingNone}
+	case toolChoiceAuto:
+		config = &genai.FunctionCallingConfig{Mode: genai.FunctionCallingAuto}
+	case toolChoiceRequired:
+		config = &genai.FunctionCallingConfig{Mode: genai.FunctionCallingAny}
+	case toolChoiceFunction:
+		config = &genai.FunctionCallingConfig{
+			Mode:                 genai.FunctionCallingAny,
+			AllowedFunctionNames: []string{function},
+		}
+	default:
+		return tools, nil, nil
+	}
+
+	return tools, &genai.ToolConfig{FunctionCallingConfig: config}, nil
+}
+
+var jsonSchemaTypeToGemini = map[string]genai.Type{
+	"string":  genai.TypeString,
+	"number":  genai.TypeNumber,
+	"integer": genai.TypeInteger,
+	"boolean": genai.TypeBoolean,
+	"array":   genai.TypeArray,
+	"object":  genai.TypeObject,
+}
+
+// jsonSchema is the subset of JSON schema that Gemini supports. The type can
+// be a list of types to make it nullable.
+type jsonSchema struct {
+	Type        json.RawMessage        `json:"type"`
+	Format      string                 `json:"format"`
+	Description string                 `json:"description"`
+	Nullable    bool                   `json:"nullable"`
+	Enum        []any                  `json:"enum"`
+	Items       *jsonSchema            `json:"items"`
+	Properties  map[string]*jsonSchema `json:"properties"`
+	Required    []string               `json:"required"`
+}
+
+// geminiSchema translates the JSON schema of the function parameters, which
+// can be anything which encodes to JSON, to a Gemini schema
+func geminiSchema(parameters any) (*genai.Schema, error) {
+	if parameters == nil {
+		return nil, nil
+	}
+
+	data, err := json.Marshal(parameters)
+	if err != nil {
+		return nil, err
+	}
+	var schema *jsonSchema
+	if err := json.Unmarshal(data, &schema); err != nil {
+		return nil, err
+	}
+
+	return schema.toGemini()
+}
+
+func (s *jsonSchema) toGemini() (*genai.Schema, error) {
+	if s == nil {
+		return nil, nil
+	}
+
+	schema := &genai.Schema{
+		Format:      s.Format,
+		Description: s.Description,
+		Nullable:    s.Nullable,
+		Required:    s.Required,
+	}
+
+	var types []string
+	if len(s.Type) > 0 && s.Type[0] == '[' {
+		if err := json.Unmarshal(s.Type, &types); err != nil {
+			return nil, err
+		}
+	} else if len(s.Type) > 0 {
+		var schemaType string
+		if err := json.Unmarshal(s.Type, &schemaType); err != nil {
+			return nil, err
+		}
+		types = []string{schemaType}
+	}
+	for _, schemaType := range types {
+		if schemaType == "null" {
+			schema.Nullable = true
+			continue
+		}
+		geminiType, ok := jsonSchemaTypeToGemini[schemaType]
+		if !ok {
+			return nil, fmt.Errorf("unsupported type: %q", schemaType)
+		}
+		schema.Type = geminiType
+	}
+	if schema.Type == genai.TypeUnspecified && s.Properties != nil {
+		schema.Type = genai.TypeObject
+	}
+
+	// Gemini only has string enums
+	for _, value := range s.Enum {
+		schema.Enum = append(schema.Enum, fmt.Sprint(value))
+	}
+
+	var err error
+	schema.Items, err = s.Items.toGemini()
+	if err != nil {
+		return nil, err
+	}
+	if s.Properties != nil {
+		schema.Properties = make(map[string]*genai.Schema, len(s.Properties))
+		for name, property := range s.Properties {
+			schema.Properties[name], err = property.toGemini()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", name, err)
+			}
+		}
+	}
+
+	return schema, nil
+}
+
 func GeminiFinishReasonToOpenAI(
 	finishReason genai.FinishReason,
 ) openai.FinishReason {
@@ -169,3 +643,14 @@ func GeminiFinishReasonToOpenAI(
 	}
 	return openai.FinishReasonNull
 }
+
+func GeminiUsageToOpenAI(usage *genai.UsageMetadata) openai.Usage {
+	if usage == nil {
+		return openai.Usage{}
+	}
+	return openai.Usage{
+		PromptTokens:     int(usage.PromptTokenCount),
+		CompletionTokens: int(usage.CandidatesTokenCount),
+		TotalTokens:      int(usage.TotalTokenCount),
+	}
+}
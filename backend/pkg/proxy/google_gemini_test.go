@@ -0,0 +1,345 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/labstack/echo/v5"
+	"github.com/sashabaranov/go-openai"
+	"google.golang.org/api/option"
+)
+
+// The REST client requests integer enums so a finish reason of 1 is STOP
+const geminiStreamResponse = `[
+	{"candidates":[{"content":{"parts":[{"text":"Hello"}],"role":"model"},"index":0}]},
+	{"candidates":[{"content":{"parts":[{"text":" world"}],"role":"model"},"finishReason":1,"index":0}],"usageMetadata":{"promptTokenCount":5,"candidatesTokenCount":2,"totalTokenCount":7}}
+]`
+
+const geminiFunctionCallStreamResponse = `[
+	{"candidates":[{"content":{"parts":[{"functionCall":{"name":"get_weather","args":{"city":"Paris"}}}],"role":"model"},"finishReason":1,"index":0}]}
+]`
+
+// newGeminiUpstream returns an upstream for a server responding with the body,
+// keeping hold of the last request body it received
+func newGeminiUpstream(
+	t *testing.T,
+	responseBody string,
+	upstreamReq *map[string]any,
+) *proxy.GoogleGemini {
+	t.Helper()
+
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if upstreamReq != nil {
+				if err := json.NewDecoder(r.Body).Decode(upstreamReq); err != nil {
+					t.Error(err)
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(responseBody))
+		}),
+	)
+	t.Cleanup(server.Close)
+
+	client, err := genai.NewClient(
+		context.Background(),
+		option.WithAPIKey("test"),
+		option.WithEndpoint(server.URL),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	upstream, err := proxy.NewGoogleGemini(
+		client,
+		aimodel.NewInMemoryAIModelRepo(nil),
+		slog.Default(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return upstream
+}
+
+func TestGoogleGeminiChatCompletionStream(t *testing.T) {
+	upstream := newGeminiUpstream(t, geminiStreamResponse, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	resp, plainTextResponseMessage, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model:  "models/gemini-1.5-flash",
+				Stream: true,
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "system", Content: "Be helpful"},
+					{Role: "user", Content: "Hi"},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plainTextResponseMessage != "Hello world" {
+		t.Errorf(
+			"Expected plain text response %q, got %q",
+			"Hello world",
+			plainTextResponseMessage,
+		)
+	}
+
+	expectedUsage := openai.Usage{PromptTokens: 5, CompletionTokens: 2, TotalTokens: 7}
+	if resp.Usage != expectedUsage {
+		t.Errorf("Expected usage %+v, got %+v", expectedUsage, resp.Usage)
+	}
+
+	body := rec.Body.String()
+	expectedContent := []string{
+		`"object":"chat.completion.chunk"`,
+		`"model":"models/gemini-1.5-flash"`,
+		`"delta":{"role":"assistant"}`,
+		`"delta":{"content":"Hello"}`,
+		`"delta":{"content":" world"}`,
+		`"delta":{},"finish_reason":"stop"`,
+	}
+	for _, expected := range expectedContent {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s in response body:\n%s", expected, body)
+		}
+	}
+
+	if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Errorf("Expected response body to end with [DONE]:\n%s", body)
+	}
+}
+
+func TestGoogleGeminiChatCompletionStreamFunctionCall(t *testing.T) {
+	upstream := newGeminiUpstream(t, geminiFunctionCallStreamResponse, nil)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	_, plainTextResponseMessage, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model:  "models/gemini-1.5-flash",
+				Stream: true,
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "user", Content: "What's the weather in Paris?"},
+				},
+				Tools: []openai.Tool{weatherTool},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plainTextResponseMessage != "" {
+		t.Errorf("Expected no plain text response, got %q", plainTextResponseMessage)
+	}
+
+	body := rec.Body.String()
+	expectedContent := []string{
+		`"tool_calls":[{"index":0,"id":"call_`,
+		`"type":"function","function":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}}]`,
+		`"delta":{},"finish_reason":"tool_calls"`,
+	}
+	for _, expected := range expectedContent {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected %s in response body:\n%s", expected, body)
+		}
+	}
+}
+
+func TestGoogleGeminiChatCompletionUnsupportedParts(t *testing.T) {
+	var upstreamReq map[string]any
+	upstream := newGeminiUpstream(
+		t,
+		`[{"candidates":[{"content":{"parts":[{"text":"It's sunny"}],"role":"model"},"finishReason":1,"index":0}]}]`,
+		&upstreamReq,
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	_, _, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model: "models/gemini-1.5-flash",
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "user", Content: "What's the weather in Paris?"},
+					{
+						Role: "assistant",
+						ToolCalls: []openai.ToolCall{{
+							ID:   "call_1",
+							Type: openai.ToolTypeFunction,
+							Function: openai.FunctionCall{
+								Name:      "get_weather",
+								Arguments: `{"city":"Paris"}`,
+							},
+						}},
+					},
+					// Only parts Gemini can't be sent, leaving nothing of the
+					// message, before a tool result
+					{
+						Role: "user",
+						MultiContent: []openai.ChatMessagePart{
+							{Type: "input_audio"},
+						},
+					},
+					{Role: "tool", ToolCallID: "call_1", Content: "Sunny"},
+				},
+				Tools: []openai.Tool{weatherTool},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedContents := `[
+		{"role":"user","parts":[{"text":"What's the weather in Paris?"}]},
+		{"role":"model","parts":[
+			{"functionCall":{"name":"get_weather","args":{"city":"Paris"}}}
+		]},
+		{"role":"user","parts":[
+			{"functionResponse":{"name":"get_weather","response":{"content":"Sunny"}}}
+		]}
+	]`
+	assertJSONEqual(t, "contents", expectedContents, upstreamReq["contents"])
+}
+
+func TestGoogleGeminiChatCompletionTools(t *testing.T) {
+	var upstreamReq map[string]any
+	upstream := newGeminiUpstream(
+		t,
+		// The client always streams, merging the chunks when not streaming
+		`[{"candidates":[{"content":{"parts":[{"text":"Checking Rome"},{"functionCall":{"name":"get_weather","args":{"city":"Rome"}}}],"role":"model"},"finishReason":1,"index":0}],"usageMetadata":{"promptTokenCount":40,"candidatesTokenCount":10,"totalTokenCount":50}}]`,
+		&upstreamReq,
+	)
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(req, rec)
+
+	resp, plainTextResponseMessage, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model: "models/gemini-1.5-flash",
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "user", Content: "What's the weather in Paris and London?"},
+					{
+						Role: "assistant",
+						ToolCalls: []openai.ToolCall{
+							{
+								ID:   "call_1",
+								Type: openai.ToolTypeFunction,
+								Function: openai.FunctionCall{
+									Name:      "get_weather",
+									Arguments: `{"city":"Paris"}`,
+								},
+							},
+							{
+								ID:   "call_2",
+								Type: openai.ToolTypeFunction,
+								Function: openai.FunctionCall{
+									Name:      "get_weather",
+									Arguments: `{"city":"London"}`,
+								},
+							},
+						},
+					},
+					{Role: "tool", ToolCallID: "call_1", Content: `{"forecast":"Sunny"}`},
+					{Role: "tool", ToolCallID: "call_2", Content: "Rainy"},
+				},
+				Tools:      []openai.Tool{weatherTool},
+				ToolChoice: "required",
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The function responses are merged into the message that's sent and
+	// matched to the calls by name
+	expectedContents := `[
+		{"role":"user","parts":[{"text":"What's the weather in Paris and London?"}]},
+		{"role":"model","parts":[
+			{"functionCall":{"name":"get_weather","args":{"city":"Paris"}}},
+			{"functionCall":{"name":"get_weather","args":{"city":"London"}}}
+		]},
+		{"role":"user","parts":[
+			{"functionResponse":{"name":"get_weather","response":{"forecast":"Sunny"}}},
+			{"functionResponse":{"name":"get_weather","response":{"content":"Rainy"}}}
+		]}
+	]`
+	assertJSONEqual(t, "contents", expectedContents, upstreamReq["contents"])
+
+	tools, _ := json.Marshal(upstreamReq["tools"])
+	toolConfig, _ := json.Marshal(upstreamReq["toolConfig"])
+	expectedRequest := []string{
+		`"name":"get_weather"`,
+		`"description":"Get the weather in a city"`,
+		`"required":["city"]`,
+	}
+	for _, expected := range expectedRequest {
+		if !strings.Contains(string(tools), expected) {
+			t.Errorf("Expected %s in tools %s", expected, tools)
+		}
+	}
+	// The REST client sends integer enums so the mode 2 is ANY
+	if !strings.Contains(string(toolConfig), `"mode":2`) {
+		t.Errorf("Expected function calling mode ANY in tool config %s", toolConfig)
+	}
+
+	if plainTextResponseMessage != "Checking Rome" {
+		t.Errorf(
+			"Expected plain text response %q, got %q",
+			"Checking Rome",
+			plainTextResponseMessage,
+		)
+	}
+
+	if len(resp.Choices) != 1 {
+		t.Fatalf("Expected 1 choice, got %d", len(resp.Choices))
+	}
+	choice := resp.Choices[0]
+	if choice.FinishReason != openai.FinishReasonToolCalls {
+		t.Errorf("Expected finish reason tool_calls, got %s", choice.FinishReason)
+	}
+	if choice.Message.Content != "Checking Rome" {
+		t.Errorf("Expected content %q, got %q", "Checking Rome", choice.Message.Content)
+	}
+	if len(choice.Message.ToolCalls) != 1 {
+		t.Fatalf("Expected 1 tool call, got %+v", choice.Message.ToolCalls)
+	}
+	toolCall := choice.Message.ToolCalls[0]
+	if !strings.HasPrefix(toolCall.ID, "call_") ||
+		toolCall.Type != openai.ToolTypeFunction ||
+		toolCall.Function.Name != "get_weather" ||
+		toolCall.Function.Arguments != `{"city":"Rome"}` {
+		t.Errorf("Unexpected tool call %+v", toolCall)
+	}
+}
@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// MaxImageSize is the largest image accepted, Anthropic's limit as it's the
+// lowest of the providers
+const MaxImageSize = 5 << 20
+
+// ImageMediaTypes are the image formats every provider accepts
+var ImageMediaTypes = []string{"image/jpeg", "image/png", "image/gif", "image/webp"}
+
+var ErrInvalidImage = errors.New("invalid image")
+
+// maxImageRedirects is how many redirects are followed to download an image
+const maxImageRedirects = 5
+
+var errNonPublicAddress = errors.New("not a public address")
+
+// imageClient downloads the images sent by URL for the providers which only
+// accept the image data. The URLs come from users so it only connects to
+// public addresses, on every redirect too, or they could be used to reach the
+// internal network.
+var imageClient = &http.Client{
+	Timeout: 30 * time.Second,
+	Transport: &http.Transport{
+		// Not through a proxy as the address connected to must be checked
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: dialPublicAddress,
+		}).DialContext,
+		ForceAttemptHTTP2:   true,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+		TLSHandshakeTimeout: 10 * time.Second,
+	},
+	CheckRedirect: checkImageRedirect,
+}
+
+// Image is the data of an image sent in a message
+type Image struct {
+	MediaType string
+	Data      []byte
+}
+
+// Base64 returns the image data encoded as base64
+func (i Image) Base64() string {
+	return base64.StdEncoding.EncodeToString(i.Data)
+}
+
+// ParseDataURL decodes an image sent as a base64 data URL e.g.
+// `data:image/png;base64,iVBORw0KGgo...`, checking its format and size
+func ParseDataURL(url string) (Image, error) {
+	header, data, ok := strings.Cut(strings.TrimPrefix(url, "data:"), ",")
+	if !ok || !strings.HasPrefix(url, "data:") {
+		return Image{}, fmt.Errorf("%w: not a data URL", ErrInvalidImage)
+	}
+	mediaType, encoding, _ := strings.Cut(header, ";")
+	if encoding != "base64" {
+		return Image{}, fmt.Errorf("%w: data URL isn't base64 encoded", ErrInvalidImage)
+	}
+	if base64.StdEncoding.DecodedLen(len(data)) > MaxImageSize+2 {
+		return Image{}, fmt.Errorf("%w: larger than %d bytes", ErrInvalidImage, MaxImageSize)
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(data)
+	if err != nil {
+		return Image{}, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+
+	return newImage(mediaType, decoded)
+}
+
+// newImage checks the format and size of the image data
+func newImage(mediaType string, data []byte) (Image, error) {
+	if !slices.Contains(ImageMediaTypes, mediaType) {
+		return Image{}, fmt.Errorf("%w: unsupported format %q", ErrInvalidImage, mediaType)
+	}
+	if len(data) > MaxImageSize {
+		return Image{}, fmt.Errorf("%w: larger than %d bytes", ErrInvalidImage, MaxImageSize)
+	}
+
+	return Image{MediaType: mediaType, Data: data}, nil
+}
+
+// isPublicAddress reports whether the address is reachable from the internet
+// rather than e.g. the loopback, a private network or the link-local cloud
+// metadata endpoints
+func isPublicAddress(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsValid() &&
+		!addr.IsLoopback() &&
+		!addr.IsPrivate() &&
+		!addr.IsLinkLocalUnicast() &&
+		!addr.IsLinkLocalMulticast() &&
+		!addr.IsInterfaceLocalMulticast() &&
+		!addr.IsMulticast() &&
+		!addr.IsUnspecified()
+}
+
+// dialPublicAddress refuses to connect to anything but a public address, it's
+// called with the resolved address so a public host name can't point inside
+func dialPublicAddress(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !isPublicAddress(addr) {
+		return fmt.Errorf("%w: %s", errNonPublicAddress, addr)
+	}
+
+	return nil
+}
+
+// checkImageURL checks an image URL, or where it redirects to, is HTTPS and
+// isn't for a non-public IP address. The addresses host names resolve to are
+// checked when connecting.
+func checkImageURL(imageURL *url.URL) error {
+	if imageURL.Scheme != "https" {
+		return errors.New("unsupported URL")
+	}
+	addr, err := netip.ParseAddr(imageURL.Hostname())
+	if err == nil && !isPublicAddress(addr) {
+		return fmt.Errorf("%w: %s", errNonPublicAddress, addr)
+	}
+
+	return nil
+}
+
+func checkImageRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= maxImageRedirects {
+		return fmt.Errorf("stopped after %d redirects", maxImageRedirects)
+	}
+
+	return checkImageURL(req.URL)
+}
+
+// loadImage returns the data of an image URL, downloading it unless it's a
+// data URL
+func loadImage(ctx context.Context, imageURL string) (Image, error) {
+	if strings.HasPrefix(imageURL, "data:") {
+		return ParseDataURL(imageURL)
+	}
+
+	// The errors aren't wrapped so an image that can't be downloaded isn't
+	// mistaken for the provider being unreachable
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return Image{}, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	if err := checkImageURL(req.URL); err != nil {
+		return Image{}, fmt.Errorf("%w: %v", ErrInvalidImage, err)
+	}
+	resp, err := imageClient.Do(req)
+	if err != nil {
+		return Image{}, fmt.Errorf("%w: failed to download: %v", ErrInvalidImage, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Image{}, fmt.Errorf(
+			"%w: failed to download: status %d",
+			ErrInvalidImage,
+			resp.StatusCode,
+		)
+	}
+
+	if resp.ContentLength > MaxImageSize {
+		return Image{}, fmt.Errorf("%w: larger than %d bytes", ErrInvalidImage, MaxImageSize)
+	}
+
+	// Reading one more byte than allowed is enough to tell it's too large
+	data, err := io.ReadAll(io.LimitReader(resp.Body, MaxImageSize+1))
+	if err != nil {
+		return Image{}, fmt.Errorf("%w: failed to download: %v", ErrInvalidImage, err)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "image/") {
+		mediaType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+
+	return newImage(mediaType, data)
+}
+
+// MessageText returns the text of a message, joining the text parts of a
+// message with multiple parts
+func MessageText(message openai.ChatCompletionMessage) string {
+	if len(message.MultiContent) == 0 {
+		return message.Content
+	}
+
+	texts := make([]string, 0, len(message.MultiContent))
+	for _, part := range message.MultiContent {
+		if part.Type == openai.ChatMessagePartTypeText {
+			texts = append(texts, part.Text)
+		}
+	}
+	return strings.Join(texts, "\n")
+}
@@ -0,0 +1,272 @@
+package proxy_test
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/labstack/echo/v5"
+	"github.com/liushuangls/go-anthropic/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+// testPNG is enough of a PNG for its format to be detected
+const testPNG = "\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR\x00\x00\x00\x01\x00\x00\x00\x01"
+
+var testPNGBase64 = base64.StdEncoding.EncodeToString([]byte(testPNG))
+
+func TestParseDataURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		url     string
+		wantErr bool
+	}{
+		{"png", "data:image/png;base64," + testPNGBase64, false},
+		{"webp", "data:image/webp;base64," + testPNGBase64, false},
+		{"not a data URL", "https://example.com/cat.png", true},
+		{"unsupported format", "data:image/svg+xml;base64," + testPNGBase64, true},
+		{"not base64", "data:image/png," + testPNG, true},
+		{"invalid base64", "data:image/png;base64,!!!!", true},
+		{
+			"too large",
+			"data:image/png;base64," + strings.Repeat("A", proxy.MaxImageSize/3*4+8),
+			true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := proxy.ParseDataURL(tt.url)
+			if tt.wantErr {
+				if !errors.Is(err, proxy.ErrInvalidImage) {
+					t.Errorf("Expected ErrInvalidImage, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(image.Data) != testPNG {
+				t.Errorf("Expected the decoded image, got %q", image.Data)
+			}
+		})
+	}
+}
+
+func TestLoadImagePublicAddressesOnly(t *testing.T) {
+	images := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			t.Error("Expected the image not to be downloaded")
+		}),
+	)
+	defer images.Close()
+
+	for _, url := range []string{
+		"https://10.0.0.1/cat.png",
+		"https://192.168.1.1/cat.png",
+		"https://169.254.169.254/latest/meta-data/",
+		"https://[::1]/cat.png",
+		"https://[::ffff:127.0.0.1]/cat.png",
+		"https://0.0.0.0/cat.png",
+		// The host name is resolved to the loopback when connecting
+		strings.Replace(images.URL, "127.0.0.1", "localhost", 1) + "/cat.png",
+	} {
+		_, err := proxy.LoadImage(context.Background(), url)
+		if !errors.Is(err, proxy.ErrInvalidImage) ||
+			!strings.Contains(err.Error(), "not a public address") {
+			t.Errorf("Expected %s to be refused as not public, got %v", url, err)
+		}
+	}
+}
+
+func TestAnthropicChatCompletionImages(t *testing.T) {
+	images := httptest.NewTLSServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/cat.png":
+				// Without a content type the format is detected
+				w.Header().Set("Content-Type", "application/octet-stream")
+				_, _ = w.Write([]byte(testPNG))
+			case "/huge.png":
+				w.Header().Set("Content-Type", "image/png")
+				_, _ = w.Write(make([]byte, proxy.MaxImageSize+1))
+			case "/redirect-local.png":
+				local := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+				http.Redirect(w, r, "https://"+local.String()+"/redirected.png", http.StatusFound)
+			case "/redirect-metadata.png":
+				http.Redirect(w, r, "http://169.254.169.254/latest/meta-data/", http.StatusFound)
+			case "/redirected.png":
+				t.Error("Expected the redirect not to be followed")
+			default:
+				w.WriteHeader(http.StatusNotFound)
+			}
+		}),
+	)
+	defer images.Close()
+	// The images are served from a public host name, which is dialed to the
+	// test server
+	const imagesURL = "https://example.com"
+	transport := images.Client().Transport.(*http.Transport).Clone()
+	transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, images.Listener.Addr().String())
+	}
+	defer proxy.SetImageTransport(transport)()
+
+	var upstreamReq map[string]any
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&upstreamReq); err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{
+				"id": "msg_1",
+				"type": "message",
+				"role": "assistant",
+				"model": "claude-3-haiku-20240307",
+				"content": [{"type": "text", "text": "Two cats"}],
+				"stop_reason": "end_turn",
+				"usage": {"input_tokens": 80, "output_tokens": 3}
+			}`))
+		}),
+	)
+	defer server.Close()
+
+	upstream, err := proxy.NewAnthropic(
+		anthropic.NewClient("test", anthropic.WithBaseURL(server.URL)),
+		aimodel.NewInMemoryAIModelRepo(nil),
+		slog.Default(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	imageRequest := func(url string) proxy.ChatCompletionRequest {
+		return proxy.ChatCompletionRequest{ChatCompletionRequest: openai.ChatCompletionRequest{
+			Model: anthropic.ModelClaude3Haiku20240307,
+			Messages: []openai.ChatCompletionMessage{
+				{
+					Role: "user",
+					MultiContent: []openai.ChatMessagePart{
+						{Type: openai.ChatMessagePartTypeText, Text: "What are these?"},
+						{
+							Type: openai.ChatMessagePartTypeImageURL,
+							ImageURL: &openai.ChatMessageImageURL{
+								URL: "data:image/png;base64," + testPNGBase64,
+							},
+						},
+						{
+							Type:     openai.ChatMessagePartTypeImageURL,
+							ImageURL: &openai.ChatMessageImageURL{URL: url},
+						},
+					},
+				},
+			},
+		}}
+	}
+
+	c := echo.New().NewContext(
+		httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil),
+		httptest.NewRecorder(),
+	)
+	_, plainTextResponseMessage, err := upstream.ChatCompletion(
+		c,
+		imageRequest(imagesURL+"/cat.png"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plainTextResponseMessage != "Two cats" {
+		t.Errorf("Expected plain text response %q, got %q", "Two cats", plainTextResponseMessage)
+	}
+
+	// Both images are sent as data
+	image := `{"type":"image","source":{"type":"base64","media_type":"image/png","data":"` +
+		testPNGBase64 + `"}}`
+	expectedMessages := `[{"role":"user","content":[
+		{"type":"text","text":"What are these?"},` + image + `,` + image + `
+	]}]`
+	assertJSONEqual(t, "messages", expectedMessages, upstreamReq["messages"])
+
+	for _, url := range []string{
+		imagesURL + "/huge.png",
+		imagesURL + "/missing.png",
+		"http://example.com/cat.png",
+		imagesURL + "/redirect-local.png",
+		imagesURL + "/redirect-metadata.png",
+	} {
+		upstreamReq = nil
+		_, _, err := upstream.ChatCompletion(c, imageRequest(url))
+		if !errors.Is(err, proxy.ErrInvalidImage) {
+			t.Errorf("Expected ErrInvalidImage for %s, got %v", url, err)
+		}
+		if proxy.IsRetryable(err) {
+			t.Errorf("Expected an invalid image not to be retried on another provider")
+		}
+		if upstreamReq != nil {
+			t.Errorf("Expected the request not to be sent upstream")
+		}
+	}
+}
+
+func TestGoogleGeminiChatCompletionImages(t *testing.T) {
+	var upstreamReq map[string]any
+	upstream := newGeminiUpstream(t, geminiStreamResponse, &upstreamReq)
+
+	c := echo.New().NewContext(
+		httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil),
+		httptest.NewRecorder(),
+	)
+	_, _, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model: "models/gemini-1.5-flash",
+				Messages: []openai.ChatCompletionMessage{
+					{
+						Role: "system",
+						MultiContent: []openai.ChatMessagePart{
+							{Type: openai.ChatMessagePartTypeText, Text: "Be brief"},
+						},
+					},
+					{
+						Role: "user",
+						MultiContent: []openai.ChatMessagePart{
+							{Type: openai.ChatMessagePartTypeText, Text: "What's this?"},
+							{
+								Type: openai.ChatMessagePartTypeImageURL,
+								ImageURL: &openai.ChatMessageImageURL{
+									URL: "data:image/png;base64," + testPNGBase64,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expectedContents := `[{"role":"user","parts":[
+		{"text":"What's this?"},
+		{"inlineData":{"mimeType":"image/png","data":"` + testPNGBase64 + `"}}
+	]}]`
+	assertJSONEqual(t, "contents", expectedContents, upstreamReq["contents"])
+	assertJSONEqual(
+		t,
+		"system instruction",
+		`{"parts":[{"text":"Be brief"}]}`,
+		upstreamReq["systemInstruction"],
+	)
+}
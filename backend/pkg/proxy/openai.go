@@ -3,11 +3,11 @@ package proxy
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
 	"io"
 	"log/slog"
 	"strings"
 
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
 	"github.com/labstack/echo/v5"
 	"github.com/sashabaranov/go-openai"
 )
@@ -17,59 +17,62 @@ var (
 	newLine    = []byte("\n\n")
 )
 
-var openAIModelMapping = map[string]string{
-	"gpt-3.5-turbo": openai.GPT3Dot5Turbo,
-	"gpt-4o":        openai.GPT4o,
-}
-
 // compile time type checking
 var _ Upstream = (*OpenAI)(nil)
 
 type OpenAI struct {
-	client *openai.Client
-	logger *slog.Logger
+	client    *openai.Client
+	modelRepo aimodel.AIModelRepo
+	logger    *slog.Logger
 }
 
 func (o *OpenAI) LookupModel(
 	internalModel string,
 ) (string, error) {
-	return OpenAIModelMapper(internalModel)
+	return lookupUpstreamModel(o.modelRepo, ProviderOpenAI, internalModel)
 }
 
 func (o *OpenAI) ChatCompletion(
 	c echo.Context,
-	req openai.ChatCompletionRequest,
+	req ChatCompletionRequest,
 ) (response openai.ChatCompletionResponse, plainTextResponseMessage string, err error) {
 	if req.Stream {
-		return StreamOpenAIResponse(c, req, o.logger, o.client)
+		return StreamOpenAIResponse(c, req.ChatCompletionRequest, o.logger, o.client, true)
 	}
-	return ForwardOpenAIResponse(c, req, o.logger, o.client)
+	return ForwardOpenAIResponse(c, req.ChatCompletionRequest, o.logger, o.client)
 }
 
 func NewOpenAI(
 	client *openai.Client,
+	modelRepo aimodel.AIModelRepo,
 	logger *slog.Logger,
 ) (*OpenAI, error) {
 	return &OpenAI{
-		logger: logger,
-		client: client,
+		logger:    logger,
+		client:    client,
+		modelRepo: modelRepo,
 	}, nil
 }
 
-func OpenAIModelMapper(model string) (string, error) {
-	if mappedModel, ok := openAIModelMapping[model]; ok {
-		return mappedModel, nil
-	}
-	return "", fmt.Errorf("invalid model name: %s", model)
-}
-
+// StreamOpenAIResponse streams the response of an OpenAI compatible upstream
+// to the client. If streamUsage is set the upstream is always asked for the
+// token usage so it can be recorded, but it's only passed on to the client if
+// they asked for it too. Not every provider accepts `stream_options`, so
+// otherwise the request is sent as the client made it.
 func StreamOpenAIResponse(
 	c echo.Context,
 	req openai.ChatCompletionRequest,
 	logger *slog.Logger,
 	client *openai.Client,
+	streamUsage bool,
 ) (response openai.ChatCompletionResponse, plainTextResponseMessage string, err error) {
 	emptyResponse := openai.ChatCompletionResponse{}
+
+	clientWantsUsage := req.StreamOptions != nil && req.StreamOptions.IncludeUsage
+	if streamUsage {
+		req.StreamOptions = &openai.StreamOptions{IncludeUsage: true}
+	}
+
 	// Forward the request to OpenAI
 	stream, err := client.CreateChatCompletionStream(
 		c.Request().Context(),
@@ -84,24 +87,17 @@ func StreamOpenAIResponse(
 	// https://100go.co/?h=strings#under-optimized-strings-concatenation-39
 	sb := strings.Builder{}
 
-	// Set the headers for the response
-	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
-	c.Response().Header().Set(echo.HeaderConnection, "keep-alive")
-	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
-
-	respWriter := c.Response().Unwrap()
+	setStreamHeaders(c)
 
 	// Gather the response chunks
 	for {
 		chunk, err := stream.Recv()
 		if errors.Is(err, io.EOF) {
 			// stream has finished
-			_, err = respWriter.Write([]byte("data: [DONE]\n\n"))
-			if err != nil {
+			if err := writeStreamDone(c); err != nil {
 				logger.Error("Failed to write error to response", "err", err)
 				return emptyResponse, plainTextResponseMessage, err
 			}
-			c.Response().Flush()
 			break
 		}
 
@@ -111,31 +107,33 @@ func StreamOpenAIResponse(
 			return emptyResponse, plainTextResponseMessage, err
 		}
 
-		// Construct our plaintext response that will be encrypted and saved
-		sb.WriteString(chunk.Choices[0].Delta.Content)
+		// The usage of the whole request usually comes in a final chunk
+		// without choices, but some providers add it to the last delta
+		if chunk.Usage != nil {
+			response.Usage = *chunk.Usage
+			if !clientWantsUsage {
+				if len(chunk.Choices) == 0 {
+					continue
+				}
+				chunk.Usage = nil
+			}
+		}
 
-		// Re-marshal the response to send to the client
-		marshalledChunk, err := json.Marshal(chunk)
-		if err != nil {
-			// handle error
-			logger.Error("Failed to marshal chunk", "err", err)
-			return emptyResponse, plainTextResponseMessage, err
+		// Construct our plaintext response that will be encrypted and saved
+		if len(chunk.Choices) > 0 {
+			sb.WriteString(chunk.Choices[0].Delta.Content)
 		}
 
-		_, err = respWriter.Write(
-			append(append(headerData, marshalledChunk...), newLine...),
-		)
-		if err != nil {
+		// Re-marshal the response to send to the client
+		if err := writeStreamChunk(c, chunk); err != nil {
 			logger.Error("Failed to write to response", "err", err)
 			return emptyResponse, plainTextResponseMessage, err
 		}
-
-		c.Response().Flush()
 	}
 
 	plainTextResponseMessage = sb.String()
 
-	return
+	return response, plainTextResponseMessage, nil
 }
 
 func ForwardOpenAIResponse(
@@ -160,3 +158,91 @@ func ForwardOpenAIResponse(
 
 	return
 }
+
+// setStreamHeaders sets the headers for a server-sent events response.
+func setStreamHeaders(c echo.Context) {
+	c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+	c.Response().Header().Set(echo.HeaderConnection, "keep-alive")
+	c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+}
+
+// writeStreamChunk writes an OpenAI `chat.completion.chunk` to the client as a
+// server-sent event and flushes it immediately.
+func writeStreamChunk(
+	c echo.Context,
+	chunk openai.ChatCompletionStreamResponse,
+) error {
+	marshalledChunk, err := json.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+
+	_, err = c.Response().Write(
+		append(append(headerData, marshalledChunk...), newLine...),
+	)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Flush()
+	return nil
+}
+
+// writeStreamDone writes the final server-sent event which tells the client
+// that the stream has finished.
+func writeStreamDone(c echo.Context) error {
+	_, err := c.Response().Write([]byte("data: [DONE]\n\n"))
+	if err != nil {
+		return err
+	}
+
+	c.Response().Flush()
+	return nil
+}
+
+// WriteStreamResponse sends a complete response to a client that asked for a
+// stream, as `chat.completion.chunk` server-sent events. It's used when the
+// response had to be gathered before it could be sent.
+func WriteStreamResponse(c echo.Context, resp openai.ChatCompletionResponse) error {
+	setStreamHeaders(c)
+
+	for _, choice := range resp.Choices {
+		toolCalls := make([]openai.ToolCall, len(choice.Message.ToolCalls))
+		for i, toolCall := range choice.Message.ToolCalls {
+			toolCall.Index = &i
+			toolCalls[i] = toolCall
+		}
+
+		deltas := []openai.ChatCompletionStreamChoice{
+			{
+				Index: choice.Index,
+				Delta: openai.ChatCompletionStreamChoiceDelta{Role: "assistant"},
+			},
+			{
+				Index: choice.Index,
+				Delta: openai.ChatCompletionStreamChoiceDelta{
+					Content:   choice.Message.Content,
+					ToolCalls: toolCalls,
+				},
+			},
+			{
+				Index:        choice.Index,
+				FinishReason: choice.FinishReason,
+			},
+		}
+		for _, delta := range deltas {
+			err := writeStreamChunk(c, openai.ChatCompletionStreamResponse{
+				ID:      resp.ID,
+				Object:  "chat.completion.chunk",
+				Created: resp.Created,
+				Model:   resp.Model,
+				Choices: []openai.ChatCompletionStreamChoice{delta},
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return writeStreamDone(c)
+}
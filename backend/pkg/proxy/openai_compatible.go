@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/labstack/echo/v5"
+	"github.com/sashabaranov/go-openai"
+)
+
+// compile time type checking
+var _ Upstream = (*OpenAICompatible)(nil)
+
+func NewOpenAICompatibleClient(
+	providerConfig config.OpenAICompatibleProviderConfig,
+) *openai.Client {
+	openAIConfig := openai.DefaultConfig(providerConfig.APIKey)
+	openAIConfig.BaseURL = providerConfig.URL
+	return openai.NewClientWithConfig(openAIConfig)
+}
+
+// OpenAICompatible is a generic upstream for any provider that implements the
+// OpenAI chat completions API. The providers are declared in the config rather
+// than in code. Models in the model catalogue take precedence over the models
+// listed in the config.
+type OpenAICompatible struct {
+	name         string
+	client       *openai.Client
+	modelRepo    aimodel.AIModelRepo
+	modelMapping map[string]string
+	streamUsage  bool
+	logger       *slog.Logger
+}
+
+func (o *OpenAICompatible) LookupModel(
+	internalModel string,
+) (string, error) {
+	mappedModel, err := lookupUpstreamModel(o.modelRepo, o.name, internalModel)
+	if !errors.Is(err, aimodel.ErrModelNotFound) {
+		return mappedModel, err
+	}
+
+	if mappedModel, ok := o.modelMapping[internalModel]; ok {
+		return mappedModel, nil
+	}
+	return "", fmt.Errorf("invalid model name: %s", internalModel)
+}
+
+func (o *OpenAICompatible) ChatCompletion(
+	c echo.Context,
+	req ChatCompletionRequest,
+) (response openai.ChatCompletionResponse, plainTextResponseMessage string, err error) {
+	if req.Stream {
+		return StreamOpenAIResponse(c, req.ChatCompletionRequest, o.logger, o.client, o.streamUsage)
+	}
+	return ForwardOpenAIResponse(c, req.ChatCompletionRequest, o.logger, o.client)
+}
+
+func NewOpenAICompatible(
+	name string,
+	providerConfig config.OpenAICompatibleProviderConfig,
+	modelRepo aimodel.AIModelRepo,
+	logger *slog.Logger,
+) (*OpenAICompatible, error) {
+	if providerConfig.URL == "" {
+		return nil, fmt.Errorf("missing url for provider: %s", name)
+	}
+
+	modelMapping := make(map[string]string, len(providerConfig.Models))
+	for _, model := range providerConfig.Models {
+		if model.Name == "" || model.Upstream == "" {
+			return nil, fmt.Errorf("invalid model mapping for provider: %s", name)
+		}
+		modelMapping[model.Name] = model.Upstream
+	}
+
+	return &OpenAICompatible{
+		name:         name,
+		client:       NewOpenAICompatibleClient(providerConfig),
+		modelRepo:    modelRepo,
+		modelMapping: modelMapping,
+		streamUsage:  providerConfig.StreamUsage,
+		logger:       logger,
+	}, nil
+}
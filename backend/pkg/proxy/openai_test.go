@@ -0,0 +1,197 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/labstack/echo/v5"
+	"github.com/sashabaranov/go-openai"
+)
+
+var openAIStreamChunks = []string{
+	`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{"role":"assistant","content":"Hello"}}]}`,
+	`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[{"index":0,"delta":{"content":" world"},"finish_reason":"stop"}]}`,
+	`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"gpt-4o","choices":[],"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`,
+}
+
+func TestOpenAIChatCompletionStreamUsage(t *testing.T) {
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req openai.ChatCompletionRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				t.Error(err)
+			}
+			if req.StreamOptions == nil || !req.StreamOptions.IncludeUsage {
+				t.Error("Expected the usage to be requested from the upstream")
+			}
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			for _, chunk := range openAIStreamChunks {
+				fmt.Fprintf(w, "data: %s\n\n", chunk)
+			}
+			fmt.Fprint(w, "data: [DONE]\n\n")
+		}),
+	)
+	defer server.Close()
+
+	clientConfig := openai.DefaultConfig("test")
+	clientConfig.BaseURL = server.URL
+	upstream, err := proxy.NewOpenAI(
+		openai.NewClientWithConfig(clientConfig),
+		aimodel.NewInMemoryAIModelRepo(nil),
+		slog.Default(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name          string
+		streamOptions *openai.StreamOptions
+		expectUsage   bool
+	}{
+		{"client didn't ask for usage", nil, false},
+		{"client asked for usage", &openai.StreamOptions{IncludeUsage: true}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(req, rec)
+
+			resp, plainTextResponseMessage, err := upstream.ChatCompletion(
+				c,
+				proxy.ChatCompletionRequest{
+					ChatCompletionRequest: openai.ChatCompletionRequest{
+						Model:         "gpt-4o",
+						Stream:        true,
+						StreamOptions: tt.streamOptions,
+						Messages: []openai.ChatCompletionMessage{
+							{Role: "user", Content: "Hi"},
+						},
+					},
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if plainTextResponseMessage != "Hello world" {
+				t.Errorf(
+					"Expected plain text response %q, got %q",
+					"Hello world",
+					plainTextResponseMessage,
+				)
+			}
+
+			expectedUsage := openai.Usage{PromptTokens: 9, CompletionTokens: 2, TotalTokens: 11}
+			if resp.Usage != expectedUsage {
+				t.Errorf("Expected usage %+v, got %+v", expectedUsage, resp.Usage)
+			}
+
+			body := rec.Body.String()
+			if strings.Contains(body, `"usage"`) != tt.expectUsage {
+				t.Errorf("Expected usage chunk to be sent %v:\n%s", tt.expectUsage, body)
+			}
+			if !strings.HasSuffix(body, "data: [DONE]\n\n") {
+				t.Errorf("Expected response body to end with [DONE]:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestOpenAICompatibleChatCompletionStreamUsage(t *testing.T) {
+	// This provider adds the usage to the last delta, with the finish reason
+	chunks := []string{
+		`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"llama","choices":[{"index":0,"delta":{"role":"assistant","content":"Hello"}}]}`,
+		`{"id":"chatcmpl-1","object":"chat.completion.chunk","model":"llama","choices":[{"index":0,"delta":{"content":" world"},"finish_reason":"stop"}],"usage":{"prompt_tokens":9,"completion_tokens":2,"total_tokens":11}}`,
+	}
+
+	tests := []struct {
+		name               string
+		streamUsage        bool
+		expectStreamOption bool
+	}{
+		{"provider doesn't accept stream_options", false, false},
+		{"provider accepts stream_options", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(
+				http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					var req map[string]any
+					if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+						t.Error(err)
+					}
+					if _, ok := req["stream_options"]; ok != tt.expectStreamOption {
+						t.Errorf("Expected stream_options to be sent %v, got %v", tt.expectStreamOption, req)
+					}
+
+					w.Header().Set("Content-Type", "text/event-stream")
+					for _, chunk := range chunks {
+						fmt.Fprintf(w, "data: %s\n\n", chunk)
+					}
+					fmt.Fprint(w, "data: [DONE]\n\n")
+				}),
+			)
+			defer server.Close()
+
+			upstream, err := proxy.NewOpenAICompatible(
+				"test",
+				config.OpenAICompatibleProviderConfig{URL: server.URL, StreamUsage: tt.streamUsage},
+				aimodel.NewInMemoryAIModelRepo(nil),
+				slog.Default(),
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rec := httptest.NewRecorder()
+			c := echo.New().NewContext(
+				httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil),
+				rec,
+			)
+			resp, plainTextResponseMessage, err := upstream.ChatCompletion(
+				c,
+				proxy.ChatCompletionRequest{
+					ChatCompletionRequest: openai.ChatCompletionRequest{
+						Model:    "llama",
+						Stream:   true,
+						Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "Hi"}},
+					},
+				},
+			)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The last delta is kept, only its usage is dropped
+			if plainTextResponseMessage != "Hello world" {
+				t.Errorf("Expected plain text response %q, got %q", "Hello world", plainTextResponseMessage)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, `"content":" world"`) ||
+				!strings.Contains(body, `"finish_reason":"stop"`) {
+				t.Errorf("Expected the last delta to be sent:\n%s", body)
+			}
+			if strings.Contains(body, `"usage"`) {
+				t.Errorf("Expected the usage not to be sent:\n%s", body)
+			}
+
+			expectedUsage := openai.Usage{PromptTokens: 9, CompletionTokens: 2, TotalTokens: 11}
+			if resp.Usage != expectedUsage {
+				t.Errorf("Expected usage %+v, got %+v", expectedUsage, resp.Usage)
+			}
+		})
+	}
+}
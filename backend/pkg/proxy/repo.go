@@ -4,63 +4,112 @@ import (
 	"fmt"
 	"log/slog"
 
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
 	"github.com/google/generative-ai-go/genai"
 	"github.com/liushuangls/go-anthropic/v2"
 	"github.com/sashabaranov/go-openai"
 )
 
 type RepoParams struct {
-	Logger                 *slog.Logger
+	Logger *slog.Logger
+	// Maps our internal model names to the upstream model names
+	ModelRepo              aimodel.AIModelRepo
 	OpenAIClient           *openai.Client
 	CloudflareOpenAIClient *openai.Client
 	AnthropicClient        *anthropic.Client
 	GoogleGeminiAIClient   *genai.Client
 	DeepInfraOpenAIClient  *openai.Client
+	// Additional OpenAI compatible providers declared in the config
+	Providers map[string]config.OpenAICompatibleProviderConfig
 }
 
 type UpstreamRepo interface {
 	Provider(provider string) (Upstream, error)
 }
 
+// InMemoryUpstreamRepo is a registry of the upstreams available to the API keyed
+// by their provider name. The registry is built once at start-up.
 type InMemoryUpstreamRepo struct {
-	openAIClient           *openai.Client
-	cloudflareOpenAIClient *openai.Client
-	anthropicClient        *anthropic.Client
-	googleGeminiAIClient   *genai.Client
-	deepinfraOpenAIClient  *openai.Client
-	logger                 *slog.Logger
+	upstreams map[string]Upstream
+	logger    *slog.Logger
 }
 
 func (r *InMemoryUpstreamRepo) Provider(provider string) (Upstream, error) {
-	switch provider {
-	case "openai":
-		return NewOpenAI(r.openAIClient, r.logger)
-	case "cloudflare":
-		return NewCloudflare(r.cloudflareOpenAIClient, r.logger)
-	case "google":
-		return NewGoogleGemini(r.googleGeminiAIClient, r.logger)
-	case "anthropic":
-		return NewAnthropic(r.anthropicClient, r.logger)
-	case "deepinfra":
-		return NewDeepInfra(r.deepinfraOpenAIClient, r.logger)
-	case "fireworks":
-	case "together":
-	case "groq":
-	case "x":
-	default:
-		return nil, fmt.Errorf("invalid model provider: %s", provider)
+	if upstream, ok := r.upstreams[provider]; ok {
+		return upstream, nil
 	}
-	return nil, fmt.Errorf("unable to find provider: %s", provider)
+	return nil, fmt.Errorf("invalid model provider: %s", provider)
+}
+
+// Register adds an upstream to the registry under the given provider name.
+// Returns an error if the provider name has already been registered.
+func (r *InMemoryUpstreamRepo) Register(provider string, upstream Upstream) error {
+	if _, ok := r.upstreams[provider]; ok {
+		return fmt.Errorf("provider already registered: %s", provider)
+	}
+	r.upstreams[provider] = upstream
+	return nil
 }
 
 func NewInMemoryUpstreamRepo(params RepoParams,
 ) *InMemoryUpstreamRepo {
-	return &InMemoryUpstreamRepo{
-		logger:                 params.Logger,
-		openAIClient:           params.OpenAIClient,
-		cloudflareOpenAIClient: params.CloudflareOpenAIClient,
-		anthropicClient:        params.AnthropicClient,
-		googleGeminiAIClient:   params.GoogleGeminiAIClient,
-		deepinfraOpenAIClient:  params.DeepInfraOpenAIClient,
+	repo := &InMemoryUpstreamRepo{
+		upstreams: map[string]Upstream{},
+		logger:    params.Logger,
+	}
+
+	openAI, _ := NewOpenAI(params.OpenAIClient, params.ModelRepo, params.Logger)
+	_ = repo.Register(ProviderOpenAI, openAI)
+	cloudflare, _ := NewCloudflare(
+		params.CloudflareOpenAIClient,
+		params.ModelRepo,
+		params.Logger,
+	)
+	_ = repo.Register(ProviderCloudflare, cloudflare)
+	googleGemini, _ := NewGoogleGemini(
+		params.GoogleGeminiAIClient,
+		params.ModelRepo,
+		params.Logger,
+	)
+	_ = repo.Register(ProviderGoogleGemini, googleGemini)
+	anthropicUpstream, _ := NewAnthropic(
+		params.AnthropicClient,
+		params.ModelRepo,
+		params.Logger,
+	)
+	_ = repo.Register(ProviderAnthropic, anthropicUpstream)
+	deepInfra, _ := NewDeepInfra(
+		params.DeepInfraOpenAIClient,
+		params.ModelRepo,
+		params.Logger,
+	)
+	_ = repo.Register(ProviderDeepInfra, deepInfra)
+
+	for provider, providerConfig := range params.Providers {
+		upstream, err := NewOpenAICompatible(
+			provider,
+			providerConfig,
+			params.ModelRepo,
+			params.Logger,
+		)
+		if err != nil {
+			params.Logger.Error(
+				"Failed to create provider",
+				"provider", provider,
+				"err", err,
+			)
+			continue
+		}
+
+		if err := repo.Register(provider, upstream); err != nil {
+			params.Logger.Error(
+				"Failed to register provider",
+				"provider", provider,
+				"err", err,
+			)
+		}
 	}
+
+	return repo
 }
@@ -0,0 +1,123 @@
+package proxy_test
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/internal/config"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+)
+
+func TestInMemoryUpstreamRepoProvider(t *testing.T) {
+	repo := proxy.NewInMemoryUpstreamRepo(proxy.RepoParams{
+		Logger: slog.Default(),
+		ModelRepo: aimodel.NewInMemoryAIModelRepo([]aimodel.Model{
+			{Provider: "openai", Slug: "gpt-4o", UpstreamModel: "gpt-4o", Enabled: true},
+			{Provider: "openai", Slug: "gpt-3.5-turbo", UpstreamModel: "gpt-3.5-turbo"},
+			{Provider: "groq", Slug: "mixtral-8x7b", UpstreamModel: "mixtral-8x7b-32768", Enabled: true},
+			{Provider: "groq", Slug: "gemma-7b", UpstreamModel: "gemma-7b-it"},
+		}),
+		Providers: map[string]config.OpenAICompatibleProviderConfig{
+			"groq": {
+				URL: "https://api.groq.com/openai/v1",
+				Models: []config.ModelMappingConfig{
+					{Name: "llama-3-8b-instruct", Upstream: "llama3-8b-8192"},
+				},
+			},
+			// Missing URL so should not be registered
+			"together": {
+				Models: []config.ModelMappingConfig{
+					{Name: "llama-3-8b-instruct", Upstream: "meta-llama/Llama-3-8b-chat-hf"},
+				},
+			},
+			// Clashes with a built-in provider so should not replace it
+			"openai": {
+				URL: "https://example.com/v1",
+			},
+		},
+	})
+
+	tt := []struct {
+		Name string
+
+		Provider      string
+		Model         string
+		ExpectedModel string
+		ExpectedErr   bool
+	}{
+		{
+			Name:          "Built-in provider",
+			Provider:      "openai",
+			Model:         "gpt-4o",
+			ExpectedModel: "gpt-4o",
+		},
+		{
+			Name:        "Disabled model",
+			Provider:    "openai",
+			Model:       "gpt-3.5-turbo",
+			ExpectedErr: true,
+		},
+		{
+			Name:        "Unknown model",
+			Provider:    "openai",
+			Model:       "gpt-5",
+			ExpectedErr: true,
+		},
+		{
+			Name:          "Config provider model from catalogue",
+			Provider:      "groq",
+			Model:         "mixtral-8x7b",
+			ExpectedModel: "mixtral-8x7b-32768",
+		},
+		{
+			Name:        "Config provider model disabled in catalogue",
+			Provider:    "groq",
+			Model:       "gemma-7b",
+			ExpectedErr: true,
+		},
+		{
+			Name:          "Config provider",
+			Provider:      "groq",
+			Model:         "llama-3-8b-instruct",
+			ExpectedModel: "llama3-8b-8192",
+		},
+		{
+			Name:        "Config provider with unknown model",
+			Provider:    "groq",
+			Model:       "gpt-4o",
+			ExpectedErr: true,
+		},
+		{
+			Name:        "Invalid config provider",
+			Provider:    "together",
+			Model:       "llama-3-8b-instruct",
+			ExpectedErr: true,
+		},
+		{
+			Name:        "Unknown provider",
+			Provider:    "x",
+			Model:       "grok",
+			ExpectedErr: true,
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.Name, func(t *testing.T) {
+			upstream, err := repo.Provider(tc.Provider)
+			if err == nil {
+				var model string
+				model, err = upstream.LookupModel(tc.Model)
+				if err == nil && model != tc.ExpectedModel {
+					t.Errorf("Expected model %s, got %s", tc.ExpectedModel, model)
+				}
+			}
+
+			if tc.ExpectedErr && err == nil {
+				t.Error("Expected an error, got nil")
+			}
+			if !tc.ExpectedErr && err != nil {
+				t.Errorf("Expected no error, got %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,15 @@
+package proxy
+
+import (
+	"github.com/sashabaranov/go-openai"
+)
+
+// anthropicJSONPrefill starts the answer of a JSON response for Anthropic,
+// which has no JSON mode, so it can only continue with a JSON object
+const anthropicJSONPrefill = "{"
+
+// wantsJSON checks if the request asks for the response to be a JSON object
+func wantsJSON(req openai.ChatCompletionRequest) bool {
+	return req.ResponseFormat != nil &&
+		req.ResponseFormat.Type == openai.ChatCompletionResponseFormatTypeJSONObject
+}
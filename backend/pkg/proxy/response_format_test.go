@@ -0,0 +1,185 @@
+package proxy_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/proxy"
+	"github.com/google/generative-ai-go/genai"
+	"github.com/labstack/echo/v5"
+	"github.com/liushuangls/go-anthropic/v2"
+	"github.com/sashabaranov/go-openai"
+)
+
+var jsonResponseFormat = &openai.ChatCompletionResponseFormat{
+	Type: openai.ChatCompletionResponseFormatTypeJSONObject,
+}
+
+func TestAnthropicChatCompletionJSON(t *testing.T) {
+	var upstreamReq map[string]any
+	server := httptest.NewServer(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if err := json.NewDecoder(r.Body).Decode(&upstreamReq); err != nil {
+				t.Error(err)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{
+				"id": "msg_1",
+				"type": "message",
+				"role": "assistant",
+				"model": "claude-3-haiku-20240307",
+				"content": [{"type": "text", "text": "\"legs\": 8}"}],
+				"stop_reason": "end_turn",
+				"usage": {"input_tokens": 20, "output_tokens": 5}
+			}`))
+		}),
+	)
+	defer server.Close()
+
+	upstream, err := proxy.NewAnthropic(
+		anthropic.NewClient("test", anthropic.WithBaseURL(server.URL)),
+		aimodel.NewInMemoryAIModelRepo(nil),
+		slog.Default(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := echo.New().NewContext(
+		httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil),
+		httptest.NewRecorder(),
+	)
+	req := proxy.ChatCompletionRequest{
+		ChatCompletionRequest: openai.ChatCompletionRequest{
+			Model:          anthropic.ModelClaude3Haiku20240307,
+			ResponseFormat: jsonResponseFormat,
+			Messages: []openai.ChatCompletionMessage{
+				{Role: "user", Content: "How many legs does an octopus have?"},
+			},
+		},
+	}
+
+	resp, plainTextResponseMessage, err := upstream.ChatCompletion(c, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The answer is started with the opening brace, which is part of it
+	assertJSONEqual(t, "messages", `[
+		{"role":"user","content":[{"type":"text","text":"How many legs does an octopus have?"}]},
+		{"role":"assistant","content":[{"type":"text","text":"{"}]}
+	]`, upstreamReq["messages"])
+	if plainTextResponseMessage != `{"legs": 8}` {
+		t.Errorf("Expected the answer to include the prefill, got %q", plainTextResponseMessage)
+	}
+	if resp.Choices[0].Message.Content != `{"legs": 8}` {
+		t.Errorf("Expected the response to include the prefill, got %q", resp.Choices[0].Message.Content)
+	}
+
+	// The model couldn't call the tools if its answer was started for it
+	req.Tools = []openai.Tool{weatherTool}
+	if _, _, err := upstream.ChatCompletion(c, req); err != nil {
+		t.Fatal(err)
+	}
+	messages, _ := upstreamReq["messages"].([]any)
+	if len(messages) != 1 {
+		t.Errorf("Expected no prefill with tools, got %v", messages)
+	}
+}
+
+func TestAnthropicChatCompletionStreamJSON(t *testing.T) {
+	server := newAnthropicStreamServer(t, anthropicStreamEvents)
+	defer server.Close()
+
+	upstream, err := proxy.NewAnthropic(
+		anthropic.NewClient("test", anthropic.WithBaseURL(server.URL)),
+		aimodel.NewInMemoryAIModelRepo(nil),
+		slog.Default(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c := echo.New().NewContext(
+		httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil),
+		rec,
+	)
+
+	_, plainTextResponseMessage, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model:          anthropic.ModelClaude3Haiku20240307,
+				Stream:         true,
+				ResponseFormat: jsonResponseFormat,
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "user", Content: "Hi"},
+				},
+			},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if plainTextResponseMessage != "{Hello world" {
+		t.Errorf("Expected the answer to include the prefill, got %q", plainTextResponseMessage)
+	}
+	body := rec.Body.String()
+	prefill := strings.Index(body, `"delta":{"content":"{"}`)
+	if prefill == -1 || prefill > strings.Index(body, `"delta":{"content":"Hello"}`) {
+		t.Errorf("Expected the prefill to be streamed first:\n%s", body)
+	}
+}
+
+func TestGoogleGeminiChatCompletionJSON(t *testing.T) {
+	var upstreamReq map[string]any
+	upstream := newGeminiUpstream(t, geminiStreamResponse, &upstreamReq)
+
+	c := echo.New().NewContext(
+		httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil),
+		httptest.NewRecorder(),
+	)
+	_, _, err := upstream.ChatCompletion(
+		c,
+		proxy.ChatCompletionRequest{
+			ChatCompletionRequest: openai.ChatCompletionRequest{
+				Model:          "models/gemini-1.5-pro",
+				ResponseFormat: jsonResponseFormat,
+				Messages: []openai.ChatCompletionMessage{
+					{Role: "user", Content: "How many legs does an octopus have?"},
+				},
+			},
+			ResponseSchema: json.RawMessage(`{
+				"type": "object",
+				"properties": {"legs": {"type": "integer"}},
+				"required": ["legs"],
+				"additionalProperties": false
+			}`),
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generationConfig, _ := upstreamReq["generationConfig"].(map[string]any)
+	assertJSONEqual(t, "response MIME type", `"application/json"`, generationConfig["responseMimeType"])
+	// The types are sent as their enum values
+	assertJSONEqual(
+		t,
+		"response schema",
+		fmt.Sprintf(
+			`{"type":%d,"properties":{"legs":{"type":%d}},"required":["legs"]}`,
+			genai.TypeObject,
+			genai.TypeInteger,
+		),
+		generationConfig["responseSchema"],
+	)
+}
@@ -0,0 +1,66 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	"github.com/sashabaranov/go-openai"
+)
+
+// OpenAI tool choice modes, a tool choice can also be a specific function
+const (
+	toolChoiceNone     = "none"
+	toolChoiceAuto     = "auto"
+	toolChoiceRequired = "required"
+	toolChoiceFunction = "function"
+)
+
+// parseToolChoice reads the `tool_choice` of a request, which is either a mode
+// or the function the model must call. A request bound from JSON has a map
+// rather than an openai.ToolChoice so it's decoded again.
+func parseToolChoice(toolChoice any) (mode string, function string, err error) {
+	switch choice := toolChoice.(type) {
+	case nil:
+		return "", "", nil
+	case string:
+		switch choice {
+		case toolChoiceNone, toolChoiceAuto, toolChoiceRequired:
+			return choice, "", nil
+		}
+		return "", "", fmt.Errorf("invalid tool choice: %q", choice)
+	}
+
+	data, err := json.Marshal(toolChoice)
+	if err != nil {
+		return "", "", err
+	}
+	var choice openai.ToolChoice
+	if err := json.Unmarshal(data, &choice); err != nil {
+		return "", "", fmt.Errorf("invalid tool choice: %w", err)
+	}
+	if choice.Type != openai.ToolTypeFunction || choice.Function.Name == "" {
+		return "", "", fmt.Errorf("invalid tool choice: %s", data)
+	}
+
+	return toolChoiceFunction, choice.Function.Name, nil
+}
+
+// newToolCallID generates an ID for the tool calls of upstreams which don't
+// have their own, in the same format as OpenAI
+func newToolCallID() string {
+	b := make([]byte, 12)
+	// crypto/rand.Read never returns an error on supported platforms
+	_, _ = rand.Read(b)
+	return "call_" + hex.EncodeToString(b)
+}
+
+// toolArguments returns the JSON arguments of a tool call, which are empty
+// when the function has no parameters
+func toolArguments(toolCall openai.ToolCall) json.RawMessage {
+	if toolCall.Function.Arguments == "" {
+		return json.RawMessage("{}")
+	}
+	return json.RawMessage(toolCall.Function.Arguments)
+}
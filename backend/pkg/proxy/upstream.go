@@ -1,10 +1,33 @@
 package proxy
 
 import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/cognos-io/chat.cognos.io/backend/pkg/aimodel"
 	"github.com/labstack/echo/v5"
 	"github.com/sashabaranov/go-openai"
 )
 
+// Provider names of the built-in upstreams
+const (
+	ProviderOpenAI       = "openai"
+	ProviderCloudflare   = "cloudflare"
+	ProviderGoogleGemini = "google"
+	ProviderAnthropic    = "anthropic"
+	ProviderDeepInfra    = "deepinfra"
+)
+
+// ChatCompletionRequest is the OpenAI request sent upstream, with the options
+// it has no room for
+type ChatCompletionRequest struct {
+	openai.ChatCompletionRequest
+	// ResponseSchema is the JSON schema the response must match. The OpenAI
+	// request only has room for the `json_object` response format, upstreams
+	// which can constrain their output to a schema use it.
+	ResponseSchema json.RawMessage
+}
+
 // Upstream is an interface that defines the methods that an upstream server must implement
 type Upstream interface {
 	// LookupModel maps our internal model names to the upstream model names
@@ -13,6 +36,19 @@ type Upstream interface {
 	// and returns the response
 	ChatCompletion(
 		c echo.Context,
-		request openai.ChatCompletionRequest,
+		request ChatCompletionRequest,
 	) (response openai.ChatCompletionResponse, plainTextRequestMessage string, err error)
 }
+
+// lookupUpstreamModel maps our internal model name to the upstream model name
+// using the model catalogue.
+func lookupUpstreamModel(
+	modelRepo aimodel.AIModelRepo,
+	provider, internalModel string,
+) (string, error) {
+	model, err := modelRepo.LookupModel(provider, internalModel)
+	if err != nil {
+		return "", fmt.Errorf("invalid model name: %s: %w", internalModel, err)
+	}
+	return model.UpstreamModel, nil
+}
@@ -0,0 +1,74 @@
+package ttlcache
+
+import (
+	"sync"
+	"time"
+)
+
+type entry[V any] struct {
+	value   V
+	expires time.Time
+}
+
+// Cache is a small in process cache whose entries expire after a fixed time.
+// It's safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	ttl time.Duration
+	// Now is overridden in tests
+	Now func() time.Time
+
+	mu      sync.Mutex
+	entries map[K]entry[V]
+}
+
+// Get returns the value of the key, false if it isn't cached or has expired
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, ok := c.entries[key]
+	if !ok || !c.Now().Before(cached.expires) {
+		var zero V
+		return zero, false
+	}
+	return cached.value, true
+}
+
+// Set caches the value of the key for the TTL of the cache
+func (c *Cache[K, V]) Set(key K, value V) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.Now()
+	// Drop the expired entries so the cache doesn't grow forever
+	for key, cached := range c.entries {
+		if !now.Before(cached.expires) {
+			delete(c.entries, key)
+		}
+	}
+	c.entries[key] = entry[V]{value: value, expires: now.Add(c.ttl)}
+}
+
+// Delete forgets the value of the key
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// Clear forgets every value
+func (c *Cache[K, V]) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+}
+
+func New[K comparable, V any](ttl time.Duration) *Cache[K, V] {
+	return &Cache[K, V]{
+		ttl:     ttl,
+		Now:     time.Now,
+		entries: map[K]entry[V]{},
+	}
+}
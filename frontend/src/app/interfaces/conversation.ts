@@ -39,5 +39,6 @@ export const serializeConversationData = (data: ConversationData): Uint8Array =>
 export interface Conversation {
   record: ConversationsResponse;
   decryptedData: ConversationData;
-  keyPair: KeyPair;
+  keyPair: KeyPair; // the newest version of the conversation key pair
+  keyVersion: number; // the version of keyPair
 }
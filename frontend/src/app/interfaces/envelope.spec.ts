@@ -0,0 +1,46 @@
+import { decodeEnvelope, Envelope } from './envelope';
+
+describe('message envelope decode', () => {
+  interface validTestCase {
+    name: string;
+    data: string;
+    envelope: Envelope;
+  }
+  const validTable: Array<validTestCase> = [
+    {
+      name: 'legacy sealed box',
+      data: 'AQID',
+      envelope: {
+        version: 0,
+        algorithm: 'x25519-xsalsa20poly1305-sealedbox',
+        ciphertext: new Uint8Array([1, 2, 3]),
+      },
+    },
+    {
+      name: 'version 1',
+      data: '{"v":1,"alg":"x25519-xsalsa20poly1305-sealedbox","kid":2,"ct":"AQID"}',
+      envelope: {
+        version: 1,
+        algorithm: 'x25519-xsalsa20poly1305-sealedbox',
+        keyId: 2,
+        ciphertext: new Uint8Array([1, 2, 3]),
+      },
+    },
+  ];
+
+  test.each(validTable)('decodeEnvelope $name', ({ data, envelope }) => {
+    const decoded = decodeEnvelope(data);
+
+    expect(decoded.version).toEqual(envelope.version);
+    expect(decoded.algorithm).toEqual(envelope.algorithm);
+    expect(decoded.keyId).toEqual(envelope.keyId);
+    expect(Array.from(decoded.ciphertext)).toEqual(Array.from(envelope.ciphertext));
+  });
+
+  test.each([
+    ['unknown version', '{"v":2,"alg":"x25519-mlkem768-hybrid","ct":"AQID"}'],
+    ['unknown algorithm', '{"v":1,"alg":"rot13","ct":"AQID"}'],
+  ])('decodeEnvelope rejects %s', (_, data) => {
+    expect(() => decodeEnvelope(data)).toThrow();
+  });
+});
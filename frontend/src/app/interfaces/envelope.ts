@@ -0,0 +1,52 @@
+import { Base64 } from 'js-base64';
+import { z } from 'zod';
+
+/**
+ * Envelope wraps the encrypted data of a message with what's needed to
+ * decrypt it. Legacy messages are a bare base64 sealed box.
+ *
+ * This must be kept up to date with the Envelope struct in the backend.
+ */
+export const EnvelopeAlgorithm = z.enum(['x25519-xsalsa20poly1305-sealedbox']);
+export type EnvelopeAlgorithm = z.infer<typeof EnvelopeAlgorithm>;
+
+export const LEGACY_ENVELOPE_VERSION = 0;
+
+const EncodedEnvelope = z.object({
+  v: z.literal(1),
+  alg: EnvelopeAlgorithm,
+  kid: z.number().int().optional(), // the version of the conversation key
+  ct: z.string().base64(),
+});
+
+export interface Envelope {
+  version: number;
+  algorithm: EnvelopeAlgorithm;
+  keyId?: number;
+  ciphertext: Uint8Array;
+}
+
+/**
+ * decodeEnvelope - takes the data of a message record and
+ * returns the envelope, supporting legacy bare sealed boxes.
+ *
+ * @param data (string) the data of the message record
+ * @returns (Envelope) the decoded envelope
+ */
+export const decodeEnvelope = (data: string): Envelope => {
+  if (!data.startsWith('{')) {
+    return {
+      version: LEGACY_ENVELOPE_VERSION,
+      algorithm: 'x25519-xsalsa20poly1305-sealedbox',
+      ciphertext: Base64.toUint8Array(data),
+    };
+  }
+
+  const envelope = EncodedEnvelope.parse(JSON.parse(data));
+  return {
+    version: envelope.v,
+    algorithm: envelope.alg,
+    keyId: envelope.kid,
+    ciphertext: Base64.toUint8Array(envelope.ct),
+  };
+};
@@ -0,0 +1,57 @@
+import { UserKeyPairsRecord } from '@app/types/pocketbase-types';
+
+import {
+  CURRENT_KDF_PARAMS,
+  KDF_SALT_LENGTH,
+  kdfParamsFromRecord,
+  kdfParamsToRecord,
+  needsKdfUpgrade,
+  newKdfParams,
+} from './kdf-params';
+
+describe('KDF parameters', () => {
+  const legacyRecord: UserKeyPairsRecord = {
+    public_key: 'FaTq77hDYWu9pNLMwBlQ4Ks54BAfwz1Y7/nmyZTLkTE=',
+    secret_key: 'c2VjcmV0',
+    user: 'uvi8zmr78j9y5hz',
+  };
+
+  test('new parameters have a random salt', () => {
+    const first = newKdfParams();
+    const second = newKdfParams();
+
+    expect(first.salt.length).toEqual(KDF_SALT_LENGTH);
+    expect(Array.from(first.salt)).not.toEqual(Array.from(second.salt));
+    expect(first.iterations).toEqual(CURRENT_KDF_PARAMS.iterations);
+  });
+
+  test('legacy key pairs use the legacy salt', () => {
+    const params = kdfParamsFromRecord(legacyRecord, 'ory-id');
+
+    expect(new TextDecoder().decode(params.salt)).toEqual('ory-id');
+    expect(params.memory).toEqual(CURRENT_KDF_PARAMS.memory);
+    expect(needsKdfUpgrade(legacyRecord)).toBe(true);
+  });
+
+  test('stored parameters round trip', () => {
+    const params = newKdfParams();
+    const record = { ...legacyRecord, ...kdfParamsToRecord(params) };
+
+    const parsed = kdfParamsFromRecord(record, 'ory-id');
+
+    expect(Array.from(parsed.salt)).toEqual(Array.from(params.salt));
+    expect(parsed.iterations).toEqual(params.iterations);
+    expect(needsKdfUpgrade(record)).toBe(false);
+  });
+
+  test('weaker stored parameters still unlock and need an upgrade', () => {
+    const record = {
+      ...legacyRecord,
+      ...kdfParamsToRecord(newKdfParams()),
+      kdf_memory: 1024,
+    };
+
+    expect(needsKdfUpgrade(record)).toBe(true);
+    expect(kdfParamsFromRecord(record, 'ory-id').memory).toEqual(1024);
+  });
+});
@@ -0,0 +1,104 @@
+import { Base64 } from 'js-base64';
+import nacl from 'tweetnacl';
+import { z } from 'zod';
+
+import {
+  UserKeyPairsKdfAlgorithmOptions,
+  UserKeyPairsRecord,
+} from '@app/types/pocketbase-types';
+
+/**
+ * KdfParams are the parameters used to derive the key that wraps a user
+ * secret key from their vault password. They're stored with the key pair so
+ * they can be upgraded over time.
+ *
+ * This must be kept up to date with the KDFParams struct in the backend.
+ */
+export const KdfParams = z.object({
+  algorithm: z.literal('argon2id'),
+  salt: z.instanceof(Uint8Array),
+  // Older parameters can still unlock a key pair, the minimums are enforced
+  // by the backend when it's wrapped
+  iterations: z.number().int().positive(),
+  memory: z.number().int().positive(), // KiB
+  threads: z.number().int().positive(),
+});
+export type KdfParams = z.infer<typeof KdfParams>;
+
+// Argon2id parameters as recommended by the OWASP password storage cheat sheet
+// https://cheatsheetseries.owasp.org/cheatsheets/Password_Storage_Cheat_Sheet.html#introduction
+export const CURRENT_KDF_PARAMS = {
+  algorithm: 'argon2id',
+  iterations: 2,
+  memory: 19456, // 19MiB
+  threads: 1,
+} as const;
+
+export const KDF_SALT_LENGTH = 16;
+
+/**
+ * newKdfParams - returns the current parameters with a new random salt.
+ *
+ * @returns (KdfParams)
+ */
+export const newKdfParams = (): KdfParams => ({
+  ...CURRENT_KDF_PARAMS,
+  salt: nacl.randomBytes(KDF_SALT_LENGTH),
+});
+
+/**
+ * kdfParamsFromRecord - returns the parameters stored with a key pair. Legacy
+ * key pairs have none and are salted with the legacy salt.
+ *
+ * @param record (UserKeyPairsRecord)
+ * @param legacySalt (string) the salt of legacy key pairs
+ * @returns (KdfParams)
+ */
+export const kdfParamsFromRecord = (
+  record: UserKeyPairsRecord,
+  legacySalt: string,
+): KdfParams => {
+  if (!record.kdf_salt) {
+    return {
+      ...CURRENT_KDF_PARAMS,
+      salt: new TextEncoder().encode(legacySalt),
+    };
+  }
+
+  return KdfParams.parse({
+    algorithm: record.kdf_algorithm,
+    salt: Base64.toUint8Array(record.kdf_salt),
+    iterations: record.kdf_iterations,
+    memory: record.kdf_memory,
+    threads: record.kdf_threads,
+  });
+};
+
+/**
+ * kdfParamsToRecord - returns the fields of a key pair record for the
+ * parameters.
+ *
+ * @param params (KdfParams)
+ * @returns (Partial<UserKeyPairsRecord>)
+ */
+export const kdfParamsToRecord = (params: KdfParams): Partial<UserKeyPairsRecord> => ({
+  kdf_algorithm: UserKeyPairsKdfAlgorithmOptions[params.algorithm],
+  kdf_salt: Base64.fromUint8Array(params.salt),
+  kdf_iterations: params.iterations,
+  kdf_memory: params.memory,
+  kdf_threads: params.threads,
+});
+
+/**
+ * needsKdfUpgrade - whether a key pair should be re-wrapped with a new salt
+ * and the current parameters, i.e. it's a legacy key pair or its cost is
+ * lower than the current parameters.
+ *
+ * @param record (UserKeyPairsRecord)
+ * @returns (boolean)
+ */
+export const needsKdfUpgrade = (record: UserKeyPairsRecord): boolean =>
+  !record.kdf_salt ||
+  (record.kdf_iterations ?? 0) < CURRENT_KDF_PARAMS.iterations ||
+  (record.kdf_memory ?? 0) < CURRENT_KDF_PARAMS.memory ||
+  (record.kdf_threads ?? 0) < CURRENT_KDF_PARAMS.threads;
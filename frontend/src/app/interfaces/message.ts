@@ -3,6 +3,20 @@ import { z } from 'zod';
 export const MessageDataVersion = z.enum(['1']);
 export type MessageDataVersion = z.infer<typeof MessageDataVersion>;
 
+/**
+ * MessageAttachment refers to a file uploaded to the conversation. The file is
+ * encrypted with its own key, which is only kept here, inside the encrypted
+ * message.
+ */
+export const MessageAttachment = z.object({
+  id: z.string(), // the record id of the attachment
+  name: z.string(), // the original file name
+  media_type: z.string().optional(),
+  size: z.number().optional(), // size of the file before it was encrypted
+  key: z.string().base64(), // the key the file was encrypted with
+});
+export type MessageAttachment = z.infer<typeof MessageAttachment>;
+
 /**
  * MessageData is the decrypted data object of a message.
  *
@@ -16,6 +30,17 @@ export const MessageData = z.object({
   agent_id: z.string().optional(), // the agent used when generating the message
   model_id: z.string().optional(), // the model used when generating the message
   owner_id: z.string().optional(), // the user who sent the message
+  tool_calls: z.array(z.unknown()).optional(), // the built-in tools the agent called
+  tool_call_id: z.string().optional(), // the tool call this message is the result of
+  images: z
+    .array(
+      z.object({
+        url: z.string(), // a base64 data URL or link to the image
+        detail: z.string().optional(),
+      }),
+    )
+    .optional(), // the images sent with the message
+  attachments: z.array(MessageAttachment).optional(), // the files attached to the message
 });
 export type MessageData = z.infer<typeof MessageData>;
 
@@ -44,3 +69,15 @@ export interface Message {
 export const isMessageFromUser = (messageData: MessageData): boolean => {
   return messageData.owner_id !== undefined && messageData.owner_id.trim() !== '';
 };
+
+/**
+ * isToolMessage - checks if the message is a call to, or a result of, one of
+ * the built-in tools the agent ran on the server. They are stored so the
+ * conversation can be replayed but aren't shown.
+ */
+export const isToolMessage = (messageData: MessageData): boolean => {
+  return (
+    (messageData.tool_calls !== undefined && messageData.tool_calls.length > 0) ||
+    (messageData.tool_call_id !== undefined && messageData.tool_call_id !== '')
+  );
+};
@@ -0,0 +1,127 @@
+import { Injectable, inject } from '@angular/core';
+
+import PocketBase from 'pocketbase';
+
+import { Observable, from, map, switchMap } from 'rxjs';
+
+import { Base64 } from 'js-base64';
+import nacl from 'tweetnacl';
+
+import { MessageAttachment } from '@app/interfaces/message';
+import { TypedPocketBase } from '@app/types/pocketbase-types';
+
+import { CryptoService } from './crypto.service';
+
+// The largest file that can be attached, matching the backend
+export const MAX_ATTACHMENT_SIZE = 10 << 20;
+
+export interface DecryptedAttachment {
+  attachment: MessageAttachment;
+  data: Uint8Array;
+}
+
+@Injectable({
+  providedIn: 'root',
+})
+export class AttachmentService {
+  private readonly _cryptoService = inject(CryptoService);
+  private readonly _pb: TypedPocketBase = inject(PocketBase);
+
+  private attachmentsPath(conversationId: string): string {
+    return `/v1/conversations/${encodeURIComponent(conversationId)}/attachments`;
+  }
+
+  /**
+   * upload - encrypts a file with a new key and uploads it to the conversation.
+   * The returned attachment must be sent with the message it belongs to, or
+   * the upload is deleted after a day.
+   *
+   * @param conversationId (string) - The conversation to attach the file to
+   * @param file (File) - The file to attach
+   * @returns (Observable<MessageAttachment>) - The attachment, including its key
+   */
+  upload(conversationId: string, file: File): Observable<MessageAttachment> {
+    if (file.size > MAX_ATTACHMENT_SIZE) {
+      throw new Error(`The attachment must be at most ${MAX_ATTACHMENT_SIZE} bytes`);
+    }
+
+    const key = nacl.randomBytes(nacl.secretbox.keyLength);
+
+    return from(file.arrayBuffer()).pipe(
+      map((data) => this._cryptoService.secretBox(new Uint8Array(data), key)),
+      map((encrypted) => {
+        const body = new FormData();
+        body.append('file', new Blob([encrypted]), 'blob');
+        return body;
+      }),
+      switchMap((body) =>
+        this._pb.send<{ id: string }>(this.attachmentsPath(conversationId), {
+          method: 'POST',
+          body,
+        }),
+      ),
+      map((record) => ({
+        id: record.id,
+        name: file.name,
+        media_type: file.type || undefined,
+        size: file.size,
+        key: Base64.fromUint8Array(key),
+      })),
+    );
+  }
+
+  /**
+   * download - downloads an attachment of the conversation and decrypts it.
+   *
+   * @param conversationId (string) - The conversation the file is attached to
+   * @param attachment (MessageAttachment) - The attachment from the decrypted message
+   * @returns (Observable<DecryptedAttachment>) - The attachment and its contents
+   */
+  download(
+    conversationId: string,
+    attachment: MessageAttachment,
+  ): Observable<DecryptedAttachment> {
+    const url = this._pb.buildUrl(
+      `${this.attachmentsPath(conversationId)}/${encodeURIComponent(attachment.id)}`,
+    );
+
+    return from(
+      fetch(url, { headers: { Authorization: this._pb.authStore.token } }).then((res) => {
+        if (!res.ok) {
+          throw new Error(`Failed to download attachment ${attachment.id}: ${res.status}`);
+        }
+        return res.arrayBuffer();
+      }),
+    ).pipe(
+      map((encrypted) => ({
+        attachment,
+        data: this._cryptoService.openSecretBox(
+          new Uint8Array(encrypted),
+          Base64.toUint8Array(attachment.key),
+        ),
+      })),
+    );
+  }
+}
+
+/**
+ * inlineAttachments - adds the text of decrypted attachments to a prompt, so
+ * the agent can read them. Only the client can decrypt an attachment, so its
+ * contents have to be sent with the message.
+ *
+ * @param content (string) - The prompt
+ * @param attachments (DecryptedAttachment[]) - The decrypted attachments
+ * @returns (string) - The prompt followed by each attachment
+ */
+export const inlineAttachments = (
+  content: string,
+  attachments: DecryptedAttachment[],
+): string => {
+  const decoder = new TextDecoder();
+  const files = attachments.map(
+    ({ attachment, data }) =>
+      `<attachment name="${attachment.name}">\n${decoder.decode(data)}\n</attachment>`,
+  );
+
+  return [content, ...files].join('\n\n');
+};
@@ -33,6 +33,7 @@ import {
 } from '../interfaces/conversation';
 import { KeyPair } from '../interfaces/key-pair';
 import {
+  ConversationSecretKeysResponse,
   ConversationsExpiryDurationOptions,
   ConversationsRecord,
   ConversationsResponse,
@@ -76,6 +77,10 @@ export class ConversationService {
   private readonly pbConversationPublicKeysCollection = 'conversation_public_keys';
   private readonly pbConversationSecretKeyCollection = 'conversation_secret_keys';
 
+  // Versions of the conversation key pairs from before they were rotated,
+  // keyed by conversation ID and version
+  private readonly _olderKeyPairs = new Map<string, KeyPair>();
+
   // sources
   readonly selectConversation$ = new Subject<string>(); // conversationId
   readonly newConversation$ = new Subject<ConversationData>();
@@ -319,6 +324,35 @@ export class ConversationService {
         .find((conversation) => conversation.record.id === conversationId);
     });
 
+  /**
+   * conversationKeyPair - returns the version of the conversation key pair that
+   * data was sealed with. Versions from before the key was rotated are fetched
+   * the first time they're needed.
+   *
+   * @param conversation (Conversation)
+   * @param version (number) the version of the key
+   * @returns (Observable<KeyPair>)
+   */
+  readonly conversationKeyPair = (
+    conversation: Conversation,
+    version: number,
+  ): Observable<KeyPair> => {
+    if (version === conversation.keyVersion) {
+      return of(conversation.keyPair);
+    }
+
+    const cacheKey = `${conversation.record.id}:${version}`;
+    const cached = this._olderKeyPairs.get(cacheKey);
+    if (cached) {
+      return of(cached);
+    }
+
+    return this.fetchConversationKeyPair(conversation.record.id, version).pipe(
+      map(({ keyPair }) => keyPair),
+      tap((keyPair) => this._olderKeyPairs.set(cacheKey, keyPair)),
+    );
+  };
+
   readonly setConversationTitle = this.state.setConversationTitle;
   readonly isTemporaryConversation = this.state.isTemporaryConversation;
   readonly setIsTemporaryConversation = this.state.setIsTemporaryConversation;
@@ -362,6 +396,8 @@ export class ConversationService {
               record,
               decryptedData: data,
               keyPair: conversationKeyPair,
+              // The first version of the key
+              keyVersion: 1,
               expirationDuration: '',
             };
           }),
@@ -423,20 +459,30 @@ export class ConversationService {
 
   /**
    * fetchConversationPublicKey - fetches the public key for a conversation from
-   * the PocketBase backend.
+   * the PocketBase backend. The key is rotated by adding a new version, so the
+   * newest version is fetched unless one is given.
    *
    * @param conversationId (string)
+   * @param version (number) optional version of the key
    * @returns (Observable<Uint8Array>)
    */
-  private fetchConversationPublicKey(conversationId: string): Observable<Uint8Array> {
-    const filter = this._pb.filter('conversation={:conversationId}', {
-      conversationId,
-    });
+  private fetchConversationPublicKey(
+    conversationId: string,
+    version?: number,
+  ): Observable<Uint8Array> {
+    const filter = version
+      ? this._pb.filter('conversation={:conversationId} && version={:version}', {
+          conversationId,
+          version,
+        })
+      : this._pb.filter('conversation={:conversationId}', {
+          conversationId,
+        });
 
     return from(
       this._pb
         .collection(this.pbConversationPublicKeysCollection)
-        .getFirstListItem(filter),
+        .getFirstListItem(filter, { sort: '-version' }),
     ).pipe(
       ignorePocketbase404(),
       map((record) => Base64.toUint8Array(record.public_key)),
@@ -444,53 +490,75 @@ export class ConversationService {
   }
 
   /**
-   * fetchConversationSecretKey - fetches the secret key for a conversation from
-   * the PocketBase backend.
+   * fetchConversationSecretKey - fetches the secret key wrapped for the user for
+   * a conversation from the PocketBase backend. It's wrapped by the creator, or
+   * by an admin when the user is invited or the key is rotated. The newest
+   * version is fetched unless one is given.
    *
    * @param conversationId (string)
-   * @returns (Observable<Uint8Array>)
+   * @param version (number) optional version of the key
+   * @returns (Observable<ConversationSecretKeysResponse>)
    */
-  private fetchConversationSecretKey(conversationId: string): Observable<Uint8Array> {
-    const filter = this._pb.filter('conversation={:conversationId} && user={:userId}', {
-      conversationId,
-      userId: this._auth.user()?.['id'],
-    });
+  private fetchConversationSecretKey(
+    conversationId: string,
+    version?: number,
+  ): Observable<ConversationSecretKeysResponse> {
+    const userId = this._auth.user()?.['id'];
+    const filter = version
+      ? this._pb.filter(
+          'conversation={:conversationId} && user={:userId} && key_version={:version}',
+          { conversationId, userId, version },
+        )
+      : this._pb.filter('conversation={:conversationId} && user={:userId}', {
+          conversationId,
+          userId,
+        });
 
     return from(
       this._pb
         .collection(this.pbConversationSecretKeyCollection)
-        .getFirstListItem(filter),
-    ).pipe(
-      ignorePocketbase404(),
-      // Decode the encrypted base64 secret key
-      map((record) => Base64.toUint8Array(record.secret_key)),
-    );
+        .getFirstListItem(filter, { sort: '-key_version' }),
+    ).pipe(ignorePocketbase404());
   }
 
   /**
    * fetchConversationKeyPair - fetches the key pair for a conversation from the
-   * PocketBase backend.
+   * PocketBase backend, with its version. The newest version is fetched unless
+   * one is given.
    *
    * @param conversationId (string)
-   * @returns (Observable<KeyPair>)
+   * @param version (number) optional version of the key
+   * @returns (Observable<{ keyPair: KeyPair; keyVersion: number }>)
    */
-  private fetchConversationKeyPair(conversationId: string): Observable<KeyPair> {
-    return this.fetchConversationPublicKey(conversationId).pipe(
-      switchMap((publicKey) =>
-        this.fetchConversationSecretKey(conversationId).pipe(
-          map((secretKey) => {
+  private fetchConversationKeyPair(
+    conversationId: string,
+    version?: number,
+  ): Observable<{ keyPair: KeyPair; keyVersion: number }> {
+    return this.fetchConversationSecretKey(conversationId, version).pipe(
+      switchMap((secretKeyRecord) =>
+        // The secret key is wrapped with the public key of the same version
+        this.fetchConversationPublicKey(
+          conversationId,
+          secretKeyRecord.key_version,
+        ).pipe(
+          map((publicKey) => {
             const userSecretKey = this._vaultService.keyPair()?.secretKey;
             if (!userSecretKey) {
               throw UserSecretKeyNotFoundError;
             }
             const sharedKey = this._cryptoService.sharedKey(publicKey, userSecretKey);
             const decryptedSecretKey = this._cryptoService.openBox(
-              secretKey,
+              // Decode the encrypted base64 secret key
+              Base64.toUint8Array(secretKeyRecord.secret_key),
               sharedKey,
             );
             return {
-              publicKey,
-              secretKey: decryptedSecretKey,
+              keyPair: {
+                publicKey,
+                secretKey: decryptedSecretKey,
+              },
+              // Keys wrapped before the key was versioned are the first version
+              keyVersion: secretKeyRecord.key_version || 1,
             };
           }),
         ),
@@ -551,11 +619,12 @@ export class ConversationService {
    */
   private fetchConversation(record: ConversationsResponse): Observable<Conversation> {
     return this.fetchConversationKeyPair(record.id).pipe(
-      map((keyPair) => {
+      map(({ keyPair, keyVersion }) => {
         return {
           record,
           decryptedData: this.decryptConversationData(record, keyPair),
           keyPair,
+          keyVersion,
         };
       }),
       catchError((error) => {
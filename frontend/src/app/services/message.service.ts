@@ -10,9 +10,11 @@ import {
   catchError,
   combineLatest,
   concatMap,
+  defaultIfEmpty,
   exhaustMap,
   filter,
   finalize,
+  forkJoin,
   from,
   map,
   of,
@@ -22,13 +24,15 @@ import {
   tap,
 } from 'rxjs';
 
-import { Base64 } from 'js-base64';
 import { filterNil } from 'ngxtension/filter-nil';
 import { signalSlice } from 'ngxtension/signal-slice';
 import { OpenAI } from 'openai';
 
 import { generateConversationAgentId } from '@app/interfaces/agent';
-import { Message, parseMessageData } from '@app/interfaces/message';
+import { Conversation } from '@app/interfaces/conversation';
+import { decodeEnvelope } from '@app/interfaces/envelope';
+import { KeyPair } from '@app/interfaces/key-pair';
+import { Message, isToolMessage, parseMessageData } from '@app/interfaces/message';
 import {
   ConversationsResponse,
   MessagesResponse,
@@ -443,22 +447,76 @@ export class MessageService {
     );
   }
 
-  private decryptMessage(record: MessagesResponse): Message {
-    const base64EncryptedData = record.data;
-    const conversation = this._conversationService.conversation();
-
-    if (!conversation) {
-      throw new Error('No conversation selected');
+  /**
+   * fetchMessageKeyPairs - fetches the versions of the conversation key pair the
+   * messages are sealed with, keyed by version. A message sealed with a version
+   * that can't be fetched fails to decrypt.
+   *
+   * @param conversation (Conversation)
+   * @param records (MessagesResponse[])
+   * @returns (Observable<Map<number, KeyPair>>)
+   */
+  private fetchMessageKeyPairs(
+    conversation: Conversation,
+    records: MessagesResponse[],
+  ): Observable<Map<number, KeyPair>> {
+    const keyIds = new Set<number>();
+    for (const record of records) {
+      try {
+        const { keyId } = decodeEnvelope(record.data);
+        if (keyId !== undefined) {
+          keyIds.add(keyId);
+        }
+      } catch {
+        // the message fails to decrypt
+      }
+    }
+    if (keyIds.size === 0) {
+      return of(new Map());
     }
 
+    return forkJoin(
+      [...keyIds].map((keyId) =>
+        this._conversationService.conversationKeyPair(conversation, keyId).pipe(
+          map((keyPair): [number, KeyPair] => [keyId, keyPair]),
+          catchError((error) => {
+            console.error('Fetching conversation key pair failed', error);
+            return EMPTY;
+          }),
+          defaultIfEmpty(undefined),
+        ),
+      ),
+    ).pipe(
+      map(
+        (entries) =>
+          new Map(
+            entries.filter((entry): entry is [number, KeyPair] => entry !== undefined),
+          ),
+      ),
+    );
+  }
+
+  private decryptMessage(
+    record: MessagesResponse,
+    conversation: Conversation,
+    keyPairs: Map<number, KeyPair>,
+  ): Message {
     let decryptedData: Message['decryptedData'];
 
     try {
+      const envelope = decodeEnvelope(record.data);
+      // Legacy messages don't say which version of the key they're sealed
+      // with, they're from before it could be rotated
+      const keyPair =
+        envelope.keyId === undefined
+          ? conversation.keyPair
+          : keyPairs.get(envelope.keyId);
+      if (!keyPair) {
+        throw new Error(`No conversation key pair version ${envelope.keyId}`);
+      }
+
       decryptedData = parseMessageData(
-        this._cryptoService.openSealedBox(
-          Base64.toUint8Array(base64EncryptedData),
-          conversation.keyPair,
-        ),
+        this._cryptoService.openSealedBox(envelope.ciphertext, keyPair),
       );
     } catch (error) {
       // Show to the user the message failed to decrypt
@@ -485,11 +543,23 @@ export class MessageService {
       tap(() => {
         this.state.setStatus(MessageStatus.Decrypting);
       }),
-      map((response) => {
-        return {
-          ...response,
-          items: response.items.map((record) => this.decryptMessage(record)),
-        };
+      switchMap((response) => {
+        const conversation = this._conversationService.conversation();
+        if (!conversation) {
+          throw new Error('No conversation selected');
+        }
+
+        return this.fetchMessageKeyPairs(conversation, response.items).pipe(
+          map((keyPairs) => {
+            return {
+              ...response,
+              items: response.items
+                .map((record) => this.decryptMessage(record, conversation, keyPairs))
+                // the agent's built-in tool calls aren't part of the chat
+                .filter((message) => !isToolMessage(message.decryptedData)),
+            };
+          }),
+        );
       }),
     );
   }
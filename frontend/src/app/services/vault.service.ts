@@ -20,8 +20,19 @@ import { Base64 } from 'js-base64';
 import { signalSlice } from 'ngxtension/signal-slice';
 import nacl from 'tweetnacl';
 
-import { TypedPocketBase, UserKeyPairsRecord } from '@app/types/pocketbase-types';
+import {
+  TypedPocketBase,
+  UserKeyPairsRecord,
+  UserKeyPairsResponse,
+} from '@app/types/pocketbase-types';
 
+import {
+  KdfParams,
+  kdfParamsFromRecord,
+  kdfParamsToRecord,
+  needsKdfUpgrade,
+  newKdfParams,
+} from '@interfaces/kdf-params';
 import { KeyPair } from '@interfaces/key-pair';
 
 import { AuthService } from './auth.service';
@@ -30,7 +41,7 @@ import { ErrorService } from './error.service';
 
 interface VaultState {
   keyPair: KeyPair | undefined;
-  keyPairRecord: UserKeyPairsRecord | null | undefined; // null means the record does not exist
+  keyPairRecord: UserKeyPairsResponse | null | undefined; // null means the record does not exist
   isNewKeyPair: boolean;
 }
 
@@ -40,12 +51,6 @@ const initialState: VaultState = {
   isNewKeyPair: false,
 };
 
-// Argon2id parameters as recommended by the OWASP password storage cheat sheet
-// https://cheatsheetseries.owasp.org/cheatsheets/Password_Storage_Cheat_Sheet.html#introduction
-const argon2idMemory = 19456; // 19MiB
-const argon2idIterationCount = 2;
-const argon2idParallelism = 1;
-
 const setupWasmInstance = setupWasm(
   (importObject) =>
     WebAssembly.instantiateStreaming(
@@ -77,27 +82,35 @@ export class VaultService {
   private state = signalSlice({
     initialState,
     sources: [
-      // Hash the vault password and fetch the key pair
+      // Hash the vault password with the parameters of the key pair and unlock it
       (state) =>
         this.rawVaultPassword$.pipe(
-          switchMap((rawPassword) =>
-            this.hashVaultPassword(rawPassword).pipe(
+          switchMap((rawPassword) => {
+            const keyPairRecord = state().keyPairRecord;
+            if (keyPairRecord === null) {
+              return this.createNewUserKeyPair(rawPassword).pipe(
+                map((keyPair) => ({ keyPair })),
+              );
+            }
+            if (keyPairRecord === undefined) {
+              return EMPTY;
+            }
+            return this.hashVaultPassword(
+              rawPassword,
+              kdfParamsFromRecord(keyPairRecord, this._authService.oryId()),
+            ).pipe(
               switchMap((hashedVaultPassword) => {
-                const keyPairRecord = state().keyPairRecord;
-                if (keyPairRecord === null) {
-                  return this.createNewUserKeyPair(hashedVaultPassword).pipe(
-                    map((keyPair) => ({ keyPair })),
-                  );
-                }
-                if (keyPairRecord === undefined) {
-                  return EMPTY;
-                }
                 try {
                   const keyPair = this.unpackKeyPairRecord(
                     keyPairRecord,
                     hashedVaultPassword,
                   );
-                  return of({ keyPair });
+                  if (!needsKdfUpgrade(keyPairRecord)) {
+                    return of({ keyPair });
+                  }
+                  return this.upgradeUserKeyPair(keyPairRecord, keyPair, rawPassword).pipe(
+                    map((upgradedRecord) => ({ keyPair, keyPairRecord: upgradedRecord })),
+                  );
                 } catch (error) {
                   console.error('Error unpacking key pair record', error);
                   this._errorService.alert(
@@ -106,8 +119,8 @@ export class VaultService {
                   return EMPTY;
                 }
               }),
-            ),
-          ),
+            );
+          }),
         ),
       // Fetch the key pair record
       this.fetchUserKeyPairRecord().pipe(
@@ -136,24 +149,24 @@ export class VaultService {
   keyPair = this.state.keyPair;
   keyPair$ = toObservable(this.keyPair);
 
-  hashVaultPassword(rawPassword: string): Observable<Uint8Array> {
+  hashVaultPassword(rawPassword: string, params: KdfParams): Observable<Uint8Array> {
     const encoder = new TextEncoder();
 
     return from(setupWasmInstance).pipe(
       map((argon2id) =>
         argon2id({
           password: encoder.encode(rawPassword),
-          salt: encoder.encode(this._authService.oryId()),
-          parallelism: argon2idParallelism,
-          passes: argon2idIterationCount,
-          memorySize: argon2idMemory,
+          salt: params.salt,
+          parallelism: params.threads,
+          passes: params.iterations,
+          memorySize: params.memory,
           tagLength: nacl.secretbox.keyLength, // output a a hash of the same length as a secret key
         }),
       ),
     );
   }
 
-  fetchUserKeyPairRecord(): Observable<UserKeyPairsRecord> {
+  fetchUserKeyPairRecord(): Observable<UserKeyPairsResponse> {
     const filter = this._pb.filter('user={:user}', {
       user: this._authService.user()?.['id'],
     });
@@ -191,24 +204,72 @@ export class VaultService {
     };
   }
 
-  createNewUserKeyPair(hashedVaultPassword: Uint8Array): Observable<KeyPair> {
+  createNewUserKeyPair(rawPassword: string): Observable<KeyPair> {
     const keyPair = this._cryptoService.newKeyPair();
+    const kdfParams = newKdfParams();
 
-    const encryptedSecretKey = this.encryptSecretKey(
-      keyPair.secretKey,
-      hashedVaultPassword,
+    return this.hashVaultPassword(rawPassword, kdfParams).pipe(
+      switchMap((hashedVaultPassword) => {
+        const encryptedSecretKey = this.encryptSecretKey(
+          keyPair.secretKey,
+          hashedVaultPassword,
+        );
+
+        const publicKeyBase64 = Base64.fromUint8Array(keyPair.publicKey);
+        const encryptedSecretKeyBase64 = Base64.fromUint8Array(encryptedSecretKey);
+        const keyPairRecordData: Partial<UserKeyPairsRecord> = {
+          public_key: publicKeyBase64,
+          secret_key: encryptedSecretKeyBase64,
+          user: this._authService.user()?.['id'],
+          ...kdfParamsToRecord(kdfParams),
+        };
+
+        return from(
+          this._pb.collection(this.pbUserKeyPairsCollection).create(keyPairRecordData),
+        );
+      }),
+      switchMap(() => of(keyPair)),
     );
+  }
 
-    const publicKeyBase64 = Base64.fromUint8Array(keyPair.publicKey);
-    const encryptedSecretKeyBase64 = Base64.fromUint8Array(encryptedSecretKey);
-    const keyPairRecordData: Partial<UserKeyPairsRecord> = {
-      public_key: publicKeyBase64,
-      secret_key: encryptedSecretKeyBase64,
-      user: this._authService.user()?.['id'],
-    };
+  /**
+   * upgradeUserKeyPair - re-wraps the secret key with a new salt and the
+   * current KDF parameters. Legacy key pairs are salted with the Ory ID, which
+   * can change, so they're upgraded the next time the vault is unlocked.
+   *
+   * If the upgrade fails the key pair is left as it was, the vault is still
+   * unlocked and the upgrade is retried next time.
+   *
+   * @param keyPairRecord (UserKeyPairsResponse) the current record
+   * @param keyPair (KeyPair) the unlocked key pair
+   * @param rawPassword (string) the vault password
+   * @returns (Observable<UserKeyPairsResponse>) the upgraded record
+   */
+  upgradeUserKeyPair(
+    keyPairRecord: UserKeyPairsResponse,
+    keyPair: KeyPair,
+    rawPassword: string,
+  ): Observable<UserKeyPairsResponse> {
+    const kdfParams = newKdfParams();
 
-    return from(
-      this._pb.collection(this.pbUserKeyPairsCollection).create(keyPairRecordData),
-    ).pipe(switchMap(() => of(keyPair)));
+    return this.hashVaultPassword(rawPassword, kdfParams).pipe(
+      switchMap((hashedVaultPassword) => {
+        const encryptedSecretKey = this.encryptSecretKey(
+          keyPair.secretKey,
+          hashedVaultPassword,
+        );
+
+        return from(
+          this._pb.collection(this.pbUserKeyPairsCollection).update(keyPairRecord.id, {
+            secret_key: Base64.fromUint8Array(encryptedSecretKey),
+            ...kdfParamsToRecord(kdfParams),
+          }),
+        );
+      }),
+      catchError((error) => {
+        console.error('Error upgrading key pair record', error);
+        return of(keyPairRecord);
+      }),
+    );
   }
 }
@@ -51,10 +51,12 @@ export type AgentsRecord = {
 export type ConversationPublicKeysRecord = {
   conversation: RecordIdString;
   public_key?: string;
+  version?: number;
 };
 
 export type ConversationSecretKeysRecord = {
   conversation: RecordIdString;
+  key_version?: number;
   secret_key?: string;
   user: RecordIdString;
 };
@@ -104,7 +106,15 @@ export type ModelsRecord = {
   slug: string;
 };
 
+export enum UserKeyPairsKdfAlgorithmOptions {
+  'argon2id' = 'argon2id',
+}
 export type UserKeyPairsRecord = {
+  kdf_algorithm?: UserKeyPairsKdfAlgorithmOptions;
+  kdf_iterations?: number;
+  kdf_memory?: number;
+  kdf_salt?: string;
+  kdf_threads?: number;
   public_key: string;
   secret_key: string;
   user: RecordIdString;